@@ -1,30 +1,174 @@
 package custom_errors
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error kinds, match them with errors.Is. Every error type below reports
+// one of these, so callers don't need to know the concrete type.
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrQuorumNotMet    = errors.New("quorum not met")
+	ErrTimeout         = errors.New("timeout")
+	ErrUnavailable     = errors.New("unavailable")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrConflict        = errors.New("conflict")
+	// ErrResourceExhausted is a quota or limit the caller ran into, the
+	// request may succeed once usage went down
+	ErrResourceExhausted = errors.New("resource exhausted")
+)
 
 type ArgError struct {
 	Arg     string
 	Message string
 }
 
+// ValueTooLargeError is returned for values above the configured max value size
+type ValueTooLargeError struct {
+	Key  string
+	Size int
+	Max  int
+}
+
+// QuorumWriteError and QuorumReadError carry the reason of every replica that
+// did not answer. Unwrap exposes them, so errors.As finds e.g. a
+// ValueTooLargeError that all replicas returned.
 type QuorumWriteError struct {
 	Message string
 	W       int
 	N       int
+	Causes  map[string]error
 }
+
 type QuorumReadError struct {
 	Message string
 	R       int
 	N       int
+	Causes  map[string]error
+}
+
+// NotFoundError means the key is absent on a read quorum, as opposed to
+// QuorumReadError where not enough replicas answered
+type NotFoundError struct {
+	Key string
+}
+
+type TimeoutError struct {
+	Op    string
+	After time.Duration
+}
+
+// UnavailableError is a replica that could not be reached
+type UnavailableError struct {
+	Node string
+	Err  error
+}
+
+// ConflictError rejects a write that lost against a concurrent one
+type ConflictError struct {
+	Key     string
+	Message string
+}
+
+// ResourceExhaustedError rejects a request that would go over a limit, e.g.
+// the storage quota or the request rate of a table. RetryAfter is when the
+// request may succeed, 0 when only freeing space helps.
+type ResourceExhaustedError struct {
+	Resource   string
+	Limit      int64
+	Message    string
+	RetryAfter time.Duration
 }
 
 func (e *QuorumWriteError) Error() string {
-	return fmt.Sprintf("%s w %v n %v", e.Message, e.W, e.N)
+	return fmt.Sprintf("%s w %v n %v", e.Message, e.W, e.N) + formatCauses(e.Causes)
 }
 
 func (e *QuorumReadError) Error() string {
-	return fmt.Sprintf("%s r %v n %v", e.Message, e.R, e.N)
+	return fmt.Sprintf("%s r %v n %v", e.Message, e.R, e.N) + formatCauses(e.Causes)
 }
 func (e *ArgError) Error() string {
 	return fmt.Sprintf("%s - %s", e.Arg, e.Message)
 }
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("%s - value of %d bytes exceeds the max value size of %d bytes", e.Key, e.Size, e.Max)
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s - not found", e.Key)
+}
+
+func (e *TimeoutError) Error() string {
+	if e.After == 0 {
+		return fmt.Sprintf("%s timed out", e.Op)
+	}
+	return fmt.Sprintf("%s timed out after %v", e.Op, e.After)
+}
+
+func (e *UnavailableError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s is unavailable", e.Node)
+	}
+	return fmt.Sprintf("%s is unavailable: %v", e.Node, e.Err)
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s - conflict: %s", e.Key, e.Message)
+}
+
+func (e *ResourceExhaustedError) Error() string {
+	msg := fmt.Sprintf("%s - limit of %d exhausted: %s", e.Resource, e.Limit, e.Message)
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %v", e.RetryAfter)
+	}
+	return msg
+}
+
+func (e *QuorumWriteError) Is(target error) bool   { return target == ErrQuorumNotMet }
+func (e *QuorumReadError) Is(target error) bool    { return target == ErrQuorumNotMet }
+func (e *ArgError) Is(target error) bool           { return target == ErrInvalidArgument }
+func (e *ValueTooLargeError) Is(target error) bool { return target == ErrInvalidArgument }
+func (e *NotFoundError) Is(target error) bool      { return target == ErrNotFound }
+func (e *TimeoutError) Is(target error) bool       { return target == ErrTimeout }
+func (e *UnavailableError) Is(target error) bool   { return target == ErrUnavailable }
+func (e *ConflictError) Is(target error) bool      { return target == ErrConflict }
+func (e *ResourceExhaustedError) Is(target error) bool {
+	return target == ErrResourceExhausted
+}
+
+func (e *QuorumWriteError) Unwrap() []error { return causeList(e.Causes) }
+func (e *QuorumReadError) Unwrap() []error  { return causeList(e.Causes) }
+func (e *UnavailableError) Unwrap() error   { return e.Err }
+
+func sortedNodes(causes map[string]error) []string {
+	names := make([]string, 0, len(causes))
+	for n := range causes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func causeList(causes map[string]error) []error {
+	out := make([]error, 0, len(causes))
+	for _, n := range sortedNodes(causes) {
+		out = append(out, causes[n])
+	}
+	return out
+}
+
+func formatCauses(causes map[string]error) string {
+	if len(causes) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(causes))
+	for _, n := range sortedNodes(causes) {
+		parts = append(parts, fmt.Sprintf("%s: %v", n, causes[n]))
+	}
+	return " (" + strings.Join(parts, "; ") + ")"
+}
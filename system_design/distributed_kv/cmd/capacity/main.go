@@ -0,0 +1,143 @@
+// capacity replays a traffic distribution against a simulated ring and
+// reports the load per node, the hottest nodes and keys, and how much moves
+// on every join or leave of a scenario. With -limit it finds how many nodes
+// keep every node below a request rate.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"toy_dynamodb/pkg/capacity"
+	Ring "toy_dynamodb/pkg/ring"
+)
+
+func main() {
+	nodes := flag.Int("nodes", 10, "number of nodes, named node-1 to node-N")
+	weights := flag.String("weights", "", "comma separated node=weight, e.g. node-1=2,node-4=0.5 (vnodes only)")
+	vnodes := flag.Int("vnodes", Ring.VirtualSpotCount, "vnodes of a node of weight 1")
+	replicas := flag.Int("n", 3, "replica count")
+	partitioner := flag.String("partitioner", Ring.PartitionVNodes, "one of "+strings.Join(Ring.Partitioners, ", "))
+	hashName := flag.String("hash", "xxhash", "hash function: xxhash, sha1 or fnv")
+	keys := flag.Int("keys", 100_000, "number of keys")
+	rate := flag.Float64("rate", 10_000, "requests per second to the whole cluster")
+	dist := flag.String("dist", string(capacity.Uniform), "key distribution: uniform, zipf or hotkey")
+	zipfS := flag.Float64("zipf-s", 1.1, "exponent of the zipf distribution")
+	hotKeys := flag.Int("hot-keys", 10, "number of hot keys of the hotkey distribution")
+	hotShare := flag.Float64("hot-share", 0.5, "share of the requests that go to the hot keys")
+	scenario := flag.String("scenario", "", "changes applied in order, e.g. join:node-11,join:node-12=2,leave:node-3")
+	top := flag.Int("top", 5, "number of nodes and keys in the hotspot ranking")
+	limit := flag.Float64("limit", 0, "requests per second a node can serve, plans the number of nodes when set")
+	maxNodes := flag.Int("max-nodes", 1000, "largest cluster -limit may plan")
+	flag.Parse()
+
+	hash, ok := Ring.HashByName(*hashName)
+	if !ok {
+		log.Fatalf("unknown hash %q", *hashName)
+	}
+	cluster := capacity.Cluster{
+		Nodes:       capacity.Nodes(*nodes),
+		Partitioner: *partitioner,
+		Hash:        hash,
+		VNodes:      *vnodes,
+		Replicas:    *replicas,
+	}
+	if err := parseWeights(cluster.Nodes, *weights); err != nil {
+		log.Fatal(err)
+	}
+	workload := capacity.Workload{
+		Keys:         *keys,
+		Rate:         *rate,
+		Distribution: capacity.Distribution(*dist),
+		ZipfS:        *zipfS,
+		HotKeys:      *hotKeys,
+		HotShare:     *hotShare,
+	}
+	changes, err := capacity.ParseChanges(*scenario)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%d keys, %s, %.0f requests/s, %s on %d nodes, N=%d, hash %s\n\n",
+		*keys, *dist, *rate, *partitioner, *nodes, *replicas, *hashName)
+	reports, err := capacity.Simulate(cluster, workload, changes, *top)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printSummary(reports, *keys)
+	for _, r := range reports {
+		printRanking(r, *top)
+	}
+
+	if *limit > 0 {
+		joins, r, err := capacity.Plan(cluster, workload, *limit, *maxNodes)
+		if err != nil {
+			log.Fatalf("plan: %v", err)
+		}
+		fmt.Printf("plan: %d nodes keep every node below %.0f requests/s, %d more than now, the hottest node serves %.0f\n",
+			len(r.Nodes), *limit, len(joins), r.Hottest().Rate)
+	}
+}
+
+func parseWeights(nodes []capacity.Node, s string) error {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, w, ok := strings.Cut(part, "=")
+		weight, err := strconv.ParseFloat(w, 64)
+		if !ok || err != nil {
+			return fmt.Errorf("weight %q must be node=number", part)
+		}
+		found := false
+		for i := range nodes {
+			if nodes[i].Name == name {
+				nodes[i].Weight, found = weight, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("weight for unknown node %s", name)
+		}
+	}
+	return nil
+}
+
+func printSummary(reports []capacity.Report, keys int) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "state\tnodes\tkeys max\tkeys cv\trate max\trate cv\thottest\tmoved primaries\tmoved copies\tmoved rate\t")
+	for _, r := range reports {
+		state := "start"
+		if r.Change != nil {
+			state = r.Change.String()
+		}
+		hot := r.Hottest()
+		fmt.Fprintf(tw, "%s\t%d\t%.3f\t%.3f\t%.3f\t%.3f\t%s %.0f/s\t%d (%.3f)\t%d\t%.0f/s\t\n", state, len(r.Nodes),
+			r.Keys.MaxOverMean, r.Keys.CV, r.Rate.MaxOverMean, r.Rate.CV, hot.Name, hot.Rate,
+			r.MovedPrimaries, float64(r.MovedPrimaries)/float64(keys), r.MovedCopies, r.MovedRate)
+	}
+	tw.Flush()
+	fmt.Println()
+}
+
+func printRanking(r capacity.Report, top int) {
+	state := "start"
+	if r.Change != nil {
+		state = "after " + r.Change.String()
+	}
+	fmt.Printf("%s, hottest nodes:\n", state)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "node\tweight\tprimaries\tkeys\trate\t")
+	for _, n := range r.Nodes[:min(top, len(r.Nodes))] {
+		fmt.Fprintf(tw, "%s\t%g\t%d\t%d\t%.0f/s\t\n", n.Name, n.Weight, n.Primaries, n.Keys, n.Rate)
+	}
+	tw.Flush()
+	fmt.Println("hottest keys:")
+	for _, k := range r.HotKeys {
+		fmt.Printf("  %s %.0f/s on %s\n", k.Key, k.Rate, strings.Join(k.Replicas, ", "))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"toy_dynamodb/pkg/consistency"
+	Ring "toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/simnet"
+)
+
+func main() {
+	mode := flag.String("mode", "local", "local (in-process simnet) or docker (running nodes)")
+	addrs := flag.String("addrs", "localhost:50051,localhost:50052,localhost:50053", "node addresses for docker mode")
+	clients := flag.Int("clients", 5, "concurrent clients")
+	ops := flag.Int("ops", 200, "operations per client")
+	keys := flag.Int("keys", 3, "number of keys, few keys mean more conflicts")
+	reads := flag.Float64("reads", 0.5, "share of reads")
+	deletes := flag.Float64("deletes", 0.1, "share of deletes")
+	w := flag.Int("w", 2, "write quorum")
+	r := flag.Int("r", 2, "read quorum")
+	n := flag.Uint("n", 3, "replica count")
+	seed := flag.Int64("seed", 1, "seed for the workload and the simulated network")
+	loss := flag.Float64("loss", 0, "local mode: probability of losing a request or a response")
+	delay := flag.Duration("delay", time.Millisecond, "local mode: maximum link delay")
+	partition := flag.String("partition", "", "local mode: node to partition halfway through, e.g. node-3")
+	retries := flag.Int("retries", 1, "attempts per replica for writes, 1 means no retries")
+	partitioner := flag.String("partitioner", Ring.PartitionVNodes, "vnodes, rendezvous, jump or tokens")
+	flag.Parse()
+
+	p, ok := Ring.NewPartitioner(*partitioner, Ring.XXHash)
+	if !ok {
+		log.Fatalf("unknown partitioner %q", *partitioner)
+	}
+	ring := &Ring.Ring{ReplicaCount: *n, Retry: Ring.RetryPolicy{MaxAttempts: *retries}, Partitioner: p}
+	ring.Init()
+
+	wl := consistency.Workload{Clients: *clients, OpsPerClient: *ops, Keys: *keys, ReadRatio: *reads, DeleteRatio: *deletes, Seed: *seed}
+
+	switch *mode {
+	case "local":
+		dir, err := os.MkdirTemp("", "kv-consistency-")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		net := simnet.New(*seed, dir)
+		defer net.Close()
+		for i := range int(*n) {
+			name := fmt.Sprint("node-", i+1)
+			c, err := net.AddNode(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ring.RegisterClient(name, c)
+		}
+		net.SetLink(simnet.Link{MaxDelay: *delay, DropRequest: *loss, DropResponse: *loss})
+		if *partition != "" {
+			half := *clients * *ops / 2
+			net.Schedule(simnet.Event{AtStep: half, Do: simnet.Partition(*partition)})
+		}
+		wl.Before = func() { net.Step() }
+	case "docker":
+		for _, addr := range strings.Split(*addrs, ",") {
+			if err := ring.AddNode(strings.TrimSpace(addr)); err != nil {
+				log.Fatalf("Connection Error %s: %v", addr, err)
+			}
+		}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+
+	fmt.Printf("Running %d clients x %d ops on %d keys with N=%d W=%d R=%d...\n", *clients, *ops, *keys, *n, *w, *r)
+	history := wl.Run(consistency.RingStore{Ring: ring, W: *w, R: *r})
+
+	failed := 0
+	for _, op := range history {
+		if op.Err != nil {
+			failed++
+		}
+	}
+	res := consistency.Check(history)
+
+	fmt.Printf("Operations: %d (%d failed), divergent reads: %d\n", res.Ops, failed, res.DivergentReads)
+	switch {
+	case res.Unknown:
+		fmt.Println("Linearizable: unknown, the checker ran out of budget")
+	case res.Linearizable:
+		fmt.Println("Linearizable: yes")
+	default:
+		fmt.Printf("Linearizable: NO, counterexample on %s:\n", res.Key)
+		for _, op := range res.Counterexample {
+			fmt.Println("  ", op)
+		}
+	}
+	fmt.Printf("Read-your-writes violations: %d\n", len(res.RYWViolations))
+	for i, v := range res.RYWViolations {
+		if i == 5 {
+			fmt.Printf("   ... and %d more\n", len(res.RYWViolations)-i)
+			break
+		}
+		fmt.Println("  ", v)
+	}
+
+	if !res.Linearizable || len(res.RYWViolations) > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,40 +1,70 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/config"
 	Ring "toy_dynamodb/pkg/ring"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
-	ring := Ring.Ring{ReplicaCount: 3}
+	caFile := flag.String("tls-ca", "", "CA used to verify the nodes, enables TLS")
+	certFile := flag.String("tls-cert", "", "client certificate for mTLS")
+	keyFile := flag.String("tls-key", "", "client private key for mTLS")
+	serverName := flag.String("tls-server-name", "", "override the name checked against node certificates")
+	token := flag.String("token", "", "bearer token sent with every RPC")
+	// -config/KV_CONFIG, -peers/KV_PEERS and -replicas/KV_REPLICA_COUNT like the nodes
+	cluster, err := config.LoadCluster(flag.CommandLine, os.Args[1:], os.Getenv, config.Cluster{
+		Peers:        []string{"localhost:50051", "localhost:50052", "localhost:50053"},
+		ReplicaCount: 3,
+	})
+	if err != nil {
+		log.Fatalf("Config Error: %v", err)
+	}
+	quorum := int(cluster.ReplicaCount)/2 + 1
+
+	ring := Ring.Ring{ReplicaCount: cluster.ReplicaCount}
 	ring.Init()
 
-	nodes := []string{
-		"localhost:50051",
-		"localhost:50052",
-		"localhost:50053",
+	if *caFile != "" {
+		creds, err := auth.ClientTLS(*certFile, *keyFile, *caFile, *serverName)
+		if err != nil {
+			log.Fatalf("TLS Error: %v", err)
+		}
+		ring.DialOptions = append(ring.DialOptions, grpc.WithTransportCredentials(creds))
+		if *token != "" {
+			ring.DialOptions = append(ring.DialOptions, grpc.WithPerRPCCredentials(auth.TokenCredentials{Token: *token}))
+		}
 	}
 
-	for _, addr := range nodes {
+	for _, addr := range cluster.Peers {
 		if err := ring.AddNode(addr); err != nil {
 			log.Fatalf("Connection Error %s: %v", addr, err)
 		}
 		fmt.Printf("Connected to : %s\n", addr)
 	}
 
-	fmt.Println("Writing Data with w =2 (Mahmut = Ozer)...")
-	err := ring.Put("Mahmut", "Ozer", 2)
+	fmt.Printf("Writing Data with w =%d (Mahmut = Ozer)...\n", quorum)
+	err = ring.Put("Mahmut", []byte("Ozer"), quorum)
 	if err != nil {
 		log.Fatalf("Write Error:  %v", err)
 	}
 
-	fmt.Println("Reading Data with r =2 (Mahmut)...")
+	fmt.Printf("Reading Data with r =%d (Mahmut)...\n", quorum)
 
-	vals, err := ring.Get("Mahmut", 2)
+	vals, err := ring.Get("Mahmut", quorum)
 	if err == nil {
-		fmt.Printf("Retrieved Values:\n%v\n", vals)
+		fmt.Printf("Retrieved Values:\n%q\n", vals)
 	} else {
 		log.Fatalf("Read Error: %v", err)
 	}
+
+	for addr, h := range ring.Health() {
+		fmt.Printf("%s: %s (failures %d)\n", addr, h.State, h.ConsecutiveFailures)
+	}
 }
@@ -1,38 +1,53 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"toy_dynamodb/pkg/adapter"
+	"toy_dynamodb/pkg/config"
 	"toy_dynamodb/pkg/node"
 	"toy_dynamodb/pkg/ring"
 )
 
 func main() {
+	// peers ve N node'larla aynı kaynaklardan gelir (-config, -peers, -replicas),
+	// her peer için bellekte bir node açılır
+	cluster, err := config.LoadCluster(flag.CommandLine, os.Args[1:], os.Getenv, config.Cluster{
+		Peers:        []string{"node-1:50051", "node-2:50051", "node-3:50051"},
+		ReplicaCount: 3,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	quorum := int(cluster.ReplicaCount)/2 + 1
+
 	// 1. Ring'i Başlat
-	r := ring.Ring{ReplicaCount: 3}
+	r := ring.Ring{ReplicaCount: cluster.ReplicaCount}
 	r.Init()
 
-	node1, _ := node.New("memory-node-1")
-	node2, _ := node.New("memory-node-2")
-	node3, _ := node.New("memory-node-3")
-
-	r.RegisterClient("node-1", adapter.NewLocalClient(node1))
-	r.RegisterClient("node-2", adapter.NewLocalClient(node2))
-	r.RegisterClient("node-3", adapter.NewLocalClient(node3))
+	for i, peer := range cluster.Peers {
+		n, err := node.New(fmt.Sprintf("memory-node-%d", i+1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer n.Close()
+		r.RegisterClient(peer, adapter.NewLocalClient(n))
+	}
 
 	fmt.Println("🚀 Sistem 'In-Memory Mock' modunda başlatıldı!")
 
-	err := r.Put("Key", "Value", 2)
+	err = r.Put("Key", []byte("Value"), quorum)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("✅ Yazıldı.")
 
 	fmt.Println("--- Okuma Testi ---")
-	vals, err := r.Get("Key", 2)
+	vals, err := r.Get("Key", quorum)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("✅ Okunan: %v\n", vals)
+	fmt.Printf("✅ Okunan: %q\n", vals)
 }
@@ -0,0 +1,144 @@
+// partitions compares the partitioners of pkg/ring: how evenly they spread
+// keys and replicas over the nodes, how many keys move when a node joins or
+// leaves, and how long a lookup takes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+	Ring "toy_dynamodb/pkg/ring"
+)
+
+type report struct {
+	name string
+	// max/mean and stddev/mean of the per-node load, primaries only and with
+	// replicas
+	primaryMax, primaryCV float64
+	replicaMax, replicaCV float64
+	// share of keys whose primary or replica set changed
+	joinPrimary, joinReplicas   float64
+	leavePrimary, leaveReplicas float64
+	lookup                      time.Duration
+}
+
+func main() {
+	nodes := flag.Int("nodes", 10, "number of nodes")
+	keys := flag.Int("keys", 100_000, "number of keys")
+	replicas := flag.Int("n", 3, "replica count")
+	hashName := flag.String("hash", "xxhash", "hash function: xxhash, sha1 or fnv")
+	only := flag.String("partitioners", strings.Join(Ring.Partitioners, ","), "comma separated partitioners to compare")
+	flag.Parse()
+
+	hash, ok := Ring.HashByName(*hashName)
+	if !ok {
+		log.Fatalf("unknown hash %q", *hashName)
+	}
+	if *nodes < 2 {
+		log.Fatal("-nodes must be at least 2")
+	}
+
+	names := make([]string, *nodes)
+	for i := range names {
+		names[i] = fmt.Sprint("node-", i+1)
+	}
+	ks := make([]string, *keys)
+	for i := range ks {
+		ks[i] = fmt.Sprint("key-", i)
+	}
+
+	fmt.Printf("%d keys on %d nodes, N=%d, hash %s\n", *keys, *nodes, *replicas, *hashName)
+	fmt.Printf("ideal: load max/mean 1.00, cv 0.00, join moves %.3f, leave moves %.3f of the primaries\n\n",
+		1/float64(*nodes+1), 1/float64(*nodes))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "partitioner\tprimary max\tprimary cv\treplica max\treplica cv\tjoin primary\tjoin replicas\tleave primary\tleave replicas\tlookup\t")
+	for _, pname := range strings.Split(*only, ",") {
+		pname = strings.TrimSpace(pname)
+		if _, ok := Ring.NewPartitioner(pname, hash); !ok {
+			log.Fatalf("unknown partitioner %q", pname)
+		}
+		r := analyze(func() Ring.Partitioner { p, _ := Ring.NewPartitioner(pname, hash); return p }, names, ks, *replicas)
+		r.name = pname
+		fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%v\t\n", r.name,
+			r.primaryMax, r.primaryCV, r.replicaMax, r.replicaCV,
+			r.joinPrimary, r.joinReplicas, r.leavePrimary, r.leaveReplicas, r.lookup)
+	}
+	tw.Flush()
+}
+
+func analyze(build func() Ring.Partitioner, names, keys []string, n int) report {
+	p := build()
+	for _, name := range names {
+		p.Add(name)
+	}
+
+	before := make([][]string, len(keys))
+	start := time.Now()
+	for i, k := range keys {
+		before[i] = p.Replicas(k, n)
+	}
+	rep := report{lookup: time.Since(start) / time.Duration(len(keys))}
+
+	primary, all := map[string]int{}, map[string]int{}
+	for _, rs := range before {
+		primary[rs[0]]++
+		for _, r := range rs {
+			all[r]++
+		}
+	}
+	rep.primaryMax, rep.primaryCV = spread(primary, names)
+	rep.replicaMax, rep.replicaCV = spread(all, names)
+
+	p.Add(fmt.Sprint("node-", len(names)+1))
+	rep.joinPrimary, rep.joinReplicas = moved(p, keys, before, n)
+
+	// leave from the same starting point, removing a node from the middle of
+	// the list is the worst case for jump hash
+	p = build()
+	for _, name := range names {
+		p.Add(name)
+	}
+	p.Remove(names[len(names)/2])
+	rep.leavePrimary, rep.leaveReplicas = moved(p, keys, before, n)
+	return rep
+}
+
+// spread returns max/mean and the coefficient of variation of the load
+func spread(load map[string]int, names []string) (float64, float64) {
+	total, peak := 0, 0
+	for _, name := range names {
+		total += load[name]
+		peak = max(peak, load[name])
+	}
+	mean := float64(total) / float64(len(names))
+	var sq float64
+	for _, name := range names {
+		d := float64(load[name]) - mean
+		sq += d * d
+	}
+	return float64(peak) / mean, math.Sqrt(sq/float64(len(names))) / mean
+}
+
+func moved(p Ring.Partitioner, keys []string, before [][]string, n int) (float64, float64) {
+	prim, set := 0, 0
+	for i, k := range keys {
+		after := p.Replicas(k, n)
+		if after[0] != before[i][0] {
+			prim++
+		}
+		a, b := slices.Clone(after), slices.Clone(before[i])
+		slices.Sort(a)
+		slices.Sort(b)
+		if !slices.Equal(a, b) {
+			set++
+		}
+	}
+	return float64(prim) / float64(len(keys)), float64(set) / float64(len(keys))
+}
@@ -0,0 +1,120 @@
+// resp serves the Redis protocol in front of a running cluster, so redis-cli
+// and Redis clients can use it.
+//
+//	resp -listen :6379 -addrs localhost:50051,localhost:50052,localhost:50053 -consistency quorum
+//	redis-cli -p 6379 set greeting hello
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/hotkey"
+	"toy_dynamodb/pkg/resp"
+	Ring "toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/tracing"
+
+	"google.golang.org/grpc"
+)
+
+func main() {
+	listen := flag.String("listen", ":6379", "address of the Redis listener")
+	addrs := flag.String("addrs", "localhost:50051,localhost:50052,localhost:50053", "comma separated node addresses")
+	n := flag.Uint("n", 3, "replica count of the cluster")
+	partitioner := flag.String("partitioner", Ring.PartitionVNodes, "partitioner of the cluster: vnodes, rendezvous, jump or tokens")
+	consistency := flag.String("consistency", string(Ring.ConsistencyQuorum), "default read and write level of a connection: one, quorum or all")
+	healthInterval := flag.Duration("health-interval", 2*time.Second, "how often the nodes' health service is polled")
+	tablesInterval := flag.Duration("tables-interval", 10*time.Second, "how often the table catalog and rate limits are read from the nodes")
+	caFile := flag.String("tls-ca", "", "CA used to verify the nodes, enables TLS")
+	certFile := flag.String("tls-cert", "", "client certificate for mTLS")
+	keyFile := flag.String("tls-key", "", "client private key for mTLS")
+	serverName := flag.String("tls-server-name", "", "override the name checked against node certificates")
+	token := flag.String("token", "", "bearer token sent with every RPC")
+	traceExporter := flag.String("trace-exporter", "", "where spans go: stdout, otlp or empty for nowhere")
+	traceEndpoint := flag.String("trace-endpoint", "", "host:port of the OTLP collector, default "+tracing.DefaultOTLPEndpoint)
+	hotCacheTTL := flag.Duration("hot-key-cache-ttl", 0, "how long reads of hot keys are answered from memory, 0 turns the cache off")
+	hotThreshold := flag.Float64("hot-key-threshold", Ring.DefaultHotThreshold, "requests per second from which a key is cached")
+	metricsListen := flag.String("metrics-listen", "", "address of the /debug/vars endpoint with the counts of the hot keys, empty disables it")
+	flag.Parse()
+
+	// a password on the command line shows up in ps
+	password := os.Getenv("KV_RESP_PASSWORD")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "resp", tracing.Config{Exporter: tracing.Exporter(*traceExporter), Endpoint: *traceEndpoint})
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	p, ok := Ring.NewPartitioner(*partitioner, Ring.XXHash)
+	if !ok {
+		log.Fatalf("unknown partitioner %q", *partitioner)
+	}
+	r := &Ring.Ring{ReplicaCount: *n, Partitioner: p}
+	if *caFile != "" {
+		creds, err := auth.ClientTLS(*certFile, *keyFile, *caFile, *serverName)
+		if err != nil {
+			log.Fatalf("TLS Error: %v", err)
+		}
+		r.DialOptions = append(r.DialOptions, grpc.WithTransportCredentials(creds))
+		if *token != "" {
+			r.DialOptions = append(r.DialOptions, grpc.WithPerRPCCredentials(auth.TokenCredentials{Token: *token}))
+		}
+	}
+	r.HotKey = Ring.HotKeyConfig{Track: *metricsListen != "", CacheTTL: *hotCacheTTL, Threshold: *hotThreshold}
+	r.Init()
+	for _, addr := range strings.Split(*addrs, ",") {
+		if err := r.AddNode(strings.TrimSpace(addr)); err != nil {
+			log.Fatalf("Connection Error %s: %v", addr, err)
+		}
+	}
+	if _, err := r.QuorumSize(Ring.Consistency(*consistency)); err != nil {
+		log.Fatalf("Invalid consistency: %v", err)
+	}
+
+	if *metricsListen != "" {
+		expvar.Publish("hot_keys", expvar.Func(func() any { return hotkey.Counts(r.HotKeys(0)) }))
+		// expvar registers /debug/vars on the default mux
+		go func() {
+			if err := http.ListenAndServe(*metricsListen, nil); err != nil {
+				log.Printf("metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	r.StartHealthChecks(ctx, *healthInterval)
+	// the rate limits come from the nodes, without them only the nodes limit
+	if err := r.RefreshTables(ctx); err != nil {
+		log.Printf("Reading the table catalog failed, retrying every %v: %v", *tablesInterval, err)
+	}
+	r.WatchTables(ctx, *tablesInterval)
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to create tcp listener %v", err)
+	}
+	s := &resp.Server{Ring: r, Consistency: Ring.Consistency(*consistency), Password: password}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	log.Printf("RESP listening on %s (cluster %s, consistency %s, auth %v)", *listen, *addrs, *consistency, password != "")
+	if err := s.Serve(l); err != nil {
+		log.Fatalf("RESP server stopped: %v", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownTracing(flushCtx)
+	log.Printf("RESP server stopped")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/rpcerr"
+	"toy_dynamodb/pkg/table"
+	kv "toy_dynamodb/proto"
+)
+
+// adminServer adds Backup to the table RPCs of table.AdminServer
+type adminServer struct {
+	*table.AdminServer
+	backupDir string
+}
+
+// Backup writes to a directory below backupDir, callers can only pick its
+// name. Backing up to an existing backup of this node only adds the new
+// part of the WAL.
+func (s *adminServer) Backup(ctx context.Context, r *kv.BackupRequest) (*kv.BackupResponse, error) {
+	if s.backupDir == "" {
+		return nil, rpcerr.ToStatus(&custom_errors.ArgError{Arg: "backup_dir", Message: "is not configured on this node"})
+	}
+	if r.Name == "" || r.Name == "." || r.Name == ".." || strings.ContainsAny(r.Name, `/\`) {
+		return nil, rpcerr.ToStatus(&custom_errors.ArgError{Arg: "name=" + r.Name, Message: "must be a plain directory name"})
+	}
+	n, err := s.Store.Node(r.Table)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+
+	dir := filepath.Join(s.backupDir, r.Name)
+	m, err := n.Backup(dir)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	return &kv.BackupResponse{
+		Dir:         dir,
+		WalOffset:   m.WALOffset,
+		Records:     m.Records,
+		LastVersion: m.LastVersion,
+		Segments:    int32(len(m.Segments)),
+	}, nil
+}
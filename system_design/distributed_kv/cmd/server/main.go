@@ -2,38 +2,68 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/chunk"
+	"toy_dynamodb/pkg/config"
+	"toy_dynamodb/pkg/hotkey"
 	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/rpcerr"
+	"toy_dynamodb/pkg/table"
+	"toy_dynamodb/pkg/tracing"
 	kv "toy_dynamodb/proto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type server struct {
 	kv.UnimplementedKVStoreServer
-	node *node.Node
+	tables *table.Store
 }
 
 func (s *server) Get(ctx context.Context, r *kv.GetRequest) (*kv.GetResponse, error) {
+	n, err := s.tables.Admit(r.Table, r.Key)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
 
-	res, success := s.node.Get(r.Key)
+	res, version, success := n.GetVersion(r.Key)
+
+	// too large for one message, the client continues with GetStream
+	if len(res) > chunk.Threshold {
+		return &kv.GetResponse{Found: success, Chunked: true, Size: uint64(len(res)), Version: version}, nil
+	}
 
 	return &kv.GetResponse{
-		Value: []byte(res),
-		Found: success,
+		Value:   res,
+		Found:   success,
+		Version: version,
 	}, nil
 }
 
 func (s *server) Put(ctx context.Context, r *kv.PutRequest) (*kv.PutResponse, error) {
+	n, err := s.tables.Admit(r.Table, r.Key)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
 
-	err := s.node.Put(r.Key, string(r.Value))
+	err = n.ApplyContext(ctx, node.Write{RequestID: r.RequestId, Key: r.Key, Value: r.Value, Version: r.Version})
 
 	if err != nil {
 		return &kv.PutResponse{
 			Success: false,
-		}, err
+		}, rpcerr.ToStatus(err)
 	}
 
 	return &kv.PutResponse{
@@ -43,12 +73,17 @@ func (s *server) Put(ctx context.Context, r *kv.PutRequest) (*kv.PutResponse, er
 }
 
 func (s *server) Delete(ctx context.Context, r *kv.DeleteRequest) (*kv.DeleteResponse, error) {
-	err := s.node.Del(r.Key)
+	n, err := s.tables.Admit(r.Table, r.Key)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+
+	err = n.ApplyContext(ctx, node.Write{RequestID: r.RequestId, Key: r.Key, Delete: true, Version: r.Version})
 
 	if err != nil {
 		return &kv.DeleteResponse{
 			Success: false,
-		}, err
+		}, rpcerr.ToStatus(err)
 	}
 
 	return &kv.DeleteResponse{
@@ -56,26 +91,180 @@ func (s *server) Delete(ctx context.Context, r *kv.DeleteRequest) (*kv.DeleteRes
 	}, nil
 }
 
+func (s *server) PutStream(stream kv.KVStore_PutStreamServer) error {
+	// every table has the max value size of the default one
+	a := chunk.NewAssembler(s.tables.Default().MaxValueSize())
+	for {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.Add(c); err != nil {
+			return rpcerr.ToStatus(err)
+		}
+	}
+
+	key, val, err := a.Value()
+	if err != nil {
+		return rpcerr.ToStatus(err)
+	}
+	n, err := s.tables.Admit(a.Table(), key)
+	if err != nil {
+		return rpcerr.ToStatus(err)
+	}
+	if err := n.ApplyContext(stream.Context(), node.Write{RequestID: a.RequestID(), Key: key, Value: val, Version: a.Version()}); err != nil {
+		return rpcerr.ToStatus(err)
+	}
+	return stream.SendAndClose(&kv.PutResponse{Success: true})
+}
+
+// GetStream doesn't take a token of the rate limit, the Get before it did
+func (s *server) GetStream(r *kv.GetRequest, stream kv.KVStore_GetStreamServer) error {
+	n, err := s.tables.Node(r.Table)
+	if err != nil {
+		return rpcerr.ToStatus(err)
+	}
+	val, version, found := n.GetVersion(r.Key)
+	return chunk.Send(val, version, found, stream.Send)
+}
+
+func (s *server) Scan(r *kv.ScanRequest, stream kv.KVStore_ScanServer) error {
+	n, err := s.tables.Node(r.Table)
+	if err != nil {
+		return rpcerr.ToStatus(err)
+	}
+	return n.Scan(r.Prefix, func(key string, val []byte, version uint64, deleted bool) error {
+		return stream.Send(chunk.ScanEntry(key, val, version, deleted))
+	})
+}
+
+func (s *server) Query(r *kv.QueryRequest, stream kv.KVStore_QueryServer) error {
+	n, err := s.tables.Node(r.Table)
+	if err != nil {
+		return rpcerr.ToStatus(err)
+	}
+	err = n.Query(r.Index, r.Value, func(key string, val []byte, version uint64) error {
+		return stream.Send(chunk.ScanEntry(key, val, version, false))
+	})
+	return rpcerr.ToStatus(err)
+}
+
 func main() {
 
-	nn := os.Getenv("NODE_NAME")
-	if nn == "" {
-		log.Fatal("NODE_NAME variable must be set before creating grpc server")
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
-	listener, err := net.Listen("tcp", ":50051")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.NodeName, cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing %v", err)
+	}
+
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		log.Fatalf("Failed to create tcp listener %v", err)
 	}
 
 	defer listener.Close()
 
-	n, err := node.New(nn)
+	tables, err := table.Open(cfg.NodeName, cfg.NodeOptions())
 
 	if err != nil {
 		log.Fatalf("%v failed to create node", err)
 	}
-	grpcServer := grpc.NewServer()
-	kv.RegisterKVStoreServer(grpcServer, &server{node: n})
+	n := tables.Default()
+	tables.TrackHotKeys(cfg.HotKeys)
+	expvar.Publish("hot_keys", expvar.Func(func() any { return hotkey.Counts(tables.HotKeys(0)) }))
+
+	opts := []grpc.ServerOption{tracing.ServerOption()}
+	if cfg.TLS.Enabled() {
+		creds, err := auth.ServerTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS settings %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	if cfg.Auth.Enabled() {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(cfg.Auth.UnaryInterceptor()),
+			grpc.ChainStreamInterceptor(cfg.Auth.StreamInterceptor()),
+		)
+	}
+
+	if cfg.MetricsPort != 0 {
+		// expvar registers /debug/vars on the default mux, with the replication
+		// lag and the counts of the hot keys. Their names stay behind
+		// Admin.HotKeys, the port has no auth.
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.MetricsPort), nil); err != nil {
+				log.Printf("metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	kv.RegisterKVStoreServer(grpcServer, &server{tables: tables})
+	kv.RegisterAdminServer(grpcServer, &adminServer{AdminServer: &table.AdminServer{Store: tables}, backupDir: cfg.BackupDir})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(kv.KVStore_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
 
-	grpcServer.Serve(listener)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := startReplication(ctx, cfg, tables); err != nil {
+		log.Fatalf("Failed to start replication %v", err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(listener)
+	}()
+
+	log.Printf("%s listening on %s (data dir %s, fsync %s, clean start %v, tls %v, mtls %v, auth %v, peers %v, replication targets %d, tables %d)",
+		cfg.NodeName, cfg.ListenAddr, cfg.DataDir, cfg.FsyncMode, n.CleanStart(), cfg.TLS.Enabled(), cfg.TLS.CAFile != "", cfg.Auth.Enabled(), cfg.Peers, len(cfg.Replication), len(tables.List()))
+
+	select {
+	case err := <-serveErr:
+		log.Printf("gRPC server stopped: %v", err)
+	case <-ctx.Done():
+		log.Printf("shutdown signal received, draining for at most %v", cfg.ShutdownTimeout)
+		// coordinators stop picking this node before the listener goes away
+		healthServer.Shutdown()
+		drain(grpcServer, cfg.ShutdownTimeout)
+	}
+
+	// GracefulStop returned, no RPC can touch the node anymore
+	if err := tables.Close(); err != nil {
+		log.Fatalf("Failed to close node cleanly %v", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("flushing spans failed: %v", err)
+	}
+	log.Printf("%s stopped", cfg.NodeName)
+}
+
+// drain stops accepting new RPCs and waits for in-flight ones. If they don't
+// finish in time the remaining connections are cut.
+func drain(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("drain timed out, closing remaining connections")
+		s.Stop()
+		<-done
+	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"path/filepath"
+	"sync"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/config"
+	"toy_dynamodb/pkg/node"
+	Ring "toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/table"
+	"toy_dynamodb/pkg/xdcr"
+
+	"google.golang.org/grpc"
+)
+
+// replication runs a Replicator for every table and configured remote
+// cluster. Tables created later get theirs from table.Store.Watch, a dropped
+// table's replicator is stopped and its checkpoint removed. Drops are not
+// replicated, the remote cluster keeps the table.
+type replication struct {
+	ctx     context.Context
+	cfg     *config.Config
+	targets []target
+
+	mu      sync.Mutex
+	running map[string]*shipper
+}
+
+type target struct {
+	config.ReplicationTarget
+	ring *Ring.Ring
+}
+
+// shipper is a running Replicator of one table's node
+type shipper struct {
+	rep    *xdcr.Replicator
+	node   *node.Node
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startReplication ships the WAL of every table to every configured remote
+// cluster until ctx is done. The lag of each target is published as the
+// expvar "replication", keyed by the target's name for the default table and
+// by target/table for the others.
+func startReplication(ctx context.Context, cfg *config.Config, tables *table.Store) error {
+	rp := &replication{ctx: ctx, cfg: cfg, running: map[string]*shipper{}}
+	for _, t := range cfg.Replication {
+		r := &Ring.Ring{ReplicaCount: t.ReplicaCount}
+		if t.TLS.CAFile != "" || t.TLS.CertFile != "" {
+			creds, err := auth.ClientTLS(t.TLS.CertFile, t.TLS.KeyFile, t.TLS.CAFile, "")
+			if err != nil {
+				return err
+			}
+			r.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+		}
+		r.Init()
+		for _, p := range t.Peers {
+			if err := r.AddNode(p); err != nil {
+				return err
+			}
+		}
+		rp.targets = append(rp.targets, target{t, r})
+	}
+	expvar.Publish("replication", expvar.Func(rp.stats))
+	if len(rp.targets) == 0 {
+		return nil
+	}
+
+	// watch first, a table created while the others start isn't missed
+	tables.Watch(rp.change)
+	rp.mu.Lock()
+	rp.start(table.Spec{}, tables.Default(), false)
+	for _, info := range tables.List() {
+		if n, err := tables.Node(info.Spec.Name); err == nil {
+			rp.start(info.Spec, n, false)
+		}
+	}
+	rp.mu.Unlock()
+	return nil
+}
+
+// change follows table.Store.Watch. A created table starts without a
+// checkpoint, one that is there belongs to a dropped table of the same name.
+func (rp *replication) change(c table.Change) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if c.Dropped {
+		rp.stop(c.Spec.Name, c.Node)
+		return
+	}
+	rp.start(c.Spec, c.Node, true)
+}
+
+// start runs the replicators of a table, it is called with mu held
+func (rp *replication) start(spec table.Spec, n *node.Node, created bool) {
+	for _, t := range rp.targets {
+		key := shipperKey(t.Name, spec.Name)
+		if s, ok := rp.running[key]; ok {
+			if s.node == n {
+				continue
+			}
+			rp.stopShipper(key, s)
+		}
+		checkpoint := rp.checkpoint(t.Name, spec.Name)
+		if created {
+			os.Remove(checkpoint)
+		}
+		ctx, cancel := context.WithCancel(rp.ctx)
+		s := &shipper{
+			rep: &xdcr.Replicator{
+				WAL:        n.Path(),
+				Table:      spec,
+				Checkpoint: checkpoint,
+				Target:     t.ring,
+				W:          t.W,
+				Keys:       rp.cfg.Keys(),
+			},
+			node:   n,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		rp.running[key] = s
+		go func() {
+			defer close(s.done)
+			s.rep.Run(ctx)
+		}()
+	}
+}
+
+// stop ends the replicators of a dropped table, unless the name already
+// belongs to a table created after it. It is called with mu held.
+func (rp *replication) stop(name string, n *node.Node) {
+	for _, t := range rp.targets {
+		key := shipperKey(t.Name, name)
+		if s, ok := rp.running[key]; ok && s.node == n {
+			rp.stopShipper(key, s)
+		}
+	}
+}
+
+// stopShipper waits for the replicator's pass to end, so it doesn't write
+// its checkpoint after it was removed
+func (rp *replication) stopShipper(key string, s *shipper) {
+	s.cancel()
+	<-s.done
+	os.Remove(s.rep.Checkpoint)
+	delete(rp.running, key)
+}
+
+// checkpoint keeps the position of the default table where it always was,
+// the ones of the other tables are next to their directories
+func (rp *replication) checkpoint(targetName, tableName string) string {
+	if tableName == table.Default {
+		return filepath.Join(rp.cfg.DataDir, rp.cfg.NodeName+"."+targetName+".xdcr")
+	}
+	return filepath.Join(rp.cfg.DataDir, rp.cfg.NodeName+".tables", tableName+"."+targetName+".xdcr")
+}
+
+func shipperKey(targetName, tableName string) string {
+	if tableName == table.Default {
+		return targetName
+	}
+	return targetName + "/" + tableName
+}
+
+func (rp *replication) stats() any {
+	rp.mu.Lock()
+	reps := make(map[string]*xdcr.Replicator, len(rp.running))
+	for key, s := range rp.running {
+		reps[key] = s.rep
+	}
+	rp.mu.Unlock()
+
+	out := map[string]any{}
+	for key, rep := range reps {
+		s := rep.Stats()
+		out[key] = map[string]any{
+			"offset":       s.Offset,
+			"behind_bytes": s.BehindBytes,
+			"lag_seconds":  s.Lag.Seconds(),
+			"last_version": s.LastVersion,
+			"shipped":      s.Shipped,
+			"errors":       s.Errors,
+		}
+	}
+	return out
+}
@@ -0,0 +1,290 @@
+// tables creates, drops and lists the tables of a cluster and changes their
+// limits. A change is made on every node, list shows what each node has.
+// reencrypt moves the values of a table to the active key of every node
+// after a key rotation. hotkeys lists the most requested keys of every node.
+//
+//	tables create    -addrs localhost:50051,localhost:50052,localhost:50053 -name sessions -n 2 -ttl 24h -quota 1073741824 -compression zstd
+//	tables limits    -addrs ... -name sessions -rate 500 -burst 1000 -quota 2147483648
+//	tables reencrypt -addrs ... -name sessions -dry-run
+//	tables hotkeys   -addrs ... -limit 10
+//	tables drop      -addrs ... -name sessions
+//	tables list      -addrs ...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/limit"
+	Ring "toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/table"
+	kv "toy_dynamodb/proto"
+
+	"google.golang.org/grpc"
+)
+
+type clusterFlags struct {
+	addrs      *string
+	timeout    *time.Duration
+	caFile     *string
+	certFile   *string
+	keyFile    *string
+	serverName *string
+	token      *string
+}
+
+func newClusterFlags(fs *flag.FlagSet) clusterFlags {
+	return clusterFlags{
+		addrs:      fs.String("addrs", "localhost:50051,localhost:50052,localhost:50053", "comma separated addresses of every node"),
+		timeout:    fs.Duration("timeout", 30*time.Second, "how long the command may take"),
+		caFile:     fs.String("tls-ca", "", "CA used to verify the nodes, enables TLS"),
+		certFile:   fs.String("tls-cert", "", "client certificate for mTLS"),
+		keyFile:    fs.String("tls-key", "", "client private key for mTLS"),
+		serverName: fs.String("tls-server-name", "", "override the name checked against node certificates"),
+		token:      fs.String("token", "", "bearer token of an admin identity"),
+	}
+}
+
+// ring connects to every node, the replica count only matters for reads and
+// writes which this command doesn't do
+func (c clusterFlags) ring() *Ring.Ring {
+	r := &Ring.Ring{ReplicaCount: 1}
+	if *c.caFile != "" {
+		creds, err := auth.ClientTLS(*c.certFile, *c.keyFile, *c.caFile, *c.serverName)
+		if err != nil {
+			log.Fatalf("TLS Error: %v", err)
+		}
+		r.DialOptions = append(r.DialOptions, grpc.WithTransportCredentials(creds))
+		if *c.token != "" {
+			r.DialOptions = append(r.DialOptions, grpc.WithPerRPCCredentials(auth.TokenCredentials{Token: *c.token}))
+		}
+	}
+	r.Init()
+	for _, addr := range strings.Split(*c.addrs, ",") {
+		if err := r.AddNode(strings.TrimSpace(addr)); err != nil {
+			log.Fatalf("Connection Error %s: %v", addr, err)
+		}
+	}
+	return r
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "create":
+		create(os.Args[2:])
+	case "drop":
+		drop(os.Args[2:])
+	case "limits":
+		limits(os.Args[2:])
+	case "list":
+		list(os.Args[2:])
+	case "reencrypt":
+		reencrypt(os.Args[2:])
+	case "hotkeys":
+		hotkeys(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tables create|drop|limits|list|reencrypt|hotkeys [flags], -h for the flags of a command")
+	os.Exit(2)
+}
+
+func create(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	c := newClusterFlags(fs)
+	name := fs.String("name", "", "table name, a-z, 0-9, '_' and '-'")
+	n := fs.Uint("n", 3, "replica count of the table")
+	consistency := fs.String("consistency", "", "default R and W of front-ends: one, quorum or all, empty for quorum")
+	ttl := fs.Duration("ttl", 0, "values older than this are expired, 0 keeps them")
+	quota := fs.Int64("quota", 0, "bytes of keys and values the table may hold on every node, 0 for no quota")
+	rate := fs.Float64("rate", 0, "requests per second of the table on every coordinator and node, 0 for no limit")
+	burst := fs.Int("burst", 0, "requests that may come at once, 0 for one second of -rate")
+	compression := fs.String("compression", "", "compression of the values: snappy, zstd or none, empty for the node's setting")
+	minSize := fs.Int("compress-min-size", 0, "values below this many bytes aren't compressed, 0 for the node's setting")
+	fs.Parse(args)
+
+	spec := table.Spec{Name: *name, ReplicaCount: *n, Consistency: *consistency, TTL: *ttl,
+		Compression: *compression, CompressMinSize: *minSize,
+		Limits: table.Limits{QuotaBytes: *quota, Rate: limit.Rate{PerSecond: *rate, Burst: *burst}}}
+	ctx, cancel := context.WithTimeout(context.Background(), *c.timeout)
+	defer cancel()
+	if err := c.ring().CreateTable(ctx, spec); err != nil {
+		log.Fatalf("Create failed: %v", err)
+	}
+	fmt.Printf("created %s\n", *name)
+}
+
+func drop(args []string) {
+	fs := flag.NewFlagSet("drop", flag.ExitOnError)
+	c := newClusterFlags(fs)
+	name := fs.String("name", "", "table to drop, its data is deleted")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *c.timeout)
+	defer cancel()
+	if err := c.ring().DropTable(ctx, *name); err != nil {
+		log.Fatalf("Drop failed: %v", err)
+	}
+	fmt.Printf("dropped %s\n", *name)
+}
+
+// limits replaces all limits of a table, a limit that isn't given is removed
+func limits(args []string) {
+	fs := flag.NewFlagSet("limits", flag.ExitOnError)
+	c := newClusterFlags(fs)
+	name := fs.String("name", "", "table to change, empty for the default table")
+	quota := fs.Int64("quota", 0, "bytes of keys and values the table may hold on every node, 0 for no quota")
+	rate := fs.Float64("rate", 0, "requests per second of the table on every coordinator and node, 0 for no limit")
+	burst := fs.Int("burst", 0, "requests that may come at once, 0 for one second of -rate")
+	fs.Parse(args)
+
+	r := c.ring()
+	ctx, cancel := context.WithTimeout(context.Background(), *c.timeout)
+	defer cancel()
+	if err := r.RefreshTables(ctx); err != nil {
+		log.Fatalf("Reading the tables failed: %v", err)
+	}
+	l := table.Limits{QuotaBytes: *quota, Rate: limit.Rate{PerSecond: *rate, Burst: *burst}}
+	if err := r.SetLimits(ctx, *name, l); err != nil {
+		log.Fatalf("Changing the limits failed: %v", err)
+	}
+	fmt.Printf("limits of %s: %s\n", limit.Tenant(*name), formatLimits(l))
+}
+
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	c := newClusterFlags(fs)
+	fs.Parse(args)
+
+	r := c.ring()
+	ctx, cancel := context.WithTimeout(context.Background(), *c.timeout)
+	defer cancel()
+	for _, addr := range strings.Split(*c.addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		ac := r.AdminClient(addr)
+		if ac == nil {
+			log.Fatalf("%s isn't in the ring", addr)
+		}
+		res, err := ac.ListTables(ctx, &kv.ListTablesRequest{})
+		if err != nil {
+			fmt.Printf("%s: %v\n", addr, err)
+			continue
+		}
+		fmt.Printf("%s:\n", addr)
+		if def := res.DefaultTable; def != nil {
+			fmt.Printf("  %-20s %s used=%d\n", "(default)", formatLimits(table.FromProto(def.Spec).Limits), def.UsedBytes)
+		}
+		for _, info := range res.Tables {
+			s := table.FromProto(info.Spec)
+			fmt.Printf("  %-20s n=%d consistency=%s ttl=%s compression=%s %s used=%d\n",
+				s.Name, s.ReplicaCount, orQuorum(s.Consistency), s.TTL, orNode(s.Compression), formatLimits(s.Limits), info.UsedBytes)
+		}
+	}
+}
+
+// reencrypt runs on every node even when one fails, the nodes have their own
+// key files
+func reencrypt(args []string) {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	c := newClusterFlags(fs)
+	name := fs.String("name", "", "table to rewrite, empty for the default table")
+	dryRun := fs.Bool("dry-run", false, "only count the values that aren't under the active key")
+	fs.Parse(args)
+
+	r := c.ring()
+	ctx, cancel := context.WithTimeout(context.Background(), *c.timeout)
+	defer cancel()
+	failed := false
+	for _, addr := range strings.Split(*c.addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		ac := r.AdminClient(addr)
+		if ac == nil {
+			log.Fatalf("%s isn't in the ring", addr)
+		}
+		res, err := ac.Reencrypt(ctx, &kv.ReencryptRequest{Table: *name, DryRun: *dryRun})
+		if err != nil {
+			fmt.Printf("%s: %v\n", addr, err)
+			failed = true
+			continue
+		}
+		usage := make([]string, 0, len(res.KeyUsage))
+		for _, id := range slices.Sorted(maps.Keys(res.KeyUsage)) {
+			usage = append(usage, fmt.Sprintf("%s=%d", orPlain(id), res.KeyUsage[id]))
+		}
+		fmt.Printf("%s: active=%s rewritten=%d values %s\n", addr, orPlain(res.ActiveKey), res.Rewritten, strings.Join(usage, " "))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// hotkeys shows every node's list, the node whose list is hotter than the
+// others' is the one a key pins (ADR 0030)
+func hotkeys(args []string) {
+	fs := flag.NewFlagSet("hotkeys", flag.ExitOnError)
+	c := newClusterFlags(fs)
+	n := fs.Int("limit", 10, "keys per node, 0 for every tracked key")
+	fs.Parse(args)
+
+	r := c.ring()
+	ctx, cancel := context.WithTimeout(context.Background(), *c.timeout)
+	defer cancel()
+	for _, addr := range strings.Split(*c.addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		ac := r.AdminClient(addr)
+		if ac == nil {
+			log.Fatalf("%s isn't in the ring", addr)
+		}
+		res, err := ac.HotKeys(ctx, &kv.HotKeysRequest{Limit: int32(*n)})
+		if err != nil {
+			fmt.Printf("%s: %v\n", addr, err)
+			continue
+		}
+		fmt.Printf("%s:\n", addr)
+		for _, k := range res.Keys {
+			name := k.Table
+			if name == table.Default {
+				name = "(default)"
+			}
+			fmt.Printf("  %-20s %-40q %10.1f/s count=%d\n", name, k.Key, k.Rate, k.Count)
+		}
+	}
+}
+
+func orPlain(keyID string) string {
+	if keyID == "" {
+		return "(plain)"
+	}
+	return keyID
+}
+
+func orNode(compression string) string {
+	if compression == "" {
+		return "(node)"
+	}
+	return compression
+}
+
+func orQuorum(c string) string {
+	if c == "" {
+		return string(Ring.ConsistencyQuorum)
+	}
+	return c
+}
+
+func formatLimits(l table.Limits) string {
+	return fmt.Sprintf("rate=%v/s burst=%d quota=%d", l.Rate.PerSecond, l.Rate.Burst, l.QuotaBytes)
+}
@@ -0,0 +1,154 @@
+// transfer exports the keyspace of a running cluster to a file and imports
+// such a file into a cluster.
+//
+//	transfer export -addrs localhost:50051,localhost:50052,localhost:50053 -out dump.jsonl
+//	transfer import -addrs ... -in dump.jsonl -w 2 -checkpoint dump.checkpoint
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"toy_dynamodb/pkg/auth"
+	Ring "toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/transfer"
+
+	"google.golang.org/grpc"
+)
+
+// clusterFlags are shared by both commands
+type clusterFlags struct {
+	addrs, partitioner                    *string
+	n                                     *uint
+	caFile, certFile, keyFile, serverName *string
+	token                                 *string
+	format                                *string
+}
+
+func addClusterFlags(fs *flag.FlagSet) *clusterFlags {
+	return &clusterFlags{
+		addrs:       fs.String("addrs", "localhost:50051,localhost:50052,localhost:50053", "comma separated node addresses"),
+		n:           fs.Uint("n", 3, "replica count of the cluster"),
+		partitioner: fs.String("partitioner", Ring.PartitionVNodes, "partitioner of the cluster: vnodes, rendezvous, jump or tokens"),
+		caFile:      fs.String("tls-ca", "", "CA used to verify the nodes, enables TLS"),
+		certFile:    fs.String("tls-cert", "", "client certificate for mTLS"),
+		keyFile:     fs.String("tls-key", "", "client private key for mTLS"),
+		serverName:  fs.String("tls-server-name", "", "override the name checked against node certificates"),
+		token:       fs.String("token", "", "bearer token sent with every RPC, export needs an admin identity"),
+		format:      fs.String("format", string(transfer.FormatJSONL), "jsonl or binary"),
+	}
+}
+
+func (f *clusterFlags) ring() *Ring.Ring {
+	p, ok := Ring.NewPartitioner(*f.partitioner, Ring.XXHash)
+	if !ok {
+		log.Fatalf("unknown partitioner %q", *f.partitioner)
+	}
+	r := &Ring.Ring{ReplicaCount: *f.n, Partitioner: p}
+	if *f.caFile != "" {
+		creds, err := auth.ClientTLS(*f.certFile, *f.keyFile, *f.caFile, *f.serverName)
+		if err != nil {
+			log.Fatalf("TLS Error: %v", err)
+		}
+		r.DialOptions = append(r.DialOptions, grpc.WithTransportCredentials(creds))
+		if *f.token != "" {
+			r.DialOptions = append(r.DialOptions, grpc.WithPerRPCCredentials(auth.TokenCredentials{Token: *f.token}))
+		}
+	}
+	r.Init()
+	for _, addr := range strings.Split(*f.addrs, ",") {
+		if err := r.AddNode(strings.TrimSpace(addr)); err != nil {
+			log.Fatalf("Connection Error %s: %v", addr, err)
+		}
+	}
+	return r
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch os.Args[1] {
+	case "export":
+		export(ctx, os.Args[2:])
+	case "import":
+		importFile(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: transfer export|import [flags], -h for the flags of a command")
+	os.Exit(2)
+}
+
+func export(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cf := addClusterFlags(fs)
+	out := fs.String("out", "-", "output file, - for stdout")
+	values := fs.String("values", string(transfer.ValuesBase64), "jsonl values: base64 or raw")
+	prefix := fs.String("prefix", "", "only export keys starting with this prefix")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	tw, err := transfer.NewWriter(transfer.Format(*cf.format), transfer.ValueEncoding(*values), w)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := transfer.Export(ctx, cf.ring(), *prefix, tw)
+	if err != nil {
+		log.Fatalf("Export failed after %d keys: %v", n, err)
+	}
+	log.Printf("exported %d keys", n)
+}
+
+func importFile(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	cf := addClusterFlags(fs)
+	in := fs.String("in", "-", "input file, - for stdin")
+	w := fs.Int("w", 2, "write quorum")
+	workers := fs.Int("workers", transfer.DefaultImportWorkers, "batches written in parallel")
+	batch := fs.Int("batch", transfer.DefaultImportBatch, "records per batch")
+	checkpoint := fs.String("checkpoint", "", "file that records the progress, rerun with it to resume")
+	reset := fs.Bool("reset-versions", false, "give every record a new version instead of the exported one")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	tr, err := transfer.NewReader(transfer.Format(*cf.format), r)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	im := &transfer.Importer{Ring: cf.ring(), W: *w, Workers: *workers, BatchSize: *batch, Checkpoint: *checkpoint, ResetVersions: *reset}
+	s, err := im.Run(ctx, tr)
+	if err != nil {
+		log.Fatalf("Import stopped after %d records (%d skipped): %v", s.Imported, s.Skipped, err)
+	}
+	log.Printf("imported %d records, skipped %d of an earlier run", s.Imported, s.Skipped)
+}
@@ -2,41 +2,175 @@ package adapter
 
 import (
 	"context"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/chunk"
 	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/rpcerr"
+	"toy_dynamodb/pkg/table"
 	kv "toy_dynamodb/proto"
 
 	"google.golang.org/grpc"
 )
 
 type LocalClient struct {
-	node *node.Node
+	node   *node.Node
+	tables *table.Store
 }
 
 func NewLocalClient(n *node.Node) *LocalClient {
 	return &LocalClient{node: n}
 }
 
+// table resolves a request's table, a client made by NewLocalClient only has
+// the default table and no rate limits
+func (l *LocalClient) table(name string) (*node.Node, error) {
+	if l.tables != nil {
+		n, err := l.tables.Node(name)
+		return n, rpcerr.ToStatus(err)
+	}
+	if name != table.Default {
+		return nil, rpcerr.ToStatus(&custom_errors.ArgError{Arg: "table " + name, Message: "doesn't exist on " + l.node.Name})
+	}
+	return l.node, nil
+}
+
+// admit is table for a request of key, like the server it takes a token of
+// the rate limit and counts the key for HotKeys
+func (l *LocalClient) admit(name, key string) (*node.Node, error) {
+	if l.tables != nil {
+		n, err := l.tables.Admit(name, key)
+		return n, rpcerr.ToStatus(err)
+	}
+	return l.table(name)
+}
+
 func (l *LocalClient) Put(ctx context.Context, in *kv.PutRequest, opts ...grpc.CallOption) (*kv.PutResponse, error) {
-	err := l.node.Put(in.Key, string(in.Value))
+	n, err := l.admit(in.Table, in.Key)
+	if err != nil {
+		return nil, err
+	}
+	err = n.ApplyContext(ctx, node.Write{RequestID: in.RequestId, Key: in.Key, Value: in.Value, Version: in.Version})
 	if err != nil {
-		return &kv.PutResponse{Success: false}, err
+		return &kv.PutResponse{Success: false}, rpcerr.ToStatus(err)
 	}
 	return &kv.PutResponse{Success: true}, nil
 }
 
+// Get answers like the gRPC server does, large values have to be fetched
+// with GetStream
 func (l *LocalClient) Get(ctx context.Context, in *kv.GetRequest, opts ...grpc.CallOption) (*kv.GetResponse, error) {
-	val, found := l.node.Get(in.Key)
+	n, err := l.admit(in.Table, in.Key)
+	if err != nil {
+		return nil, err
+	}
+	val, version, found := n.GetVersion(in.Key)
+	if len(val) > chunk.Threshold {
+		return &kv.GetResponse{Found: found, Chunked: true, Size: uint64(len(val)), Version: version}, nil
+	}
 
 	return &kv.GetResponse{
-		Value: []byte(val),
-		Found: found,
+		Value:   val,
+		Found:   found,
+		Version: version,
 	}, nil
 }
 
 func (l *LocalClient) Delete(ctx context.Context, in *kv.DeleteRequest, opts ...grpc.CallOption) (*kv.DeleteResponse, error) {
-	err := l.node.Del(in.Key)
+	n, err := l.admit(in.Table, in.Key)
 	if err != nil {
-		return &kv.DeleteResponse{Success: false}, err
+		return nil, err
+	}
+	err = n.ApplyContext(ctx, node.Write{RequestID: in.RequestId, Key: in.Key, Delete: true, Version: in.Version})
+	if err != nil {
+		return &kv.DeleteResponse{Success: false}, rpcerr.ToStatus(err)
 	}
 	return &kv.DeleteResponse{Success: true}, nil
 }
+
+func (l *LocalClient) PutStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[kv.PutChunk, kv.PutResponse], error) {
+	return &putStream{localStream: localStream{ctx: ctx}, client: l, asm: chunk.NewAssembler(l.node.MaxValueSize())}, nil
+}
+
+func (l *LocalClient) Scan(ctx context.Context, in *kv.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[kv.ScanEntry], error) {
+	n, err := l.table(in.Table)
+	if err != nil {
+		return nil, err
+	}
+	s := &scanStream{localStream: localStream{ctx: ctx}}
+	n.Scan(in.Prefix, func(key string, val []byte, version uint64, deleted bool) error {
+		s.entries = append(s.entries, chunk.ScanEntry(key, val, version, deleted))
+		return nil
+	})
+	return s, nil
+}
+
+func (l *LocalClient) Query(ctx context.Context, in *kv.QueryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[kv.ScanEntry], error) {
+	n, err := l.table(in.Table)
+	if err != nil {
+		return nil, err
+	}
+	s := &scanStream{localStream: localStream{ctx: ctx}}
+	err = n.Query(in.Index, in.Value, func(key string, val []byte, version uint64) error {
+		s.entries = append(s.entries, chunk.ScanEntry(key, val, version, false))
+		return nil
+	})
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	return s, nil
+}
+
+func (l *LocalClient) GetStream(ctx context.Context, in *kv.GetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[kv.GetChunk], error) {
+	n, err := l.table(in.Table)
+	if err != nil {
+		return nil, err
+	}
+	val, version, found := n.GetVersion(in.Key)
+	s := &getStream{localStream: localStream{ctx: ctx}}
+	chunk.Send(val, version, found, func(c *kv.GetChunk) error {
+		s.chunks = append(s.chunks, c)
+		return nil
+	})
+	return s, nil
+}
+
+// StoreClient is a LocalClient over all tables of a node, it also answers
+// the table RPCs of the Admin service with table.AdminServer, like the
+// server, so a Ring can create tables in tests
+type StoreClient struct {
+	*LocalClient
+	admin *table.AdminServer
+}
+
+func NewStoreClient(s *table.Store) *StoreClient {
+	return &StoreClient{&LocalClient{node: s.Default(), tables: s}, &table.AdminServer{Store: s}}
+}
+
+// Backup isn't served in-process, there is no backup_dir
+func (s *StoreClient) Backup(ctx context.Context, in *kv.BackupRequest, opts ...grpc.CallOption) (*kv.BackupResponse, error) {
+	return nil, rpcerr.ToStatus(&custom_errors.ArgError{Arg: "backup_dir", Message: "is not configured on this node"})
+}
+
+func (s *StoreClient) CreateTable(ctx context.Context, in *kv.CreateTableRequest, opts ...grpc.CallOption) (*kv.TableInfo, error) {
+	return s.admin.CreateTable(ctx, in)
+}
+
+func (s *StoreClient) DropTable(ctx context.Context, in *kv.DropTableRequest, opts ...grpc.CallOption) (*kv.DropTableResponse, error) {
+	return s.admin.DropTable(ctx, in)
+}
+
+func (s *StoreClient) ListTables(ctx context.Context, in *kv.ListTablesRequest, opts ...grpc.CallOption) (*kv.ListTablesResponse, error) {
+	return s.admin.ListTables(ctx, in)
+}
+
+func (s *StoreClient) SetLimits(ctx context.Context, in *kv.SetLimitsRequest, opts ...grpc.CallOption) (*kv.TableInfo, error) {
+	return s.admin.SetLimits(ctx, in)
+}
+
+func (s *StoreClient) Reencrypt(ctx context.Context, in *kv.ReencryptRequest, opts ...grpc.CallOption) (*kv.ReencryptResponse, error) {
+	return s.admin.Reencrypt(ctx, in)
+}
+
+func (s *StoreClient) HotKeys(ctx context.Context, in *kv.HotKeysRequest, opts ...grpc.CallOption) (*kv.HotKeysResponse, error) {
+	return s.admin.HotKeys(ctx, in)
+}
@@ -0,0 +1,127 @@
+package adapter
+
+import (
+	"context"
+	"io"
+	"toy_dynamodb/pkg/chunk"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/rpcerr"
+	kv "toy_dynamodb/proto"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// localStream is the in-process stand-in for grpc.ClientStream, there are no
+// headers or trailers to deliver
+type localStream struct {
+	ctx context.Context
+}
+
+func (s localStream) Header() (metadata.MD, error) { return nil, nil }
+func (s localStream) Trailer() metadata.MD         { return nil }
+func (s localStream) CloseSend() error             { return nil }
+func (s localStream) Context() context.Context     { return s.ctx }
+
+// putStream assembles the chunks and stores the value on CloseAndRecv, like
+// the server does when the client half-closes the stream
+type putStream struct {
+	localStream
+	client *LocalClient
+	asm    *chunk.Assembler
+	err    error
+}
+
+func (s *putStream) Send(c *kv.PutChunk) error {
+	if s.err == nil {
+		s.err = s.asm.Add(c)
+	}
+	return s.ctx.Err()
+}
+
+func (s *putStream) CloseAndRecv() (*kv.PutResponse, error) {
+	if s.err != nil {
+		return nil, rpcerr.ToStatus(s.err)
+	}
+	key, val, err := s.asm.Value()
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	n, err := s.client.admit(s.asm.Table(), key)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.ApplyContext(s.ctx, node.Write{RequestID: s.asm.RequestID(), Key: key, Value: val, Version: s.asm.Version()}); err != nil {
+		return &kv.PutResponse{Success: false}, rpcerr.ToStatus(err)
+	}
+	return &kv.PutResponse{Success: true}, nil
+}
+
+func (s *putStream) SendMsg(m any) error {
+	return s.Send(m.(*kv.PutChunk))
+}
+
+func (s *putStream) RecvMsg(m any) error {
+	res, err := s.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(proto.Message), res)
+	return nil
+}
+
+type getStream struct {
+	localStream
+	chunks []*kv.GetChunk
+}
+
+func (s *getStream) Recv() (*kv.GetChunk, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.chunks) == 0 {
+		return nil, io.EOF
+	}
+	c := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return c, nil
+}
+
+func (s *getStream) SendMsg(m any) error { return nil }
+
+func (s *getStream) RecvMsg(m any) error {
+	c, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(proto.Message), c)
+	return nil
+}
+
+type scanStream struct {
+	localStream
+	entries []*kv.ScanEntry
+}
+
+func (s *scanStream) Recv() (*kv.ScanEntry, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.entries) == 0 {
+		return nil, io.EOF
+	}
+	e := s.entries[0]
+	s.entries = s.entries[1:]
+	return e, nil
+}
+
+func (s *scanStream) SendMsg(m any) error { return nil }
+
+func (s *scanStream) RecvMsg(m any) error {
+	e, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	proto.Merge(m.(proto.Message), e)
+	return nil
+}
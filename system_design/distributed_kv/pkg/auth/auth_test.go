@@ -0,0 +1,368 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/chunk"
+	kv "toy_dynamodb/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var policy = &auth.Policy{
+	Tokens: map[string]string{"app": "app-token", "ops": "ops-token", "tenant": "tenant-token", "ingest": "ingest-token"},
+	Rules: []auth.Rule{
+		{Identity: "app", Read: []string{"users/", "public/"}, Write: []string{"users/"}},
+		{Identity: "svc-cert", Read: []string{""}},
+		{Identity: "ops", Admin: true},
+		{Identity: "tenant", Read: []string{"s/"}, Write: []string{"s/"}, Tables: []string{"sessions"}},
+		{Identity: "ingest", Write: []string{"events/"}},
+	},
+}
+
+// caller builds the context of an RPC with a bearer token and/or a verified
+// client certificate, either may be empty
+func caller(token, cn string) context.Context {
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	}
+	if cn != "" {
+		state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+	}
+	return ctx
+}
+
+func TestUnaryPolicy(t *testing.T) {
+	unverified := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	cases := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		req    any
+		code   codes.Code
+	}{
+		{"token read", caller("app-token", ""), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "users/1"}, codes.OK},
+		{"token write", caller("app-token", ""), kv.KVStore_Put_FullMethodName, &kv.PutRequest{Key: "users/1"}, codes.OK},
+		{"read only prefix", caller("app-token", ""), kv.KVStore_Put_FullMethodName, &kv.PutRequest{Key: "public/1"}, codes.PermissionDenied},
+		{"wrong prefix", caller("app-token", ""), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "orders/1"}, codes.PermissionDenied},
+		{"certificate read", caller("", "svc-cert"), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "orders/1"}, codes.OK},
+		{"certificate write", caller("", "svc-cert"), kv.KVStore_Delete_FullMethodName, &kv.DeleteRequest{Key: "orders/1"}, codes.PermissionDenied},
+		// the token names the identity when both are present
+		{"token over certificate", caller("app-token", "svc-cert"), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "orders/1"}, codes.PermissionDenied},
+		{"admin method", caller("app-token", ""), kv.Admin_CreateTable_FullMethodName, &kv.CreateTableRequest{}, codes.PermissionDenied},
+		{"admin identity", caller("ops-token", ""), kv.Admin_CreateTable_FullMethodName, &kv.CreateTableRequest{}, codes.OK},
+		{"unknown method needs admin", caller("app-token", ""), "/kv.Admin/Unknown", nil, codes.PermissionDenied},
+		// ListTables has no key, it still needs a read prefix
+		{"list tables", caller("", "svc-cert"), kv.Admin_ListTables_FullMethodName, &kv.ListTablesRequest{}, codes.OK},
+		{"write only list tables", caller("ingest-token", ""), kv.Admin_ListTables_FullMethodName, &kv.ListTablesRequest{}, codes.PermissionDenied},
+		{"write only put", caller("ingest-token", ""), kv.KVStore_Put_FullMethodName, &kv.PutRequest{Key: "events/1"}, codes.OK},
+		{"scan needs admin", caller("", "svc-cert"), kv.KVStore_Scan_FullMethodName, &kv.ScanRequest{}, codes.PermissionDenied},
+		{"public method", context.Background(), healthpb.Health_Check_FullMethodName, &healthpb.HealthCheckRequest{}, codes.OK},
+		{"unknown token", caller("guess", ""), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "users/1"}, codes.Unauthenticated},
+		{"no credentials", context.Background(), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "users/1"}, codes.Unauthenticated},
+		{"unverified certificate", unverified, kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "users/1"}, codes.Unauthenticated},
+		{"certificate without rule", caller("", "stranger"), kv.KVStore_Get_FullMethodName, &kv.GetRequest{Key: "users/1"}, codes.PermissionDenied},
+	}
+
+	intercept := policy.UnaryInterceptor()
+	handler := func(ctx context.Context, req any) (any, error) { return req, nil }
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := intercept(c.ctx, c.req, &grpc.UnaryServerInfo{FullMethod: c.method}, handler)
+			if got := status.Code(err); got != c.code {
+				t.Errorf("Expected %v but got %v (%v)", c.code, got, err)
+			}
+		})
+	}
+
+	var open *auth.Policy
+	if _, err := open.UnaryInterceptor()(context.Background(), &kv.PutRequest{Key: "x"}, &grpc.UnaryServerInfo{FullMethod: kv.KVStore_Put_FullMethodName}, handler); err != nil {
+		t.Errorf("Expected a policy without rules to allow everything but got %v", err)
+	}
+}
+
+// chunkStream is a server stream that receives msgs in order
+type chunkStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	msgs []proto.Message
+}
+
+func (s *chunkStream) Context() context.Context { return s.ctx }
+
+func (s *chunkStream) RecvMsg(m any) error {
+	if len(s.msgs) == 0 {
+		return io.EOF
+	}
+	proto.Merge(m.(proto.Message), s.msgs[0])
+	s.msgs = s.msgs[1:]
+	return nil
+}
+
+// Only the first chunk of a PutStream has the key, the chunks after it
+// belong to the same value. A later chunk with another key is checked again.
+func TestStreamChunks(t *testing.T) {
+	cases := []struct {
+		name   string
+		chunks []proto.Message
+		code   codes.Code
+	}{
+		{"allowed key", []proto.Message{&kv.PutChunk{Key: "users/big", Data: []byte("a")}, &kv.PutChunk{Data: []byte("b")}, &kv.PutChunk{Data: []byte("c")}}, codes.OK},
+		{"wrong prefix", []proto.Message{&kv.PutChunk{Key: "orders/big", Data: []byte("a")}, &kv.PutChunk{Data: []byte("b")}}, codes.PermissionDenied},
+		{"key changes", []proto.Message{&kv.PutChunk{Key: "users/big", Data: []byte("a")}, &kv.PutChunk{Key: "orders/big", Data: []byte("b")}}, codes.PermissionDenied},
+	}
+
+	intercept := policy.StreamInterceptor()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			received := 0
+			handler := func(srv any, ss grpc.ServerStream) error {
+				for {
+					var chunk kv.PutChunk
+					if err := ss.RecvMsg(&chunk); err == io.EOF {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					received++
+				}
+			}
+			ss := &chunkStream{ctx: caller("app-token", ""), msgs: c.chunks}
+			err := intercept(nil, ss, &grpc.StreamServerInfo{FullMethod: kv.KVStore_PutStream_FullMethodName, IsClientStream: true}, handler)
+			if got := status.Code(err); got != c.code {
+				t.Errorf("Expected %v but got %v (%v)", c.code, got, err)
+			}
+			if c.code == codes.OK && received != len(c.chunks) {
+				t.Errorf("Expected %d chunks but got %d", len(c.chunks), received)
+			}
+		})
+	}
+}
+
+// A rule limited to tables lets its identity stream values above
+// chunk.Threshold in these tables and no others
+func TestTableScopedStreams(t *testing.T) {
+	val := make([]byte, chunk.Threshold+1)
+	split := func(table string) []proto.Message {
+		var chunks []proto.Message
+		if err := chunk.Split(table, "s/1", "", 0, val, func(c *kv.PutChunk) error {
+			chunks = append(chunks, c)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return chunks
+	}
+	cases := []struct {
+		name   string
+		method string
+		msgs   []proto.Message
+		code   codes.Code
+	}{
+		{"put own table", kv.KVStore_PutStream_FullMethodName, split("sessions"), codes.OK},
+		{"put other table", kv.KVStore_PutStream_FullMethodName, split("users"), codes.PermissionDenied},
+		{"put default table", kv.KVStore_PutStream_FullMethodName, split(""), codes.PermissionDenied},
+		{"get own table", kv.KVStore_GetStream_FullMethodName, []proto.Message{&kv.GetRequest{Table: "sessions", Key: "s/1"}}, codes.OK},
+		{"get other prefix", kv.KVStore_GetStream_FullMethodName, []proto.Message{&kv.GetRequest{Table: "sessions", Key: "x/1"}}, codes.PermissionDenied},
+	}
+
+	intercept := policy.StreamInterceptor()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if len(c.msgs) < 2 && c.method == kv.KVStore_PutStream_FullMethodName {
+				t.Fatalf("Expected a value above the threshold to take several chunks but got %d", len(c.msgs))
+			}
+			put := c.method == kv.KVStore_PutStream_FullMethodName
+			a := chunk.NewAssembler(len(val))
+			handler := func(srv any, ss grpc.ServerStream) error {
+				if !put {
+					return ss.RecvMsg(new(kv.GetRequest))
+				}
+				for {
+					var m kv.PutChunk
+					if err := ss.RecvMsg(&m); err == io.EOF {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := a.Add(&m); err != nil {
+						return err
+					}
+				}
+			}
+			ss := &chunkStream{ctx: caller("tenant-token", ""), msgs: c.msgs}
+			err := intercept(nil, ss, &grpc.StreamServerInfo{FullMethod: c.method, IsClientStream: put, IsServerStream: !put}, handler)
+			if got := status.Code(err); got != c.code {
+				t.Fatalf("Expected %v but got %v (%v)", c.code, got, err)
+			}
+			if put && c.code == codes.OK {
+				if _, got, err := a.Value(); err != nil || len(got) != len(val) {
+					t.Errorf("Expected the whole value of %d bytes but got %d (%v)", len(val), len(got), err)
+				}
+			}
+		})
+	}
+
+	// the access class is still checked before the first message
+	ss := &chunkStream{ctx: caller("tenant-token", "")}
+	handler := func(srv any, ss grpc.ServerStream) error { return nil }
+	if err := intercept(nil, ss, &grpc.StreamServerInfo{FullMethod: kv.KVStore_Scan_FullMethodName}, handler); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected a scan without admin to be denied but got %v", err)
+	}
+}
+
+type certFiles struct {
+	cert, key string
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, name+".pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue signs a certificate for cn that serves localhost and authenticates
+// clients
+func (ca *testCA) issue(t *testing.T, dir, cn string) certFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := certFiles{cert: filepath.Join(dir, cn+".pem"), key: filepath.Join(dir, cn+"-key.pem")}
+	writePEM(t, f.cert, "CERTIFICATE", der)
+	writePEM(t, f.key, "EC PRIVATE KEY", keyDER)
+	return f
+}
+
+type kvServer struct {
+	kv.UnimplementedKVStoreServer
+}
+
+// With a CA the server only accepts client certificates it signed, and the
+// CommonName of an accepted certificate is the identity of the policy
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, other := newCA(t, dir, "ca"), newCA(t, dir, "other-ca")
+	server := ca.issue(t, dir, "node-1")
+
+	creds, err := auth.ServerTLS(server.cert, server.key, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(creds), grpc.UnaryInterceptor(policy.UnaryInterceptor()))
+	kv.RegisterKVStoreServer(s, kvServer{})
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	dial := func(client certFiles) kv.KVStoreClient {
+		t.Helper()
+		creds, err := auth.ClientTLS(client.cert, client.key, ca.file, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return kv.NewKVStoreClient(conn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	trusted := dial(ca.issue(t, dir, "svc-cert"))
+	// Unimplemented means the policy let the call through to the server
+	if _, err := trusted.Get(ctx, &kv.GetRequest{Key: "orders/1"}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected svc-cert to be allowed to read but got %v", err)
+	}
+	if _, err := trusted.Put(ctx, &kv.PutRequest{Key: "orders/1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected svc-cert to be denied writes but got %v", err)
+	}
+
+	stranger := dial(other.issue(t, dir, "svc-cert-other"))
+	if _, err := stranger.Get(ctx, &kv.GetRequest{Key: "orders/1"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the handshake to reject a certificate of another CA but got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"slices"
+	"strings"
+	kv "toy_dynamodb/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type Access int
+
+const (
+	Read Access = iota
+	Write
+	// Admin is required for every method that is not listed in MethodAccess
+	Admin
+	// Public methods are callable without an identity
+	Public
+)
+
+// MethodAccess tells the interceptors what kind of access an RPC needs.
+// Keyed requests (anything with GetKey) are additionally checked against
+// the identity's key prefixes.
+var MethodAccess = map[string]Access{
+	kv.KVStore_Get_FullMethodName:       Read,
+	kv.KVStore_Put_FullMethodName:       Write,
+	kv.KVStore_Delete_FullMethodName:    Write,
+	kv.KVStore_PutStream_FullMethodName: Write,
+	kv.KVStore_GetStream_FullMethodName: Read,
+	kv.Admin_Backup_FullMethodName:      Admin,
+	kv.Admin_CreateTable_FullMethodName: Admin,
+	kv.Admin_DropTable_FullMethodName:   Admin,
+	// coordinators read the catalog and the rate limits with it
+	kv.Admin_ListTables_FullMethodName: Read,
+	kv.Admin_SetLimits_FullMethodName:  Admin,
+	kv.Admin_Reencrypt_FullMethodName:  Admin,
+	// HotKeys names keys of every table
+	kv.Admin_HotKeys_FullMethodName: Admin,
+	// Scan ignores key prefixes, it is for exports
+	kv.KVStore_Scan_FullMethodName: Admin,
+	// Query returns values of any key below the index prefix
+	kv.KVStore_Query_FullMethodName: Admin,
+
+	// load balancers and the ring's health checker must reach these without credentials
+	healthpb.Health_Check_FullMethodName: Public,
+	healthpb.Health_Watch_FullMethodName: Public,
+	healthpb.Health_List_FullMethodName:  Public,
+}
+
+// Rule grants an identity access to keys starting with one of the prefixes.
+// The empty prefix matches every key. Tables limits the read and write
+// prefixes to these tables, "" is the default table and no tables means all.
+type Rule struct {
+	Identity string   `yaml:"identity"`
+	Read     []string `yaml:"read"`
+	Write    []string `yaml:"write"`
+	Tables   []string `yaml:"tables"`
+	Admin    bool     `yaml:"admin"`
+}
+
+// Policy maps callers to identities and identities to rules. An identity is
+// either the owner of a bearer token or the CommonName of a verified client
+// certificate. A Policy without rules allows everything.
+type Policy struct {
+	// Tokens maps identity -> token
+	Tokens map[string]string `yaml:"tokens"`
+	Rules  []Rule            `yaml:"rules"`
+}
+
+func (p *Policy) Enabled() bool {
+	return p != nil && len(p.Rules) > 0
+}
+
+type keyed interface {
+	GetKey() string
+}
+
+type tabled interface {
+	GetTable() string
+}
+
+func (p *Policy) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := p.authorize(ctx, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (p *Policy) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := p.authorize(ss.Context(), info.FullMethod, nil); err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{ServerStream: ss, policy: p, method: info.FullMethod})
+	}
+}
+
+// authorizedStream checks the table and the key of every received message
+// that carries a key. Only the first PutChunk of a stream has one, later
+// chunks without a key belong to the same value and are let through.
+type authorizedStream struct {
+	grpc.ServerStream
+	policy  *Policy
+	method  string
+	checked bool
+}
+
+func (s *authorizedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if k, ok := m.(keyed); ok && s.checked && k.GetKey() == "" {
+		return nil
+	}
+	s.checked = true
+	return s.policy.authorize(s.Context(), s.method, m)
+}
+
+func (p *Policy) authorize(ctx context.Context, method string, req any) error {
+	if !p.Enabled() {
+		return nil
+	}
+
+	access, known := MethodAccess[method]
+	if !known {
+		access = Admin
+	}
+	if access == Public {
+		return nil
+	}
+
+	id, ok := p.identity(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "no valid token or client certificate")
+	}
+	if req == nil {
+		return p.authorizeStream(id, method, access)
+	}
+
+	key, hasKey := "", false
+	if k, ok := req.(keyed); ok {
+		key, hasKey = k.GetKey(), true
+	}
+	tbl := ""
+	if t, ok := req.(tabled); ok {
+		tbl = t.GetTable()
+	}
+
+	for _, r := range p.Rules {
+		if r.Identity != id {
+			continue
+		}
+		if r.Admin {
+			return nil
+		}
+		if len(r.Tables) > 0 && !slices.Contains(r.Tables, tbl) {
+			continue
+		}
+		switch access {
+		case Read:
+			// a method without a key still needs a read prefix, like a stream
+			if len(r.Read) > 0 && (!hasKey || matchPrefix(r.Read, key)) {
+				return nil
+			}
+		case Write:
+			if len(r.Write) > 0 && (!hasKey || matchPrefix(r.Write, key)) {
+				return nil
+			}
+		}
+	}
+	if tbl != "" {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s on %q in table %s", id, method, key, tbl)
+	}
+	return status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s on %q", id, method, key)
+}
+
+// authorizeStream checks a stream before its first message, which carries
+// the table and the key. Any rule of the identity that grants the access
+// lets the stream start, authorizedStream checks the rest on that message.
+func (p *Policy) authorizeStream(id, method string, access Access) error {
+	for _, r := range p.Rules {
+		if r.Identity != id {
+			continue
+		}
+		if r.Admin || access == Read && len(r.Read) > 0 || access == Write && len(r.Write) > 0 {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s", id, method)
+}
+
+func (p *Policy) identity(ctx context.Context) (string, bool) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("authorization") {
+			token, found := strings.CutPrefix(v, "Bearer ")
+			if !found {
+				continue
+			}
+			for id, t := range p.Tokens {
+				if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+					return id, true
+				}
+			}
+		}
+	}
+
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.AuthInfo == nil {
+		return "", false
+	}
+	tlsInfo, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cn := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	return cn, cn != ""
+}
+
+func matchPrefix(prefixes []string, key string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	custom_errors "toy_dynamodb/Errors"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// ServerTLS loads the node certificate. When caFile is set, clients must
+// present a certificate signed by that CA (mutual TLS).
+func ServerTLS(certFile, keyFile, caFile string) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// ClientTLS is used by the coordinator (Ring) to dial nodes. certFile/keyFile
+// are optional and only needed when the nodes require client certificates.
+func ClientTLS(certFile, keyFile, caFile, serverName string) (credentials.TransportCredentials, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+func loadPool(caFile string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, &custom_errors.ArgError{Arg: caFile, Message: "no PEM certificates found"}
+	}
+	return pool, nil
+}
+
+// TokenCredentials attaches a bearer token to every RPC.
+type TokenCredentials struct {
+	Token string
+	// AllowInsecure lets the token travel over plaintext connections,
+	// only meant for local testing.
+	AllowInsecure bool
+}
+
+func (t TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": fmt.Sprintf("Bearer %s", t.Token)}, nil
+}
+
+func (t TokenCredentials) RequireTransportSecurity() bool {
+	return !t.AllowInsecure
+}
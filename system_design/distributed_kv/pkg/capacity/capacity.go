@@ -0,0 +1,503 @@
+// Package capacity replays a key and traffic distribution against a
+// partitioner of pkg/ring and reports how the load lands on the nodes, which
+// nodes and keys are the hottest, and how many keys move when nodes join or
+// leave (ADR 0029). It takes the place of the hashing prototypes for planning
+// cluster growth.
+package capacity
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	custom_errors "toy_dynamodb/Errors"
+	Ring "toy_dynamodb/pkg/ring"
+)
+
+// Distribution is how the requests are spread over the keys
+type Distribution string
+
+const (
+	Uniform Distribution = "uniform"
+	// Zipf gives the key of rank i a share proportional to 1/(i+1)^ZipfS
+	Zipf Distribution = "zipf"
+	// HotKey gives HotShare of the requests to the first HotKeys keys and
+	// spreads the rest evenly
+	HotKey Distribution = "hotkey"
+)
+
+// Workload is the keyspace and the traffic on it. The rates are expected
+// values, not samples, so the same workload always gives the same report.
+type Workload struct {
+	Keys int
+	// Rate is the number of requests per second to the whole cluster
+	Rate         float64
+	Distribution Distribution
+	ZipfS        float64
+	HotKeys      int
+	HotShare     float64
+}
+
+func (w Workload) Validate() error {
+	if w.Keys < 1 {
+		return &custom_errors.ArgError{Arg: fmt.Sprint("keys=", w.Keys), Message: "must be at least 1"}
+	}
+	if w.Rate < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprint("rate=", w.Rate), Message: "can't be negative"}
+	}
+	switch w.Distribution {
+	case Uniform:
+	case Zipf:
+		if w.ZipfS <= 0 {
+			return &custom_errors.ArgError{Arg: fmt.Sprint("zipf s=", w.ZipfS), Message: "must be positive"}
+		}
+	case HotKey:
+		if w.HotKeys < 1 || w.HotKeys > w.Keys {
+			return &custom_errors.ArgError{Arg: fmt.Sprint("hot keys=", w.HotKeys), Message: "must be between 1 and the number of keys"}
+		}
+		if w.HotShare < 0 || w.HotShare > 1 {
+			return &custom_errors.ArgError{Arg: fmt.Sprint("hot share=", w.HotShare), Message: "must be between 0 and 1"}
+		}
+	default:
+		return &custom_errors.ArgError{Arg: "distribution " + string(w.Distribution), Message: "must be uniform, zipf or hotkey"}
+	}
+	return nil
+}
+
+// Key is the name of the key of rank i, rank 0 is the hottest
+func Key(i int) string {
+	return "key-" + strconv.Itoa(i)
+}
+
+// Rates returns the requests per second of every key by rank
+func (w Workload) Rates() []float64 {
+	rates := make([]float64, w.Keys)
+	switch w.Distribution {
+	case Uniform:
+		for i := range rates {
+			rates[i] = w.Rate / float64(w.Keys)
+		}
+	case Zipf:
+		var sum float64
+		for i := range rates {
+			rates[i] = 1 / math.Pow(float64(i+1), w.ZipfS)
+			sum += rates[i]
+		}
+		for i := range rates {
+			rates[i] *= w.Rate / sum
+		}
+	case HotKey:
+		cold := w.Rate * (1 - w.HotShare)
+		if w.HotKeys == w.Keys {
+			cold = 0
+		}
+		for i := range rates {
+			if i < w.HotKeys {
+				rates[i] = (w.Rate - cold) / float64(w.HotKeys)
+			} else {
+				rates[i] = cold / float64(w.Keys-w.HotKeys)
+			}
+		}
+	}
+	return rates
+}
+
+// Node is a member of the simulated cluster. Weight scales the vnodes of the
+// node, 0 is taken as 1.
+type Node struct {
+	Name   string
+	Weight float64
+}
+
+func (n Node) weight() float64 {
+	if n.Weight == 0 {
+		return 1
+	}
+	return n.Weight
+}
+
+// Cluster is the ring to simulate
+type Cluster struct {
+	Nodes []Node
+	// Partitioner is one of ring.Partitioners, empty is vnodes
+	Partitioner string
+	// Hash is nil for XXHash, like the ring
+	Hash Ring.HashFunc
+	// VNodes is the number of positions of a node of weight 1, 0 is
+	// ring.VirtualSpotCount. Only the vnodes partitioner uses it.
+	VNodes   int
+	Replicas int
+}
+
+// Nodes generates n nodes named node-1 to node-n with weight 1
+func Nodes(n int) []Node {
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = Node{Name: fmt.Sprint("node-", i+1), Weight: 1}
+	}
+	return nodes
+}
+
+func (c Cluster) Validate() error {
+	if len(c.Nodes) == 0 {
+		return &custom_errors.ArgError{Arg: "nodes", Message: "the cluster needs at least one node"}
+	}
+	if c.Replicas < 1 {
+		return &custom_errors.ArgError{Arg: fmt.Sprint("replicas=", c.Replicas), Message: "must be at least 1"}
+	}
+	if c.VNodes < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprint("vnodes=", c.VNodes), Message: "can't be negative"}
+	}
+	seen := map[string]bool{}
+	for _, n := range c.Nodes {
+		if err := c.validateNode(n); err != nil {
+			return err
+		}
+		if seen[n.Name] {
+			return &custom_errors.ArgError{Arg: "node " + n.Name, Message: "is listed twice"}
+		}
+		seen[n.Name] = true
+	}
+	if _, ok := Ring.NewPartitioner(c.partitioner(), c.hash()); !ok {
+		return &custom_errors.ArgError{Arg: "partitioner " + c.Partitioner, Message: "must be one of " + strings.Join(Ring.Partitioners, ", ")}
+	}
+	return nil
+}
+
+func (c Cluster) validateNode(n Node) error {
+	if n.Name == "" {
+		return &custom_errors.ArgError{Arg: "node", Message: "needs a name"}
+	}
+	if n.Weight < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("node %s weight=%v", n.Name, n.Weight), Message: "can't be negative"}
+	}
+	if n.weight() != 1 && c.partitioner() != Ring.PartitionVNodes {
+		return &custom_errors.ArgError{Arg: "node " + n.Name, Message: "weights need the vnodes partitioner"}
+	}
+	return nil
+}
+
+func (c Cluster) partitioner() string {
+	if c.Partitioner == "" {
+		return Ring.PartitionVNodes
+	}
+	return c.Partitioner
+}
+
+func (c Cluster) hash() Ring.HashFunc {
+	if c.Hash == nil {
+		return Ring.XXHash
+	}
+	return c.Hash
+}
+
+func (c Cluster) build() Ring.Partitioner {
+	var p Ring.Partitioner
+	if c.partitioner() == Ring.PartitionVNodes {
+		vnodes := c.VNodes
+		if vnodes == 0 {
+			vnodes = Ring.VirtualSpotCount
+		}
+		p = Ring.NewConsistentHash(c.hash(), vnodes)
+	} else {
+		p, _ = Ring.NewPartitioner(c.partitioner(), c.hash())
+	}
+	for _, n := range c.Nodes {
+		add(p, n)
+	}
+	return p
+}
+
+func add(p Ring.Partitioner, n Node) {
+	if ch, ok := p.(*Ring.ConsistentHash); ok {
+		ch.AddWeighted(n.Name, n.weight())
+		return
+	}
+	p.Add(n.Name)
+}
+
+// Change is a node joining or leaving
+type Change struct {
+	Leave bool
+	Node  Node
+}
+
+func (c Change) String() string {
+	if c.Leave {
+		return "leave " + c.Node.Name
+	}
+	if c.Node.weight() != 1 {
+		return fmt.Sprintf("join %s (weight %g)", c.Node.Name, c.Node.weight())
+	}
+	return "join " + c.Node.Name
+}
+
+// ParseChanges reads a comma separated scenario like
+// "join:node-11,join:node-12=2,leave:node-3", the number after '=' is the
+// weight of a joining node
+func ParseChanges(s string) ([]Change, error) {
+	var changes []Change
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		op, name, ok := strings.Cut(part, ":")
+		if !ok || name == "" {
+			return nil, &custom_errors.ArgError{Arg: part, Message: "must be join:<node>[=<weight>] or leave:<node>"}
+		}
+		c := Change{Node: Node{Name: name, Weight: 1}}
+		switch op {
+		case "join":
+			if name, w, ok := strings.Cut(name, "="); ok {
+				weight, err := strconv.ParseFloat(w, 64)
+				if err != nil {
+					return nil, &custom_errors.ArgError{Arg: part, Message: "weight is not a number"}
+				}
+				c.Node = Node{Name: name, Weight: weight}
+			}
+		case "leave":
+			c.Leave = true
+		default:
+			return nil, &custom_errors.ArgError{Arg: part, Message: "must be join:<node>[=<weight>] or leave:<node>"}
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// NodeLoad is what one node holds and serves. Every request of a key counts
+// on each of its replicas, as it does for writes and for reads with R=N.
+type NodeLoad struct {
+	Name   string
+	Weight float64
+	// Primaries is the number of keys the node is the first replica of
+	Primaries int
+	// Keys is the number of keys the node holds a replica of
+	Keys int
+	// Rate is the requests per second to the keys it holds
+	Rate float64
+}
+
+// KeyLoad is a key with its rate and the nodes that serve it
+type KeyLoad struct {
+	Key      string
+	Rate     float64
+	Replicas []string
+}
+
+// Spread is how uneven a load is over the nodes, both 0 for a perfectly even
+// one. The load of a node is divided by its weight first.
+type Spread struct {
+	// MaxOverMean is the busiest node's load over the mean load
+	MaxOverMean float64
+	// CV is the standard deviation over the mean
+	CV float64
+}
+
+// Report is the state of the cluster after a change, or the starting state
+type Report struct {
+	// Change is nil for the starting cluster
+	Change *Change
+	// Nodes ranks the nodes by rate per weight, the hottest first
+	Nodes []NodeLoad
+	Keys  Spread
+	Rate  Spread
+	// HotKeys are the keys with the highest rates, hottest first
+	HotKeys []KeyLoad
+	// MovedPrimaries is the number of keys whose first replica changed and
+	// MovedCopies the number of replicas a node has to receive
+	MovedPrimaries int
+	MovedCopies    int
+	// MovedRate is the requests per second that go to a node that didn't
+	// serve them before the change
+	MovedRate float64
+}
+
+// Hottest returns the node with the most requests per weight
+func (r Report) Hottest() NodeLoad {
+	return r.Nodes[0]
+}
+
+// simulation keeps the placement of every key between changes
+type simulation struct {
+	cluster Cluster
+	p       Ring.Partitioner
+	rates   []float64
+	keys    []string
+	placed  [][]string
+	top     int
+}
+
+func newSimulation(c Cluster, w Workload, top int) (*simulation, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	s := &simulation{cluster: c, p: c.build(), rates: w.Rates(), keys: make([]string, w.Keys), top: top}
+	s.cluster.Nodes = slices.Clone(c.Nodes)
+	for i := range s.keys {
+		s.keys[i] = Key(i)
+	}
+	s.placed = s.place()
+	return s, nil
+}
+
+func (s *simulation) place() [][]string {
+	placed := make([][]string, len(s.keys))
+	for i, k := range s.keys {
+		placed[i] = s.p.Replicas(k, s.cluster.Replicas)
+	}
+	return placed
+}
+
+func (s *simulation) apply(c Change) error {
+	i := slices.IndexFunc(s.cluster.Nodes, func(n Node) bool { return n.Name == c.Node.Name })
+	if c.Leave {
+		if i < 0 {
+			return &custom_errors.ArgError{Arg: c.String(), Message: "node is not in the cluster"}
+		}
+		if len(s.cluster.Nodes) == 1 {
+			return &custom_errors.ArgError{Arg: c.String(), Message: "the last node can't leave"}
+		}
+		s.cluster.Nodes = slices.Delete(s.cluster.Nodes, i, i+1)
+		s.p.Remove(c.Node.Name)
+		return nil
+	}
+	if i >= 0 {
+		return &custom_errors.ArgError{Arg: c.String(), Message: "node is already in the cluster"}
+	}
+	if err := s.cluster.validateNode(c.Node); err != nil {
+		return err
+	}
+	s.cluster.Nodes = append(s.cluster.Nodes, c.Node)
+	add(s.p, c.Node)
+	return nil
+}
+
+// step applies c and reports the cluster after it, with what moved
+func (s *simulation) step(c Change) (Report, error) {
+	if err := s.apply(c); err != nil {
+		return Report{}, err
+	}
+	before := s.placed
+	s.placed = s.place()
+	rep := s.report()
+	rep.Change = &c
+	for i, after := range s.placed {
+		if after[0] != before[i][0] {
+			rep.MovedPrimaries++
+		}
+		for _, n := range after {
+			if !slices.Contains(before[i], n) {
+				rep.MovedCopies++
+				rep.MovedRate += s.rates[i]
+			}
+		}
+	}
+	return rep, nil
+}
+
+func (s *simulation) report() Report {
+	loads := make(map[string]*NodeLoad, len(s.cluster.Nodes))
+	rep := Report{Nodes: make([]NodeLoad, len(s.cluster.Nodes))}
+	for i, n := range s.cluster.Nodes {
+		rep.Nodes[i] = NodeLoad{Name: n.Name, Weight: n.weight()}
+		loads[n.Name] = &rep.Nodes[i]
+	}
+	for i, rs := range s.placed {
+		loads[rs[0]].Primaries++
+		for _, n := range rs {
+			loads[n].Keys++
+			loads[n].Rate += s.rates[i]
+		}
+	}
+	rep.Keys = spread(rep.Nodes, func(l NodeLoad) float64 { return float64(l.Keys) })
+	rep.Rate = spread(rep.Nodes, func(l NodeLoad) float64 { return l.Rate })
+	slices.SortStableFunc(rep.Nodes, func(a, b NodeLoad) int {
+		return cmp.Or(cmp.Compare(b.Rate/b.Weight, a.Rate/a.Weight), cmp.Compare(a.Name, b.Name))
+	})
+
+	// the rates are sorted by rank for zipf and hotkey, uniform keys are
+	// all equally hot
+	for i := range min(s.top, len(s.keys)) {
+		rep.HotKeys = append(rep.HotKeys, KeyLoad{Key: s.keys[i], Rate: s.rates[i], Replicas: s.placed[i]})
+	}
+	return rep
+}
+
+func spread(loads []NodeLoad, load func(NodeLoad) float64) Spread {
+	var total, weights, peak float64
+	for _, l := range loads {
+		total += load(l)
+		weights += l.Weight
+		peak = max(peak, load(l)/l.Weight)
+	}
+	mean := total / weights
+	if mean == 0 {
+		return Spread{}
+	}
+	var sq float64
+	for _, l := range loads {
+		d := load(l)/l.Weight - mean
+		sq += d * d
+	}
+	return Spread{MaxOverMean: peak / mean, CV: math.Sqrt(sq/float64(len(loads))) / mean}
+}
+
+// Simulate reports the starting cluster and the cluster after each change,
+// in order. top is the number of hot keys in each report.
+func Simulate(c Cluster, w Workload, changes []Change, top int) ([]Report, error) {
+	s, err := newSimulation(c, w, top)
+	if err != nil {
+		return nil, err
+	}
+	reports := []Report{s.report()}
+	for _, ch := range changes {
+		rep, err := s.step(ch)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
+
+// Plan adds nodes of weight 1 until no node serves more than limit requests
+// per second, at most maxNodes in total. It returns the joins and the report
+// of the resulting cluster. A key whose rate alone is above the limit can't
+// be spread by adding nodes, Plan returns an error naming it.
+func Plan(c Cluster, w Workload, limit float64, maxNodes int) ([]Change, Report, error) {
+	if limit <= 0 {
+		return nil, Report{}, &custom_errors.ArgError{Arg: fmt.Sprint("limit=", limit), Message: "must be positive"}
+	}
+	s, err := newSimulation(c, w, 1)
+	if err != nil {
+		return nil, Report{}, err
+	}
+	if hot := slices.Max(s.rates); hot > limit {
+		i := slices.Index(s.rates, hot)
+		return nil, Report{}, &custom_errors.ArgError{Arg: Key(i), Message: fmt.Sprintf("gets %.0f requests/s alone, more than the limit of %.0f on every replica", hot, limit)}
+	}
+	var joins []Change
+	rep := s.report()
+	for next := len(s.cluster.Nodes) + 1; rep.Hottest().Rate > limit; next++ {
+		if len(s.cluster.Nodes) >= maxNodes {
+			return joins, rep, &custom_errors.ArgError{Arg: fmt.Sprint("max nodes=", maxNodes), Message: fmt.Sprintf("reached with %s still at %.0f requests/s", rep.Hottest().Name, rep.Hottest().Rate)}
+		}
+		name := fmt.Sprint("node-", next)
+		if slices.ContainsFunc(s.cluster.Nodes, func(n Node) bool { return n.Name == name }) {
+			continue
+		}
+		ch := Change{Node: Node{Name: name, Weight: 1}}
+		if rep, err = s.step(ch); err != nil {
+			return joins, rep, err
+		}
+		joins = append(joins, ch)
+	}
+	return joins, rep, nil
+}
@@ -0,0 +1,69 @@
+package capacity_test
+
+import (
+	"errors"
+	"testing"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/capacity"
+)
+
+// A join moves about the new node's share of the keys, a node of weight 2
+// takes about twice the keys of the others
+func TestJoinAndWeights(t *testing.T) {
+	cluster := capacity.Cluster{Nodes: capacity.Nodes(10), Replicas: 3}
+	workload := capacity.Workload{Keys: 50_000, Rate: 1000, Distribution: capacity.Uniform}
+	changes, err := capacity.ParseChanges("join:node-11,join:big=2,leave:node-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := capacity.Simulate(cluster, workload, changes, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 4 {
+		t.Fatalf("Expected a report for the start and each change but got %d", len(reports))
+	}
+	if got := float64(reports[1].MovedPrimaries) / float64(workload.Keys); got < 0.05 || got > 0.15 {
+		t.Errorf("Expected about 1/11 of the primaries to move on a join but got %.3f", got)
+	}
+	if reports[0].MovedCopies != 0 {
+		t.Errorf("Expected nothing to move at the start but got %d copies", reports[0].MovedCopies)
+	}
+
+	var big, others, count int
+	for _, n := range reports[2].Nodes {
+		if n.Name == "big" {
+			big = n.Primaries
+		} else {
+			others += n.Primaries
+			count++
+		}
+	}
+	if ratio := float64(big) / (float64(others) / float64(count)); ratio < 1.5 || ratio > 2.5 {
+		t.Errorf("Expected the node of weight 2 to hold about twice the primaries but got %.2f times", ratio)
+	}
+	if got := len(reports[3].Nodes); got != 11 {
+		t.Errorf("Expected 11 nodes after the leave but got %d", got)
+	}
+}
+
+// Adding nodes spreads a zipf load below the limit, but not a single key that
+// is hotter than the limit
+func TestPlan(t *testing.T) {
+	cluster := capacity.Cluster{Nodes: capacity.Nodes(3), Replicas: 3}
+	workload := capacity.Workload{Keys: 10_000, Rate: 3000, Distribution: capacity.Zipf, ZipfS: 0.8}
+	joins, rep, err := capacity.Plan(cluster, workload, 1500, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(joins) == 0 || rep.Hottest().Rate > 1500 {
+		t.Errorf("Expected joins to bring the hottest node below 1500/s but got %d joins and %.0f/s", len(joins), rep.Hottest().Rate)
+	}
+
+	workload = capacity.Workload{Keys: 10_000, Rate: 3000, Distribution: capacity.HotKey, HotKeys: 1, HotShare: 0.6}
+	_, _, err = capacity.Plan(cluster, workload, 1500, 100)
+	var argErr *custom_errors.ArgError
+	if !errors.As(err, &argErr) || argErr.Arg != "key-0" {
+		t.Errorf("Expected an error naming key-0 but got %v", err)
+	}
+}
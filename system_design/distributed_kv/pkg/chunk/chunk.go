@@ -0,0 +1,165 @@
+// Package chunk splits values that don't fit into a single gRPC message into
+// PutChunk/GetChunk messages and puts them back together. It is shared by the
+// server, the in-process adapter and the ring.
+package chunk
+
+import (
+	"fmt"
+	"io"
+	"math"
+	custom_errors "toy_dynamodb/Errors"
+	kv "toy_dynamodb/proto"
+)
+
+const (
+	// Size is the payload of one chunk
+	Size = 512 << 10
+	// Threshold is the largest value sent in a single Put/Get message, well
+	// below the default 4 MiB gRPC message limit
+	Threshold = 1 << 20
+)
+
+// Split sends val as PutChunks, the first one carries the table, the key, the
+// total size, the request id and the version
+func Split(table, key, requestID string, version uint64, val []byte, send func(*kv.PutChunk) error) error {
+	first := &kv.PutChunk{Table: table, Key: key, TotalSize: uint64(len(val)), RequestId: requestID, Version: version}
+	if len(val) == 0 {
+		return send(first)
+	}
+	for off := 0; off < len(val); off += Size {
+		c := &kv.PutChunk{Data: val[off:min(off+Size, len(val))]}
+		if off == 0 {
+			first.Data = c.Data
+			c = first
+		}
+		if err := send(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send is the GetStream counterpart of Split
+func Send(val []byte, version uint64, found bool, send func(*kv.GetChunk) error) error {
+	first := &kv.GetChunk{Found: found, TotalSize: uint64(len(val)), Version: version}
+	if len(val) == 0 {
+		return send(first)
+	}
+	for off := 0; off < len(val); off += Size {
+		c := &kv.GetChunk{Data: val[off:min(off+Size, len(val))]}
+		if off == 0 {
+			first.Data = c.Data
+			c = first
+		}
+		if err := send(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanEntry announces values above Threshold with their size only, like Get
+// does, the caller fetches them with GetStream
+func ScanEntry(key string, val []byte, version uint64, deleted bool) *kv.ScanEntry {
+	e := &kv.ScanEntry{Key: key, Version: version, Deleted: deleted, Size: uint64(len(val))}
+	if len(val) > Threshold {
+		e.Chunked = true
+	} else {
+		e.Value = val
+	}
+	return e
+}
+
+// Assembler collects the chunks of one PutStream into a single buffer that is
+// allocated once from the announced total size
+type Assembler struct {
+	table   string
+	key     string
+	id      string
+	version uint64
+	buf     []byte
+	total   uint64
+	max     int
+	started bool
+}
+
+// NewAssembler rejects values larger than max bytes, 0 means no limit
+func NewAssembler(max int) *Assembler {
+	return &Assembler{max: max}
+}
+
+func (a *Assembler) Add(c *kv.PutChunk) error {
+	if !a.started {
+		if c.Key == "" {
+			return &custom_errors.ArgError{Arg: "key", Message: "first chunk must carry the key"}
+		}
+		if a.max > 0 && c.TotalSize > uint64(a.max) {
+			return &custom_errors.ValueTooLargeError{Key: c.Key, Size: int(min(c.TotalSize, math.MaxInt)), Max: a.max}
+		}
+		capacity := c.TotalSize
+		if a.max == 0 {
+			// without a limit the announced size is not trusted for the allocation
+			capacity = min(capacity, Threshold)
+		}
+		a.table, a.key, a.id, a.version, a.total, a.started = c.Table, c.Key, c.RequestId, c.Version, c.TotalSize, true
+		a.buf = make([]byte, 0, capacity)
+	} else if c.Key != "" && c.Key != a.key {
+		return &custom_errors.ArgError{Arg: c.Key, Message: fmt.Sprintf("key changed in the middle of the stream for %s", a.key)}
+	}
+
+	if uint64(len(a.buf))+uint64(len(c.Data)) > a.total {
+		return &custom_errors.ArgError{Arg: a.key, Message: fmt.Sprintf("stream carries more than the announced %d bytes", a.total)}
+	}
+	a.buf = append(a.buf, c.Data...)
+	return nil
+}
+
+// Value returns the key and the complete value once every chunk arrived
+func (a *Assembler) Value() (string, []byte, error) {
+	if !a.started {
+		return "", nil, &custom_errors.ArgError{Arg: "stream", Message: "no chunk received"}
+	}
+	if uint64(len(a.buf)) != a.total {
+		return "", nil, &custom_errors.ArgError{Arg: a.key, Message: fmt.Sprintf("stream ended after %d of %d bytes", len(a.buf), a.total)}
+	}
+	return a.key, a.buf, nil
+}
+
+// Table returns the table announced in the first chunk
+func (a *Assembler) Table() string {
+	return a.table
+}
+
+// RequestID returns the request id announced in the first chunk
+func (a *Assembler) RequestID() string {
+	return a.id
+}
+
+// Version returns the version announced in the first chunk
+func (a *Assembler) Version() uint64 {
+	return a.version
+}
+
+// Collect reads a GetStream to the end
+func Collect(recv func() (*kv.GetChunk, error)) ([]byte, uint64, bool, error) {
+	first, err := recv()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	buf := make([]byte, 0, first.TotalSize)
+	buf = append(buf, first.Data...)
+	for {
+		c, err := recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		buf = append(buf, c.Data...)
+	}
+	if uint64(len(buf)) != first.TotalSize {
+		return nil, 0, false, fmt.Errorf("GetStream ended after %d of %d bytes", len(buf), first.TotalSize)
+	}
+	return buf, first.Version, first.Found, nil
+}
@@ -0,0 +1,543 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/auth"
+	"toy_dynamodb/pkg/hotkey"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/tracing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Precedence is defaults < config file < environment < flags.
+// The config file path itself comes from -config or KV_CONFIG.
+
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// ReplicationTarget is a remote cluster that receives the writes of this
+// node asynchronously, see pkg/xdcr. TLS holds the client certificate and CA
+// used to dial its peers.
+type ReplicationTarget struct {
+	Name         string   `yaml:"name"`
+	Peers        []string `yaml:"peers"`
+	ReplicaCount uint     `yaml:"replica_count"`
+	W            int      `yaml:"w"`
+	TLS          TLS      `yaml:"tls"`
+}
+
+// Cluster is the seed peers and the replication factor (N) of the cluster.
+// A node only validates and logs them, the coordinators built by
+// cmd/docker_test and cmd/local_test dial the peers and replicate N times,
+// see LoadCluster.
+type Cluster struct {
+	Peers        []string `yaml:"peers"`
+	ReplicaCount uint     `yaml:"replica_count"`
+}
+
+type Config struct {
+	NodeName      string         `yaml:"node_name"`
+	ListenAddr    string         `yaml:"listen_addr"`
+	DataDir       string         `yaml:"data_dir"`
+	FsyncMode     node.FsyncMode `yaml:"fsync_mode"`
+	FsyncInterval time.Duration  `yaml:"fsync_interval"`
+	TLS           TLS            `yaml:"tls"`
+	// Cluster is also read by the coordinators, see LoadCluster
+	Cluster     `yaml:",inline"`
+	MetricsPort int `yaml:"metrics_port"`
+	// MaxValueSize in bytes, larger values are rejected
+	MaxValueSize int `yaml:"max_value_size"`
+	// DedupWindow is how long request ids of applied writes are remembered,
+	// 0 turns deduplication of retried writes off
+	DedupWindow time.Duration `yaml:"dedup_window"`
+	// ShutdownTimeout bounds how long in-flight RPCs may run after SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// BackupDir is where the Backup RPC writes, empty disables it
+	BackupDir string `yaml:"backup_dir"`
+	// Auth is only configurable from the file
+	Auth auth.Policy `yaml:"auth"`
+	// Replication is only configurable from the file
+	Replication []ReplicationTarget `yaml:"replication"`
+	// Indexes are only configurable from the file, every node of a cluster
+	// needs the same ones for Ring.QueryIndex
+	Indexes []node.Index `yaml:"indexes"`
+	// Compression of the values in the WAL of the tables that don't choose
+	// one, values below CompressMinSize bytes are stored as they are
+	Compression     node.Compression `yaml:"compression"`
+	CompressMinSize int              `yaml:"compress_min_size"`
+	// EncryptionKeyFile holds the keys values are encrypted with at rest,
+	// empty stores them in plain (ADR 0027)
+	EncryptionKeyFile string `yaml:"encryption_key_file"`
+	// Tracing exports the spans of the node's RPCs, WAL appends and fsyncs
+	// (ADR 0028)
+	Tracing tracing.Config `yaml:"tracing"`
+	// HotKeys sizes the tracker of the most requested keys, only
+	// configurable from the file (ADR 0030)
+	HotKeys hotkey.Config `yaml:"hot_keys"`
+
+	// keys is loaded from EncryptionKeyFile by Validate
+	keys *node.Keyring
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:      ":50051",
+		DataDir:         node.DefaultDataDir,
+		FsyncMode:       node.FsyncAlways,
+		FsyncInterval:   time.Second,
+		Cluster:         Cluster{ReplicaCount: 3},
+		MaxValueSize:    node.DefaultMaxValueSize,
+		DedupWindow:     node.DefaultDedupWindow,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+func (c *Config) NodeOptions() node.Options {
+	dedup := c.DedupWindow
+	if dedup == 0 {
+		// for node.Options 0 means the default
+		dedup = -1
+	}
+	return node.Options{DataDir: c.DataDir, FsyncMode: c.FsyncMode, FsyncInterval: c.FsyncInterval, MaxValueSize: c.MaxValueSize, DedupWindow: dedup,
+		Indexes: c.Indexes, Compression: c.Compression, CompressMinSize: c.CompressMinSize, Keys: c.keys}
+}
+
+// Keys is the keyring of EncryptionKeyFile, nil when values aren't encrypted
+func (c *Config) Keys() *node.Keyring {
+	return c.keys
+}
+
+// Load builds the configuration from args (usually os.Args[1:]) and the
+// environment and validates it.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", "", "path to a YAML config file")
+	name := fs.String("name", "", "node name, also used as the WAL file name")
+	listen := fs.String("listen", "", "gRPC listen address, e.g. :50051")
+	dataDir := fs.String("data-dir", "", "directory for WAL files")
+	fsync := fs.String("fsync", "", "fsync mode: always, interval or never")
+	fsyncInterval := fs.Duration("fsync-interval", 0, "flush period when -fsync=interval")
+	cert := fs.String("tls-cert", "", "server certificate (PEM)")
+	key := fs.String("tls-key", "", "server private key (PEM)")
+	ca := fs.String("tls-ca", "", "CA bundle used to verify peers (PEM)")
+	peers := fs.String("peers", "", "comma separated peer seed addresses")
+	replicas := fs.Uint("replicas", 0, "replica count (N)")
+	metrics := fs.Int("metrics-port", 0, "port for the metrics endpoint, 0 disables it")
+	maxValue := fs.Int("max-value-size", 0, "largest accepted value in bytes")
+	dedup := fs.Duration("dedup-window", 0, "how long retried writes are deduplicated, 0 disables it")
+	shutdown := fs.Duration("shutdown-timeout", 0, "how long to drain in-flight RPCs on SIGTERM")
+	backupDir := fs.String("backup-dir", "", "directory the Backup RPC writes to, empty disables it")
+	compression := fs.String("compression", "", "compression of WAL values: snappy, zstd or empty")
+	keyFile := fs.String("encryption-key-file", "", "YAML file with the keys values are encrypted with at rest")
+	traceExporter := fs.String("trace-exporter", "", "where spans go: stdout, otlp or empty for nowhere")
+	traceEndpoint := fs.String("trace-endpoint", "", "host:port of the OTLP collector, default "+tracing.DefaultOTLPEndpoint)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path == "" {
+		*path = getenv("KV_CONFIG")
+	}
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.loadEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	// only flags given explicitly on the command line override file/env values
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			c.NodeName = *name
+		case "listen":
+			c.ListenAddr = *listen
+		case "data-dir":
+			c.DataDir = *dataDir
+		case "fsync":
+			c.FsyncMode = node.FsyncMode(*fsync)
+		case "fsync-interval":
+			c.FsyncInterval = *fsyncInterval
+		case "tls-cert":
+			c.TLS.CertFile = *cert
+		case "tls-key":
+			c.TLS.KeyFile = *key
+		case "tls-ca":
+			c.TLS.CAFile = *ca
+		case "peers":
+			c.Peers = splitList(*peers)
+		case "replicas":
+			c.ReplicaCount = *replicas
+		case "metrics-port":
+			c.MetricsPort = *metrics
+		case "max-value-size":
+			c.MaxValueSize = *maxValue
+		case "dedup-window":
+			c.DedupWindow = *dedup
+		case "shutdown-timeout":
+			c.ShutdownTimeout = *shutdown
+		case "backup-dir":
+			c.BackupDir = *backupDir
+		case "compression":
+			c.Compression = node.Compression(*compression)
+		case "encryption-key-file":
+			c.EncryptionKeyFile = *keyFile
+		case "trace-exporter":
+			c.Tracing.Exporter = tracing.Exporter(*traceExporter)
+		case "trace-endpoint":
+			c.Tracing.Endpoint = *traceEndpoint
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return &custom_errors.ArgError{Arg: path, Message: "invalid config file: " + err.Error()}
+	}
+	return nil
+}
+
+func (c *Config) loadEnv(getenv func(string) string) error {
+	// NODE_NAME is kept for the existing docker-compose setup
+	if v := getenv("NODE_NAME"); v != "" {
+		c.NodeName = v
+	}
+	if v := getenv("KV_LISTEN_ADDR"); v != "" {
+		c.ListenAddr = v
+	}
+	if v := getenv("KV_DATA_DIR"); v != "" {
+		c.DataDir = v
+	}
+	if v := getenv("KV_FSYNC"); v != "" {
+		c.FsyncMode = node.FsyncMode(v)
+	}
+	if v := getenv("KV_FSYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "KV_FSYNC_INTERVAL=" + v, Message: "is not a duration"}
+		}
+		c.FsyncInterval = d
+	}
+	if v := getenv("KV_TLS_CERT"); v != "" {
+		c.TLS.CertFile = v
+	}
+	if v := getenv("KV_TLS_KEY"); v != "" {
+		c.TLS.KeyFile = v
+	}
+	if v := getenv("KV_TLS_CA"); v != "" {
+		c.TLS.CAFile = v
+	}
+	if err := c.Cluster.loadEnv(getenv); err != nil {
+		return err
+	}
+	if v := getenv("KV_METRICS_PORT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "KV_METRICS_PORT=" + v, Message: "is not a number"}
+		}
+		c.MetricsPort = n
+	}
+	if v := getenv("KV_MAX_VALUE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "KV_MAX_VALUE_SIZE=" + v, Message: "is not a number"}
+		}
+		c.MaxValueSize = n
+	}
+	if v := getenv("KV_DEDUP_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "KV_DEDUP_WINDOW=" + v, Message: "is not a duration"}
+		}
+		c.DedupWindow = d
+	}
+	if v := getenv("KV_SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "KV_SHUTDOWN_TIMEOUT=" + v, Message: "is not a duration"}
+		}
+		c.ShutdownTimeout = d
+	}
+	if v := getenv("KV_BACKUP_DIR"); v != "" {
+		c.BackupDir = v
+	}
+	if v := getenv("KV_COMPRESSION"); v != "" {
+		c.Compression = node.Compression(v)
+	}
+	if v := getenv("KV_ENCRYPTION_KEY_FILE"); v != "" {
+		c.EncryptionKeyFile = v
+	}
+	if v := getenv("KV_TRACE_EXPORTER"); v != "" {
+		c.Tracing.Exporter = tracing.Exporter(v)
+	}
+	if v := getenv("KV_TRACE_ENDPOINT"); v != "" {
+		c.Tracing.Endpoint = v
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.NodeName == "" {
+		return &custom_errors.ArgError{Arg: "node_name", Message: "must be set (-name, NODE_NAME or node_name in the config file)"}
+	}
+	if strings.ContainsAny(c.NodeName, `/\`) {
+		return &custom_errors.ArgError{Arg: "node_name=" + c.NodeName, Message: "must not contain path separators"}
+	}
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil || port == "" {
+		return &custom_errors.ArgError{Arg: "listen_addr=" + c.ListenAddr, Message: "must be host:port or :port"}
+	}
+	if c.DataDir == "" {
+		return &custom_errors.ArgError{Arg: "data_dir", Message: "must not be empty"}
+	}
+	switch c.FsyncMode {
+	case node.FsyncAlways, node.FsyncNever:
+	case node.FsyncInterval:
+		if c.FsyncInterval <= 0 {
+			return &custom_errors.ArgError{Arg: "fsync_interval=" + c.FsyncInterval.String(), Message: "must be positive when fsync_mode is interval"}
+		}
+	default:
+		return &custom_errors.ArgError{Arg: "fsync_mode=" + string(c.FsyncMode), Message: "must be one of always, interval, never"}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return &custom_errors.ArgError{Arg: "tls", Message: "cert_file and key_file must be set together"}
+	}
+	for _, f := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.CAFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return &custom_errors.ArgError{Arg: f, Message: "tls file is not readable: " + err.Error()}
+		}
+	}
+	if c.TLS.CAFile != "" && !c.TLS.Enabled() {
+		return &custom_errors.ArgError{Arg: "tls.ca_file", Message: "requires cert_file and key_file"}
+	}
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+	if err := c.Cluster.Validate(); err != nil {
+		return err
+	}
+	if c.MetricsPort < 0 || c.MetricsPort > 65535 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("metrics_port=%d", c.MetricsPort), Message: "must be between 0 and 65535"}
+	}
+	if c.MaxValueSize <= 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("max_value_size=%d", c.MaxValueSize), Message: "must be positive"}
+	}
+	if c.DedupWindow < 0 {
+		return &custom_errors.ArgError{Arg: "dedup_window=" + c.DedupWindow.String(), Message: "must not be negative"}
+	}
+	if c.ShutdownTimeout <= 0 {
+		return &custom_errors.ArgError{Arg: "shutdown_timeout=" + c.ShutdownTimeout.String(), Message: "must be positive"}
+	}
+	if err := c.validateIndexes(); err != nil {
+		return err
+	}
+	if err := c.Compression.Validate(); err != nil {
+		return err
+	}
+	if c.CompressMinSize < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("compress_min_size=%d", c.CompressMinSize), Message: "must not be negative"}
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	if err := c.HotKeys.Validate(); err != nil {
+		return err
+	}
+	if c.EncryptionKeyFile != "" {
+		keys, err := node.LoadKeyring(c.EncryptionKeyFile)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "encryption_key_file=" + c.EncryptionKeyFile, Message: err.Error()}
+		}
+		c.keys = keys
+	}
+	return c.validateReplication()
+}
+
+// LoadCluster reads the cluster a coordinator dials from the same sources as
+// Load: -config/KV_CONFIG, KV_PEERS/KV_REPLICA_COUNT and -peers/-replicas.
+// It registers these flags on fs, so callers add their own flags before.
+// Unlike a node, a coordinator needs at least one peer.
+func LoadCluster(fs *flag.FlagSet, args []string, getenv func(string) string, def Cluster) (*Cluster, error) {
+	path := fs.String("config", "", "path to a YAML config file, only peers and replica_count are read")
+	peers := fs.String("peers", "", "comma separated peer seed addresses")
+	replicas := fs.Uint("replicas", 0, "replica count (N)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := def
+	if *path == "" {
+		*path = getenv("KV_CONFIG")
+	}
+	if *path != "" {
+		// the file is a node's config, the other fields are ignored here
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return nil, &custom_errors.ArgError{Arg: *path, Message: "invalid config file: " + err.Error()}
+		}
+	}
+	if err := c.loadEnv(getenv); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "peers":
+			c.Peers = splitList(*peers)
+		case "replicas":
+			c.ReplicaCount = *replicas
+		}
+	})
+
+	if len(c.Peers) == 0 {
+		return nil, &custom_errors.ArgError{Arg: "peers", Message: "must not be empty"}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Cluster) loadEnv(getenv func(string) string) error {
+	if v := getenv("KV_PEERS"); v != "" {
+		c.Peers = splitList(v)
+	}
+	if v := getenv("KV_REPLICA_COUNT"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return &custom_errors.ArgError{Arg: "KV_REPLICA_COUNT=" + v, Message: "is not a positive number"}
+		}
+		c.ReplicaCount = uint(n)
+	}
+	return nil
+}
+
+func (c *Cluster) Validate() error {
+	for _, p := range c.Peers {
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return &custom_errors.ArgError{Arg: "peers=" + p, Message: "must be host:port"}
+		}
+	}
+	if c.ReplicaCount == 0 {
+		return &custom_errors.ArgError{Arg: "replica_count", Message: "must be at least 1"}
+	}
+	if len(c.Peers) > 0 && int(c.ReplicaCount) > len(c.Peers) {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("replica_count=%d", c.ReplicaCount), Message: fmt.Sprintf("can't be greater than the number of peers (%d)", len(c.Peers))}
+	}
+	return nil
+}
+
+func (c *Config) validateIndexes() error {
+	names := map[string]bool{}
+	for i, ix := range c.Indexes {
+		if err := ix.Validate(); err != nil {
+			return &custom_errors.ArgError{Arg: fmt.Sprintf("indexes[%d]", i), Message: err.Error()}
+		}
+		if names[ix.Name] {
+			return &custom_errors.ArgError{Arg: fmt.Sprintf("indexes[%d].name=%s", i, ix.Name), Message: "is used twice"}
+		}
+		names[ix.Name] = true
+	}
+	return nil
+}
+
+func (c *Config) validateReplication() error {
+	names := map[string]bool{}
+	for i, t := range c.Replication {
+		arg := fmt.Sprintf("replication[%d]", i)
+		// the name is part of the checkpoint file name
+		if t.Name == "" || strings.ContainsAny(t.Name, `/\`) {
+			return &custom_errors.ArgError{Arg: arg + ".name=" + t.Name, Message: "must be set and must not contain path separators"}
+		}
+		if names[t.Name] {
+			return &custom_errors.ArgError{Arg: arg + ".name=" + t.Name, Message: "is used twice"}
+		}
+		names[t.Name] = true
+		if len(t.Peers) == 0 {
+			return &custom_errors.ArgError{Arg: arg + ".peers", Message: "must not be empty"}
+		}
+		for _, p := range t.Peers {
+			if _, _, err := net.SplitHostPort(p); err != nil {
+				return &custom_errors.ArgError{Arg: arg + ".peers=" + p, Message: "must be host:port"}
+			}
+		}
+		if t.ReplicaCount == 0 || int(t.ReplicaCount) > len(t.Peers) {
+			return &custom_errors.ArgError{Arg: fmt.Sprintf("%s.replica_count=%d", arg, t.ReplicaCount), Message: fmt.Sprintf("must be between 1 and the number of peers (%d)", len(t.Peers))}
+		}
+		if t.W <= 0 || t.W > int(t.ReplicaCount) {
+			return &custom_errors.ArgError{Arg: fmt.Sprintf("%s.w=%d", arg, t.W), Message: "must be between 1 and replica_count"}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateAuth() error {
+	for id, t := range c.Auth.Tokens {
+		if t == "" {
+			return &custom_errors.ArgError{Arg: "auth.tokens." + id, Message: "token must not be empty"}
+		}
+	}
+	if len(c.Auth.Tokens) > 0 && !c.TLS.Enabled() {
+		return &custom_errors.ArgError{Arg: "auth.tokens", Message: "tokens are not accepted over plaintext, configure tls"}
+	}
+	if !c.Auth.Enabled() {
+		return nil
+	}
+	if len(c.Auth.Tokens) == 0 && c.TLS.CAFile == "" {
+		return &custom_errors.ArgError{Arg: "auth.rules", Message: "need auth.tokens or tls.ca_file (client certificates) to identify callers"}
+	}
+	for i, r := range c.Auth.Rules {
+		if r.Identity == "" {
+			return &custom_errors.ArgError{Arg: fmt.Sprintf("auth.rules[%d]", i), Message: "identity must be set"}
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+package config_test
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/config"
+	"toy_dynamodb/pkg/node"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Every layer overrides the one below it: defaults < file < env < flags
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, `
+node_name: file-node
+listen_addr: ":6001"
+data_dir: /file/wal
+fsync_mode: interval
+fsync_interval: 2s
+`)
+	cases := []struct {
+		name      string
+		env       map[string]string
+		args      []string
+		nodeName  string
+		listen    string
+		dataDir   string
+		fsyncMode node.FsyncMode
+		replicas  uint
+		noFile    bool
+	}{
+		{name: "defaults", args: []string{"-name", "flag-node"}, noFile: true,
+			nodeName: "flag-node", listen: ":50051", dataDir: node.DefaultDataDir, fsyncMode: node.FsyncAlways, replicas: 3},
+		{name: "file",
+			nodeName: "file-node", listen: ":6001", dataDir: "/file/wal", fsyncMode: node.FsyncInterval, replicas: 3},
+		{name: "env", env: map[string]string{"KV_LISTEN_ADDR": ":6002", "KV_FSYNC": "never", "KV_REPLICA_COUNT": "2"},
+			nodeName: "file-node", listen: ":6002", dataDir: "/file/wal", fsyncMode: node.FsyncNever, replicas: 2},
+		{name: "flags", env: map[string]string{"KV_LISTEN_ADDR": ":6002", "KV_FSYNC": "never", "KV_REPLICA_COUNT": "2"},
+			args:     []string{"-listen", ":6003", "-fsync", "always", "-replicas", "1"},
+			nodeName: "file-node", listen: ":6003", dataDir: "/file/wal", fsyncMode: node.FsyncAlways, replicas: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, k := range []string{"KV_CONFIG", "NODE_NAME", "KV_LISTEN_ADDR", "KV_DATA_DIR", "KV_FSYNC", "KV_REPLICA_COUNT"} {
+				t.Setenv(k, "")
+			}
+			if !c.noFile {
+				t.Setenv("KV_CONFIG", path)
+			}
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := config.Load(c.args, os.Getenv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.NodeName != c.nodeName || cfg.ListenAddr != c.listen || cfg.DataDir != c.dataDir || cfg.FsyncMode != c.fsyncMode || cfg.ReplicaCount != c.replicas {
+				t.Errorf("Expected %s %s %s %s N=%d but got %s %s %s %s N=%d", c.nodeName, c.listen, c.dataDir, c.fsyncMode, c.replicas,
+					cfg.NodeName, cfg.ListenAddr, cfg.DataDir, cfg.FsyncMode, cfg.ReplicaCount)
+			}
+		})
+	}
+
+	t.Run("config flag", func(t *testing.T) {
+		t.Setenv("KV_CONFIG", "/does/not/exist.yaml")
+		cfg, err := config.Load([]string{"-config", path}, os.Getenv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.FsyncInterval != 2*time.Second {
+			t.Errorf("Expected -config to win over KV_CONFIG but got fsync_interval %v", cfg.FsyncInterval)
+		}
+	})
+}
+
+func TestValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		arg  string
+	}{
+		{name: "fsync mode", args: []string{"-fsync", "sometimes"}, arg: "fsync_mode=sometimes"},
+		{name: "fsync interval", file: "fsync_mode: interval\nfsync_interval: 0s\n", arg: "fsync_interval=0s"},
+		{name: "zero replicas", args: []string{"-replicas", "0"}, arg: "replica_count"},
+		{name: "more replicas than peers", args: []string{"-peers", "a:1,b:1", "-replicas", "3"}, arg: "replica_count=3"},
+		{name: "replica count env", env: map[string]string{"KV_REPLICA_COUNT": "three"}, arg: "KV_REPLICA_COUNT=three"},
+		{name: "peer address", args: []string{"-peers", "localhost"}, arg: "peers=localhost"},
+		{name: "no node name", args: []string{"-name", ""}, arg: "node_name"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := append([]string{"-name", "node-1"}, c.args...)
+			if c.file != "" {
+				args = append(args, "-config", writeFile(t, c.file))
+			}
+			getenv := func(k string) string { return c.env[k] }
+
+			_, err := config.Load(args, getenv)
+			var argErr *custom_errors.ArgError
+			if !errors.As(err, &argErr) || argErr.Arg != c.arg {
+				t.Errorf("Expected an ArgError for %s but got %v", c.arg, err)
+			}
+		})
+	}
+}
+
+// The coordinators read peers and replica_count from a node's config file,
+// the env and their own flags
+func TestLoadCluster(t *testing.T) {
+	path := writeFile(t, `
+node_name: node-1
+peers: ["a:1", "b:1", "c:1"]
+replica_count: 3
+`)
+	def := config.Cluster{Peers: []string{"localhost:50051"}, ReplicaCount: 1}
+	cases := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		peers    int
+		replicas uint
+		arg      string
+	}{
+		{name: "defaults", peers: 1, replicas: 1},
+		{name: "file", env: map[string]string{"KV_CONFIG": path}, peers: 3, replicas: 3},
+		{name: "env", env: map[string]string{"KV_CONFIG": path, "KV_REPLICA_COUNT": "2"}, peers: 3, replicas: 2},
+		{name: "flags", env: map[string]string{"KV_CONFIG": path, "KV_REPLICA_COUNT": "2"}, args: []string{"-peers", "a:1,b:1", "-replicas", "1"}, peers: 2, replicas: 1},
+		{name: "config flag", args: []string{"-config", path}, peers: 3, replicas: 3},
+		{name: "no peers", args: []string{"-peers", ""}, arg: "peers"},
+		{name: "more replicas than peers", args: []string{"-replicas", "2"}, arg: "replica_count=2"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+			getenv := func(k string) string { return c.env[k] }
+
+			cluster, err := config.LoadCluster(fs, c.args, getenv, def)
+			if c.arg != "" {
+				var argErr *custom_errors.ArgError
+				if !errors.As(err, &argErr) || argErr.Arg != c.arg {
+					t.Errorf("Expected an ArgError for %s but got %v", c.arg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cluster.Peers) != c.peers || cluster.ReplicaCount != c.replicas {
+				t.Errorf("Expected %d peers N=%d but got %v N=%d", c.peers, c.replicas, cluster.Peers, cluster.ReplicaCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package consistency
+
+import (
+	"cmp"
+	"slices"
+)
+
+// DefaultStepBudget bounds the search per key, the problem is NP-complete
+// and a pathological history would otherwise run forever
+const DefaultStepBudget = 5_000_000
+
+// minimizeLimit is the largest per key history that is shrunk to a minimal
+// counterexample, every shrinking step re-runs the checker
+const minimizeLimit = 5000
+
+type Result struct {
+	Linearizable bool
+	// Unknown is set when the step budget ran out before an answer was found
+	Unknown        bool
+	Ops            int
+	DivergentReads int
+	// Key and Counterexample describe the first non-linearizable key. The
+	// counterexample is a sub-history of that key from which no single
+	// operation can be removed without it becoming linearizable.
+	Key            string
+	Counterexample []Operation
+	RYWViolations  []Violation
+}
+
+// register is the sequential model of a single key
+type register struct {
+	value  string
+	exists bool
+}
+
+func step(s register, op *Operation) (register, bool) {
+	switch op.Kind {
+	case OpPut:
+		return register{value: op.Value, exists: true}, true
+	case OpDelete:
+		return register{}, true
+	default:
+		if !op.Found {
+			return s, !s.exists
+		}
+		return s, s.exists && slices.Contains(op.Values, s.value)
+	}
+}
+
+// Check runs the linearizability and read-your-writes checkers on a history
+func Check(history []Operation) Result {
+	res := Result{Linearizable: true, Ops: len(history)}
+
+	byKey := map[string][]Operation{}
+	var keys []string
+	for _, op := range history {
+		if op.Kind == OpGet && op.Err != nil {
+			// a failed read has no effect and tells nothing
+			continue
+		}
+		if op.Kind == OpGet && op.Divergent() {
+			res.DivergentReads++
+		}
+		if _, ok := byKey[op.Key]; !ok {
+			keys = append(keys, op.Key)
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	slices.Sort(keys)
+
+	// a register history is linearizable iff every key is (P-compositionality)
+	for _, k := range keys {
+		byKey[k] = dropUnobservedPending(byKey[k])
+		ok, done := checkKey(byKey[k], DefaultStepBudget)
+		if !done {
+			res.Unknown = true
+			continue
+		}
+		if !ok {
+			res.Linearizable = false
+			res.Key = k
+			res.Counterexample = minimize(byKey[k])
+			break
+		}
+	}
+	if res.Unknown && res.Linearizable {
+		res.Linearizable = false
+	}
+
+	res.RYWViolations = CheckReadYourWrites(history)
+	return res
+}
+
+type entry struct {
+	op       *Operation
+	id       int
+	isReturn bool
+	time     int64
+	match    *entry
+	prev     *entry
+	next     *entry
+}
+
+func buildList(ops []Operation) *entry {
+	events := make([]*entry, 0, 2*len(ops))
+	for i := range ops {
+		call := &entry{op: &ops[i], id: i, time: ops[i].Call}
+		ret := &entry{op: &ops[i], id: i, isReturn: true, time: ops[i].Return}
+		call.match = ret
+		events = append(events, call, ret)
+	}
+	// calls sort before returns at the same instant, which treats touching
+	// operations as concurrent
+	slices.SortStableFunc(events, func(a, b *entry) int {
+		if c := cmp.Compare(a.time, b.time); c != 0 {
+			return c
+		}
+		switch {
+		case !a.isReturn && b.isReturn:
+			return -1
+		case a.isReturn && !b.isReturn:
+			return 1
+		}
+		return 0
+	})
+
+	head := &entry{}
+	prev := head
+	for _, e := range events {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+	return head
+}
+
+func lift(e *entry) {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func unlift(e *entry) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int) bitset   { b[i/64] |= 1 << (i % 64); return b }
+func (b bitset) clear(i int) bitset { b[i/64] &^= 1 << (i % 64); return b }
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      register
+}
+
+// checkKey is the Wing & Gong search with Lowe's memoization, as used by
+// Porcupine. It walks the call/return list, tentatively linearizes every
+// call whose effect is legal in the current state and backtracks when it
+// reaches a return whose call could not be placed.
+func checkKey(ops []Operation, budget int) (ok bool, done bool) {
+	head := buildList(ops)
+	linearized := make(bitset, len(ops)/64+1)
+	cache := map[uint64][]cacheEntry{}
+
+	type frame struct {
+		e     *entry
+		state register
+	}
+	var calls []frame
+	state := register{}
+
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps > budget {
+			return false, false
+		}
+
+		if !e.isReturn {
+			next, legal := step(state, e.op)
+			if legal {
+				nl := slices.Clone(linearized).set(e.id)
+				h := nl.hash()
+				seen := slices.ContainsFunc(cache[h], func(c cacheEntry) bool {
+					return c.state == next && slices.Equal(c.linearized, nl)
+				})
+				if !seen {
+					cache[h] = append(cache[h], cacheEntry{linearized: nl, state: next})
+					calls = append(calls, frame{e: e, state: state})
+					state = next
+					linearized.set(e.id)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// e is the return of an operation that has not been linearized yet
+		if len(calls) == 0 {
+			return false, true
+		}
+		f := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = f.state
+		linearized.clear(f.e.id)
+		unlift(f.e)
+		e = f.e.next
+	}
+	return true, true
+}
+
+// minimize removes operations while the history stays non-linearizable,
+// first in large chunks and then one at a time (ddmin). Reads can always be
+// dropped and so can writes no remaining read observed: if the original
+// history were linearizable, such a sub-history would be too, so what remains
+// is a real anomaly.
+func minimize(ops []Operation) []Operation {
+	if len(ops) > minimizeLimit {
+		return ops
+	}
+	cur := slices.Clone(ops)
+	for size := max(len(cur)/2, 1); ; size /= 2 {
+		for i := 0; i < len(cur); i += size {
+			candidate := without(cur, i, min(i+size, len(cur)))
+			if len(candidate) == len(cur) {
+				continue
+			}
+			if ok, done := checkKey(candidate, DefaultStepBudget); done && !ok {
+				cur = candidate
+				i -= size
+			}
+		}
+		if size == 1 {
+			return cur
+		}
+	}
+}
+
+// without drops the reads in ops[from:to] and then the writes in that range
+// no remaining read observed
+func without(ops []Operation, from, to int) []Operation {
+	var kept []Operation
+	for i, op := range ops {
+		if i < from || i >= to || op.Kind != OpGet {
+			kept = append(kept, op)
+		}
+	}
+	var out []Operation
+	for _, op := range kept {
+		inRange := slices.ContainsFunc(ops[from:to], func(o Operation) bool { return o.ID == op.ID })
+		if inRange && observed(kept, op) {
+			out = append(out, op)
+		} else if !inRange {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// dropUnobservedPending removes failed writes nobody read. They can always be
+// linearized after everything else, so the answer doesn't change, but each
+// of them doubles the search space.
+func dropUnobservedPending(ops []Operation) []Operation {
+	return slices.DeleteFunc(slices.Clone(ops), func(op Operation) bool {
+		return op.Kind != OpGet && op.Return == Pending && !observed(ops, op)
+	})
+}
+
+func observed(ops []Operation, w Operation) bool {
+	for _, op := range ops {
+		if op.Kind != OpGet {
+			continue
+		}
+		if w.Kind == OpDelete && !op.Found {
+			return true
+		}
+		if w.Kind == OpPut && op.Found && slices.Contains(op.Values, w.Value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package consistency_test
+
+import (
+	"errors"
+	"testing"
+	"toy_dynamodb/pkg/consistency"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/simnet"
+)
+
+func put(id, client int, val string, call, ret int64) consistency.Operation {
+	return consistency.Operation{ID: id, Client: client, Kind: consistency.OpPut, Key: "k", Value: val, Call: call, Return: ret}
+}
+
+func get(id, client int, call, ret int64, vals ...string) consistency.Operation {
+	return consistency.Operation{ID: id, Client: client, Kind: consistency.OpGet, Key: "k", Values: vals, Found: len(vals) > 0, Call: call, Return: ret}
+}
+
+func TestSequentialHistoryIsLinearizable(t *testing.T) {
+	h := []consistency.Operation{
+		put(0, 0, "a", 0, 10),
+		get(1, 1, 20, 30, "a"),
+		put(2, 0, "b", 40, 50),
+		get(3, 1, 60, 70, "b"),
+	}
+	if res := consistency.Check(h); !res.Linearizable {
+		t.Errorf("Expected a sequential history to be linearizable, but got counterexample %v", res.Counterexample)
+	}
+}
+
+func TestConcurrentReadMaySeeEitherValue(t *testing.T) {
+	h := []consistency.Operation{
+		put(0, 0, "a", 0, 10),
+		put(1, 0, "b", 20, 100),
+		get(2, 1, 30, 40, "b"),
+		get(3, 2, 50, 60, "b"),
+	}
+	if res := consistency.Check(h); !res.Linearizable {
+		t.Errorf("Expected reads during a write to see the new value, but got counterexample %v", res.Counterexample)
+	}
+}
+
+func TestStaleReadIsNotLinearizable(t *testing.T) {
+	h := []consistency.Operation{
+		put(0, 0, "a", 0, 10),
+		get(1, 2, 12, 14, "a"),
+		put(2, 0, "b", 20, 30),
+		get(3, 1, 40, 50, "b"),
+		get(4, 2, 60, 70, "a"),
+	}
+	res := consistency.Check(h)
+	if res.Linearizable {
+		t.Fatal("Expected a read of an overwritten value to be rejected")
+	}
+	// get #1 and get #3 are not needed to show the anomaly
+	if len(res.Counterexample) != 3 {
+		t.Errorf("Expected a counterexample of 3 operations, but got %v", res.Counterexample)
+	}
+}
+
+func TestFailedWriteMayTakeEffectLater(t *testing.T) {
+	failed := put(1, 0, "b", 20, consistency.Pending)
+	failed.Err = errors.New("quorum not met")
+	h := []consistency.Operation{
+		put(0, 0, "a", 0, 10),
+		failed,
+		get(2, 1, 30, 40, "a"),
+		get(3, 1, 50, 60, "b"),
+	}
+	if res := consistency.Check(h); !res.Linearizable {
+		t.Errorf("Expected an unacknowledged write to be allowed to appear later, but got counterexample %v", res.Counterexample)
+	}
+}
+
+func TestAnyOfReplicaValuesIsAccepted(t *testing.T) {
+	h := []consistency.Operation{
+		put(0, 0, "a", 0, 10),
+		put(1, 0, "b", 20, 30),
+		get(2, 1, 40, 50, "a", "b"),
+	}
+	res := consistency.Check(h)
+	if !res.Linearizable {
+		t.Errorf("Expected a read returning the latest value among others to be accepted, but got %v", res.Counterexample)
+	}
+	if res.DivergentReads != 1 {
+		t.Errorf("Expected 1 divergent read, but got %d", res.DivergentReads)
+	}
+}
+
+func TestReadYourWritesViolation(t *testing.T) {
+	h := []consistency.Operation{
+		put(0, 1, "a", 0, 10),
+		put(1, 0, "b", 20, 30),
+		get(2, 0, 40, 50, "a"),
+	}
+	v := consistency.CheckReadYourWrites(h)
+	if len(v) != 1 {
+		t.Fatalf("Expected 1 read-your-writes violation, but got %v", v)
+	}
+	if v[0].Write.ID != 1 || v[0].Read.ID != 2 {
+		t.Errorf("Expected get #2 after put #1, but got %v", v[0])
+	}
+
+	// another client's later write is fine
+	h = append(h[:2], put(3, 1, "c", 35, 45), get(2, 0, 40, 50, "c"))
+	if v := consistency.CheckReadYourWrites(h); len(v) != 0 {
+		t.Errorf("Expected no violation when a newer write is read, but got %v", v)
+	}
+}
+
+// With R+W>N and a healthy network the ring behaves like a single register.
+func TestRingWithStrictQuorumsIsLinearizable(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	r.Init()
+	net := simnet.New(1, t.TempDir())
+	defer net.Close()
+	for _, name := range []string{"node-1", "node-2", "node-3"} {
+		c, err := net.AddNode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RegisterClient(name, c)
+	}
+
+	h := consistency.Workload{Clients: 4, OpsPerClient: 50, Keys: 3, ReadRatio: 0.5, DeleteRatio: 0.1, Seed: 1}.
+		Run(consistency.RingStore{Ring: r, W: 3, R: 3})
+	res := consistency.Check(h)
+	if !res.Linearizable {
+		t.Errorf("Expected W=R=N to be linearizable, but %s failed with %v", res.Key, res.Counterexample)
+	}
+	if len(res.RYWViolations) != 0 {
+		t.Errorf("Expected no read-your-writes violations, but got %v", res.RYWViolations)
+	}
+}
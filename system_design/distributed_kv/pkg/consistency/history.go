@@ -0,0 +1,133 @@
+// Package consistency records histories of concurrent client operations
+// against the ring and checks them for linearizability and read-your-writes,
+// in the spirit of Jepsen/Knossos and Porcupine.
+package consistency
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OpKind int
+
+const (
+	OpPut OpKind = iota
+	OpGet
+	OpDelete
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpPut:
+		return "put"
+	case OpGet:
+		return "get"
+	default:
+		return "delete"
+	}
+}
+
+// Pending is the return time of operations whose outcome is unknown (the
+// client got an error, but a replica may have applied the write). They may
+// take effect at any point after their call.
+const Pending = math.MaxInt64
+
+// Operation is one client call with its invocation and completion time in
+// nanoseconds since the start of the recording
+type Operation struct {
+	ID     int
+	Client int
+	Kind   OpKind
+	Key    string
+	// Value is the written value for puts
+	Value string
+	// Values are what a get returned, one per replica in the read quorum.
+	// Without versions the client can't tell which one is newest, so a read
+	// is accepted if any of them is correct; Divergent marks reads where the
+	// replicas disagreed.
+	Values []string
+	Found  bool
+	Err    error
+	Call   int64
+	Return int64
+}
+
+func (o Operation) Divergent() bool {
+	for _, v := range o.Values {
+		if v != o.Values[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Operation) String() string {
+	ret := fmt.Sprint(o.Return)
+	if o.Return == Pending {
+		ret = "?"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#%d c%d [%d,%s] %s(%s", o.ID, o.Client, o.Call, ret, o.Kind, o.Key)
+	if o.Kind == OpPut {
+		fmt.Fprintf(&b, ", %s", o.Value)
+	}
+	b.WriteString(")")
+	switch {
+	case o.Err != nil:
+		fmt.Fprintf(&b, " -> error: %v", o.Err)
+	case o.Kind == OpGet && !o.Found:
+		b.WriteString(" -> not found")
+	case o.Kind == OpGet:
+		fmt.Fprintf(&b, " -> %v", o.Values)
+	default:
+		b.WriteString(" -> ok")
+	}
+	return b.String()
+}
+
+// Recorder collects operations from concurrent clients
+type Recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	ops   []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+func (r *Recorder) now() int64 {
+	return int64(time.Since(r.start))
+}
+
+// Invoke marks the start of an operation, Complete records it
+func (r *Recorder) Invoke() int64 {
+	return r.now()
+}
+
+func (r *Recorder) Complete(op Operation) {
+	op.Return = r.now()
+	if op.Err != nil && op.Kind != OpGet {
+		op.Return = Pending
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op.ID = len(r.ops)
+	r.ops = append(r.ops, op)
+}
+
+// History returns the recorded operations ordered by invocation time
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := slices.Clone(r.ops)
+	slices.SortStableFunc(h, func(a, b Operation) int { return cmp.Compare(a.Call, b.Call) })
+	return h
+}
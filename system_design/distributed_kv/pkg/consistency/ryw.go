@@ -0,0 +1,73 @@
+package consistency
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// Violation is a read that broke a client's read-your-writes guarantee
+type Violation struct {
+	Write Operation
+	Read  Operation
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v after own %v", v.Read, v.Write)
+}
+
+// CheckReadYourWrites looks at every read that a client issued after one of
+// its own acknowledged writes to the same key completed. Such a read must
+// return that write, or a write/delete by anyone that was not already over
+// before the client's write started.
+func CheckReadYourWrites(history []Operation) []Violation {
+	h := slices.Clone(history)
+	slices.SortStableFunc(h, func(a, b Operation) int { return cmp.Compare(a.Call, b.Call) })
+
+	type clientKey struct {
+		client int
+		key    string
+	}
+	last := map[clientKey]Operation{}
+	var out []Violation
+
+	for _, op := range h {
+		ck := clientKey{op.Client, op.Key}
+		if op.Kind != OpGet {
+			if op.Err == nil {
+				last[ck] = op
+			}
+			continue
+		}
+		if op.Err != nil {
+			continue
+		}
+		w, ok := last[ck]
+		if !ok || op.Call < w.Return {
+			continue
+		}
+		if !allowedAfter(h, w, op) {
+			out = append(out, Violation{Write: w, Read: op})
+		}
+	}
+	return out
+}
+
+func allowedAfter(h []Operation, own, read Operation) bool {
+	for _, w := range h {
+		if w.Key != own.Key || w.Kind == OpGet {
+			continue
+		}
+		// strictly older than the client's own write, or started after the read
+		if (w.ID != own.ID && w.Return < own.Call) || w.Call > read.Return {
+			continue
+		}
+		if w.Kind == OpDelete && !read.Found {
+			return true
+		}
+		if w.Kind == OpPut && read.Found && slices.Contains(read.Values, w.Value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package consistency
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/ring"
+)
+
+// Store is what the workload talks to
+type Store interface {
+	Put(key, val string) error
+	// Get returns every value the read quorum answered with
+	Get(key string) (values []string, found bool, err error)
+	Delete(key string) error
+}
+
+// RingStore runs the workload against a Ring with fixed quorum sizes
+type RingStore struct {
+	Ring *ring.Ring
+	W    int
+	R    int
+}
+
+func (s RingStore) Put(key, val string) error {
+	return s.Ring.Put(key, []byte(val), s.W)
+}
+
+func (s RingStore) Get(key string) ([]string, bool, error) {
+	res, err := s.Ring.Get(key, s.R)
+	if errors.Is(err, custom_errors.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	names := make([]string, 0, len(res))
+	for n := range res {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	vals := make([]string, 0, len(res))
+	for _, n := range names {
+		vals = append(vals, string(res[n]))
+	}
+	return vals, true, nil
+}
+
+func (s RingStore) Delete(key string) error {
+	return s.Ring.Delete(key, s.W)
+}
+
+// Workload describes a random mix of reads and writes over a small key space,
+// small so that clients collide on keys
+type Workload struct {
+	Clients      int
+	OpsPerClient int
+	Keys         int
+	// ReadRatio is the share of reads and DeleteRatio the share of deletes,
+	// the rest are writes
+	ReadRatio   float64
+	DeleteRatio float64
+	Seed        int64
+	// Before, if set, runs before every operation, e.g. to step a simnet schedule
+	Before func()
+}
+
+// Run lets the clients loose and returns the recorded history. Every write
+// has a unique value so a read identifies exactly which write it saw.
+func (w Workload) Run(s Store) []Operation {
+	rec := NewRecorder()
+
+	var wg sync.WaitGroup
+	for c := range w.Clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(w.Seed + int64(c)))
+			for i := range w.OpsPerClient {
+				if w.Before != nil {
+					w.Before()
+				}
+				op := Operation{Client: c, Key: fmt.Sprint("key-", rng.Intn(w.Keys))}
+				switch p := rng.Float64(); {
+				case p < w.ReadRatio:
+					op.Kind = OpGet
+					op.Call = rec.Invoke()
+					op.Values, op.Found, op.Err = s.Get(op.Key)
+				case p < w.ReadRatio+w.DeleteRatio:
+					op.Kind = OpDelete
+					op.Call = rec.Invoke()
+					op.Err = s.Delete(op.Key)
+				default:
+					op.Kind = OpPut
+					op.Value = fmt.Sprintf("c%d-%d", c, i)
+					op.Call = rec.Invoke()
+					op.Err = s.Put(op.Key, op.Value)
+				}
+				rec.Complete(op)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return rec.History()
+}
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/rpcerr"
+)
+
+// errorBody is the JSON of every error response, reason is one of the
+// rpcerr reasons so HTTP and gRPC clients see the same names
+type errorBody struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// statusOf maps the error taxonomy (ADR 0014) to HTTP. Argument errors are
+// checked before quorum errors, a quorum error whose replicas all rejected
+// the request is the caller's fault.
+func statusOf(err error) (int, string) {
+	var tooLarge *custom_errors.ValueTooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, rpcerr.ReasonValueTooLarge
+	case errors.Is(err, custom_errors.ErrConflict):
+		return http.StatusPreconditionFailed, rpcerr.ReasonConflict
+	case errors.Is(err, custom_errors.ErrResourceExhausted):
+		return http.StatusTooManyRequests, rpcerr.ReasonResourceExhausted
+	case errors.Is(err, custom_errors.ErrNotFound):
+		return http.StatusNotFound, rpcerr.ReasonNotFound
+	case errors.Is(err, custom_errors.ErrInvalidArgument):
+		return http.StatusBadRequest, rpcerr.ReasonInvalidArgument
+	case errors.Is(err, custom_errors.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, rpcerr.ReasonTimeout
+	case errors.Is(err, custom_errors.ErrQuorumNotMet):
+		return http.StatusServiceUnavailable, rpcerr.ReasonQuorumNotMet
+	case errors.Is(err, custom_errors.ErrUnavailable):
+		return http.StatusServiceUnavailable, rpcerr.ReasonUnavailable
+	}
+	return http.StatusInternalServerError, "INTERNAL"
+}
+
+func fail(w http.ResponseWriter, err error) {
+	code, reason := statusOf(err)
+	// Retry-After is in whole seconds, a wait below a second rounds up
+	var exhausted *custom_errors.ResourceExhaustedError
+	if errors.As(err, &exhausted) && exhausted.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((exhausted.RetryAfter+time.Second-1)/time.Second)))
+	}
+	writeError(w, code, reason, err.Error())
+}
+
+func writeError(w http.ResponseWriter, code int, reason, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("ETag")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorBody{Error: msg, Reason: reason})
+}
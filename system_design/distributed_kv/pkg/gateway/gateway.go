@@ -0,0 +1,177 @@
+// Package gateway serves a Ring over HTTP for curl, shell scripts and browser
+// frontends. Values travel as raw bytes and the ETag of a key is its version,
+// so If-Match turns a write into a compare-and-set on the version. The routes
+// also describe themselves, see openapi.go.
+package gateway
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hlc"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/ring"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("toy_dynamodb/pkg/gateway")
+
+type Gateway struct {
+	Ring *ring.Ring
+	// Consistency gives R and W of requests without r, w or consistency
+	// parameters. Empty means quorum.
+	Consistency ring.Consistency
+	// Token makes every request send "Authorization: Bearer <Token>", empty
+	// lets everyone in
+	Token string
+	// MaxValueSize bounds request bodies, 0 means node.DefaultMaxValueSize
+	MaxValueSize int
+
+	// clock versions the writes, the version is returned as the ETag
+	clock hlc.Clock
+}
+
+// route is one endpoint, the handler and its OpenAPI description come from
+// the same entry
+type route struct {
+	method  string
+	path    string
+	handle  func(g *Gateway, w http.ResponseWriter, r *http.Request)
+	summary string
+	params  []param
+	// body describes the request body, empty for none
+	body string
+	// produces is the content type of the success responses with a body
+	produces  string
+	responses map[int]string
+}
+
+var routes = []route{
+	{
+		method: http.MethodGet, path: "/v1/keys/{key}", handle: (*Gateway).getKey,
+		summary:  "Read the newest value of a key",
+		params:   []param{keyParam, readQuorum, consistencyParam, ifNoneMatch},
+		produces: "application/octet-stream",
+		responses: map[int]string{
+			200: "The value as raw bytes, the ETag header holds its version",
+			304: "The version named in If-None-Match is still the newest",
+			404: "No replica of the read quorum has the key",
+			429: "The rate limit of the table, Retry-After says when to retry",
+		},
+	},
+	{
+		method: http.MethodPut, path: "/v1/keys/{key}", handle: (*Gateway).putKey,
+		summary: "Write a value, the request body as raw bytes",
+		params:  []param{keyParam, readQuorum, writeQuorum, consistencyParam, ifMatch, ifNoneMatch},
+		body:    "The value",
+		responses: map[int]string{
+			204: "Written to the write quorum, the ETag header holds the new version",
+			412: "If-Match or If-None-Match didn't hold",
+			413: "The value is larger than the maximum value size",
+			429: "The rate limit or the storage quota of the table, Retry-After is set for the rate limit",
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/keys/{key}", handle: (*Gateway).deleteKey,
+		summary: "Delete a key",
+		params:  []param{keyParam, readQuorum, writeQuorum, consistencyParam, ifMatch},
+		responses: map[int]string{
+			204: "The tombstone is written to the write quorum",
+			412: "If-Match didn't hold",
+			429: "The rate limit of the table, Retry-After says when to retry",
+		},
+	},
+	{
+		method: http.MethodGet, path: "/v1/keys", handle: (*Gateway).scan,
+		summary:  "Stream every key with a prefix in key order as JSON Lines, the export format of cmd/transfer",
+		params:   []param{prefixParam, valuesParam, limitParam},
+		produces: "application/x-ndjson",
+		responses: map[int]string{
+			200: `One {"key", "value" | "value_b64", "version"} object per line. A scan that fails after the first line ends with an {"error"} line.`,
+		},
+	},
+	{
+		method: http.MethodGet, path: "/v1/nodes", handle: (*Gateway).nodes,
+		summary:  "Breaker state of every node the gateway has talked to",
+		produces: "application/json",
+		responses: map[int]string{
+			200: "A map from node address to its state",
+		},
+	},
+}
+
+// Handler serves the routes and the OpenAPI document at /openapi.json
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		// {key...} keeps slashes in keys, the OpenAPI path names it {key}
+		pattern := rt.method + " " + strings.Replace(rt.path, "{key}", "{key...}", 1)
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			// a traceparent header makes the request part of the caller's trace
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, rt.method+" "+rt.path, trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attribute.String("http.request.method", rt.method), attribute.String("http.route", rt.path)))
+			defer span.End()
+			r = r.WithContext(ctx)
+			if !g.authorized(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "missing or wrong bearer token")
+				return
+			}
+			rt.handle(g, w, r)
+		})
+	}
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(OpenAPI())
+	})
+	return mux
+}
+
+// ring is the default table with the request's span as the parent of the
+// ring's spans
+func (g *Gateway) ring(r *http.Request) *ring.Table {
+	return g.Ring.WithContext(r.Context())
+}
+
+func (g *Gateway) authorized(r *http.Request) bool {
+	if g.Token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(g.Token)) == 1
+}
+
+func (g *Gateway) maxValueSize() int {
+	if g.MaxValueSize > 0 {
+		return g.MaxValueSize
+	}
+	return node.DefaultMaxValueSize
+}
+
+// quorum reads the r or w parameter, falls back to consistency and then to
+// the gateway's default level
+func (g *Gateway) quorum(r *http.Request, name string) (int, error) {
+	q := r.URL.Query()
+	if v := q.Get(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > int(g.Ring.ReplicaCount) {
+			return 0, &custom_errors.ArgError{Arg: name + "=" + v, Message: "must be between 1 and the replica count " + strconv.Itoa(int(g.Ring.ReplicaCount))}
+		}
+		return n, nil
+	}
+	level := ring.Consistency(q.Get("consistency"))
+	if level == "" {
+		level = g.Consistency
+	}
+	if level == "" {
+		level = ring.ConsistencyQuorum
+	}
+	return g.Ring.QuorumSize(level)
+}
@@ -0,0 +1,166 @@
+package gateway_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"toy_dynamodb/pkg/adapter"
+	"toy_dynamodb/pkg/gateway"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/transfer"
+)
+
+// newGateway serves a gateway over an in-process cluster of three nodes
+func newGateway(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	r := &ring.Ring{ReplicaCount: 3}
+	r.Init()
+	opts := node.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.FsyncMode = node.FsyncNever
+	for _, name := range []string{"node-1", "node-2", "node-3"} {
+		n, err := node.NewWithOptions(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { n.Close() })
+		r.RegisterClient(name, adapter.NewLocalClient(n))
+	}
+
+	srv := httptest.NewServer((&gateway.Gateway{Ring: r, Token: token, MaxValueSize: 1024}).Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func do(t *testing.T, method, url string, body []byte, header ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, b
+}
+
+func reason(b []byte) string {
+	var e struct{ Reason string }
+	json.Unmarshal(b, &e)
+	return e.Reason
+}
+
+func TestKeyLifecycle(t *testing.T) {
+	srv := newGateway(t, "")
+	url := srv.URL + "/v1/keys/users/42"
+
+	res, _ := do(t, http.MethodPut, url, []byte{0xff, 0x00})
+	tag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusNoContent || tag == "" {
+		t.Fatalf("Expected 204 with an ETag, but got %d %q", res.StatusCode, tag)
+	}
+
+	res, body := do(t, http.MethodGet, url, nil)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, []byte{0xff, 0x00}) || res.Header.Get("ETag") != tag {
+		t.Errorf("Expected the written bytes with ETag %s, but got %d %v %q", tag, res.StatusCode, body, res.Header.Get("ETag"))
+	}
+	if res, _ := do(t, http.MethodGet, url, nil, "If-None-Match", tag); res.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for the current ETag, but got %d", res.StatusCode)
+	}
+
+	res, body = do(t, http.MethodPut, url+"?w=3", []byte("v2"), "If-Match", `"1"`)
+	if res.StatusCode != http.StatusPreconditionFailed || reason(body) != "CONFLICT" {
+		t.Errorf("Expected 412 CONFLICT for a stale If-Match, but got %d %s", res.StatusCode, body)
+	}
+	if res, _ := do(t, http.MethodPut, url, []byte("v2"), "If-None-Match", "*"); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for If-None-Match * on an existing key, but got %d", res.StatusCode)
+	}
+	res, _ = do(t, http.MethodPut, url+"?consistency=all", []byte("v2"), "If-Match", tag)
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("ETag") == tag {
+		t.Errorf("Expected the write with the current ETag to pass with a new ETag, but got %d %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+
+	if res, _ := do(t, http.MethodDelete, url, nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 for DELETE, but got %d", res.StatusCode)
+	}
+	res, body = do(t, http.MethodGet, url+"?r=3", nil)
+	if res.StatusCode != http.StatusNotFound || reason(body) != "NOT_FOUND" {
+		t.Errorf("Expected 404 NOT_FOUND after the delete, but got %d %s", res.StatusCode, body)
+	}
+
+	if res, _ := do(t, http.MethodGet, url+"?r=4", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for r above the replica count, but got %d", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodPut, url, make([]byte, 2048)); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a value above the limit, but got %d", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodPut, srv.URL+"/v1/keys/a,b", []byte("v")); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a key the WAL can't hold, but got %d", res.StatusCode)
+	}
+}
+
+func TestScanStreamsJSONLines(t *testing.T) {
+	srv := newGateway(t, "")
+	for i := range 150 {
+		do(t, http.MethodPut, fmt.Sprintf("%s/v1/keys/p/%03d", srv.URL, i), []byte(fmt.Sprint("v", i)))
+	}
+	do(t, http.MethodPut, srv.URL+"/v1/keys/other", []byte("v"))
+
+	res, body := do(t, http.MethodGet, srv.URL+"/v1/keys?prefix=p/&values=raw", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d %s", res.StatusCode, body)
+	}
+	rd, _ := transfer.NewReader(transfer.FormatJSONL, bytes.NewReader(body))
+	for i := range 150 {
+		rec, err := rd.Read()
+		if err != nil || rec.Key != fmt.Sprintf("p/%03d", i) || string(rec.Value) != fmt.Sprint("v", i) || rec.Version == 0 {
+			t.Fatalf("Expected p/%03d in key order, but got %+v and %v", i, rec, err)
+		}
+	}
+	if _, err := rd.Read(); err != io.EOF {
+		t.Errorf("Expected the scan to end after the prefix, but got %v", err)
+	}
+
+	_, body = do(t, http.MethodGet, srv.URL+"/v1/keys?limit=10", nil)
+	if n := strings.Count(string(body), "\n"); n != 10 {
+		t.Errorf("Expected 10 lines with limit=10, but got %d", n)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	srv := newGateway(t, "secret")
+	if res, _ := do(t, http.MethodGet, srv.URL+"/v1/keys/k", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, but got %d", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodGet, srv.URL+"/v1/keys/k", nil, "Authorization", "Bearer secret"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 with the token, but got %d", res.StatusCode)
+	}
+}
+
+// docs/openapi.json is generated, a route change must regenerate it
+func TestOpenAPIDocumentIsCurrent(t *testing.T) {
+	committed, err := os.ReadFile("../../docs/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(committed, gateway.OpenAPI()) {
+		t.Errorf("docs/openapi.json is out of date, run go run ./cmd/gateway -openapi > docs/openapi.json")
+	}
+}
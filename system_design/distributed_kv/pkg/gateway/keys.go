@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/transfer"
+)
+
+// scanFlushEvery is how many scanned keys are sent to the client at once
+const scanFlushEvery = 100
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matches reports whether the If-Match or If-None-Match header value lists
+// tag or is "*"
+func matches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) getKey(w http.ResponseWriter, r *http.Request) {
+	q, err := g.quorum(r, "r")
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	e, err := g.ring(r).GetLatest(r.PathValue("key"), q)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	tag := etag(e.Version)
+	w.Header().Set("ETag", tag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && matches(inm, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.Value)))
+	w.Write(e.Value)
+}
+
+func (g *Gateway) putKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	wq, err := g.quorum(r, "w")
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	val, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(g.maxValueSize())))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		fail(w, &custom_errors.ValueTooLargeError{Key: key, Size: int(r.ContentLength), Max: g.maxValueSize()})
+		return
+	}
+	if err != nil {
+		fail(w, &custom_errors.ArgError{Arg: "body", Message: err.Error()})
+		return
+	}
+	if err := g.precondition(r, key); err != nil {
+		fail(w, err)
+		return
+	}
+
+	version := g.clock.Now()
+	if err := g.ring(r).Apply(ring.Mutation{Key: key, Value: val, Version: version}, wq); err != nil {
+		fail(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) deleteKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	wq, err := g.quorum(r, "w")
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	if err := g.precondition(r, key); err != nil {
+		fail(w, err)
+		return
+	}
+	if err := g.ring(r).Apply(ring.Mutation{Key: key, Delete: true, Version: g.clock.Now()}, wq); err != nil {
+		fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// precondition checks If-Match and If-None-Match against the newest version
+// a read quorum has. The check and the write that follows aren't atomic, two
+// writers with the same If-Match can both pass it. The versions still make
+// the replicas agree on one of them. The read skips the cache of hot keys.
+func (g *Gateway) precondition(r *http.Request, key string) error {
+	im, inm := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if im == "" && inm == "" {
+		return nil
+	}
+	rq, err := g.quorum(r, "r")
+	if err != nil {
+		return err
+	}
+	e, err := g.ring(r).WithoutCache().GetLatest(key, rq)
+	found := err == nil
+	if err != nil && !errors.Is(err, custom_errors.ErrNotFound) {
+		return err
+	}
+
+	current := "none"
+	if found {
+		current = etag(e.Version)
+	}
+	switch {
+	case im != "" && (!found || !matches(im, current)):
+		return &custom_errors.ConflictError{Key: key, Message: fmt.Sprintf("If-Match %s doesn't match the current version %s", im, current)}
+	case inm != "" && found && matches(inm, current):
+		return &custom_errors.ConflictError{Key: key, Message: fmt.Sprintf("If-None-Match %s matches the current version %s", inm, current)}
+	}
+	return nil
+}
+
+// errScanLimit ends a scan that reached its limit
+var errScanLimit = errors.New("limit reached")
+
+func (g *Gateway) scan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	values := transfer.ValuesBase64
+	if v := q.Get("values"); v != "" {
+		values = transfer.ValueEncoding(v)
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			fail(w, &custom_errors.ArgError{Arg: "limit=" + v, Message: "must be a positive number"})
+			return
+		}
+		limit = n
+	}
+	tw, err := transfer.NewWriter(transfer.FormatJSONL, values, w)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err = g.Ring.Scan(r.Context(), q.Get("prefix"), func(e ring.Entry) error {
+		if err := tw.Write(transfer.Record{Key: e.Key, Value: e.Value, Version: e.Version}); err != nil {
+			return err
+		}
+		n++
+		if n == limit {
+			return errScanLimit
+		}
+		if n%scanFlushEvery == 0 {
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errScanLimit {
+		if n == 0 {
+			// nothing is sent yet, the status can still tell
+			fail(w, err)
+			return
+		}
+		tw.Flush()
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	tw.Flush()
+}
+
+func (g *Gateway) nodes(w http.ResponseWriter, r *http.Request) {
+	type nodeState struct {
+		State               string `json:"state"`
+		ConsecutiveFailures int    `json:"consecutive_failures"`
+		LastError           string `json:"last_error,omitempty"`
+		Since               string `json:"since,omitempty"`
+	}
+	out := map[string]nodeState{}
+	for addr, h := range g.Ring.Health() {
+		s := nodeState{State: h.State.String(), ConsecutiveFailures: h.ConsecutiveFailures, LastError: h.LastError}
+		if !h.Since.IsZero() {
+			s.Since = h.Since.UTC().Format(time.RFC3339)
+		}
+		out[addr] = s
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenAPI describes the routes as an OpenAPI 3 document. It is built from
+// the same table that registers the handlers, docs/openapi.json is its output
+// (go run ./cmd/gateway -openapi).
+func OpenAPI() []byte {
+	paths := map[string]map[string]any{}
+	for _, rt := range routes {
+		if paths[rt.path] == nil {
+			paths[rt.path] = map[string]any{}
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = operation(rt)
+	}
+
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "toy_dynamodb HTTP gateway",
+			"version":     "v1",
+			"description": "Reads and writes go through the coordinator ring. R and W come from the r, w or consistency parameters, otherwise from the gateway's default level. The ETag of a key is its version.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": map[string]any{
+				"Error": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"error":  map[string]any{"type": "string"},
+						"reason": map[string]any{"type": "string", "example": "QUORUM_NOT_MET"},
+					},
+				},
+			},
+		},
+		// the token is optional, a gateway without one accepts every request
+		"security": []any{map[string]any{}, map[string]any{"bearer": []any{}}},
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+func operation(rt route) map[string]any {
+	op := map[string]any{"summary": rt.summary}
+
+	var params []any
+	for _, p := range rt.params {
+		params = append(params, map[string]any{
+			"name":        p.name,
+			"in":          p.in,
+			"required":    p.in == "path",
+			"description": p.description,
+			"schema":      map[string]any{"type": p.typ},
+		})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if rt.body != "" {
+		op["requestBody"] = map[string]any{
+			"required":    true,
+			"description": rt.body,
+			"content": map[string]any{
+				"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+			},
+		}
+	}
+
+	responses := map[string]any{}
+	for code, desc := range rt.responses {
+		res := map[string]any{"description": desc}
+		switch {
+		case code == http.StatusOK && rt.produces != "":
+			res["content"] = map[string]any{rt.produces: map[string]any{"schema": map[string]any{"type": "string"}}}
+		case code >= 400:
+			res["content"] = errorContent
+		}
+		if rt.method != http.MethodDelete && (code == http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified) && strings.Contains(rt.path, "{key}") {
+			res["headers"] = map[string]any{"ETag": map[string]any{"description": "The version of the value", "schema": map[string]any{"type": "string"}}}
+		}
+		if code == http.StatusTooManyRequests {
+			res["headers"] = map[string]any{"Retry-After": map[string]any{"description": "Seconds until the request may succeed", "schema": map[string]any{"type": "integer"}}}
+		}
+		responses[strconv.Itoa(code)] = res
+	}
+	responses["default"] = map[string]any{"description": "An error, see reason", "content": errorContent}
+	op["responses"] = responses
+	return op
+}
+
+var errorContent = map[string]any{
+	"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+}
+
+type param struct {
+	name, in, typ, description string
+}
+
+var (
+	keyParam         = param{"key", "path", "string", "The key, may contain slashes"}
+	readQuorum       = param{"r", "query", "integer", "Read quorum, also used to check If-Match and If-None-Match"}
+	writeQuorum      = param{"w", "query", "integer", "Write quorum"}
+	consistencyParam = param{"consistency", "query", "string", "one, quorum or all, used when r or w is missing"}
+	ifMatch          = param{"If-Match", "header", "string", `Write only if the current ETag is one of these, or "*" if the key exists`}
+	ifNoneMatch      = param{"If-None-Match", "header", "string", `For reads, answer 304 if the ETag is one of these. For writes, "*" writes only if the key doesn't exist.`}
+	prefixParam      = param{"prefix", "query", "string", "Only keys starting with this prefix"}
+	valuesParam      = param{"values", "query", "string", "base64 (default) or raw, raw values that aren't UTF-8 stay in value_b64"}
+	limitParam       = param{"limit", "query", "integer", "Stop after this many keys"}
+)
@@ -0,0 +1,40 @@
+// Package hlc hands out hybrid timestamps used as value versions: wall clock
+// nanoseconds that never go backwards on one process and stay ahead of every
+// timestamp the process has observed, so causally later writes get higher
+// versions even with some clock skew between machines.
+package hlc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is safe for concurrent use, the zero value is ready
+type Clock struct {
+	last atomic.Uint64
+}
+
+func (c *Clock) Now() uint64 {
+	for {
+		last := c.last.Load()
+		t := max(uint64(time.Now().UnixNano()), last+1)
+		if c.last.CompareAndSwap(last, t) {
+			return t
+		}
+	}
+}
+
+// Observe moves the clock past ts, e.g. a version received from another node
+func (c *Clock) Observe(ts uint64) {
+	for {
+		last := c.last.Load()
+		if ts <= last || c.last.CompareAndSwap(last, ts) {
+			return
+		}
+	}
+}
+
+// Time converts a timestamp back to wall clock time
+func Time(ts uint64) time.Time {
+	return time.Unix(0, int64(ts))
+}
@@ -0,0 +1,256 @@
+// Package hotkey finds the most requested keys of a process in constant
+// memory (ADR 0030). A count-min sketch counts every request and a small
+// list keeps the keys with the highest counts. Counts cover the current and
+// the previous window, older requests are forgotten.
+package hotkey
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	kv "toy_dynamodb/proto"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// DefaultTopK is the number of keys a tracker keeps when Config.TopK is 0
+	DefaultTopK = 32
+	// DefaultWindow is how long a window lasts when Config.Window is 0
+	DefaultWindow = 10 * time.Second
+
+	// with 4 rows of 4096 counters a key is overestimated by more than
+	// 1/1500 of the window's requests with a probability below 2%
+	sketchDepth = 4
+	sketchWidth = 4096
+)
+
+// Config sizes a tracker, the zero value uses the defaults
+type Config struct {
+	TopK   int           `yaml:"top_k"`
+	Window time.Duration `yaml:"window"`
+}
+
+func (c Config) Validate() error {
+	if c.TopK < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprint("hot_keys.top_k=", c.TopK), Message: "can't be negative"}
+	}
+	if c.Window < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprint("hot_keys.window=", c.Window), Message: "can't be negative"}
+	}
+	return nil
+}
+
+// Key is a tracked key with the requests counted for it. Count may be too
+// high by the collisions of the sketch, never too low.
+type Key struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	// Rate is Count over the time it was counted in, in requests per second
+	Rate float64 `json:"rate"`
+}
+
+func (k Key) Proto() *kv.HotKey {
+	return &kv.HotKey{Table: k.Table, Key: k.Key, Count: k.Count, Rate: k.Rate}
+}
+
+func FromProto(p *kv.HotKey) Key {
+	return Key{Table: p.GetTable(), Key: p.GetKey(), Count: p.GetCount(), Rate: p.GetRate()}
+}
+
+// Count is a tracked key without its name
+type Count struct {
+	Table string  `json:"table"`
+	Count uint64  `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+// Counts drops the names of keys for the unauthenticated /debug/vars, the
+// names are only served by Admin.HotKeys, which needs the admin role
+func Counts(keys []Key) []Count {
+	out := make([]Count, len(keys))
+	for i, k := range keys {
+		out[i] = Count{Table: k.Table, Count: k.Count, Rate: k.Rate}
+	}
+	return out
+}
+
+// Response is the answer of Admin.HotKeys with keys
+func Response(keys []Key) *kv.HotKeysResponse {
+	res := &kv.HotKeysResponse{Keys: make([]*kv.HotKey, len(keys))}
+	for i, k := range keys {
+		res.Keys[i] = k.Proto()
+	}
+	return res
+}
+
+// sketch is a count-min sketch, a key's estimate is the smallest of its
+// counters
+type sketch [sketchDepth][sketchWidth]uint32
+
+// slots returns the counter of h in every row, from two halves of one hash
+func slots(h uint64) [sketchDepth]uint32 {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	var s [sketchDepth]uint32
+	for i := range s {
+		s[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return s
+}
+
+func (s *sketch) estimate(slot [sketchDepth]uint32) uint32 {
+	est := s[0][slot[0]]
+	for i := 1; i < sketchDepth; i++ {
+		est = min(est, s[i][slot[i]])
+	}
+	return est
+}
+
+// add increments only the counters at the key's estimate, a conservative
+// update that keeps collisions from adding up
+func (s *sketch) add(slot [sketchDepth]uint32) uint32 {
+	est := s.estimate(slot)
+	for i := range sketchDepth {
+		if s[i][slot[i]] == est {
+			s[i][slot[i]]++
+		}
+	}
+	return est + 1
+}
+
+// Tracker counts requests by table and key. It is safe for concurrent use.
+type Tracker struct {
+	mu     sync.Mutex
+	k      int
+	window time.Duration
+	// cur counts the window that started at start, prev the one before it.
+	// hasPrev is false in the first window of the tracker.
+	cur, prev *sketch
+	start     time.Time
+	hasPrev   bool
+	// top holds up to k keys by their count in both windows. minID is the
+	// key with the lowest count of a full list.
+	top   map[string]uint64
+	minID string
+	now   func() time.Time
+}
+
+func NewTracker(c Config) *Tracker {
+	if c.TopK == 0 {
+		c.TopK = DefaultTopK
+	}
+	if c.Window == 0 {
+		c.Window = DefaultWindow
+	}
+	return &Tracker{k: c.TopK, window: c.Window, cur: new(sketch), prev: new(sketch), top: make(map[string]uint64, c.TopK+1), now: time.Now, start: time.Now()}
+}
+
+// id joins the table and the key, table names can't contain a NUL byte
+func id(table, key string) string {
+	return table + "\x00" + key
+}
+
+// Record counts a request of key and returns its count
+func (t *Tracker) Record(table, key string) uint64 {
+	s := id(table, key)
+	slot := slots(xxhash.Sum64String(s))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	count := uint64(t.cur.add(slot)) + uint64(t.prev.estimate(slot))
+
+	if _, ok := t.top[s]; ok || len(t.top) < t.k {
+		t.top[s] = count
+		if ok && s != t.minID {
+			return count
+		}
+	} else if count > t.top[t.minID] {
+		delete(t.top, t.minID)
+		t.top[s] = count
+	} else {
+		return count
+	}
+	t.findMin()
+	return count
+}
+
+func (t *Tracker) findMin() {
+	t.minID = ""
+	for s, c := range t.top {
+		if t.minID == "" || c < t.top[t.minID] {
+			t.minID = s
+		}
+	}
+}
+
+// rotate starts a new window when the current one is over. A tracker that
+// was idle for more than a window forgets both.
+func (t *Tracker) rotate() {
+	elapsed := t.now().Sub(t.start)
+	if elapsed < t.window {
+		return
+	}
+	t.cur, t.prev = t.prev, t.cur
+	clear(t.cur[:])
+	if elapsed >= 2*t.window {
+		clear(t.prev[:])
+	}
+	t.start = t.start.Add(elapsed.Truncate(t.window))
+	t.hasPrev = true
+
+	for s := range t.top {
+		slot := slots(xxhash.Sum64String(s))
+		if c := uint64(t.prev.estimate(slot)); c > 0 {
+			t.top[s] = c
+		} else {
+			delete(t.top, s)
+		}
+	}
+	t.findMin()
+}
+
+// span is the time the counts cover, at least a second so the first
+// requests of a tracker don't look like a burst
+func (t *Tracker) span() time.Duration {
+	d := t.now().Sub(t.start)
+	if t.hasPrev {
+		d += t.window
+	}
+	return max(d, time.Second)
+}
+
+// Rate returns the requests per second of key in the current and the
+// previous window
+func (t *Tracker) Rate(table, key string) float64 {
+	slot := slots(xxhash.Sum64String(id(table, key)))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return float64(uint64(t.cur.estimate(slot))+uint64(t.prev.estimate(slot))) / t.span().Seconds()
+}
+
+// Top returns up to n of the most requested keys, the most requested first.
+// n <= 0 returns all the tracker keeps.
+func (t *Tracker) Top(n int) []Key {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	secs := t.span().Seconds()
+	keys := make([]Key, 0, len(t.top))
+	for s, c := range t.top {
+		table, key, _ := strings.Cut(s, "\x00")
+		keys = append(keys, Key{Table: table, Key: key, Count: c, Rate: float64(c) / secs})
+	}
+	slices.SortFunc(keys, func(a, b Key) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Table, b.Table), cmp.Compare(a.Key, b.Key))
+	})
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
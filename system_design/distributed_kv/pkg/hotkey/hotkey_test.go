@@ -0,0 +1,53 @@
+package hotkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A hot key stays on top of many cold keys and is never undercounted, the
+// counts fade after two windows without requests
+func TestTopKeysAndWindows(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := NewTracker(Config{TopK: 8, Window: 10 * time.Second})
+	tr.now, tr.start = func() time.Time { return now }, now
+
+	for i := range 20_000 {
+		tr.Record("", fmt.Sprint("cold-", i))
+		if i%10 == 0 {
+			tr.Record("scores", "leaderboard")
+		}
+	}
+	top := tr.Top(0)
+	if len(top) != 8 || top[0].Table != "scores" || top[0].Key != "leaderboard" || top[0].Count < 2000 {
+		t.Fatalf("Expected 8 keys with leaderboard first and at least 2000 requests but got %+v", top)
+	}
+	if top[1].Count >= 2000 {
+		t.Errorf("Expected every cold key far below the hot one but got %+v", top[1])
+	}
+
+	now = now.Add(15 * time.Second)
+	if rate := tr.Rate("scores", "leaderboard"); rate < 2000/15.0 {
+		t.Errorf("Expected the previous window to count but got %.1f/s", rate)
+	}
+	now = now.Add(20 * time.Second)
+	if top := tr.Top(0); len(top) != 0 {
+		t.Errorf("Expected no keys after two idle windows but got %+v", top)
+	}
+	if rate := tr.Rate("scores", "leaderboard"); rate != 0 {
+		t.Errorf("Expected a rate of 0 after two idle windows but got %.1f/s", rate)
+	}
+}
+
+// The metrics endpoints have no auth, they only get the counts
+func TestCountsHaveNoNames(t *testing.T) {
+	out, err := json.Marshal(Counts([]Key{{Table: "users", Key: "users/secret", Count: 7, Rate: 0.7}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"table":"users","count":7,"rate":0.7}]`; string(out) != want {
+		t.Errorf("Expected %s but got %s", want, out)
+	}
+}
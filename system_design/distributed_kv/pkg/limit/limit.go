@@ -0,0 +1,119 @@
+// Package limit is a token bucket per tenant. Coordinators and nodes keep one
+// each: a coordinator limits its clients, the nodes bound what all
+// coordinators together send them (ADR 0026).
+package limit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+// Rate is the requests per second a tenant may send and how many may come at
+// once. A zero Rate doesn't limit.
+type Rate struct {
+	PerSecond float64 `json:"per_second,omitempty"`
+	// Burst is the size of the bucket, 0 means one second of PerSecond
+	Burst int `json:"burst,omitempty"`
+}
+
+func (r Rate) Validate() error {
+	if r.PerSecond < 0 || math.IsNaN(r.PerSecond) || math.IsInf(r.PerSecond, 0) || r.Burst < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("rate %v/s burst %d", r.PerSecond, r.Burst), Message: "must not be negative"}
+	}
+	return nil
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return max(r.PerSecond, 1)
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token, or tells how long until there is one
+func (b *bucket) take(now time.Time) (time.Duration, bool) {
+	b.tokens = min(b.rate.burst(), b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second)), false
+}
+
+// Limiter holds the buckets of all tenants. The zero value limits nothing.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// now is replaced by tests
+	now func() time.Time
+}
+
+// Set changes the rate of tenant, a zero rate removes its limit. A changed
+// rate starts with a full bucket.
+func (l *Limiter) Set(tenant string, r Rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r.PerSecond == 0 {
+		delete(l.buckets, tenant)
+		return
+	}
+	if b, ok := l.buckets[tenant]; ok && b.rate == r {
+		return
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	l.buckets[tenant] = &bucket{rate: r, tokens: r.burst(), last: l.clock()}
+}
+
+// Get returns the rate of tenant, zero when it isn't limited
+func (l *Limiter) Get(tenant string) Rate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[tenant]; ok {
+		return b.rate
+	}
+	return Rate{}
+}
+
+// Allow takes a token of tenant. Without one it returns a
+// ResourceExhaustedError with the time until the next token.
+func (l *Limiter) Allow(tenant string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[tenant]
+	if !ok {
+		return nil
+	}
+	wait, ok := b.take(l.clock())
+	if ok {
+		return nil
+	}
+	return &custom_errors.ResourceExhaustedError{Resource: "requests of " + Tenant(tenant), Limit: int64(math.Ceil(b.rate.PerSecond)),
+		Message: fmt.Sprintf("rate limit of %v/s with a burst of %v", b.rate.PerSecond, b.rate.burst()), RetryAfter: wait}
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Tenant names a tenant in messages, the default table has the empty name
+func Tenant(name string) string {
+	if name == "" {
+		return "the default table"
+	}
+	return "table " + name
+}
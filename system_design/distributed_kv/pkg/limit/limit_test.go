@@ -0,0 +1,40 @@
+package limit
+
+import (
+	"errors"
+	"testing"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+// A tenant gets its burst at once and then PerSecond, the others are not
+// slowed down by it
+func TestBucketRefills(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &Limiter{now: func() time.Time { return now }}
+	l.Set("jobs", Rate{PerSecond: 10, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := l.Allow("jobs"); err != nil {
+			t.Fatalf("Expected request %d of the burst to pass but got %v", i, err)
+		}
+	}
+	err := l.Allow("jobs")
+	var re *custom_errors.ResourceExhaustedError
+	if !errors.As(err, &re) || re.RetryAfter != 100*time.Millisecond {
+		t.Fatalf("Expected a retry after 100ms but got %v", err)
+	}
+	if err := l.Allow("web"); err != nil {
+		t.Errorf("Expected an unlimited tenant to pass but got %v", err)
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	if err := l.Allow("jobs"); err != nil {
+		t.Errorf("Expected a token after 100ms but got %v", err)
+	}
+
+	l.Set("jobs", Rate{})
+	if err := l.Allow("jobs"); err != nil {
+		t.Errorf("Expected no limit after removing it but got %v", err)
+	}
+}
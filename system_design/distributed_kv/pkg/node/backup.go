@@ -0,0 +1,284 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+const (
+	ManifestFile = "manifest.json"
+	SnapshotFile = "snapshot.aof"
+)
+
+// Manifest describes a backup directory. The snapshot holds the state of the
+// node at WALOffset, one record per key, tombstones included. The segments
+// are the WAL itself from offset 0 to WALOffset, they are what a restore to
+// an earlier point replays. The manifest is written last, a backup that
+// didn't finish leaves the previous manifest in place.
+type Manifest struct {
+	Node      string    `json:"node"`
+	Created   time.Time `json:"created"`
+	WALOffset int64     `json:"wal_offset"`
+	// Records is the number of WAL records up to WALOffset, the sequence
+	// number of the last one
+	Records     uint64    `json:"records"`
+	LastVersion uint64    `json:"last_version"`
+	Snapshot    string    `json:"snapshot"`
+	Segments    []Segment `json:"segments"`
+}
+
+// Segment is a copy of the WAL between two offsets. Sequence numbers count
+// the records of the WAL from 1.
+type Segment struct {
+	File       string `json:"file"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+	FirstSeq   uint64 `json:"first_seq"`
+	LastSeq    uint64 `json:"last_seq"`
+	MaxVersion uint64 `json:"max_version"`
+}
+
+// RestorePoint limits a restore, the zero value restores everything
+type RestorePoint struct {
+	// Seq keeps the records up to this sequence number
+	Seq uint64
+	// Time keeps the records whose version is not later than it. Records
+	// written before versions existed are always kept.
+	Time time.Time
+}
+
+func (p RestorePoint) IsZero() bool {
+	return p.Seq == 0 && p.Time.IsZero()
+}
+
+func (p RestorePoint) keeps(seq uint64, rec Record) bool {
+	if p.Seq > 0 && seq > p.Seq {
+		return false
+	}
+	return p.Time.IsZero() || rec.Version <= uint64(p.Time.UnixNano())
+}
+
+// Backup copies the WAL written so far into dir while the node keeps
+// serving. Writes are only held up while the end of the log is read. If dir
+// already holds a backup of this node only the records after it are copied,
+// as a new segment, and the snapshot is brought up to date.
+func (n *Node) Backup(dir string) (Manifest, error) {
+	n.backupmu.Lock()
+	defer n.backupmu.Unlock()
+
+	n.walmu.Lock()
+	if n.closed.Load() {
+		n.walmu.Unlock()
+		return Manifest{}, ErrClosed
+	}
+	// appends are complete under walmu, so the size is a record boundary
+	st, err := n.file.Stat()
+	n.walmu.Unlock()
+	if err != nil {
+		return Manifest{}, err
+	}
+	end := st.Size()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Manifest{}, err
+	}
+	m, err := ReadManifest(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		m = Manifest{Node: n.Name, Snapshot: SnapshotFile}
+	case err != nil:
+		return Manifest{}, err
+	case m.Node != n.Name:
+		return Manifest{}, &custom_errors.ArgError{Arg: dir, Message: fmt.Sprintf("holds a backup of %s", m.Node)}
+	case m.WALOffset > end:
+		return Manifest{}, &custom_errors.ArgError{Arg: dir, Message: "the WAL is shorter than this backup, it was rewritten, use a new directory"}
+	}
+	if m.WALOffset == end && len(m.Segments) > 0 {
+		return m, nil
+	}
+
+	state := map[string]Record{}
+	if len(m.Segments) > 0 {
+		if err := loadState(filepath.Join(dir, m.Snapshot), state, RestorePoint{}, 0); err != nil {
+			return Manifest{}, err
+		}
+	}
+
+	seg := Segment{File: fmt.Sprintf("wal-%020d.seg", m.WALOffset), Start: m.WALOffset, End: end, FirstSeq: m.Records + 1, LastSeq: m.Records}
+	if err := copyRange(n.Path(), filepath.Join(dir, seg.File), seg.Start, seg.End); err != nil {
+		return Manifest{}, err
+	}
+	_, err = ReadWAL(filepath.Join(dir, seg.File), 0, func(rec Record, next int64) error {
+		seg.LastSeq++
+		seg.MaxVersion = max(seg.MaxVersion, rec.Version)
+		state[rec.Key] = rec
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := writeState(filepath.Join(dir, m.Snapshot), state); err != nil {
+		return Manifest{}, err
+	}
+
+	m.Created = time.Now().UTC()
+	m.WALOffset, m.Records = end, seg.LastSeq
+	m.LastVersion = max(m.LastVersion, seg.MaxVersion)
+	m.Segments = append(m.Segments, seg)
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ManifestFile), func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	}); err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, &custom_errors.ArgError{Arg: dir, Message: "invalid manifest: " + err.Error()}
+	}
+	return m, nil
+}
+
+// Restore builds the WAL of node name in opts.DataDir from the backup in dir
+// and returns the number of keys it holds, tombstones included. The node
+// must not have a WAL yet. The zero RestorePoint uses the snapshot, any
+// other point replays the segments up to it.
+func Restore(dir string, opts Options, name string, to RestorePoint) (int, error) {
+	if opts.DataDir == "" {
+		opts.DataDir = DefaultDataDir
+	}
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var start int64
+	for _, s := range m.Segments {
+		st, err := os.Stat(filepath.Join(dir, s.File))
+		if err != nil {
+			return 0, err
+		}
+		if s.Start != start || st.Size() != s.End-s.Start {
+			return 0, &custom_errors.ArgError{Arg: s.File, Message: "segment doesn't continue the previous one or is incomplete"}
+		}
+		start = s.End
+	}
+	if to.Seq > m.Records {
+		return 0, &custom_errors.ArgError{Arg: fmt.Sprint(to.Seq), Message: fmt.Sprintf("the backup ends at sequence number %d", m.Records)}
+	}
+
+	path := filepath.Join(opts.DataDir, name+".aof")
+	if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+		return 0, &custom_errors.ArgError{Arg: path, Message: "already exists, restore into an empty data directory"}
+	}
+
+	state := map[string]Record{}
+	if to.IsZero() {
+		err = loadState(filepath.Join(dir, m.Snapshot), state, to, 0)
+	} else {
+		for _, s := range m.Segments {
+			if to.Seq > 0 && s.FirstSeq > to.Seq {
+				break
+			}
+			if err = loadState(filepath.Join(dir, s.File), state, to, s.FirstSeq); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(opts.DataDir, 0755); err != nil {
+		return 0, err
+	}
+	if err := writeState(path, state); err != nil {
+		return 0, err
+	}
+	return len(state), nil
+}
+
+// loadState replays the records of a WAL file that to keeps into state, seq
+// is the sequence number of its first record
+func loadState(path string, state map[string]Record, to RestorePoint, seq uint64) error {
+	_, err := ReadWAL(path, 0, func(rec Record, next int64) error {
+		if to.keeps(seq, rec) {
+			state[rec.Key] = rec
+		}
+		seq++
+		return nil
+	})
+	return err
+}
+
+// writeState writes one record per key, sorted so equal states give equal files
+func writeState(path string, state map[string]Record) error {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return writeFileAtomic(path, func(w io.Writer) error {
+		for _, k := range keys {
+			if _, err := w.Write(state[k].encode()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func copyRange(src, dst string, start, end int64) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.CopyN(w, f, end-start)
+		return err
+	})
+}
+
+// writeFileAtomic fsyncs the content before renaming it over path, a crash
+// leaves either the old or the new file
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
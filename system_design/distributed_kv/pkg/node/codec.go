@@ -0,0 +1,312 @@
+package node
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	custom_errors "toy_dynamodb/Errors"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v3"
+)
+
+// Compression of the values in the WAL
+type Compression string
+
+const (
+	CompressNone   Compression = ""
+	CompressSnappy Compression = "snappy"
+	CompressZstd   Compression = "zstd"
+)
+
+// DefaultCompressMinSize is the smallest value that is compressed when
+// Options.CompressMinSize is 0, shorter values rarely get smaller
+const DefaultCompressMinSize = 256
+
+func (c Compression) Validate() error {
+	switch c {
+	case CompressNone, CompressSnappy, CompressZstd:
+		return nil
+	}
+	return &custom_errors.ArgError{Arg: "compression " + string(c), Message: "must be snappy, zstd or empty"}
+}
+
+// the zstd coders are safe for concurrent EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// Keyring holds the AES keys of a node by key id. New records are encrypted
+// with the active key, the other keys only decrypt older records.
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// NewKeyring takes 16, 24 or 32 byte keys for AES-128, -192 or -256. Key ids
+// are stored in every record, they may contain letters, digits, '_' and '-'.
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, &custom_errors.ArgError{Arg: "active key " + active, Message: "is not one of the keys"}
+	}
+	k := &Keyring{active: active, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || strings.ContainsFunc(id, func(c rune) bool {
+			return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-')
+		}) {
+			return nil, &custom_errors.ArgError{Arg: "key id " + strconv.Quote(id), Message: "may only contain letters, digits, '_' and '-'"}
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, &custom_errors.ArgError{Arg: "key " + id, Message: err.Error()}
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// keyFile is the YAML of LoadKeyring, the keys are base64
+type keyFile struct {
+	Active string            `yaml:"active"`
+	Keys   map[string]string `yaml:"keys"`
+}
+
+// LoadKeyring reads a key file:
+//
+//	active: k2
+//	keys:
+//	  k1: <base64 of 32 random bytes>
+//	  k2: <base64 of 32 random bytes>
+//
+// Rotating adds a key and makes it active, the old one stays until no live
+// value and no backup that may be restored needs it.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, &custom_errors.ArgError{Arg: path, Message: "invalid key file: " + err.Error()}
+	}
+	keys := make(map[string][]byte, len(f.Keys))
+	for id, s := range f.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, &custom_errors.ArgError{Arg: path + " key " + id, Message: "is not base64"}
+		}
+	}
+	return NewKeyring(f.Active, keys)
+}
+
+// Active is the id of the key new records are encrypted with
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+// codec is how a record's value is stored: its compression and the id of its
+// key, joined by '+' in the record, e.g. "zstd+aes:k2". Empty is plain.
+type codec struct {
+	compression Compression
+	keyID       string
+}
+
+func (c codec) String() string {
+	var parts []string
+	if c.compression != CompressNone {
+		parts = append(parts, string(c.compression))
+	}
+	if c.keyID != "" {
+		parts = append(parts, "aes:"+c.keyID)
+	}
+	return strings.Join(parts, "+")
+}
+
+func parseCodec(s string) (codec, error) {
+	var c codec
+	if s == "" {
+		return c, nil
+	}
+	for _, p := range strings.Split(s, "+") {
+		switch {
+		case strings.HasPrefix(p, "aes:") && len(p) > len("aes:"):
+			c.keyID = p[len("aes:"):]
+		case Compression(p) == CompressSnappy || Compression(p) == CompressZstd:
+			c.compression = Compression(p)
+		default:
+			return c, &parseLineError{arg: s, message: "unknown value codec"}
+		}
+	}
+	return c, nil
+}
+
+// seal turns the value of a record into what the WAL stores. It is only
+// compressed when it gets smaller. The record's key and version are
+// authenticated with it, so a value can't be moved to another record.
+func (n *Node) seal(key string, version uint64, val []byte) ([]byte, codec, error) {
+	var c codec
+	if n.opts.Compression != CompressNone && len(val) >= n.opts.CompressMinSize {
+		var packed []byte
+		switch n.opts.Compression {
+		case CompressSnappy:
+			packed = s2.EncodeSnappy(nil, val)
+		case CompressZstd:
+			packed = zstdEncoder.EncodeAll(val, nil)
+		}
+		if len(packed) < len(val) {
+			val, c.compression = packed, n.opts.Compression
+		}
+	}
+	if n.opts.Keys == nil {
+		return val, c, nil
+	}
+	c.keyID = n.opts.Keys.active
+	aead := n.opts.Keys.aeads[c.keyID]
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(val)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, c, err
+	}
+	return aead.Seal(out, out, val, additionalData(key, version)), c, nil
+}
+
+// openValue reverses seal, keys may be nil for records that aren't encrypted
+func openValue(keys *Keyring, c codec, key string, version uint64, val []byte, maxSize int) ([]byte, error) {
+	if c.keyID != "" {
+		var aead cipher.AEAD
+		if keys != nil {
+			aead = keys.aeads[c.keyID]
+		}
+		if aead == nil {
+			return nil, &custom_errors.ArgError{Arg: "key " + strconv.Quote(key), Message: "is encrypted with key " + c.keyID + ", which is not in the key file"}
+		}
+		if len(val) < aead.NonceSize() {
+			return nil, &parseLineError{arg: key, message: "encrypted value is too short"}
+		}
+		var err error
+		val, err = aead.Open(nil, val[:aead.NonceSize()], val[aead.NonceSize():], additionalData(key, version))
+		if err != nil {
+			return nil, &parseLineError{arg: key, message: "value doesn't decrypt with key " + c.keyID + ": " + err.Error()}
+		}
+	}
+	switch c.compression {
+	case CompressSnappy:
+		if size, err := s2.DecodedLen(val); err != nil || size > maxSize {
+			return nil, &parseLineError{arg: key, message: fmt.Sprintf("snappy value of %d bytes is corrupt or larger than %d", size, maxSize)}
+		}
+		return s2.Decode(nil, val)
+	case CompressZstd:
+		out, err := zstdDecoder.DecodeAll(val, nil)
+		if err != nil {
+			return nil, &parseLineError{arg: key, message: "zstd value is corrupt: " + err.Error()}
+		}
+		return out, nil
+	}
+	return val, nil
+}
+
+func additionalData(key string, version uint64) []byte {
+	return strconv.AppendUint(append([]byte(key), ','), version, 10)
+}
+
+// Decode returns r with its value as it was written, for readers of the WAL
+// outside the node like cross-cluster replication. keys may be nil when the
+// node doesn't encrypt.
+func (r Record) Decode(keys *Keyring) (Record, error) {
+	if r.Delete || r.Codec == "" {
+		return r, nil
+	}
+	c, err := parseCodec(r.Codec)
+	if err != nil {
+		return r, err
+	}
+	if r.Value, err = openValue(keys, c, r.Key, r.Version, r.Value, math.MaxInt); err != nil {
+		return r, err
+	}
+	r.Codec = ""
+	return r, nil
+}
+
+// KeyUsage counts the live values by the id of the key their record is
+// encrypted with, "" counts the values stored in plain
+func (n *Node) KeyUsage() map[string]int64 {
+	usage := make(map[string]int64)
+	for i := range n.shards {
+		sh := &n.shards[i]
+		sh.mu.RLock()
+		for _, e := range sh.items {
+			if e.deleted || n.expired(e) {
+				continue
+			}
+			c, _ := parseCodec(e.codec)
+			usage[c.keyID]++
+		}
+		sh.mu.RUnlock()
+	}
+	return usage
+}
+
+// Reencrypt writes the live values that aren't encrypted with the active key
+// again, with their version, and returns how many it wrote. Once it is done
+// and the WAL has no older record of them, the old key is only needed by
+// backups. dryRun only counts them.
+func (n *Node) Reencrypt(dryRun bool) (int, error) {
+	var active string
+	if n.opts.Keys != nil {
+		active = n.opts.Keys.active
+	}
+	var rewritten int
+	for i := range n.shards {
+		sh := &n.shards[i]
+		sh.wmu.Lock()
+		// only wmu holders change the map, reading it here needs no lock
+		for key, e := range sh.items {
+			if e.deleted || n.expired(e) {
+				continue
+			}
+			if c, _ := parseCodec(e.codec); c.keyID == active {
+				continue
+			}
+			rewritten++
+			if dryRun {
+				continue
+			}
+			if n.closed.Load() {
+				sh.wmu.Unlock()
+				return rewritten - 1, ErrClosed
+			}
+			sealed, c, err := n.seal(key, e.version, e.val)
+			if err == nil {
+				err = n.appendWAL(context.Background(), Record{Key: key, Value: sealed, Version: e.version, Codec: c.String()}.encode())
+			}
+			if err != nil {
+				sh.wmu.Unlock()
+				return rewritten - 1, err
+			}
+			e.codec = c.String()
+			sh.mu.Lock()
+			sh.items[key] = e
+			sh.mu.Unlock()
+		}
+		sh.wmu.Unlock()
+	}
+	return rewritten, nil
+}
+
+// ActiveKey is the id of the key new records are encrypted with, empty when
+// the node doesn't encrypt
+func (n *Node) ActiveKey() string {
+	if n.opts.Keys == nil {
+		return ""
+	}
+	return n.opts.Keys.active
+}
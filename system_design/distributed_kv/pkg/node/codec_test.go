@@ -0,0 +1,140 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, active string, keys map[string][]byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(active, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func randomKey() []byte {
+	return []byte(rand.Text() + rand.Text())[:32]
+}
+
+// Every codec stores values the WAL can't show in plain and reads them back
+// after a restart, values below the threshold stay uncompressed
+func TestCodecsRoundTrip(t *testing.T) {
+	keys := testKeyring(t, "k1", map[string][]byte{"k1": randomKey()})
+	long := []byte(strings.Repeat("secret value ", 100))
+	for _, tc := range []struct {
+		name        string
+		compression Compression
+		keys        *Keyring
+		codec       string
+	}{
+		{"snappy", CompressSnappy, nil, "snappy"},
+		{"zstd", CompressZstd, nil, "zstd"},
+		{"aes", CompressNone, keys, "aes:k1"},
+		{"zstd+aes", CompressZstd, keys, "zstd+aes:k1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.DataDir = t.TempDir()
+			opts.Compression, opts.Keys = tc.compression, tc.keys
+			n, err := NewWithOptions("n1", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := n.Put("long", long); err != nil {
+				t.Fatal(err)
+			}
+			if err := n.Put("short", []byte("secret")); err != nil {
+				t.Fatal(err)
+			}
+			n.Close()
+
+			wal, _ := os.ReadFile(n.Path())
+			if bytes.Contains(wal, []byte("c2VjcmV0")) && tc.keys != nil {
+				t.Errorf("Expected no plain value in the WAL but got %s", wal)
+			}
+			var codecs []string
+			ReadWAL(n.Path(), 0, func(rec Record, next int64) error {
+				codecs = append(codecs, rec.Codec)
+				return nil
+			})
+			wantShort := ""
+			if tc.keys != nil {
+				wantShort = "aes:k1"
+			}
+			if len(codecs) != 2 || codecs[0] != tc.codec || codecs[1] != wantShort {
+				t.Errorf("Expected codecs [%s %s] but got %q", tc.codec, wantShort, codecs)
+			}
+
+			n, err = NewWithOptions("n1", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer n.Close()
+			if v, _ := n.Get("long"); !bytes.Equal(v, long) {
+				t.Errorf("Expected the long value after replay but got %q", v)
+			}
+			if v, _ := n.Get("short"); string(v) != "secret" {
+				t.Errorf("Expected secret after replay but got %q", v)
+			}
+			if got, want := n.UsedBytes(), int64(len("long")+len(long)+len("short")+len("secret")); got != want {
+				t.Errorf("Expected %d used bytes of plain values but got %d", want, got)
+			}
+		})
+	}
+}
+
+// After a rotation Reencrypt moves the live values to the new key, then the
+// old key can leave the key file
+func TestKeyRotation(t *testing.T) {
+	k1, k2 := randomKey(), randomKey()
+	opts := DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.Keys = testKeyring(t, "k1", map[string][]byte{"k1": k1})
+	n, err := NewWithOptions("n1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := n.Put(k, []byte("v-"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n.Del("c")
+	n.Close()
+
+	opts.Keys = testKeyring(t, "k2", map[string][]byte{"k1": k1, "k2": k2})
+	if n, err = NewWithOptions("n1", opts); err != nil {
+		t.Fatal(err)
+	}
+	n.Put("b", []byte("v-b2"))
+	if usage := n.KeyUsage(); usage["k1"] != 1 || usage["k2"] != 1 {
+		t.Errorf("Expected one value per key but got %v", usage)
+	}
+	if count, err := n.Reencrypt(true); err != nil || count != 1 {
+		t.Errorf("Expected a dry run to count 1 value but got %d %v", count, err)
+	}
+	if count, err := n.Reencrypt(false); err != nil || count != 1 {
+		t.Errorf("Expected 1 value to be rewritten but got %d %v", count, err)
+	}
+	if usage := n.KeyUsage(); usage["k1"] != 0 || usage["k2"] != 2 {
+		t.Errorf("Expected every value under k2 but got %v", usage)
+	}
+	n.Close()
+
+	opts.Keys = testKeyring(t, "k2", map[string][]byte{"k2": k2})
+	if n, err = NewWithOptions("n1", opts); err != nil {
+		t.Fatalf("Expected the node to start without k1 but got %v", err)
+	}
+	defer n.Close()
+	if v, _ := n.Get("a"); string(v) != "v-a" {
+		t.Errorf("Expected v-a but got %q", v)
+	}
+	if v, _ := n.Get("b"); string(v) != "v-b2" {
+		t.Errorf("Expected v-b2 but got %q", v)
+	}
+}
@@ -0,0 +1,78 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDedupWindow is how long a node remembers the request ids of
+	// applied writes, longer than any retry schedule of the ring
+	DefaultDedupWindow = 5 * time.Minute
+	// DefaultDedupMaxEntries bounds the memory of the window, the oldest ids
+	// are forgotten first
+	DefaultDedupMaxEntries = 100_000
+)
+
+type dedupEntry struct {
+	id string
+	at time.Time
+}
+
+// dedupWindow remembers the ids of recently applied writes. Entries are
+// appended in time order, so expiring and evicting both pop from the front.
+// Retries of one write go to the same key, so the shard's writer lock keeps
+// contains and add of an id from interleaving.
+type dedupWindow struct {
+	mu     sync.Mutex
+	window time.Duration
+	max    int
+	seen   map[string]struct{}
+	order  []dedupEntry
+	now    func() time.Time
+}
+
+func newDedupWindow(window time.Duration, max int) *dedupWindow {
+	return &dedupWindow{window: window, max: max, seen: make(map[string]struct{}), now: time.Now}
+}
+
+// contains reports whether id was applied within the window
+func (d *dedupWindow) contains(id string) bool {
+	if id == "" || d.window <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire()
+	_, ok := d.seen[id]
+	return ok
+}
+
+func (d *dedupWindow) add(id string) {
+	if id == "" || d.window <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[id]; ok {
+		return
+	}
+	d.seen[id] = struct{}{}
+	d.order = append(d.order, dedupEntry{id: id, at: d.now()})
+	for len(d.order) > d.max {
+		d.pop()
+	}
+}
+
+func (d *dedupWindow) expire() {
+	cutoff := d.now().Add(-d.window)
+	for len(d.order) > 0 && d.order[0].at.Before(cutoff) {
+		d.pop()
+	}
+}
+
+func (d *dedupWindow) pop() {
+	delete(d.seen, d.order[0].id)
+	d.order[0] = dedupEntry{}
+	d.order = d.order[1:]
+}
@@ -0,0 +1,160 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+// Index declares a secondary index: the keys starting with Prefix whose
+// value is a JSON object are indexed by the scalar at Field, a dotted path
+// like "email" or "address.city". Strings are indexed as they are, numbers
+// as they are written and booleans as "true" or "false". Values that aren't
+// JSON or don't have the field are left out.
+type Index struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	Field  string `yaml:"field"`
+	// Table whose keys are indexed, empty is the default table. The node
+	// itself doesn't look at it, pkg/table hands every table its indexes.
+	Table string `yaml:"table"`
+}
+
+func (ix Index) Validate() error {
+	if ix.Name == "" {
+		return &custom_errors.ArgError{Arg: "index name", Message: "must be set"}
+	}
+	if ix.Field == "" || slices.Contains(strings.Split(ix.Field, "."), "") {
+		return &custom_errors.ArgError{Arg: "index " + ix.Name + " field=" + ix.Field, Message: "must be a dotted path of JSON object fields"}
+	}
+	return nil
+}
+
+// indexed is the value a key is indexed under and the version it came from
+type indexed struct {
+	value   string
+	version uint64
+}
+
+// index is the in-memory state of an Index. It is derived from the WAL like
+// the shards: Apply updates it after the record is appended and replay
+// rebuilds it, so there is nothing to persist and a new Index covers the
+// existing keys after a restart.
+type index struct {
+	Index
+	path []string
+
+	mu     sync.RWMutex
+	keys   map[string]map[string]struct{}
+	values map[string]indexed
+}
+
+func newIndex(ix Index) *index {
+	return &index{Index: ix, path: strings.Split(ix.Field, "."),
+		keys: make(map[string]map[string]struct{}), values: make(map[string]indexed)}
+}
+
+// extract returns the indexed form of the field in val
+func (ix *index) extract(val []byte) (string, bool) {
+	d := json.NewDecoder(bytes.NewReader(val))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, f := range ix.path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[f]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	}
+	return "", false
+}
+
+// update moves key to the value of e, a tombstone or a value without the
+// field removes it. Writers of the same key call it in version order, they
+// hold the key's shard wmu.
+func (ix *index) update(key string, e entry) {
+	if !strings.HasPrefix(key, ix.Prefix) {
+		return
+	}
+	value, ok := "", false
+	if !e.deleted {
+		value, ok = ix.extract(e.val)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if old, had := ix.values[key]; had {
+		delete(ix.keys[old.value], key)
+		if len(ix.keys[old.value]) == 0 {
+			delete(ix.keys, old.value)
+		}
+		delete(ix.values, key)
+	}
+	if !ok {
+		return
+	}
+	if ix.keys[value] == nil {
+		ix.keys[value] = make(map[string]struct{})
+	}
+	ix.keys[value][key] = struct{}{}
+	ix.values[key] = indexed{value: value, version: e.version}
+}
+
+func (n *Node) reindex(key string, e entry) {
+	for _, ix := range n.indexes {
+		ix.update(key, e)
+	}
+}
+
+// Query calls fn for every key whose value has value in the field of the
+// named index, in key order. A key written since it was indexed is skipped
+// instead of being reported with a value the index hasn't seen yet.
+func (n *Node) Query(name, value string, fn func(key string, val []byte, version uint64) error) error {
+	ix, ok := n.indexes[name]
+	if !ok {
+		return &custom_errors.ArgError{Arg: "index " + name, Message: "is not declared on node " + n.Name}
+	}
+
+	ix.mu.RLock()
+	keys := make([]string, 0, len(ix.keys[value]))
+	versions := make(map[string]uint64, len(ix.keys[value]))
+	for k := range ix.keys[value] {
+		keys = append(keys, k)
+		versions[k] = ix.values[k].version
+	}
+	ix.mu.RUnlock()
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		sh := n.shardOf(k)
+		sh.mu.RLock()
+		e := sh.items[k]
+		sh.mu.RUnlock()
+		if e.deleted || e.version != versions[k] || n.expired(e) {
+			continue
+		}
+		if err := fn(k, e.val, e.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
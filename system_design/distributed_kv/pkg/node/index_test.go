@@ -0,0 +1,66 @@
+package node
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+func query(t *testing.T, n *Node, index, value string) []string {
+	t.Helper()
+	var keys []string
+	if err := n.Query(index, value, func(key string, val []byte, version uint64) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// The index follows every Put and Delete and comes back from the WAL
+func TestIndexFollowsWritesAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.DataDir = dir
+	opts.Indexes = []Index{{Name: "email", Prefix: "users/", Field: "email"}, {Name: "city", Prefix: "users/", Field: "address.city"}}
+	n, err := NewWithOptions("n1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Put("users/1", []byte(`{"email":"a@x.com","address":{"city":"Ankara"}}`))
+	n.Put("users/2", []byte(`{"email":"a@x.com"}`))
+	n.Put("users/3", []byte(`{"email":"b@x.com"}`))
+	n.Put("users/4", []byte(`not json`))
+	n.Put("orders/1", []byte(`{"email":"a@x.com"}`))
+	if got := query(t, n, "email", "a@x.com"); !slices.Equal(got, []string{"users/1", "users/2"}) {
+		t.Errorf("Expected users/1 and users/2 below the prefix, but got %v", got)
+	}
+	if got := query(t, n, "city", "Ankara"); !slices.Equal(got, []string{"users/1"}) {
+		t.Errorf("Expected the nested field to be indexed, but got %v", got)
+	}
+
+	n.Put("users/2", []byte(`{"email":"b@x.com"}`))
+	n.Del("users/1")
+	if got := query(t, n, "email", "a@x.com"); len(got) != 0 {
+		t.Errorf("Expected the update and the delete to leave the old value, but got %v", got)
+	}
+	if got := query(t, n, "city", "Ankara"); len(got) != 0 {
+		t.Errorf("Expected the delete to leave the nested index, but got %v", got)
+	}
+	n.Close()
+
+	n, err = NewWithOptions("n1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if got := query(t, n, "email", "b@x.com"); !slices.Equal(got, []string{"users/2", "users/3"}) {
+		t.Errorf("Expected the replayed index to hold users/2 and users/3, but got %v", got)
+	}
+	if err := n.Query("missing", "v", nil); !errors.Is(err, custom_errors.ErrInvalidArgument) {
+		t.Errorf("Expected an undeclared index to be rejected, but got %v", err)
+	}
+}
@@ -2,14 +2,82 @@ package node
 
 import (
 	"bufio"
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
+	"hash/maphash"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hlc"
+	"toy_dynamodb/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("toy_dynamodb/pkg/node")
+
+// FsyncMode controls when WAL writes are flushed to physical disk.
+type FsyncMode string
+
+const (
+	// FsyncAlways fsyncs every record before the write is acknowledged (ADR 0004).
+	FsyncAlways FsyncMode = "always"
+	// FsyncInterval fsyncs in the background every Options.FsyncInterval.
+	// A crash can lose the writes of the last interval.
+	FsyncInterval FsyncMode = "interval"
+	// FsyncNever leaves flushing to the OS page cache.
+	FsyncNever FsyncMode = "never"
+)
+
+const DefaultDataDir = "./wal"
+
+// DefaultMaxValueSize bounds a single value, larger ones are rejected with
+// custom_errors.ValueTooLargeError
+const DefaultMaxValueSize = 64 << 20
+
+type Options struct {
+	DataDir       string
+	FsyncMode     FsyncMode
+	FsyncInterval time.Duration
+	// MaxValueSize in bytes, 0 means DefaultMaxValueSize
+	MaxValueSize int
+	// DedupWindow is how long the request id of an applied write is
+	// remembered, 0 means DefaultDedupWindow and a negative value turns
+	// deduplication off. DedupMaxEntries 0 means DefaultDedupMaxEntries.
+	DedupWindow     time.Duration
+	DedupMaxEntries int
+	// Indexes are the secondary indexes the node maintains, see index.go
+	Indexes []Index
+	// TTL hides values older than it, measured from their version. Values
+	// without a version never expire, 0 keeps every value.
+	TTL time.Duration
+	// MaxBytes bounds the keys and live values the node holds, a write that
+	// would go over it fails with a ResourceExhaustedError. 0 means no limit.
+	MaxBytes int64
+	// Compression of values of at least CompressMinSize bytes in the WAL,
+	// CompressMinSize 0 means DefaultCompressMinSize. Keys encrypts the values
+	// with its active key, nil stores them in plain. See codec.go.
+	Compression     Compression
+	CompressMinSize int
+	Keys            *Keyring
+}
+
+func DefaultOptions() Options {
+	return Options{DataDir: DefaultDataDir, FsyncMode: FsyncAlways, FsyncInterval: time.Second, MaxValueSize: DefaultMaxValueSize,
+		DedupWindow: DefaultDedupWindow, DedupMaxEntries: DefaultDedupMaxEntries}
+}
+
 type parseLineError struct {
 	arg     string
 	message string
@@ -19,65 +87,255 @@ func (e *parseLineError) Error() string {
 	return fmt.Sprintf("%s - %s", e.arg, e.message)
 }
 
+var ErrClosed = errors.New("node is closed")
+
 type Node struct {
-	Name  string
-	items map[string]string
-	rwmu  *sync.RWMutex
-	file  *os.File
-}
-
-func (n *Node) Put(key, val string) error {
-	n.rwmu.Lock()
-	defer n.rwmu.Unlock()
-
-	encLen := base64.StdEncoding.EncodedLen(len(val))
-
-	// Şimdi buradaki sistemi şöyle anlatmak istiyorum
-	// Burada biz bellekte n limitli bir byte arrray oluşturuyoruz
-	// fakat şu anda hepsi boş yani capacity = n , len=0 durumunda
-	buf := make([]byte, 0, 4+len(key)+1+encLen+1)
-
-	// Append akıllı olduğu için len'i arttırıp içerisine yazıyor
-	// ve len değerini ileriye öteliyor ve artık oraya yazabiliyor düşünelim
-	// yani örnek key = foo ,se  aşağıda len=8 oluyor
-	buf = append(buf, 'S', 'E', 'T', ',')
-	buf = append(buf, key...)
-	buf = append(buf, ',')
-
-	// Ne yazıkki base64 append kadar akıllı değil
-	// Bunun sebebi base64 yazmak için var append allocate+yazmak
-	// O yüzden güncel yazdığmız alan len(buf)+encode edilmiş stringin boyutu
-	// kadar olan alanı 	buf = buf[:start+encLen] syntaxı ile claim ediyoruz
-	// Eğer bu işlemi yapmazsak veriyi yazarız fakat len değeri artmaz o yüzden
-	// 	buf = append(buf, '\n') değeri encoded değerin sonuna değil ilk karakterine yazılır
-	start := len(buf)
-	buf = buf[:start+encLen]
-	base64.StdEncoding.Encode(buf[start:], []byte(val))
-
-	buf = append(buf, '\n')
+	Name   string
+	shards [shardCount]shard
+	seed   maphash.Seed
+	// walmu guards file and closed, it is held for the append and the fsync
+	// but never together with a shard's read lock, see shard.go
+	walmu      *sync.Mutex
+	file       *os.File
+	opts       Options
+	closed     atomic.Bool
+	cleanStart bool
+	done       chan struct{}
+	dedup      *dedupWindow
+	clock      hlc.Clock
+	// indexes is fixed after NewWithOptions, only their contents change
+	indexes map[string]*index
+	// used is the size of the keys and live values, see Options.MaxBytes.
+	// maxBytes starts as Options.MaxBytes and is changed by SetMaxBytes.
+	used     atomic.Int64
+	maxBytes atomic.Int64
+	// backupmu lets one Backup run at a time, see backup.go
+	backupmu sync.Mutex
+}
 
-	c, err := n.file.Write(buf)
-	if err != nil {
+// Put keeps val without copying it, the caller must not modify it afterwards
+func (n *Node) Put(key string, val []byte) error {
+	return n.PutOnce("", key, val)
+}
+
+// PutOnce is Put for a write that may be retried. A requestID that was already
+// applied within the dedup window is acknowledged without writing the WAL
+// again, an empty requestID is never deduplicated.
+func (n *Node) PutOnce(requestID, key string, val []byte) error {
+	return n.Apply(Write{RequestID: requestID, Key: key, Value: val})
+}
+
+func (n *Node) Del(key string) error {
+	return n.DelOnce("", key)
+}
+
+// DelOnce is the Del counterpart of PutOnce
+func (n *Node) DelOnce(requestID, key string) error {
+	return n.Apply(Write{RequestID: requestID, Key: key, Delete: true})
+}
+
+// ValidKey rejects keys the WAL can't hold, it separates the fields of a
+// record with ',' and records with '\n'
+func ValidKey(key string) error {
+	if strings.ContainsAny(key, ",\n") {
+		return &custom_errors.ArgError{Arg: "key " + strconv.Quote(key), Message: "must not contain ',' or a newline"}
+	}
+	return nil
+}
+
+// Write is one versioned mutation, see Apply
+type Write struct {
+	RequestID string
+	Key       string
+	Value     []byte
+	Delete    bool
+	// Version orders the writes of a key across replicas and clusters, the
+	// higher one wins. 0 takes a version from the node's clock.
+	Version uint64
+}
+
+// Apply stores w unless the key already holds a newer version (last writer
+// wins). A write that lost is acknowledged without a WAL record, like a
+// duplicate request id, so replicas that see the same writes in a different
+// order end up with the same value. Deletes leave a versioned tombstone.
+// The secondary indexes follow the map, they are derived from the same
+// record and rebuilt from the WAL on restart.
+func (n *Node) Apply(w Write) error {
+	return n.ApplyContext(context.Background(), w)
+}
+
+// ApplyContext is Apply as a child of the span in ctx, it traces the WAL
+// append and the fsync
+func (n *Node) ApplyContext(ctx context.Context, w Write) (err error) {
+	ctx, span := tracer.Start(ctx, "node.Apply", trace.WithAttributes(attribute.String("kv.node", n.Name),
+		attribute.String("kv.key", w.Key), attribute.Bool("kv.delete", w.Delete), attribute.Int("kv.value_size", len(w.Value))))
+	defer func() { tracing.End(span, err) }()
+
+	if err := ValidKey(w.Key); err != nil {
 		return err
 	}
-	if c == 0 {
-		return fmt.Errorf("WAL write failed: wrote 0 bytes")
+	if !w.Delete && len(w.Value) > n.opts.MaxValueSize {
+		return &custom_errors.ValueTooLargeError{Key: w.Key, Size: len(w.Value), Max: n.opts.MaxValueSize}
 	}
-	if err := n.file.Sync(); err != nil {
+
+	sh := n.shardOf(w.Key)
+	sh.wmu.Lock()
+	defer sh.wmu.Unlock()
+	if n.closed.Load() {
+		return ErrClosed
+	}
+	if n.dedup.contains(w.RequestID) {
+		span.SetAttributes(attribute.Bool("kv.duplicate", true))
+		return nil
+	}
+
+	if w.Version == 0 {
+		w.Version = n.clock.Now()
+	} else {
+		n.clock.Observe(w.Version)
+	}
+	e := entry{val: w.Value, version: w.Version, deleted: w.Delete}
+	if w.Delete {
+		e.val = nil
+	}
+	// only wmu holders change the map, reading it here needs no lock
+	cur, had := sh.items[w.Key]
+	if had && !e.wins(cur) {
+		span.SetAttributes(attribute.Bool("kv.superseded", true))
+		n.dedup.add(w.RequestID)
+		return nil
+	}
+	grow := e.size(w.Key)
+	if had {
+		grow -= cur.size(w.Key)
+	}
+	// writers of other shards may grow it at the same time, the limit can be
+	// passed by the writes in flight
+	if used, limit := n.used.Load(), n.maxBytes.Load(); grow > 0 && limit > 0 && used+grow > limit {
+		return &custom_errors.ResourceExhaustedError{Resource: "storage of " + n.Name, Limit: limit,
+			Message: fmt.Sprintf("%d bytes are in use, the write of %s needs %d more", used, w.Key, grow)}
+	}
+
+	rec := Record{Key: w.Key, Delete: e.deleted, Version: e.version}
+	if !e.deleted {
+		sealed, c, err := n.seal(w.Key, e.version, e.val)
+		if err != nil {
+			return err
+		}
+		rec.Value, rec.Codec = sealed, c.String()
+		e.codec = rec.Codec
+	}
+	if err := n.appendWAL(ctx, rec.encode()); err != nil {
 		return err
 	}
 
-	n.items[key] = val
+	sh.mu.Lock()
+	sh.items[w.Key] = e
+	sh.mu.Unlock()
+	n.used.Add(grow)
+	n.reindex(w.Key, e)
+	n.dedup.add(w.RequestID)
 	return nil
 }
 
-func (n *Node) Del(key string) error {
-	n.rwmu.Lock()
-	defer n.rwmu.Unlock()
-	buf := make([]byte, 0, 4+len(key)+1)
-	buf = append(buf, 'D', 'E', 'L', ',')
-	buf = append(buf, key...)
-	buf = append(buf, '\n')
+// Get returns the stored slice itself, it must not be modified
+func (n *Node) Get(key string) ([]byte, bool) {
+	v, _, ok := n.GetVersion(key)
+	return v, ok
+}
+
+// GetVersion is Get with the version of the value. A deleted key reports the
+// version of its tombstone.
+func (n *Node) GetVersion(key string) ([]byte, uint64, bool) {
+
+	sh := n.shardOf(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, exist := sh.items[key]
+	if n.expired(e) {
+		return nil, e.version, false
+	}
+	return e.val, e.version, exist && !e.deleted
+}
+
+// expired reports whether e is older than the node's TTL. An expired value
+// reads like a tombstone of the same version, a newer write replaces it.
+func (n *Node) expired(e entry) bool {
+	return n.opts.TTL > 0 && !e.deleted && e.version != 0 && time.Since(hlc.Time(e.version)) > n.opts.TTL
+}
+
+// SetMaxBytes changes Options.MaxBytes of a running node. Lowering it below
+// UsedBytes only rejects writes that grow the node, deletes still free space.
+func (n *Node) SetMaxBytes(limit int64) error {
+	if limit < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("max bytes %d", limit), Message: "must not be negative"}
+	}
+	n.maxBytes.Store(limit)
+	return nil
+}
+
+// MaxBytes is the current storage limit, 0 means no limit
+func (n *Node) MaxBytes() int64 {
+	return n.maxBytes.Load()
+}
+
+// UsedBytes is the size of the keys and live values the node holds, expired
+// values count until they are overwritten or deleted
+func (n *Node) UsedBytes() int64 {
+	return n.used.Load()
+}
+
+// Scan calls fn for every key starting with prefix in key order, deleted keys
+// included. The keys are listed first and each value is read when its turn
+// comes, so writes during the scan may or may not be seen.
+func (n *Node) Scan(prefix string, fn func(key string, val []byte, version uint64, deleted bool) error) error {
+	var keys []string
+	for i := range n.shards {
+		sh := &n.shards[i]
+		sh.mu.RLock()
+		for k := range sh.items {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		sh := n.shardOf(k)
+		sh.mu.RLock()
+		e := sh.items[k]
+		sh.mu.RUnlock()
+		if n.expired(e) {
+			e = entry{version: e.version, deleted: true}
+		}
+		if err := fn(k, e.val, e.version, e.deleted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) MaxValueSize() int {
+	return n.opts.MaxValueSize
+}
+
+// appendWAL writes one encoded record and, depending on the fsync mode, flushes it
+// before returning. Memory may only change after it succeeded (ADR 0004).
+// The append span includes the wait for walmu, writers of other shards
+// fsyncing show up there.
+func (n *Node) appendWAL(ctx context.Context, buf []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "wal.append", trace.WithAttributes(attribute.Int("wal.bytes", len(buf))))
+	defer func() { tracing.End(span, err) }()
+
+	n.walmu.Lock()
+	defer n.walmu.Unlock()
+	span.AddEvent("wal.locked")
+	if n.closed.Load() {
+		return ErrClosed
+	}
 
 	c, err := n.file.Write(buf)
 	if err != nil {
@@ -86,46 +344,135 @@ func (n *Node) Del(key string) error {
 	if c == 0 {
 		return fmt.Errorf("WAL write failed: wrote 0 bytes")
 	}
+	return n.sync(ctx)
+}
 
-	if err = n.file.Sync(); err != nil {
-		return err
+// sync must be called with walmu held
+func (n *Node) sync(ctx context.Context) (err error) {
+	if n.opts.FsyncMode != FsyncAlways {
+		return nil
 	}
-
-	delete(n.items, key)
-
-	return nil
+	_, span := tracer.Start(ctx, "wal.fsync")
+	defer func() { tracing.End(span, err) }()
+	return n.file.Sync()
 }
 
-func (n *Node) Get(key string) (string, bool) {
-
-	n.rwmu.RLock()
-	defer n.rwmu.RUnlock()
-
-	v, exist := n.items[key]
-	return v, exist
+// syncLoop flushes the WAL periodically when FsyncMode is FsyncInterval
+func (n *Node) syncLoop() {
+	t := time.NewTicker(n.opts.FsyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-t.C:
+		}
+		n.walmu.Lock()
+		if !n.closed.Load() {
+			n.file.Sync()
+		}
+		n.walmu.Unlock()
+	}
 }
 
 func New(name string) (*Node, error) {
-	n := &Node{Name: name, items: make(map[string]string), rwmu: &sync.RWMutex{}}
+	return NewWithOptions(name, DefaultOptions())
+}
 
-	err := os.MkdirAll("./wal", 0755)
-	path := filepath.Join("./wal", name+".aof")
+func NewWithOptions(name string, opts Options) (*Node, error) {
+	if opts.DataDir == "" {
+		opts.DataDir = DefaultDataDir
+	}
+	if opts.FsyncMode == "" {
+		opts.FsyncMode = FsyncAlways
+	}
+	if opts.MaxValueSize == 0 {
+		opts.MaxValueSize = DefaultMaxValueSize
+	}
+	if opts.MaxValueSize < 0 {
+		return nil, &custom_errors.ArgError{Arg: fmt.Sprint(opts.MaxValueSize), Message: "max value size must be positive"}
+	}
+	if opts.DedupWindow == 0 {
+		opts.DedupWindow = DefaultDedupWindow
+	}
+	if opts.DedupMaxEntries == 0 {
+		opts.DedupMaxEntries = DefaultDedupMaxEntries
+	}
+	if opts.TTL < 0 || opts.MaxBytes < 0 {
+		return nil, &custom_errors.ArgError{Arg: fmt.Sprintf("ttl %v max bytes %d", opts.TTL, opts.MaxBytes), Message: "must not be negative"}
+	}
+	if err := opts.Compression.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.CompressMinSize == 0 {
+		opts.CompressMinSize = DefaultCompressMinSize
+	}
+	if opts.DedupMaxEntries < 0 {
+		return nil, &custom_errors.ArgError{Arg: fmt.Sprint(opts.DedupMaxEntries), Message: "dedup max entries must be positive"}
+	}
+	switch opts.FsyncMode {
+	case FsyncAlways, FsyncNever:
+	case FsyncInterval:
+		if opts.FsyncInterval <= 0 {
+			return nil, &custom_errors.ArgError{Arg: fmt.Sprint(opts.FsyncInterval), Message: "fsync interval must be positive"}
+		}
+	default:
+		return nil, &custom_errors.ArgError{Arg: string(opts.FsyncMode), Message: "unknown fsync mode"}
+	}
+
+	n := &Node{Name: name, seed: maphash.MakeSeed(), walmu: &sync.Mutex{}, opts: opts, done: make(chan struct{}),
+		dedup: newDedupWindow(opts.DedupWindow, opts.DedupMaxEntries), indexes: make(map[string]*index)}
+	n.maxBytes.Store(opts.MaxBytes)
+	for i := range n.shards {
+		n.shards[i].items = make(map[string]entry)
+	}
+	for _, ix := range opts.Indexes {
+		if err := ix.Validate(); err != nil {
+			return nil, err
+		}
+		if _, dup := n.indexes[ix.Name]; dup {
+			return nil, &custom_errors.ArgError{Arg: "index " + ix.Name, Message: "is declared twice"}
+		}
+		n.indexes[ix.Name] = newIndex(ix)
+	}
+
+	err := os.MkdirAll(opts.DataDir, 0755)
+	path := n.Path()
 
 	if err != nil {
 		return nil, err
 	}
 
+	// Marker varsa önceki kapanış Close ile yapılmış demektir, log'un sonu sağlam.
+	// Yoksa crash olmuş olabilir, son kayıt yarım yazılmış olabilir o yüzden
+	// replay toleranslı yapılıp yarım kalan kuyruk kesiliyor
+	if _, err := os.Stat(n.markerPath()); err == nil {
+		n.cleanStart = true
+		if err := os.Remove(n.markerPath()); err != nil {
+			return nil, err
+		}
+	}
+
 	readFile, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0755)
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = setMap(n, readFile)
+	valid, err := replay(n, readFile, n.cleanStart)
+	readFile.Close()
 	if err != nil {
 		return nil, err
 	}
-	readFile.Close()
+	if err := n.openReplayed(); err != nil {
+		return nil, err
+	}
+
+	if !n.cleanStart {
+		if err := truncateTail(path, valid); err != nil {
+			return nil, err
+		}
+	}
 
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
 
@@ -134,38 +481,148 @@ func New(name string) (*Node, error) {
 	}
 
 	n.file = f
+	if opts.FsyncMode == FsyncInterval {
+		go n.syncLoop()
+	}
 	return n, nil
 }
 
-func setMap(n *Node, f *os.File) error {
+// CleanStart reports whether the previous run ended with Close, in which case
+// the tail repair during recovery was skipped.
+func (n *Node) CleanStart() bool {
+	return n.cleanStart
+}
+
+// Close flushes and fsyncs the WAL, closes it and leaves a clean shutdown
+// marker so the next start can trust the log tail. Writes after Close fail
+// with ErrClosed.
+func (n *Node) Close() error {
+	n.walmu.Lock()
+	defer n.walmu.Unlock()
 
-	scanner := bufio.NewScanner(f)
+	if n.closed.Load() {
+		return nil
+	}
+	n.closed.Store(true)
+	close(n.done)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		vals := strings.Split(line, ",")
+	if err := n.file.Sync(); err != nil {
+		n.file.Close()
+		return err
+	}
+	if err := n.file.Close(); err != nil {
+		return err
+	}
 
-		if len(vals) == 0 {
-			return &parseLineError{arg: "strings.Split(line,\",\")", message: "Failed to extract line"}
-		}
+	m, err := os.Create(n.markerPath())
+	if err != nil {
+		return err
+	}
+	if err := m.Sync(); err != nil {
+		m.Close()
+		return err
+	}
+	return m.Close()
+}
 
-		if strings.ToUpper(vals[0]) == "SET" && len(vals) == 3 {
-			dval, err := base64.StdEncoding.DecodeString(vals[2])
+// Kill simulates a crash: the WAL is closed without a final fsync and without
+// the clean shutdown marker, so the next start runs the tail repair. Meant for
+// tests and fault injection.
+func (n *Node) Kill() error {
+	n.walmu.Lock()
+	defer n.walmu.Unlock()
 
-			if err != nil {
-				return err
-			}
-			n.items[vals[1]] = string(dval)
+	if n.closed.Load() {
+		return nil
+	}
+	n.closed.Store(true)
+	close(n.done)
+	return n.file.Close()
+}
 
-		} else if strings.ToUpper(vals[0]) == "DEL" && len(vals) == 2 {
-			delete(n.items, vals[1])
-		} else {
-			return &parseLineError{arg: "SET or DEL Insufficient val", message: "Failed to parse line"}
+// Path returns the WAL file of the node
+func (n *Node) Path() string {
+	return filepath.Join(n.opts.DataDir, n.Name+".aof")
+}
 
+func (n *Node) markerPath() string {
+	return filepath.Join(n.opts.DataDir, n.Name+".clean")
+}
+
+// replay reads the WAL into memory and returns the size of its valid prefix.
+// When strict is false a torn or corrupt last record, which is what a crash in
+// the middle of a write leaves behind, is dropped instead of failing recovery.
+// Damage anywhere else in the log is always an error.
+func replay(n *Node, f *os.File, strict bool) (int64, error) {
+	r := bufio.NewReader(f)
+	var off int64
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if line != "" && strict {
+				return off, &parseLineError{arg: line, message: "Last record is not terminated"}
+			}
+			return off, nil
 		}
+		if err != nil {
+			return off, err
+		}
+
+		if err := applyLine(n, strings.TrimSuffix(line, "\n")); err != nil {
+			if _, peekErr := r.Peek(1); !strict && peekErr == io.EOF {
+				return off, nil
+			}
+			return off, err
+		}
+		off += int64(len(line))
 	}
-	if err := scanner.Err(); err != nil {
+}
+
+func truncateTail(path string, valid int64) error {
+	st, err := os.Stat(path)
+	if err != nil {
 		return err
 	}
+	if st.Size() == valid {
+		return nil
+	}
+	log.Printf("%s: dropping %d bytes of torn WAL tail", path, st.Size()-valid)
+	return os.Truncate(path, valid)
+}
+
+func applyLine(n *Node, line string) error {
+	rec, err := ParseRecord(line)
+	if err != nil {
+		return err
+	}
+	// only winning writes are logged, so the log order is the version order.
+	// The value stays as stored until openReplayed, records that were
+	// overwritten are never decoded.
+	n.shardOf(rec.Key).items[rec.Key] = entry{val: rec.Value, version: rec.Version, deleted: rec.Delete, codec: rec.Codec}
+	n.clock.Observe(rec.Version)
+	return nil
+}
+
+// openReplayed decodes the values replay left as stored and counts and
+// indexes them. A key that no live value uses can be removed from the key
+// file, the records it encrypted are all overwritten.
+func (n *Node) openReplayed() error {
+	for i := range n.shards {
+		for key, e := range n.shards[i].items {
+			if e.codec != "" && !e.deleted {
+				c, err := parseCodec(e.codec)
+				if err != nil {
+					return err
+				}
+				if e.val, err = openValue(n.opts.Keys, c, key, e.version, e.val, n.opts.MaxValueSize); err != nil {
+					return err
+				}
+				n.shards[i].items[key] = e
+			}
+			n.used.Add(e.size(key))
+			n.reindex(key, e)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,288 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+func newNode(t *testing.T, dir string) *Node {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.DataDir = dir
+	n, err := NewWithOptions("n1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// A write stuck in the WAL must not block readers, not even of the same key.
+func TestReadsDoNotWaitForWAL(t *testing.T) {
+	n := newNode(t, t.TempDir())
+	defer n.Close()
+	if err := n.Put("k", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// hold the WAL like a slow fsync would
+	n.walmu.Lock()
+	done := make(chan error)
+	go func() { done <- n.Put("k", []byte("v2")) }()
+
+	got := make(chan string)
+	go func() {
+		v, _ := n.Get("k")
+		got <- string(v)
+	}()
+	select {
+	case v := <-got:
+		if v != "v1" {
+			t.Errorf("Expected v1 before the write is durable, but got %s", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Get to return while a write waits for the WAL")
+	}
+
+	n.walmu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := n.Get("k"); string(v) != "v2" {
+		t.Errorf("Expected v2 after the write, but got %s", v)
+	}
+}
+
+// Writers of the same key must reach the WAL and the map in the same order,
+// otherwise a restart would bring back a different value.
+func TestMemoryMatchesWALUnderConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	n := newNode(t, dir)
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				key := fmt.Sprint("key-", i%4)
+				var err error
+				if i%7 == 0 {
+					err = n.Del(key)
+				} else {
+					err = n.Put(key, []byte(fmt.Sprintf("w%d-%d", w, i)))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	before := map[string]string{}
+	for i := range 4 {
+		key := fmt.Sprint("key-", i)
+		if v, ok := n.Get(key); ok {
+			before[key] = string(v)
+		}
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n = newNode(t, dir)
+	defer n.Close()
+	for i := range 4 {
+		key := fmt.Sprint("key-", i)
+		v, ok := n.Get(key)
+		if want, had := before[key]; ok != had || string(v) != want {
+			t.Errorf("Expected %s=%q (present %v) after replay, but got %q (present %v)", key, want, had, v, ok)
+		}
+	}
+}
+
+// Replicas and clusters may receive the writes of a key in any order, the
+// highest version has to win everywhere.
+func TestOlderVersionLoses(t *testing.T) {
+	dir := t.TempDir()
+	n := newNode(t, dir)
+
+	writes := []Write{
+		{Key: "k", Value: []byte("new"), Version: 20},
+		{Key: "k", Value: []byte("old"), Version: 10},
+		{Key: "k", Delete: true, Version: 15},
+	}
+	for _, w := range writes {
+		if err := n.Apply(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, version, ok := n.GetVersion("k"); !ok || string(v) != "new" || version != 20 {
+		t.Errorf("Expected new at version 20, but got %q at %d (present %v)", v, version, ok)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := os.ReadFile(filepath.Join(dir, "n1.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := strings.Count(string(wal), "\n"); c != 1 {
+		t.Errorf("Expected only the winning write in the WAL, but got %d records", c)
+	}
+}
+
+// Logs written before versions existed have no version field
+func TestReplaysUnversionedWAL(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "n1.aof"), []byte("SET,a,djE=\nSET,b,djI=\nDEL,a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n := newNode(t, dir)
+	defer n.Close()
+
+	if _, ok := n.Get("a"); ok {
+		t.Errorf("Expected a to be deleted")
+	}
+	if v, _ := n.Get("b"); string(v) != "v2" {
+		t.Errorf("Expected b=v2, but got %q", v)
+	}
+	if err := n.Put("b", []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	if v, version, _ := n.GetVersion("b"); string(v) != "v3" || version == 0 {
+		t.Errorf("Expected a versioned v3 to replace the old record, but got %q at %d", v, version)
+	}
+}
+
+// A value older than the TTL reads like a tombstone, the quota rejects
+// writes that grow the node past it and counts deletes as freeing space
+func TestTTLAndQuota(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.TTL = time.Hour
+	opts.MaxBytes = 10
+	n, err := NewWithOptions("n1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	old := uint64(time.Now().Add(-2 * time.Hour).UnixNano())
+	if err := n.Apply(Write{Key: "a", Value: []byte("1234"), Version: old}); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, found := n.GetVersion("a"); found || version != old {
+		t.Errorf("Expected a to be expired at version %d but got found=%v version=%d", old, found, version)
+	}
+	if err := n.Put("b", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := n.Get("b"); !found {
+		t.Error("Expected b to be found but it wasn't")
+	}
+
+	err = n.Put("c", []byte("1234"))
+	var re *custom_errors.ResourceExhaustedError
+	if !errors.As(err, &re) || re.Limit != 10 {
+		t.Fatalf("Expected a ResourceExhaustedError with limit 10 but got %v", err)
+	}
+	if got := n.UsedBytes(); got != 10 {
+		t.Errorf("Expected 10 used bytes but got %d", got)
+	}
+	if err := n.Del("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Put("c", []byte("1234")); err != nil {
+		t.Errorf("Expected the delete of a to make room for c but got %v", err)
+	}
+}
+
+// After Close the WAL is replayed strictly, after a crash a torn or corrupt
+// last record is cut off. Damage before the last record fails both.
+func TestCleanMarkerAndTornTail(t *testing.T) {
+	dir := t.TempDir()
+	n := newNode(t, dir)
+	if err := n.Put("a", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n = newNode(t, dir)
+	if !n.CleanStart() {
+		t.Errorf("Expected a clean start after Close")
+	}
+	if v, _ := n.Get("a"); string(v) != "v1" {
+		t.Errorf("Expected a=v1 after a clean start, but got %q", v)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := n.Path()
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the marker promises an intact tail, so a torn one is not repaired
+	if err := os.WriteFile(path, append(bytes.Clone(valid), "SET,b,dj"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions("n1", Options{DataDir: dir}); err == nil {
+		t.Errorf("Expected an unterminated record after Close to fail the strict replay")
+	}
+
+	cases := []struct {
+		name string
+		tail string
+		ok   bool
+	}{
+		{"unterminated", "SET,b,djI=", true},
+		{"corrupt last", "SET,b,not base64!\n", true},
+		{"corrupt middle", "garbage\nSET,b,djI=\n", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// no marker: the previous run crashed
+			os.Remove(filepath.Join(dir, "n1.clean"))
+			if err := os.WriteFile(path, append(bytes.Clone(valid), c.tail...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			n, err := NewWithOptions("n1", Options{DataDir: dir})
+			if !c.ok {
+				if err == nil {
+					n.Close()
+					t.Fatalf("Expected a corrupt record before the tail to fail recovery")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer n.Close()
+			if n.CleanStart() {
+				t.Errorf("Expected no clean start without the marker")
+			}
+			if v, _ := n.Get("a"); string(v) != "v1" {
+				t.Errorf("Expected a=v1 to survive the repair, but got %q", v)
+			}
+			if _, ok := n.Get("b"); ok {
+				t.Errorf("Expected the torn record of b to be dropped")
+			}
+			if st, err := os.Stat(path); err != nil || st.Size() != int64(len(valid)) {
+				t.Errorf("Expected the WAL to be cut to %d bytes, but got %v %v", len(valid), st.Size(), err)
+			}
+		})
+	}
+}
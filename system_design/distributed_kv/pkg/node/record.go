@@ -0,0 +1,146 @@
+package node
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Record is one WAL entry: `SET,key,base64,version` or `DEL,key,version`.
+// Logs written before versions existed have no version field, their records
+// read as version 0. A compressed or encrypted value adds its codec,
+// `SET,key,base64,version,zstd+aes:k2`, and Value holds it as stored, see
+// Decode.
+type Record struct {
+	Key     string
+	Value   []byte
+	Delete  bool
+	Version uint64
+	Codec   string
+}
+
+func (r Record) encode() []byte {
+	if r.Delete {
+		buf := make([]byte, 0, 4+len(r.Key)+1+20+1)
+		buf = append(buf, 'D', 'E', 'L', ',')
+		buf = append(buf, r.Key...)
+		buf = append(buf, ',')
+		buf = strconv.AppendUint(buf, r.Version, 10)
+		return append(buf, '\n')
+	}
+
+	encLen := base64.StdEncoding.EncodedLen(len(r.Value))
+
+	// Şimdi buradaki sistemi şöyle anlatmak istiyorum
+	// Burada biz bellekte n limitli bir byte arrray oluşturuyoruz
+	// fakat şu anda hepsi boş yani capacity = n , len=0 durumunda
+	buf := make([]byte, 0, 4+len(r.Key)+1+encLen+1+20+1+len(r.Codec)+1)
+
+	// Append akıllı olduğu için len'i arttırıp içerisine yazıyor
+	// ve len değerini ileriye öteliyor ve artık oraya yazabiliyor düşünelim
+	// yani örnek key = foo ,se  aşağıda len=8 oluyor
+	buf = append(buf, 'S', 'E', 'T', ',')
+	buf = append(buf, r.Key...)
+	buf = append(buf, ',')
+
+	// Ne yazıkki base64 append kadar akıllı değil
+	// Bunun sebebi base64 yazmak için var append allocate+yazmak
+	// O yüzden güncel yazdığmız alan len(buf)+encode edilmiş stringin boyutu
+	// kadar olan alanı 	buf = buf[:start+encLen] syntaxı ile claim ediyoruz
+	// Eğer bu işlemi yapmazsak veriyi yazarız fakat len değeri artmaz o yüzden
+	// 	buf = append(buf, '\n') değeri encoded değerin sonuna değil ilk karakterine yazılır
+	start := len(buf)
+	buf = buf[:start+encLen]
+	base64.StdEncoding.Encode(buf[start:], r.Value)
+
+	buf = append(buf, ',')
+	buf = strconv.AppendUint(buf, r.Version, 10)
+	if r.Codec != "" {
+		buf = append(buf, ',')
+		buf = append(buf, r.Codec...)
+	}
+	buf = append(buf, '\n')
+	return buf
+}
+
+// ParseRecord parses one WAL line without the trailing newline
+func ParseRecord(line string) (Record, error) {
+	vals := strings.Split(line, ",")
+
+	if len(vals) == 0 {
+		return Record{}, &parseLineError{arg: "strings.Split(line,\",\")", message: "Failed to extract line"}
+	}
+
+	var rec Record
+	var version string
+	switch op := strings.ToUpper(vals[0]); {
+	case op == "SET" && len(vals) >= 3 && len(vals) <= 5:
+		dval, err := base64.StdEncoding.DecodeString(vals[2])
+		if err != nil {
+			return Record{}, err
+		}
+		rec = Record{Key: vals[1], Value: dval}
+		if len(vals) >= 4 {
+			version = vals[3]
+		}
+		if len(vals) == 5 {
+			if _, err := parseCodec(vals[4]); err != nil || vals[4] == "" {
+				return Record{}, &parseLineError{arg: vals[4], message: "unknown value codec"}
+			}
+			rec.Codec = vals[4]
+		}
+	case op == "DEL" && (len(vals) == 2 || len(vals) == 3):
+		rec = Record{Key: vals[1], Delete: true}
+		if len(vals) == 3 {
+			version = vals[2]
+		}
+	default:
+		return Record{}, &parseLineError{arg: "SET or DEL Insufficient val", message: "Failed to parse line"}
+	}
+
+	if version != "" {
+		v, err := strconv.ParseUint(version, 10, 64)
+		if err != nil {
+			return Record{}, &parseLineError{arg: version, message: "Version is not a number"}
+		}
+		rec.Version = v
+	}
+	return rec, nil
+}
+
+// ReadWAL calls fn for every complete record of the WAL at path from byte
+// offset off on, with the offset of the next record. It stops at a record
+// that is still being written and returns the offset to continue from, so a
+// running node's log can be followed by calling it again.
+func ReadWAL(path string, off int64, fn func(rec Record, next int64) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return off, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return off, err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+		rec, err := ParseRecord(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return off, err
+		}
+		if err := fn(rec, off+int64(len(line))); err != nil {
+			return off, err
+		}
+		off += int64(len(line))
+	}
+}
@@ -0,0 +1,53 @@
+package node
+
+import (
+	"bytes"
+	"hash/maphash"
+	"sync"
+)
+
+// shardCount is the number of independently locked parts of the in-memory index
+const shardCount = 64
+
+// shard is one part of the in-memory index. wmu serializes the writers of
+// the shard across the WAL append, so the records of a key reach the log and
+// the map in the same order. mu is only held for the map access itself, so
+// readers never wait for a disk write.
+type shard struct {
+	wmu   sync.Mutex
+	mu    sync.RWMutex
+	items map[string]entry
+}
+
+// entry is the current value of a key, or its tombstone when deleted. val is
+// always the plain value, codec is how its WAL record stores it.
+type entry struct {
+	val     []byte
+	version uint64
+	deleted bool
+	codec   string
+}
+
+// wins reports whether e replaces cur. Equal versions are broken the same way
+// on every replica: a delete wins, then the larger value.
+func (e entry) wins(cur entry) bool {
+	if e.version != cur.version {
+		return e.version > cur.version
+	}
+	if e.deleted != cur.deleted {
+		return e.deleted
+	}
+	return bytes.Compare(e.val, cur.val) > 0
+}
+
+// size is what e counts against Options.MaxBytes
+func (e entry) size(key string) int64 {
+	if e.deleted {
+		return 0
+	}
+	return int64(len(key) + len(e.val))
+}
+
+func (n *Node) shardOf(key string) *shard {
+	return &n.shards[maphash.String(n.seed, key)%shardCount]
+}
@@ -0,0 +1,629 @@
+package resp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/ring"
+)
+
+type command struct {
+	// arity counts the command name too, negative means at least -arity
+	arity int
+	// noAuth commands run before AUTH
+	noAuth bool
+	fn     func(c *conn, args [][]byte) (quit bool)
+}
+
+var commands = map[string]command{
+	"PING":        {arity: -1, noAuth: true, fn: ping},
+	"ECHO":        {arity: 2, fn: echo},
+	"HELLO":       {arity: -1, noAuth: true, fn: hello},
+	"AUTH":        {arity: -2, noAuth: true, fn: authCmd},
+	"QUIT":        {arity: -1, noAuth: true, fn: quit},
+	"SELECT":      {arity: 2, fn: selectDB},
+	"CLIENT":      {arity: -2, fn: client},
+	"COMMAND":     {arity: -1, fn: commandCmd},
+	"INFO":        {arity: -1, fn: info},
+	"CONSISTENCY": {arity: -1, fn: consistency},
+	"GET":         {arity: 2, fn: get},
+	"SET":         {arity: -3, fn: set},
+	"DEL":         {arity: -2, fn: del},
+	"EXISTS":      {arity: -2, fn: exists},
+	"TYPE":        {arity: 2, fn: typeCmd},
+	"MGET":        {arity: -2, fn: mget},
+	"MSET":        {arity: -3, fn: mset},
+	"EXPIRE":      {arity: -3, fn: expireCmd(time.Second)},
+	"PEXPIRE":     {arity: -3, fn: expireCmd(time.Millisecond)},
+	"TTL":         {arity: 2, fn: ttlCmd(time.Second)},
+	"PTTL":        {arity: 2, fn: ttlCmd(time.Millisecond)},
+	"PERSIST":     {arity: 2, fn: persist},
+	"SCAN":        {arity: -2, fn: scan},
+}
+
+var errSyntax = errors.New("syntax error")
+
+// checkKey rejects keys the front-end can't store, see node.ValidKey for the
+// ones the nodes reject
+func checkKey(key string) error {
+	if strings.HasPrefix(key, internalPrefix) {
+		return &custom_errors.ArgError{Arg: "key " + strconv.Quote(key), Message: "uses a prefix reserved by the Redis front-end"}
+	}
+	return nil
+}
+
+func ping(c *conn, args [][]byte) bool {
+	switch {
+	case len(args) > 2:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	case len(args) == 2:
+		c.w.bulk(args[1])
+	default:
+		c.w.simple("PONG")
+	}
+	return false
+}
+
+func echo(c *conn, args [][]byte) bool {
+	c.w.bulk(args[1])
+	return false
+}
+
+func quit(c *conn, args [][]byte) bool {
+	c.w.simple("OK")
+	return true
+}
+
+// hello switches the protocol version: HELLO [protover [AUTH user pass] [SETNAME name]]
+func hello(c *conn, args [][]byte) bool {
+	proto := c.w.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil || v < 2 || v > 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return false
+		}
+		proto = v
+	}
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "AUTH" && i+2 < len(args):
+			if !c.auth(args[i+2]) {
+				return false
+			}
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			name = string(args[i+1])
+			i++
+		default:
+			c.w.error("ERR syntax error in HELLO option '" + clean(opt) + "'")
+			return false
+		}
+	}
+	if !c.authed {
+		c.w.error("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return false
+	}
+	c.w.proto, c.name = proto, name
+
+	c.w.mapHeader(7)
+	c.w.bulkString("server")
+	c.w.bulkString("toy_dynamodb")
+	c.w.bulkString("version")
+	c.w.bulkString("7.2.0")
+	c.w.bulkString("proto")
+	c.w.int(int64(proto))
+	c.w.bulkString("id")
+	c.w.int(c.id)
+	c.w.bulkString("mode")
+	c.w.bulkString("standalone")
+	c.w.bulkString("role")
+	c.w.bulkString("master")
+	c.w.bulkString("modules")
+	c.w.array(0)
+	return false
+}
+
+// authCmd takes AUTH password and AUTH username password, the username is
+// ignored
+func authCmd(c *conn, args [][]byte) bool {
+	if len(args) > 3 {
+		c.w.error("ERR syntax error")
+		return false
+	}
+	if c.auth(args[len(args)-1]) {
+		c.w.simple("OK")
+	}
+	return false
+}
+
+// auth checks password and answers when it is wrong
+func (c *conn) auth(password []byte) bool {
+	if c.s.Password == "" {
+		c.w.error("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return false
+	}
+	if subtle.ConstantTimeCompare(password, []byte(c.s.Password)) != 1 {
+		c.w.error("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+	c.authed = true
+	return true
+}
+
+// selectDB only knows database 0, the cluster has one keyspace
+func selectDB(c *conn, args [][]byte) bool {
+	if string(args[1]) != "0" {
+		c.w.error("ERR DB index is out of range")
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
+
+// client answers what client libraries send when they connect
+func client(c *conn, args [][]byte) bool {
+	switch strings.ToUpper(string(args[1])) {
+	case "SETNAME":
+		if len(args) != 3 {
+			c.w.error("ERR wrong number of arguments for 'client|setname' command")
+			return false
+		}
+		c.name = string(args[2])
+		c.w.simple("OK")
+	case "GETNAME":
+		if c.name == "" {
+			c.w.null()
+		} else {
+			c.w.bulkString(c.name)
+		}
+	case "ID":
+		c.w.int(c.id)
+	case "SETINFO":
+		c.w.simple("OK")
+	default:
+		c.w.error("ERR unknown subcommand '" + clean(string(args[1])) + "'")
+	}
+	return false
+}
+
+// commandCmd has no command docs to offer, redis-cli asks on start
+func commandCmd(c *conn, args [][]byte) bool {
+	c.w.array(0)
+	return false
+}
+
+func info(c *conn, args [][]byte) bool {
+	c.w.bulkString("# Server\r\nredis_version:7.2.0\r\nredis_mode:standalone\r\nconsistency:" + string(c.level) + "\r\n")
+	return false
+}
+
+// consistency reads or changes the level of this connection:
+// CONSISTENCY [one|quorum|all]
+func consistency(c *conn, args [][]byte) bool {
+	switch len(args) {
+	case 1:
+		c.w.bulkString(string(c.level))
+	case 2:
+		if err := c.setLevel(ring.Consistency(strings.ToLower(string(args[1])))); err != nil {
+			c.fail(err)
+			return false
+		}
+		c.w.simple("OK")
+	default:
+		c.w.error("ERR wrong number of arguments for 'consistency' command")
+	}
+	return false
+}
+
+func get(c *conn, args [][]byte) bool {
+	it, found, err := c.lookup(string(args[1]))
+	switch {
+	case err != nil:
+		c.fail(err)
+	case !found:
+		c.w.null()
+	default:
+		c.w.bulk(it.Value)
+	}
+	return false
+}
+
+type setOptions struct {
+	nx, xx, get, keepTTL bool
+	// expires is zero without EX, PX, EXAT or PXAT
+	expires time.Time
+}
+
+func parseSetOptions(args [][]byte) (setOptions, error) {
+	var o setOptions
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX":
+			o.nx = true
+		case "XX":
+			o.xx = true
+		case "GET":
+			o.get = true
+		case "KEEPTTL":
+			o.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 == len(args) || !o.expires.IsZero() {
+				return o, errSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				return o, errors.New("invalid expire time in 'set' command")
+			}
+			o.expires = deadline(opt, n)
+		default:
+			return o, errSyntax
+		}
+	}
+	if o.nx && o.xx || o.keepTTL && !o.expires.IsZero() {
+		return o, errSyntax
+	}
+	return o, nil
+}
+
+func deadline(opt string, n int64) time.Time {
+	switch opt {
+	case "EX":
+		return time.Now().Add(time.Duration(min(n, math.MaxInt64/int64(time.Second))) * time.Second)
+	case "PX":
+		return time.Now().Add(time.Duration(min(n, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond)
+	case "EXAT":
+		return time.Unix(n, 0)
+	}
+	return time.UnixMilli(n)
+}
+
+// set is SET key value [NX|XX] [GET] [EX s|PX ms|EXAT ts|PXAT ts|KEEPTTL].
+// NX, XX, GET and KEEPTTL read the key first, the read and the write aren't
+// atomic.
+func set(c *conn, args [][]byte) bool {
+	key := string(args[1])
+	o, err := parseSetOptions(args[3:])
+	if err != nil {
+		c.w.error("ERR " + err.Error())
+		return false
+	}
+	if err := checkKey(key); err != nil {
+		c.fail(err)
+		return false
+	}
+
+	var old item
+	var found bool
+	if o.nx || o.xx || o.get || o.keepTTL {
+		if old, found, err = c.lookup(key); err != nil {
+			c.fail(err)
+			return false
+		}
+	}
+	if o.nx && found || o.xx && !found {
+		if o.get && found {
+			c.w.bulk(old.Value)
+		} else {
+			c.w.null()
+		}
+		return false
+	}
+
+	version := c.s.clock.Now()
+	if err := c.write(ring.Mutation{Key: key, Value: args[2], Version: version}); err != nil {
+		c.fail(err)
+		return false
+	}
+	if o.keepTTL && !old.expires.IsZero() {
+		o.expires = old.expires
+	}
+	if !o.expires.IsZero() {
+		if err := c.setExpiry(key, version, o.expires); err != nil {
+			c.fail(err)
+			return false
+		}
+	}
+
+	switch {
+	case o.get && found:
+		c.w.bulk(old.Value)
+	case o.get:
+		c.w.null()
+	default:
+		c.w.simple("OK")
+	}
+	return false
+}
+
+// each runs fn for every key in parallel and returns the first error
+func each(keys [][]byte, fn func(i int, key string) error) error {
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, string(key))
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// del deletes every key, also those no replica of the read quorum has, and
+// counts the ones that existed
+func del(c *conn, args [][]byte) bool {
+	existed := make([]bool, len(args)-1)
+	err := each(args[1:], func(i int, key string) error {
+		it, found, err := c.lookup(key)
+		if err != nil {
+			return err
+		}
+		existed[i] = found
+		if err := c.write(ring.Mutation{Key: key, Delete: true}); err != nil {
+			return err
+		}
+		if !it.expires.IsZero() {
+			return c.clearExpiry(key)
+		}
+		return nil
+	})
+	if err != nil {
+		c.fail(err)
+		return false
+	}
+	c.w.int(count(existed))
+	return false
+}
+
+// exists counts a key as often as it is named, like Redis
+func exists(c *conn, args [][]byte) bool {
+	found := make([]bool, len(args)-1)
+	err := each(args[1:], func(i int, key string) (err error) {
+		_, found[i], err = c.lookup(key)
+		return err
+	})
+	if err != nil {
+		c.fail(err)
+		return false
+	}
+	c.w.int(count(found))
+	return false
+}
+
+func count(bs []bool) int64 {
+	var n int64
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+func typeCmd(c *conn, args [][]byte) bool {
+	_, found, err := c.lookup(string(args[1]))
+	switch {
+	case err != nil:
+		c.fail(err)
+	case found:
+		c.w.simple("string")
+	default:
+		c.w.simple("none")
+	}
+	return false
+}
+
+func mget(c *conn, args [][]byte) bool {
+	items := make([]item, len(args)-1)
+	found := make([]bool, len(args)-1)
+	err := each(args[1:], func(i int, key string) (err error) {
+		items[i], found[i], err = c.lookup(key)
+		return err
+	})
+	if err != nil {
+		c.fail(err)
+		return false
+	}
+	c.w.array(len(items))
+	for i, it := range items {
+		if found[i] {
+			c.w.bulk(it.Value)
+		} else {
+			c.w.null()
+		}
+	}
+	return false
+}
+
+// mset writes the pairs in parallel. It isn't atomic, after an error some of
+// them may be written.
+func mset(c *conn, args [][]byte) bool {
+	if len(args)%2 == 0 {
+		c.w.error("ERR wrong number of arguments for 'mset' command")
+		return false
+	}
+	keys := make([][]byte, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		if err := checkKey(string(args[i])); err != nil {
+			c.fail(err)
+			return false
+		}
+		keys = append(keys, args[i])
+	}
+	err := each(keys, func(i int, key string) error {
+		return c.write(ring.Mutation{Key: key, Value: args[2+2*i]})
+	})
+	if err != nil {
+		c.fail(err)
+		return false
+	}
+	c.w.simple("OK")
+	return false
+}
+
+// expireCmd is EXPIRE and PEXPIRE: key ttl [NX|XX|GT|LT]
+func expireCmd(unit time.Duration) func(*conn, [][]byte) bool {
+	return func(c *conn, args [][]byte) bool {
+		key := string(args[1])
+		n, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			c.w.error("ERR value is not an integer or out of range")
+			return false
+		}
+		var cond string
+		switch len(args) {
+		case 3:
+		case 4:
+			cond = strings.ToUpper(string(args[3]))
+			if cond != "NX" && cond != "XX" && cond != "GT" && cond != "LT" {
+				c.w.error("ERR Unsupported option " + clean(string(args[3])))
+				return false
+			}
+		default:
+			c.w.error("ERR syntax error")
+			return false
+		}
+
+		it, found, err := c.lookup(key)
+		if err != nil {
+			c.fail(err)
+			return false
+		}
+		at := time.Now().Add(time.Duration(min(n, math.MaxInt64/int64(unit))) * unit)
+		// no deadline counts as an infinite one for GT and LT
+		has := !it.expires.IsZero()
+		if !found || cond == "NX" && has || cond == "XX" && !has ||
+			cond == "GT" && (!has || !at.After(it.expires)) || cond == "LT" && has && !at.Before(it.expires) {
+			c.w.int(0)
+			return false
+		}
+
+		if n <= 0 {
+			err = c.write(ring.Mutation{Key: key, Delete: true, Version: it.Version})
+			if err == nil && has {
+				err = c.clearExpiry(key)
+			}
+		} else {
+			err = c.setExpiry(key, it.Version, at)
+		}
+		if err != nil {
+			c.fail(err)
+			return false
+		}
+		c.w.int(1)
+		return false
+	}
+}
+
+// ttlCmd is TTL and PTTL: -2 for a missing key, -1 for one without deadline
+func ttlCmd(unit time.Duration) func(*conn, [][]byte) bool {
+	return func(c *conn, args [][]byte) bool {
+		it, found, err := c.lookup(string(args[1]))
+		switch {
+		case err != nil:
+			c.fail(err)
+		case !found:
+			c.w.int(-2)
+		case it.expires.IsZero():
+			c.w.int(-1)
+		default:
+			// Redis rounds to the nearest unit
+			left := time.Until(it.expires)
+			c.w.int(int64((left + unit/2) / unit))
+		}
+		return false
+	}
+}
+
+func persist(c *conn, args [][]byte) bool {
+	key := string(args[1])
+	it, found, err := c.lookup(key)
+	if err != nil {
+		c.fail(err)
+		return false
+	}
+	if !found || it.expires.IsZero() {
+		c.w.int(0)
+		return false
+	}
+	if err := c.clearExpiry(key); err != nil {
+		c.fail(err)
+		return false
+	}
+	c.w.int(1)
+	return false
+}
+
+// scan is SCAN cursor [MATCH pattern] [COUNT n] [TYPE type], see scan.go for
+// what a cursor is. Every key of the cluster is a string.
+func scan(c *conn, args [][]byte) bool {
+	id, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return false
+	}
+	pattern, n, typ := "*", 10, "string"
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.error("ERR syntax error")
+			return false
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			n, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				c.w.error("ERR syntax error")
+				return false
+			}
+		case "TYPE":
+			typ = strings.ToLower(string(args[i+1]))
+		default:
+			c.w.error("ERR syntax error")
+			return false
+		}
+	}
+	if typ != "string" {
+		c.w.array(2)
+		c.w.bulkString("0")
+		c.w.array(0)
+		return false
+	}
+
+	if id == 0 {
+		id = c.scans.start(c.ctx, c, pattern)
+	}
+	cur, ok := c.scans.get(id)
+	if !ok {
+		c.w.error("ERR invalid cursor")
+		return false
+	}
+	keys, more, err := cur.page(n)
+	if !more {
+		c.scans.done(id)
+		id = 0
+	}
+	if err != nil {
+		c.fail(err)
+		return false
+	}
+
+	c.w.array(2)
+	c.w.bulkString(strconv.FormatUint(id, 10))
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulkString(key)
+	}
+	return false
+}
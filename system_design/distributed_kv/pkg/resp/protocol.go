@@ -0,0 +1,168 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxArgs and maxBulk bound what a client can make the server allocate,
+	// the same limits Redis uses by default
+	maxArgs   = 1 << 20
+	maxBulk   = 512 << 20
+	maxInline = 64 << 10
+)
+
+// errProtocol closes the connection after the reply, the stream can't be
+// parsed any further
+var errProtocol = errors.New("protocol error")
+
+func protocolError(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{errProtocol}, args...)...)
+}
+
+type reader struct {
+	r *bufio.Reader
+}
+
+// readCommand reads one command, an array of bulk strings or an inline
+// command as typed into telnet
+func (rd *reader) readCommand() ([][]byte, error) {
+	for {
+		b, err := rd.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '*' {
+			return rd.readArray()
+		}
+		line, err := rd.line(maxInline)
+		if err != nil {
+			return nil, err
+		}
+		if args := bytes.Fields(line); len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+func (rd *reader) readArray() ([][]byte, error) {
+	line, err := rd.line(maxInline)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for range n {
+		line, err := rd.line(maxInline)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$', got '%.1s'", line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(rd.r, arg); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, protocolError("bulk string is not terminated by CRLF")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// line reads up to '\n' and drops the line ending
+func (rd *reader) line(limit int) ([]byte, error) {
+	var line []byte
+	for {
+		part, err := rd.r.ReadSlice('\n')
+		line = append(line, part...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(line) > limit {
+			return nil, protocolError("too big inline request")
+		}
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return line, nil
+}
+
+// writer encodes replies for the protocol version the client chose with
+// HELLO, RESP2 until then
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) error(s string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) int(n int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(b []byte) {
+	w.w.WriteByte('$')
+	w.w.WriteString(strconv.Itoa(len(b)))
+	w.w.WriteString("\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulkString(s string) {
+	w.bulk([]byte(s))
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.w.WriteByte('*')
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+// mapHeader starts n key/value pairs, RESP2 has no map type and gets a flat
+// array instead
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		w.w.WriteByte('%')
+		w.w.WriteString(strconv.Itoa(n))
+		w.w.WriteString("\r\n")
+		return
+	}
+	w.array(2 * n)
+}
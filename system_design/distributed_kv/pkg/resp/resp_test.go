@@ -0,0 +1,244 @@
+package resp_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+	"toy_dynamodb/pkg/adapter"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/resp"
+	"toy_dynamodb/pkg/ring"
+)
+
+// newServer runs the front-end on an in-process cluster of three nodes
+func newServer(t *testing.T, password string) string {
+	t.Helper()
+
+	r := &ring.Ring{ReplicaCount: 3}
+	r.Init()
+	opts := node.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.FsyncMode = node.FsyncNever
+	for _, name := range []string{"node-1", "node-2", "node-3"} {
+		n, err := node.NewWithOptions(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { n.Close() })
+		r.RegisterClient(name, adapter.NewLocalClient(n))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &resp.Server{Ring: r, Password: password}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+type client struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &client{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+// do sends a command and returns the reply: string, int64, nil, error
+// replies as respError and arrays or maps as []any
+func (c *client) do(args ...string) any {
+	c.t.Helper()
+	b := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, a := range args {
+		b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.nc.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+	v, err := c.read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+type respError string
+
+func (c *client) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		_, err := io.ReadFull(c.r, b)
+		return string(b[:n]), err
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		out := []any{}
+		for range n {
+			v, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *client) expect(want any, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Errorf("Expected %v to answer %#v, but got %#v", args, want, got)
+	}
+}
+
+func TestStringCommands(t *testing.T) {
+	c := dial(t, newServer(t, ""))
+
+	c.expect("PONG", "PING")
+	c.expect(nil, "GET", "missing")
+	c.expect("OK", "SET", "k", "v")
+	c.expect("v", "GET", "k")
+	c.expect(nil, "SET", "k", "other", "NX")
+	c.expect("v", "SET", "k", "v2", "XX", "GET")
+	c.expect("OK", "MSET", "a", "1", "b", "2")
+	c.expect([]any{"1", nil, "2", "v2"}, "MGET", "a", "missing", "b", "k")
+	c.expect(int64(3), "EXISTS", "a", "a", "k", "missing")
+	c.expect("string", "TYPE", "a")
+	c.expect(int64(2), "DEL", "a", "b", "missing")
+	c.expect(int64(0), "EXISTS", "a", "b")
+	c.expect("none", "TYPE", "a")
+
+	if got, ok := c.do("SET", "a,b", "v").(respError); !ok || got[:3] != "ERR" {
+		t.Errorf("Expected a key with a comma to be rejected, but got %#v", got)
+	}
+	if _, ok := c.do("NOPE").(respError); !ok {
+		t.Errorf("Expected an error for an unknown command")
+	}
+	c.expect("quorum", "CONSISTENCY")
+	c.expect("OK", "CONSISTENCY", "all")
+	c.expect("v2", "GET", "k")
+}
+
+func TestExpiry(t *testing.T) {
+	c := dial(t, newServer(t, ""))
+
+	c.expect("OK", "SET", "k", "v", "PX", "100")
+	if ttl := c.do("PTTL", "k").(int64); ttl <= 0 || ttl > 100 {
+		t.Errorf("Expected a PTTL of at most 100ms, but got %d", ttl)
+	}
+	time.Sleep(150 * time.Millisecond)
+	c.expect(nil, "GET", "k")
+	c.expect(int64(-2), "TTL", "k")
+
+	// a new value drops the deadline of the old one
+	c.expect("OK", "SET", "k", "v", "EX", "100")
+	c.expect("OK", "SET", "k", "v2")
+	c.expect(int64(-1), "TTL", "k")
+
+	c.expect(int64(1), "EXPIRE", "k", "100")
+	c.expect(int64(0), "EXPIRE", "k", "200", "NX")
+	c.expect(int64(100), "TTL", "k")
+	c.expect(int64(1), "PERSIST", "k")
+	c.expect(int64(-1), "TTL", "k")
+	c.expect(int64(1), "EXPIRE", "k", "0")
+	c.expect(int64(0), "EXISTS", "k")
+}
+
+func TestScan(t *testing.T) {
+	c := dial(t, newServer(t, ""))
+
+	var want []string
+	for i := range 25 {
+		key := fmt.Sprint("user:", i)
+		want = append(want, key)
+		c.expect("OK", "SET", key, "v")
+	}
+	c.expect("OK", "SET", "order:1", "v")
+	c.expect("OK", "SET", "user:gone", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	var got []string
+	cursor, pages := "0", 0
+	for {
+		res := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "10").([]any)
+		cursor = res[0].(string)
+		for _, k := range res[1].([]any) {
+			got = append(got, k.(string))
+		}
+		pages++
+		if cursor == "0" {
+			break
+		}
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected SCAN to return %v in key order, but got %v", want, got)
+	}
+	if pages != 3 {
+		t.Errorf("Expected 3 pages of at most 10 keys, but got %d", pages)
+	}
+
+	c.expect([]any{"0", []any{"order:1"}}, "SCAN", "0", "MATCH", "o?der:[0-9]")
+	if _, ok := c.do("SCAN", "12345").(respError); !ok {
+		t.Errorf("Expected an unknown cursor to be rejected")
+	}
+}
+
+func TestHelloAndAuth(t *testing.T) {
+	c := dial(t, newServer(t, "secret"))
+
+	if got, ok := c.do("GET", "k").(respError); !ok || got[:6] != "NOAUTH" {
+		t.Errorf("Expected NOAUTH before AUTH, but got %#v", got)
+	}
+	if got, ok := c.do("AUTH", "wrong").(respError); !ok || got[:9] != "WRONGPASS" {
+		t.Errorf("Expected WRONGPASS, but got %#v", got)
+	}
+	hello := c.do("HELLO", "3", "AUTH", "default", "secret").([]any)
+	if hello[4] != "proto" || hello[5] != int64(3) {
+		t.Errorf("Expected HELLO 3 to switch to RESP3, but got %v", hello)
+	}
+	// RESP3 has its own null
+	if _, err := c.nc.Write([]byte("GET missing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Errorf("Expected a RESP3 null for an inline GET, but got %q", line)
+	}
+}
@@ -0,0 +1,207 @@
+package resp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"toy_dynamodb/pkg/ring"
+)
+
+// maxCursors is how many SCANs a connection may leave unfinished, starting
+// one more drops the oldest
+const maxCursors = 16
+
+// Redis cursors are positions in its hash table. Ring.Scan can't resume from a
+// position, so a SCAN keeps running on the server: its keys are handed out a
+// page at a time and the cursor names the paused scan. It belongs to the
+// connection that started it.
+type cursor struct {
+	keys   chan string
+	err    error
+	cancel context.CancelFunc
+}
+
+type cursors struct {
+	mu   sync.Mutex
+	open map[uint64]*cursor
+	next uint64
+}
+
+func newCursors() *cursors {
+	return &cursors{open: make(map[uint64]*cursor)}
+}
+
+// start runs the scan in the background and returns its cursor id
+func (cs *cursors) start(ctx context.Context, c *conn, pattern string) uint64 {
+	ctx, cancel := context.WithCancel(ctx)
+	cur := &cursor{keys: make(chan string), cancel: cancel}
+	go func() {
+		defer close(cur.keys)
+		cur.err = scanKeys(ctx, c.s.Ring, pattern, func(key string) error {
+			select {
+			case cur.keys <- key:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.open) == maxCursors {
+		oldest := cs.next
+		for id := range cs.open {
+			oldest = min(oldest, id)
+		}
+		cs.open[oldest].cancel()
+		delete(cs.open, oldest)
+	}
+	cs.next++
+	cs.open[cs.next] = cur
+	return cs.next
+}
+
+func (cs *cursors) get(id uint64) (*cursor, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cur, ok := cs.open[id]
+	return cur, ok
+}
+
+func (cs *cursors) done(id uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cur, ok := cs.open[id]; ok {
+		cur.cancel()
+		delete(cs.open, id)
+	}
+}
+
+// page takes up to count keys. More is false once the scan ended, err is set
+// when it ended early.
+func (cur *cursor) page(count int) (keys []string, more bool, err error) {
+	for len(keys) < count {
+		key, ok := <-cur.keys
+		if !ok {
+			return keys, false, cur.err
+		}
+		keys = append(keys, key)
+	}
+	return keys, true, nil
+}
+
+// scanKeys calls fn for the keys matching pattern that haven't expired. The
+// deadlines are read first, only keys with a deadline take memory.
+func scanKeys(ctx context.Context, r *ring.Ring, pattern string, fn func(string) error) error {
+	prefix := literalPrefix(pattern)
+	deadlines := map[string]expiry{}
+	err := r.Scan(ctx, ttlPrefix+prefix, func(e ring.Entry) error {
+		if x, err := parseExpiry(e.Value); err == nil {
+			deadlines[strings.TrimPrefix(e.Key, ttlPrefix)] = x
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.Scan(ctx, prefix, func(e ring.Entry) error {
+		if strings.HasPrefix(e.Key, internalPrefix) || !match(pattern, e.Key) {
+			return nil
+		}
+		if x, ok := deadlines[e.Key]; ok && x.version == e.Version && !x.at.After(time.Now()) {
+			return nil
+		}
+		return fn(e.Key)
+	})
+}
+
+// literalPrefix is the part of a glob pattern before its first wildcard, only
+// keys starting with it are scanned
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// match reports whether s matches the glob pattern the way Redis does:
+// * and ? wildcards, [abc], [^a] and [a-z] classes and \ escapes
+func match(pattern, s string) bool {
+	// star and its match are where to continue after a mismatch, the
+	// last * takes one more byte
+	star, starMatch := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starMatch = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern, p, s[i]); ok {
+					p = end
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starMatch++
+		p, i = star+1, starMatch
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches b against the class starting at pattern[p] == '[' and
+// returns the index after it
+func matchClass(pattern string, p int, b byte) (int, bool) {
+	p++
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	found := false
+	for ; p < len(pattern) && pattern[p] != ']'; p++ {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			found = found || pattern[p] == b
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := min(pattern[p], pattern[p+2]), max(pattern[p], pattern[p+2])
+			found = found || lo <= b && b <= hi
+			p += 2
+		default:
+			found = found || pattern[p] == b
+		}
+	}
+	if p == len(pattern) {
+		// an unterminated class matches like Redis, up to the pattern's end
+		return p, found != negate
+	}
+	return p + 1, found != negate
+}
@@ -0,0 +1,245 @@
+// Package resp puts a Redis protocol (RESP2 and RESP3) front-end on a Ring,
+// so redis-cli and Redis client libraries can talk to the cluster. Each
+// connection reads and writes with the quorum sizes of its consistency level.
+// See commands.go for the supported commands.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hlc"
+	"toy_dynamodb/pkg/ring"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("toy_dynamodb/pkg/resp")
+
+type Server struct {
+	Ring *ring.Ring
+	// Consistency is where every connection starts, a client can change its
+	// own level with CONSISTENCY. Empty means quorum.
+	Consistency ring.Consistency
+	// Password makes clients AUTH before any other command, empty lets
+	// everyone in
+	Password string
+
+	// clock versions the writes of the server, an expiry names the version
+	// of the value it belongs to, see ttl.go
+	clock hlc.Clock
+
+	mu     sync.Mutex
+	lis    map[net.Listener]struct{}
+	conns  map[*conn]struct{}
+	nextID int64
+	closed bool
+}
+
+type conn struct {
+	s      *Server
+	id     int64
+	nc     net.Conn
+	rd     reader
+	w      writer
+	ctx    context.Context
+	cancel context.CancelFunc
+	// span is the context of the running command, see run
+	span context.Context
+
+	level  ring.Consistency
+	rq, wq int
+	authed bool
+	name   string
+	scans  *cursors
+}
+
+// Serve accepts connections on l until Close is called, then returns nil
+func (s *Server) Serve(l net.Listener) error {
+	level := s.Consistency
+	if level == "" {
+		level = ring.ConsistencyQuorum
+	}
+	rq, err := s.Ring.QuorumSize(level)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.lis == nil {
+		s.lis = make(map[net.Listener]struct{})
+		s.conns = make(map[*conn]struct{})
+	}
+	s.lis[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &conn{
+			s:      s,
+			nc:     nc,
+			rd:     reader{r: bufio.NewReader(nc)},
+			w:      writer{w: bufio.NewWriter(nc), proto: 2},
+			ctx:    ctx,
+			cancel: cancel,
+			level:  level,
+			rq:     rq,
+			wq:     rq,
+			authed: s.Password == "",
+			scans:  newCursors(),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return nil
+		}
+		s.nextID++
+		c.id = s.nextID
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Close stops the listeners and drops every connection, commands in flight
+// may or may not have been applied
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.lis {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	return nil
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.cancel()
+		c.nc.Close()
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+	}()
+
+	for {
+		args, err := c.rd.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.error("ERR Protocol error: " + strings.TrimPrefix(err.Error(), errProtocol.Error()+": "))
+				c.w.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.run(args)
+		// pipelined commands are answered together
+		if quit || c.rd.r.Buffered() == 0 {
+			if err := c.w.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// run executes one command and reports whether the connection should close
+func (c *conn) run(args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.error("ERR unknown command '" + clean(string(args[0])) + "'")
+		return false
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		c.w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return false
+	}
+	if !c.authed && !cmd.noAuth {
+		c.w.error("NOAUTH Authentication required.")
+		return false
+	}
+	ctx, span := tracer.Start(c.ctx, "resp."+name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Int64("resp.conn", c.id)))
+	defer span.End()
+	c.span = ctx
+	return cmd.fn(c, args)
+}
+
+// ring is the default table with the command's span as the parent of the
+// ring's spans
+func (c *conn) ring() *ring.Table {
+	return c.s.Ring.WithContext(c.span)
+}
+
+// setLevel changes the quorum sizes of the connection
+func (c *conn) setLevel(level ring.Consistency) error {
+	q, err := c.s.Ring.QuorumSize(level)
+	if err != nil {
+		return err
+	}
+	c.level, c.rq, c.wq = level, q, q
+	return nil
+}
+
+// write applies m with the write quorum of the connection. Every write of the
+// server takes its version from one clock, so they are ordered the way they
+// were sent.
+func (c *conn) write(m ring.Mutation) error {
+	if m.Version == 0 {
+		m.Version = c.s.clock.Now()
+	}
+	return c.ring().Apply(m, c.wq)
+}
+
+// fail answers with err. Errors a retry may fix are TRYAGAIN, like a Redis
+// cluster that is resharding. A full quota is OOM, like a Redis at its
+// maxmemory, and a rate limit TRYAGAIN with the wait in the message.
+func (c *conn) fail(err error) {
+	var exhausted *custom_errors.ResourceExhaustedError
+	switch {
+	case errors.As(err, &exhausted) && exhausted.RetryAfter == 0:
+		c.w.error("OOM " + clean(err.Error()))
+	case errors.As(err, &exhausted):
+		c.w.error("TRYAGAIN " + clean(err.Error()))
+	case errors.Is(err, custom_errors.ErrQuorumNotMet), errors.Is(err, custom_errors.ErrUnavailable), errors.Is(err, custom_errors.ErrTimeout):
+		c.w.error("TRYAGAIN " + clean(err.Error()))
+	default:
+		c.w.error("ERR " + clean(err.Error()))
+	}
+}
+
+// clean keeps a message on one line, a line break would end the reply early
+func clean(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,120 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/ring"
+)
+
+// The nodes have no expiry, so the front-end keeps the deadline of a key in a
+// key of its own. The deadline names the version of the value it was set for:
+// a later SET writes a new version and the old deadline stops applying
+// without another write. An expired key is deleted when it is read.
+const (
+	// internalPrefix starts the keys of the front-end, clients never see them
+	internalPrefix = "\x00resp:"
+	ttlPrefix      = internalPrefix + "ttl:"
+)
+
+// item is a key as a Redis client sees it
+type item struct {
+	ring.Entry
+	// expires is zero for a key without a deadline
+	expires time.Time
+}
+
+// expiry is the value of a ttlPrefix key: "<version> <deadline in unix ms>"
+type expiry struct {
+	version uint64
+	at      time.Time
+}
+
+func (x expiry) encode() []byte {
+	return fmt.Appendf(nil, "%d %d", x.version, x.at.UnixMilli())
+}
+
+func parseExpiry(b []byte) (expiry, error) {
+	v, ms, ok := strings.Cut(string(b), " ")
+	version, err1 := strconv.ParseUint(v, 10, 64)
+	at, err2 := strconv.ParseInt(ms, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return expiry{}, &custom_errors.ArgError{Arg: "expiry " + strconv.Quote(string(b)), Message: "is corrupt"}
+	}
+	return expiry{version: version, at: time.UnixMilli(at)}, nil
+}
+
+// lookup reads key and its deadline in parallel. An expired key is deleted
+// and reported as missing.
+func (c *conn) lookup(key string) (item, bool, error) {
+	var (
+		meta    ring.Entry
+		metaErr error
+		wg      sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		meta, metaErr = c.ring().GetLatest(ttlPrefix+key, c.rq)
+	}()
+	e, err := c.ring().GetLatest(key, c.rq)
+	wg.Wait()
+
+	if errors.Is(err, custom_errors.ErrNotFound) {
+		return item{}, false, nil
+	}
+	if err != nil {
+		return item{}, false, err
+	}
+	it := item{Entry: e}
+	if errors.Is(metaErr, custom_errors.ErrNotFound) {
+		return it, true, nil
+	}
+	if metaErr != nil {
+		return item{}, false, metaErr
+	}
+	x, err := parseExpiry(meta.Value)
+	if err != nil {
+		return item{}, false, err
+	}
+
+	switch {
+	case x.version < e.Version:
+		// set for a value that was overwritten since. The tombstone takes the
+		// version of the deadline, a newer one written meanwhile survives it.
+		if err := c.write(ring.Mutation{Key: meta.Key, Delete: true, Version: meta.Version}); err != nil {
+			return item{}, false, err
+		}
+	case x.version == e.Version:
+		if !x.at.After(time.Now()) {
+			return item{}, false, c.expire(e, meta)
+		}
+		it.expires = x.at
+	}
+	// a deadline newer than the value was read from a replica that has the
+	// newer value too, the next read sees both
+	return it, true, nil
+}
+
+// expire deletes a key whose deadline passed. The tombstone has the version
+// of the expired value, so a value written after it isn't deleted.
+func (c *conn) expire(e, meta ring.Entry) error {
+	if err := c.write(ring.Mutation{Key: e.Key, Delete: true, Version: e.Version}); err != nil {
+		return err
+	}
+	return c.write(ring.Mutation{Key: meta.Key, Delete: true, Version: meta.Version})
+}
+
+// setExpiry makes the value of key with the given version expire at
+func (c *conn) setExpiry(key string, version uint64, at time.Time) error {
+	return c.write(ring.Mutation{Key: ttlPrefix + key, Value: expiry{version: version, at: at}.encode()})
+}
+
+// clearExpiry removes the deadline of key, the value stays
+func (c *conn) clearExpiry(key string) error {
+	return c.write(ring.Mutation{Key: ttlPrefix + key, Delete: true})
+}
@@ -0,0 +1,242 @@
+package ring
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultBreakerCooldown  = 5 * time.Second
+)
+
+// NodeState is the circuit breaker state of a node.
+//
+//	Up       -> every request goes through
+//	Down     -> requests are skipped until the cooldown passes
+//	HalfOpen -> a single probe request is let through, its outcome decides
+type NodeState int
+
+const (
+	NodeUp NodeState = iota
+	NodeHalfOpen
+	NodeDown
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeUp:
+		return "up"
+	case NodeHalfOpen:
+		return "half-open"
+	default:
+		return "down"
+	}
+}
+
+// BreakerConfig zero values are replaced with the defaults in Init
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures open the breaker
+	FailureThreshold int
+	// Cooldown is how long an open breaker waits before the half-open probe
+	Cooldown time.Duration
+}
+
+// NodeHealth is a snapshot of what the ring knows about a node
+type NodeHealth struct {
+	State               NodeState
+	ConsecutiveFailures int
+	LastError           string
+	Since               time.Time
+}
+
+type nodeHealth struct {
+	NodeHealth
+	probing bool
+}
+
+type healthTracker struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeHealth
+	cfg   BreakerConfig
+	now   func() time.Time
+}
+
+func newHealthTracker(cfg BreakerConfig) *healthTracker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = DefaultFailureThreshold
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultBreakerCooldown
+	}
+	return &healthTracker{nodes: make(map[string]*nodeHealth), cfg: cfg, now: time.Now}
+}
+
+// must be called with h.mu held
+func (h *healthTracker) get(addr string) *nodeHealth {
+	nh, ok := h.nodes[addr]
+	if !ok {
+		nh = &nodeHealth{NodeHealth: NodeHealth{State: NodeUp, Since: h.now()}}
+		h.nodes[addr] = nh
+	}
+	return nh
+}
+
+// allow reports whether a request may be sent to addr. An open breaker whose
+// cooldown has passed turns half-open and lets exactly one request through.
+func (h *healthTracker) allow(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nh := h.get(addr)
+	switch nh.State {
+	case NodeUp:
+		return true
+	case NodeDown:
+		if h.now().Sub(nh.Since) < h.cfg.Cooldown {
+			return false
+		}
+		nh.State, nh.Since = NodeHalfOpen, h.now()
+		fallthrough
+	default:
+		if nh.probing {
+			return false
+		}
+		nh.probing = true
+		return true
+	}
+}
+
+func (h *healthTracker) record(addr string, err error) {
+	if err != nil && !isNodeFailure(err) {
+		// the node answered, the request itself was wrong
+		err = nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nh := h.get(addr)
+	nh.probing = false
+
+	if err == nil {
+		if nh.State != NodeUp {
+			nh.State, nh.Since = NodeUp, h.now()
+		}
+		nh.ConsecutiveFailures = 0
+		return
+	}
+
+	nh.ConsecutiveFailures++
+	nh.LastError = err.Error()
+	if nh.State == NodeHalfOpen || nh.ConsecutiveFailures >= h.cfg.FailureThreshold {
+		nh.State, nh.Since = NodeDown, h.now()
+	}
+}
+
+// release gives back a half-open probe slot that allow handed out but the
+// caller ended up not using
+func (h *healthTracker) release(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if nh := h.get(addr); nh.State == NodeHalfOpen {
+		nh.probing = false
+	}
+}
+
+// markDown opens the breaker right away, used when the node itself says it
+// is not serving (e.g. draining on shutdown)
+func (h *healthTracker) markDown(addr, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nh := h.get(addr)
+	nh.probing = false
+	nh.LastError = reason
+	if nh.State != NodeDown {
+		nh.State, nh.Since = NodeDown, h.now()
+	}
+}
+
+func (h *healthTracker) snapshot() map[string]NodeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string]NodeHealth, len(h.nodes))
+	for addr, nh := range h.nodes {
+		out[addr] = nh.NodeHealth
+	}
+	return out
+}
+
+// isNodeFailure separates errors that say something about the node's
+// availability from errors about the request
+func isNodeFailure(err error) bool {
+	if errors.Is(err, custom_errors.ErrInvalidArgument) || errors.Is(err, custom_errors.ErrNotFound) || errors.Is(err, custom_errors.ErrConflict) ||
+		errors.Is(err, custom_errors.ErrResourceExhausted) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.Unauthenticated, codes.FailedPrecondition, codes.OutOfRange, codes.Canceled:
+		return false
+	}
+	return true
+}
+
+// Health returns the breaker state of every node the ring has talked to
+func (r *Ring) Health() map[string]NodeHealth {
+	return r.health.snapshot()
+}
+
+// NodeState returns the breaker state of a single node
+func (r *Ring) NodeState(address string) NodeState {
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	return r.health.get(address).State
+}
+
+// StartHealthChecks polls the standard gRPC health service of every node added
+// with AddNode until ctx is cancelled. In-memory clients registered with
+// RegisterClient are only tracked through RPC outcomes.
+func (r *Ring) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			for addr, c := range r.snapshot().health {
+				go r.checkNode(ctx, addr, c, interval)
+			}
+		}
+	}()
+}
+
+func (r *Ring) checkNode(ctx context.Context, addr string, c healthpb.HealthClient, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res, err := c.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		r.health.record(addr, err)
+		return
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		r.health.markDown(addr, "health check: "+res.Status.String())
+		return
+	}
+	r.health.record(addr, nil)
+}
@@ -0,0 +1,119 @@
+package ring
+
+import (
+	"context"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/rpcerr"
+	"toy_dynamodb/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ReadStrategy int
+
+const (
+	// ReadAll sends the read to every replica and returns after R answers
+	ReadAll ReadStrategy = iota
+	// ReadHedged sends the read to the R fastest replicas only and adds one
+	// more replica whenever an answer is missing after the hedge delay or a
+	// replica fails
+	ReadHedged
+)
+
+const (
+	DefaultHedgePercentile = 0.95
+	DefaultHedgeDelay      = 10 * time.Millisecond
+)
+
+// HedgeConfig zero values are replaced with the defaults in Init
+type HedgeConfig struct {
+	// Percentile of recent read latencies used as the hedge delay
+	Percentile float64
+	// Delay is used until the ring has seen any read latency
+	Delay time.Duration
+}
+
+func (r *Ring) hedgeDelay() time.Duration {
+	if d, ok := r.latency.percentile(r.Hedge.Percentile); ok {
+		return d
+	}
+	return r.Hedge.Delay
+}
+
+func (r *Ring) fetch(ctx context.Context, table, key string, p replica, ch chan<- getResponse) {
+	start := time.Now()
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "ring.replica.Get", trace.WithAttributes(attribute.String("kv.node", p.name)))
+	v, version, found, err := getValue(ctx, p.nd, table, key)
+	r.health.record(p.name, err)
+	if err != nil {
+		err = rpcerr.FromStatus(err, p.name)
+		tracing.End(span, err)
+		ch <- getResponse{nodeName: p.name, err: err}
+		return
+	}
+	span.SetAttributes(attribute.Bool("kv.found", found), attribute.Int64("kv.version", int64(version)))
+	span.End()
+	r.latency.observe(p.name, time.Since(start))
+	ch <- getResponse{nodeName: p.name, value: v, version: version, found: found}
+}
+
+// getHedged contacts q replicas, fastest first. A failed or not-found answer
+// and every expired hedge timer bring in the next replica, so a slow or dead
+// node costs at most one hedge delay instead of the whole RPC timeout.
+func (r *Ring) getHedged(ctx context.Context, table, key string, q int, nodes []replica, n int, causes map[string]error) (*replies, error) {
+	nodes = r.latency.fastestFirst(nodes)
+	rs := newReplies()
+	ch := make(chan getResponse, len(nodes))
+
+	next, inflight := 0, 0
+	defer func() {
+		for _, p := range nodes[next:] {
+			r.health.release(p.name)
+		}
+	}()
+	launch := func() {
+		go r.fetch(ctx, table, key, nodes[next], ch)
+		next++
+		inflight++
+	}
+	for next < q {
+		launch()
+	}
+
+	delay := r.hedgeDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	answered := 0
+	for {
+		select {
+		case res := <-ch:
+			inflight--
+			if res.err == nil {
+				answered++
+				rs.add(res)
+			} else {
+				causes[res.nodeName] = res.err
+			}
+			if !res.found && next < len(nodes) {
+				launch()
+			}
+		case <-timer.C:
+			if next < len(nodes) {
+				launch()
+				timer.Reset(delay)
+			}
+			continue
+		}
+
+		if len(rs.vals) == q {
+			return rs, nil
+		} else if inflight == 0 && next == len(nodes) {
+			return r.readResult(key, q, n, rs, answered, causes)
+		} else if answered+inflight+len(nodes)-next < q {
+			return nil, &custom_errors.QuorumReadError{Message: "Failed to hit quorum", R: q, N: n, Causes: causes}
+		}
+	}
+}
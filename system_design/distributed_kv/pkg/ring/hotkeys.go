@@ -0,0 +1,214 @@
+package ring
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hotkey"
+	"toy_dynamodb/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultHotThreshold is the rate in requests per second from which
+	// GetLatest answers a key from the cache
+	DefaultHotThreshold = 100
+	// DefaultHotCacheSize bounds the cached keys
+	DefaultHotCacheSize = 1024
+)
+
+// HotKeyConfig makes the coordinator count its requests per key and serve
+// reads of the hottest keys from memory (ADR 0030). Zero values are replaced
+// with the defaults in Init.
+type HotKeyConfig struct {
+	// Track counts the reads and writes of this coordinator for
+	// Ring.HotKeys
+	Track   bool
+	Tracker hotkey.Config
+	// CacheTTL is how long GetLatest answers a hot key without asking the
+	// replicas, 0 turns the cache off. A write through this coordinator
+	// removes the key from the cache, a write of another coordinator is read
+	// at most CacheTTL later. The cache needs Track, Init turns it on.
+	CacheTTL time.Duration
+	// Threshold is the rate in requests per second of this coordinator from
+	// which a key is cached
+	Threshold float64
+	CacheSize int
+}
+
+func (r *Ring) initHotKeys() {
+	c := &r.HotKey
+	if c.CacheTTL > 0 {
+		c.Track = true
+		if c.Threshold <= 0 {
+			c.Threshold = DefaultHotThreshold
+		}
+		if c.CacheSize <= 0 {
+			c.CacheSize = DefaultHotCacheSize
+		}
+		r.cache = &hotCache{ttl: c.CacheTTL, size: c.CacheSize, entries: make(map[cacheKey]*cacheEntry)}
+	}
+	if c.Track {
+		r.hot = hotkey.NewTracker(c.Tracker)
+	}
+}
+
+// HotKeys returns up to n of the keys this coordinator read and wrote most,
+// the most requested first. It is nil unless HotKey.Track is set.
+func (r *Ring) HotKeys(n int) []hotkey.Key {
+	if r.hot == nil {
+		return nil
+	}
+	return r.hot.Top(n)
+}
+
+// WithoutCache returns the table with reads that always ask the replicas,
+// for checks that must not see an answer up to CacheTTL old
+func (tb *Table) WithoutCache() *Table {
+	c := *tb
+	c.uncached = true
+	return &c
+}
+
+func (tb *Table) record(key string) {
+	if tb.r.hot != nil {
+		tb.r.hot.Record(tb.spec.Name, key)
+	}
+}
+
+// cachedLatest is GetLatest through the cache. Only keys above the
+// threshold are cached. An entry read with quorum q answers reads with a
+// quorum up to q, a stronger read goes to the replicas.
+func (tb *Table) cachedLatest(key string, q int) (Entry, error) {
+	r := tb.r
+	if r.cache == nil || tb.uncached || r.hot.Rate(tb.spec.Name, key) < r.HotKey.Threshold {
+		return tb.getLatest(key, q)
+	}
+	ck := cacheKey{tb.spec.Name, key}
+	if e, found, ok := r.cache.get(ck, q); ok {
+		return tb.cacheHit(key, q, e, found)
+	}
+	gen, ok := r.cache.begin(ck)
+	e, err := tb.getLatest(key, q)
+	var notFound *custom_errors.NotFoundError
+	switch {
+	case !ok:
+	case err == nil:
+		r.cache.fill(ck, gen, q, e, true)
+	case errors.As(err, &notFound):
+		r.cache.fill(ck, gen, q, Entry{}, false)
+	}
+	return e, err
+}
+
+// cacheHit still takes a token of the table's rate limit, the limit is the
+// client's and not the replicas'. Every caller gets its own copy of the value.
+func (tb *Table) cacheHit(key string, q int, e Entry, found bool) (_ Entry, err error) {
+	_, span := tracer.Start(tb.context(), "ring.Get", trace.WithAttributes(append(tb.attributes(key, q), attribute.Bool("kv.cached", true))...))
+	defer func() { tracing.End(span, err) }()
+	tb.record(key)
+	if err := tb.admit(false); err != nil {
+		return Entry{}, err
+	}
+	if !found {
+		return Entry{}, &custom_errors.NotFoundError{Key: key}
+	}
+	e.Value = bytes.Clone(e.Value)
+	return e, nil
+}
+
+// invalidate drops key from the cache, Apply calls it before and after a
+// write so no read that overlaps the write fills the cache
+func (tb *Table) invalidate(key string) {
+	if tb.r.cache != nil {
+		tb.r.cache.invalidate(cacheKey{tb.spec.Name, key})
+	}
+}
+
+type cacheKey struct {
+	table, key string
+}
+
+// cacheEntry is a cached answer of GetLatest. gen changes on every
+// invalidation, a read only fills the entry when it didn't change since the
+// read began.
+type cacheEntry struct {
+	gen     uint64
+	filled  bool
+	entry   Entry
+	found   bool
+	q       int
+	expires time.Time
+}
+
+type hotCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	// seq hands out the generations, an entry that is dropped and created
+	// again never gets a generation an older read began with
+	seq uint64
+}
+
+func (c *hotCache) get(k cacheKey, q int) (Entry, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok || !e.filled || e.q < q || time.Now().After(e.expires) {
+		return Entry{}, false, false
+	}
+	return e.entry, e.found, true
+}
+
+// begin returns the generation a read of k has to see unchanged to fill the
+// cache, false when the cache is full
+func (c *hotCache) begin(k cacheKey) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[k]; ok {
+		return e.gen, true
+	}
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, e := range c.entries {
+			if !e.filled || now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return 0, false
+		}
+	}
+	c.seq++
+	c.entries[k] = &cacheEntry{gen: c.seq}
+	return c.seq, true
+}
+
+func (c *hotCache) fill(k cacheKey, gen uint64, q int, entry Entry, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok || e.gen != gen {
+		return
+	}
+	// a weaker read doesn't replace what a stronger one left
+	if e.filled && e.q > q && time.Now().Before(e.expires) {
+		return
+	}
+	e.filled, e.entry, e.found, e.q, e.expires = true, entry, found, q, time.Now().Add(c.ttl)
+}
+
+func (c *hotCache) invalidate(k cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[k]; ok {
+		c.seq++
+		e.gen, e.filled = c.seq, false
+	}
+}
@@ -0,0 +1,84 @@
+package ring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/rpcerr"
+	kv "toy_dynamodb/proto"
+)
+
+// QueryIndex calls fn for every key whose value has value in the field of
+// the secondary index, in key order. The index is local to every node, so
+// all nodes are asked, like Scan every node has to answer.
+//
+// A replica that missed a write still reports the old value. Every match is
+// read again from q replicas and only kept when the newest version is the
+// one a node reported, a newer version no node matched has a different
+// value by now. Keys written during the query may be left out.
+func (r *Ring) QueryIndex(ctx context.Context, index, value string, q int, fn func(Entry) error) error {
+	return r.defaultTable().QueryIndex(ctx, index, value, q, fn)
+}
+
+func (tb *Table) QueryIndex(ctx context.Context, index, value string, q int, fn func(Entry) error) error {
+	if q < 1 || q > int(tb.spec.ReplicaCount) {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("q=%d", q), Message: "must be between 1 and the replica count"}
+	}
+	t := tb.r.snapshot()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	names := make([]string, 0, len(t.nodes))
+	for name := range t.nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	// the highest version of every key any node matched
+	matched := make(map[string]uint64)
+	for _, name := range names {
+		s, err := t.nodes[name].Query(ctx, &kv.QueryRequest{Table: tb.spec.Name, Index: index, Value: value})
+		if err != nil {
+			return rpcerr.FromStatus(err, name)
+		}
+		for {
+			e, err := s.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return rpcerr.FromStatus(err, name)
+			}
+			matched[e.Key] = max(matched[e.Key], e.Version)
+		}
+	}
+
+	keys := make([]string, 0, len(matched))
+	for k := range matched {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e, err := tb.WithContext(ctx).GetLatest(k, q)
+		if errors.Is(err, custom_errors.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if e.Version != matched[k] {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package ring
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize samples are kept for the hedge percentile, old ones are
+// overwritten so the delay follows the current behaviour of the cluster
+const latencyWindowSize = 256
+
+// ewmaAlpha is the weight of the newest sample in the per node average
+const ewmaAlpha = 0.2
+
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [latencyWindowSize]time.Duration
+	count   int
+	next    int
+	ewma    map[string]float64
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{ewma: make(map[string]float64)}
+}
+
+func (t *latencyTracker) observe(addr string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencyWindowSize
+	if t.count < latencyWindowSize {
+		t.count++
+	}
+
+	if avg, ok := t.ewma[addr]; ok {
+		t.ewma[addr] = ewmaAlpha*float64(d) + (1-ewmaAlpha)*avg
+	} else {
+		t.ewma[addr] = float64(d)
+	}
+}
+
+// average returns the smoothed latency of addr, ok is false if the node has
+// never answered yet
+func (t *latencyTracker) average(addr string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	avg, ok := t.ewma[addr]
+	return time.Duration(avg), ok
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of recent read
+// latencies over all nodes
+func (t *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	s := slices.Clone(t.samples[:t.count])
+	t.mu.Unlock()
+
+	if len(s) == 0 {
+		return 0, false
+	}
+	slices.Sort(s)
+	i := int(p*float64(len(s))+0.5) - 1
+	i = max(0, min(i, len(s)-1))
+	return s[i], true
+}
+
+// fastestFirst orders replicas by observed latency. Nodes without samples go
+// first so the ring learns about them; ties keep the preference list order.
+func (t *latencyTracker) fastestFirst(rs []replica) []replica {
+	out := slices.Clone(rs)
+	slices.SortStableFunc(out, func(a, b replica) int {
+		la, oka := t.average(a.name)
+		lb, okb := t.average(b.name)
+		switch {
+		case !oka && !okb:
+			return 0
+		case !oka:
+			return -1
+		case !okb:
+			return 1
+		}
+		return cmp.Compare(la, lb)
+	})
+	return out
+}
@@ -0,0 +1,37 @@
+package ring
+
+import (
+	"fmt"
+	custom_errors "toy_dynamodb/Errors"
+)
+
+// Consistency is a quorum size relative to ReplicaCount, for front-ends whose
+// clients can't pass R and W themselves
+type Consistency string
+
+const (
+	ConsistencyOne    Consistency = "one"
+	ConsistencyQuorum Consistency = "quorum"
+	ConsistencyAll    Consistency = "all"
+)
+
+// QuorumSize is the number of replicas c waits for. Quorum reads and writes
+// overlap in at least one replica. Empty is the table's default level.
+func (r *Ring) QuorumSize(c Consistency) (int, error) {
+	return r.defaultTable().QuorumSize(c)
+}
+
+func (tb *Table) QuorumSize(c Consistency) (int, error) {
+	if c == "" {
+		c = tb.Consistency()
+	}
+	switch c {
+	case ConsistencyOne:
+		return 1, nil
+	case ConsistencyQuorum:
+		return int(tb.spec.ReplicaCount)/2 + 1, nil
+	case ConsistencyAll:
+		return int(tb.spec.ReplicaCount), nil
+	}
+	return 0, &custom_errors.ArgError{Arg: fmt.Sprintf("consistency %q", c), Message: "must be one, quorum or all"}
+}
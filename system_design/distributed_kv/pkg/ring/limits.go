@@ -0,0 +1,104 @@
+package ring
+
+import (
+	"context"
+	"errors"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/limit"
+	"toy_dynamodb/pkg/table"
+	kv "toy_dynamodb/proto"
+)
+
+// DefaultQuotaBackoff is how long a coordinator turns away writes of a table
+// after a replica rejected one for the table's quota
+const DefaultQuotaBackoff = time.Second
+
+// admit takes a token of the table's rate limit. A write that may add data
+// is also turned away while the table's quota is known to be full, deletes
+// go through because they free space.
+func (tb *Table) admit(grows bool) error {
+	r := tb.r
+	if err := r.limiter.Allow(tb.spec.Name); err != nil {
+		return err
+	}
+	if !grows {
+		return nil
+	}
+	v, ok := r.full.Load(tb.spec.Name)
+	if !ok {
+		return nil
+	}
+	until := v.(time.Time)
+	wait := time.Until(until)
+	if wait <= 0 {
+		r.full.CompareAndDelete(tb.spec.Name, until)
+		return nil
+	}
+	return &custom_errors.ResourceExhaustedError{Resource: "storage of " + limit.Tenant(tb.spec.Name), Limit: tb.spec.QuotaBytes,
+		Message: "a replica reported the quota as full", RetryAfter: wait}
+}
+
+// limitResult returns the limit a replica ran into instead of the quorum
+// error around it. A quota error has no RetryAfter, the caller has to free
+// space first, and the table counts as full for QuotaBackoff.
+func (tb *Table) limitResult(err error) error {
+	var exhausted *custom_errors.ResourceExhaustedError
+	if !errors.As(err, &exhausted) {
+		return err
+	}
+	if exhausted.RetryAfter == 0 {
+		tb.r.full.Store(tb.spec.Name, time.Now().Add(tb.r.QuotaBackoff))
+	}
+	return exhausted
+}
+
+// SetLimits changes the rate limit and the quota of a table on every node
+// and on this coordinator. Other coordinators see the new rate after their
+// next RefreshTables, the nodes enforce it meanwhile.
+func (r *Ring) SetLimits(ctx context.Context, name string, l table.Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	if _, err := r.Table(name); err != nil {
+		return err
+	}
+	err := r.eachAdmin(ctx, func(ac kv.AdminClient) error {
+		_, err := ac.SetLimits(ctx, l.Proto(name))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.limiter.Set(name, l.Rate)
+	r.full.Delete(name)
+	if name == table.Default {
+		r.defLimits.Store(&l)
+		return nil
+	}
+	r.updateTables(func(m map[string]table.Spec) {
+		if spec, ok := m[name]; ok {
+			spec.Limits = l
+			m[name] = spec
+		}
+	})
+	return nil
+}
+
+// WatchTables calls RefreshTables every interval until ctx is done, so limits
+// set through another coordinator reach this one. A failed refresh keeps the
+// catalog the ring has.
+func (r *Ring) WatchTables(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.RefreshTables(ctx)
+			}
+		}
+	}()
+}
@@ -0,0 +1,387 @@
+package ring
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/fnv"
+	"maps"
+	"math"
+	"math/bits"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Partitioner maps a key to the nodes that hold its replicas. Ring never
+// changes a partitioner readers can see, it changes a Clone and publishes
+// that, so Replicas must be safe for concurrent use while Add and Remove need
+// not be.
+type Partitioner interface {
+	Add(node string)
+	Remove(node string)
+	// Replicas returns up to n distinct nodes for key, the first one is the
+	// primary. It must be deterministic, every coordinator has to agree.
+	Replicas(key string, n int) []string
+	// Clone returns an independent copy
+	Clone() Partitioner
+}
+
+// HashFunc maps a string to a 64 bit position
+type HashFunc func(string) uint64
+
+// XXHash is the default, fast and well distributed
+func XXHash(s string) uint64 {
+	return xxhash.Sum64String(s)
+}
+
+// SHA1Hash is what the hashing prototypes and ADR 0002 used, the first 8
+// bytes of the SHA1 sum
+func SHA1Hash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func FNVHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// Partitioner and hash names accepted by NewPartitioner and HashByName
+const (
+	PartitionVNodes     = "vnodes"
+	PartitionRendezvous = "rendezvous"
+	PartitionJump       = "jump"
+	PartitionTokens     = "tokens"
+)
+
+var Partitioners = []string{PartitionVNodes, PartitionRendezvous, PartitionJump, PartitionTokens}
+
+// DefaultTokenCount is the number of fixed token ranges of NewTokenRanges
+const DefaultTokenCount = 1024
+
+// NewPartitioner builds a partitioner by name with its default parameters
+func NewPartitioner(name string, hash HashFunc) (Partitioner, bool) {
+	switch name {
+	case PartitionVNodes:
+		return NewConsistentHash(hash, VirtualSpotCount), true
+	case PartitionRendezvous:
+		return NewRendezvous(hash), true
+	case PartitionJump:
+		return NewJumpHash(hash), true
+	case PartitionTokens:
+		return NewTokenRanges(hash, DefaultTokenCount), true
+	}
+	return nil, false
+}
+
+func HashByName(name string) (HashFunc, bool) {
+	switch name {
+	case "xxhash":
+		return XXHash, true
+	case "sha1":
+		return SHA1Hash, true
+	case "fnv":
+		return FNVHash, true
+	}
+	return nil, false
+}
+
+// mix is the splitmix64 finalizer, it spreads combined hashes over all bits
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ConsistentHash places vnodes positions per node on a ring and walks
+// clockwise from the key, see ADR 0002
+type ConsistentHash struct {
+	hash        HashFunc
+	vnodes      int
+	sortedNodes []uint64
+	nodeMap     map[uint64]string
+	// counts holds the number of positions of each node, vnodes unless it
+	// was added with a weight
+	counts map[string]int
+}
+
+func NewConsistentHash(hash HashFunc, vnodes int) *ConsistentHash {
+	return &ConsistentHash{hash: hash, vnodes: vnodes, nodeMap: make(map[uint64]string), counts: make(map[string]int)}
+}
+
+func (c *ConsistentHash) Add(node string) {
+	c.AddWeighted(node, 1)
+}
+
+// AddWeighted gives node weight*vnodes positions, at least one, so a node of
+// weight 2 holds about twice the keys of one of weight 1. The positions of a
+// node are the first ones of its unweighted list, a weight of 1 places it
+// exactly where Add does.
+func (c *ConsistentHash) AddWeighted(node string, weight float64) {
+	count := max(1, int(math.Round(weight*float64(c.vnodes))))
+	c.counts[node] = count
+	for i := range count {
+		uintval := c.hash(node + "#" + strconv.Itoa(i))
+		c.nodeMap[uintval] = node
+		c.sortedNodes = append(c.sortedNodes, uintval)
+	}
+	slices.Sort(c.sortedNodes)
+}
+
+func (c *ConsistentHash) Clone() Partitioner {
+	return &ConsistentHash{hash: c.hash, vnodes: c.vnodes, sortedNodes: slices.Clone(c.sortedNodes), nodeMap: maps.Clone(c.nodeMap), counts: maps.Clone(c.counts)}
+}
+
+func (c *ConsistentHash) Remove(node string) {
+	c.sortedNodes = slices.DeleteFunc(c.sortedNodes, func(u uint64) bool { return c.nodeMap[u] == node })
+	for i := range c.counts[node] {
+		uintval := c.hash(node + "#" + strconv.Itoa(i))
+		if c.nodeMap[uintval] == node {
+			delete(c.nodeMap, uintval)
+		}
+	}
+	delete(c.counts, node)
+}
+
+func (c *ConsistentHash) Replicas(key string, n int) []string {
+	if len(c.sortedNodes) == 0 {
+		return nil
+	}
+	seenSet := map[string]bool{}
+	nodes := []string{}
+	uintval := c.hash(key)
+	index := sort.Search(len(c.sortedNodes), func(i int) bool { return c.sortedNodes[i] >= uintval })
+
+	for i, ct, steps := index%len(c.sortedNodes), 0, 0; steps < len(c.sortedNodes) && ct < n; i, steps = (i+1)%len(c.sortedNodes), steps+1 {
+		if !seenSet[c.nodeMap[c.sortedNodes[i]]] {
+			seenSet[c.nodeMap[c.sortedNodes[i]]] = true
+			nodes = append(nodes, c.nodeMap[c.sortedNodes[i]])
+			ct += 1
+		}
+	}
+	return nodes
+}
+
+// Rendezvous (highest random weight) scores every node for the key and takes
+// the n highest. No per-node state besides the node hash, but a lookup costs
+// O(nodes).
+type Rendezvous struct {
+	hash  HashFunc
+	nodes []rendezvousNode
+}
+
+type rendezvousNode struct {
+	name string
+	h    uint64
+}
+
+func NewRendezvous(hash HashFunc) *Rendezvous {
+	return &Rendezvous{hash: hash}
+}
+
+func (r *Rendezvous) Add(node string) {
+	if slices.ContainsFunc(r.nodes, func(n rendezvousNode) bool { return n.name == node }) {
+		return
+	}
+	r.nodes = append(r.nodes, rendezvousNode{name: node, h: r.hash(node)})
+}
+
+func (r *Rendezvous) Clone() Partitioner {
+	return &Rendezvous{hash: r.hash, nodes: slices.Clone(r.nodes)}
+}
+
+func (r *Rendezvous) Remove(node string) {
+	r.nodes = slices.DeleteFunc(r.nodes, func(n rendezvousNode) bool { return n.name == node })
+}
+
+func (r *Rendezvous) Replicas(key string, n int) []string {
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+	kh := r.hash(key)
+	type scored struct {
+		name  string
+		score uint64
+	}
+	// keep the n best in descending order, n is the replica count and small
+	top := make([]scored, 0, n+1)
+	for _, nd := range r.nodes {
+		s := scored{nd.name, mix(kh ^ nd.h)}
+		i, _ := slices.BinarySearchFunc(top, s, func(a, b scored) int { return cmp.Compare(b.score, a.score) })
+		if i >= n {
+			continue
+		}
+		top = slices.Insert(top, i, s)
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+	out := make([]string, len(top))
+	for i, s := range top {
+		out[i] = s.name
+	}
+	return out
+}
+
+// JumpHash is Lamping and Veach's jump consistent hash over the node list. It
+// needs no memory and balances perfectly, but only the last bucket can be
+// removed cheaply: Remove moves the last node into the removed slot, which
+// also moves that node's keys.
+type JumpHash struct {
+	hash  HashFunc
+	nodes []string
+}
+
+func NewJumpHash(hash HashFunc) *JumpHash {
+	return &JumpHash{hash: hash}
+}
+
+func (j *JumpHash) Add(node string) {
+	if slices.Contains(j.nodes, node) {
+		return
+	}
+	j.nodes = append(j.nodes, node)
+}
+
+func (j *JumpHash) Clone() Partitioner {
+	return &JumpHash{hash: j.hash, nodes: slices.Clone(j.nodes)}
+}
+
+func (j *JumpHash) Remove(node string) {
+	i := slices.Index(j.nodes, node)
+	if i < 0 {
+		return
+	}
+	last := len(j.nodes) - 1
+	j.nodes[i] = j.nodes[last]
+	j.nodes = j.nodes[:last]
+}
+
+// Replicas takes the buckets following the primary
+func (j *JumpHash) Replicas(key string, n int) []string {
+	n = min(n, len(j.nodes))
+	if n <= 0 {
+		return nil
+	}
+	b := jump(j.hash(key), len(j.nodes))
+	out := make([]string, n)
+	for i := range n {
+		out[i] = j.nodes[(b+i)%len(j.nodes)]
+	}
+	return out
+}
+
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// TokenRanges splits the hash space into a fixed number of equal ranges and
+// assigns whole ranges to nodes, like Dynamo's strategy 3. A new node takes
+// ranges from nodes above their fair share, a removed node's ranges go to the
+// least loaded ones, so only the ranges that change owner move.
+type TokenRanges struct {
+	hash   HashFunc
+	owners []string
+	counts map[string]int
+}
+
+func NewTokenRanges(hash HashFunc, tokens int) *TokenRanges {
+	return &TokenRanges{hash: hash, owners: make([]string, tokens), counts: make(map[string]int)}
+}
+
+func (t *TokenRanges) Add(node string) {
+	if _, ok := t.counts[node]; ok {
+		return
+	}
+	if len(t.counts) == 0 {
+		for i := range t.owners {
+			t.owners[i] = node
+		}
+		t.counts[node] = len(t.owners)
+		return
+	}
+
+	target := len(t.owners) / (len(t.counts) + 1)
+	t.counts[node] = 0
+	// visit the ranges in an order specific to the node so the taken ranges
+	// are spread over the ring instead of being one contiguous block
+	order := make([]int, len(t.owners))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(t.hash(node+"#"+strconv.Itoa(a)), t.hash(node+"#"+strconv.Itoa(b)))
+	})
+	for _, p := range order {
+		if t.counts[node] >= target {
+			break
+		}
+		if o := t.owners[p]; t.counts[o] > target {
+			t.owners[p] = node
+			t.counts[o]--
+			t.counts[node]++
+		}
+	}
+}
+
+func (t *TokenRanges) Clone() Partitioner {
+	return &TokenRanges{hash: t.hash, owners: slices.Clone(t.owners), counts: maps.Clone(t.counts)}
+}
+
+func (t *TokenRanges) Remove(node string) {
+	if _, ok := t.counts[node]; !ok {
+		return
+	}
+	delete(t.counts, node)
+	if len(t.counts) == 0 {
+		clear(t.owners)
+		return
+	}
+	for p, o := range t.owners {
+		if o != node {
+			continue
+		}
+		least := ""
+		for n, c := range t.counts {
+			if least == "" || c < t.counts[least] || (c == t.counts[least] && n < least) {
+				least = n
+			}
+		}
+		t.owners[p] = least
+		t.counts[least]++
+	}
+}
+
+// Replicas takes the owners of the following ranges, skipping nodes that were
+// already picked
+func (t *TokenRanges) Replicas(key string, n int) []string {
+	n = min(n, len(t.counts))
+	if n <= 0 {
+		return nil
+	}
+	// range p covers [p, p+1) * 2^64/tokens
+	hi, _ := bits.Mul64(t.hash(key), uint64(len(t.owners)))
+	p := int(hi)
+	out := make([]string, 0, n)
+	for i := 0; i < len(t.owners) && len(out) < n; i++ {
+		o := t.owners[(p+i)%len(t.owners)]
+		if !slices.Contains(out, o) {
+			out = append(out, o)
+		}
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package ring_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"toy_dynamodb/pkg/ring"
+)
+
+func newPartitioner(t testing.TB, name string, nodes int) ring.Partitioner {
+	t.Helper()
+	p, ok := ring.NewPartitioner(name, ring.XXHash)
+	if !ok {
+		t.Fatalf("Expected partitioner %s to exist", name)
+	}
+	for i := range nodes {
+		p.Add(fmt.Sprint("node-", i+1))
+	}
+	return p
+}
+
+func TestPartitionersReturnDistinctReplicas(t *testing.T) {
+	for _, name := range ring.Partitioners {
+		p := newPartitioner(t, name, 5)
+		for i := range 1000 {
+			key := fmt.Sprint("key-", i)
+			rs := p.Replicas(key, 3)
+			if len(rs) != 3 {
+				t.Fatalf("%s: Expected 3 replicas for %s, but got %v", name, key, rs)
+			}
+			if len(slices.Compact(slices.Sorted(slices.Values(rs)))) != 3 {
+				t.Fatalf("%s: Expected distinct replicas for %s, but got %v", name, key, rs)
+			}
+			if again := p.Replicas(key, 3); !slices.Equal(rs, again) {
+				t.Fatalf("%s: Expected the same replicas for %s, but got %v and %v", name, key, rs, again)
+			}
+		}
+		if rs := p.Replicas("k", 10); len(rs) != 5 {
+			t.Errorf("%s: Expected all 5 nodes when asking for more replicas than nodes, but got %v", name, rs)
+		}
+	}
+}
+
+// Only the keys of a removed node may change their primary. Jump hash moves
+// the last bucket into the hole and is left out.
+func TestRemoveMovesOnlyKeysOfRemovedNode(t *testing.T) {
+	for _, name := range []string{ring.PartitionVNodes, ring.PartitionRendezvous, ring.PartitionTokens} {
+		p := newPartitioner(t, name, 6)
+		before := map[string]string{}
+		for i := range 2000 {
+			key := fmt.Sprint("key-", i)
+			before[key] = p.Replicas(key, 1)[0]
+		}
+
+		p.Remove("node-3")
+		for key, was := range before {
+			now := p.Replicas(key, 1)[0]
+			if now == "node-3" {
+				t.Fatalf("%s: Expected removed node-3 to own nothing, but it owns %s", name, key)
+			}
+			if was != "node-3" && now != was {
+				t.Errorf("%s: Expected %s to stay on %s, but it moved to %s", name, key, was, now)
+			}
+		}
+	}
+}
+
+func BenchmarkReplicas(b *testing.B) {
+	for _, nodes := range []int{10, 100} {
+		for _, name := range ring.Partitioners {
+			b.Run(fmt.Sprintf("%s/%d", name, nodes), func(b *testing.B) {
+				p := newPartitioner(b, name, nodes)
+				keys := make([]string, 1024)
+				for i := range keys {
+					keys[i] = fmt.Sprint("key-", i)
+				}
+				b.ResetTimer()
+				for i := range b.N {
+					p.Replicas(keys[i%len(keys)], 3)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ring
+
+import (
+	"sync"
+	"toy_dynamodb/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// repair writes the winner of a read back to the replicas that answered with
+// an older version (read repair, ADR 0003). The winner keeps its version, so
+// a replica that got a newer write in the meantime ignores it. The read waits
+// for the repairs: a read after it sees at least this version on every
+// replica that answered, not only on a quorum. Their errors are ignored, the
+// read already has its answer and the next one tries again. Replicas that
+// didn't answer, e.g. because q of them had the key first, aren't repaired.
+func (tb *Table) repair(key string, rs *replies) {
+	r := tb.r
+	best, deleted := rs.latest()
+	version := best.Version
+	if deleted {
+		version = rs.deleted
+	}
+
+	var stale []string
+	for name, e := range rs.vals {
+		// a tombstone wins a tie, every value loses to it
+		if deleted || e.Version < version {
+			stale = append(stale, name)
+		}
+	}
+	for name, v := range rs.missing {
+		if v < version {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	ctx, span := tracer.Start(tb.context(), "ring.ReadRepair", trace.WithAttributes(attribute.String("kv.table", tb.spec.Name),
+		attribute.String("kv.key", key), attribute.Int("kv.stale", len(stale)), attribute.Int64("kv.version", int64(version))))
+	defer tracing.End(span, nil)
+	rq := &doOpReq{ctx: ctx, table: tb.spec.Name, id: NewRequestID(), key: key, val: best.Value, isDelete: deleted, version: version}
+	t := r.snapshot()
+	var wg sync.WaitGroup
+	for _, name := range stale {
+		nd, ok := t.nodes[name]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.writeOnce(ctx, rq, name, nd)
+		}()
+	}
+	wg.Wait()
+}
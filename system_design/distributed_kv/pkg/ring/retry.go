@@ -0,0 +1,115 @@
+package ring
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	mrand "math/rand/v2"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/rpcerr"
+	"toy_dynamodb/pkg/tracing"
+	kv "toy_dynamodb/proto"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultRetryBaseDelay = 10 * time.Millisecond
+	DefaultRetryMaxDelay  = time.Second
+)
+
+// RetryPolicy controls how a write to a single replica is retried. Every
+// attempt carries the same request id, so a replica that applied the write
+// but whose answer was lost acknowledges the retry without applying it again.
+// The zero value sends every write once.
+type RetryPolicy struct {
+	// MaxAttempts per replica including the first one, 0 and 1 mean no retries
+	MaxAttempts int
+	// BaseDelay is doubled after every attempt up to MaxDelay. The actual wait
+	// is drawn uniformly from [0, delay) so retries of many clients spread out.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// AttemptTimeout bounds a single attempt, 0 means no timeout
+	AttemptTimeout time.Duration
+}
+
+// backoff returns the wait before attempt+1
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MaxDelay
+	if p.BaseDelay <= 0 {
+		d = 0
+	} else if attempt < bits.Len64(uint64(d/p.BaseDelay)) {
+		// BaseDelay<<attempt stays at most MaxDelay, so the shift can't
+		// overflow
+		d = p.BaseDelay << attempt
+	}
+	if d <= 0 {
+		return 0
+	}
+	return mrand.N(d)
+}
+
+// isRetryable reports whether the write may succeed when sent again. Errors
+// about the request itself fail the same way every time.
+func isRetryable(err error) bool {
+	return errors.Is(err, custom_errors.ErrUnavailable) || errors.Is(err, custom_errors.ErrTimeout)
+}
+
+// NewRequestID returns a random id for PutWithID and DeleteWithID
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// writeReplica sends the write to one replica and retries it according to
+// r.Retry while the replica's breaker lets requests through
+func (r *Ring) writeReplica(rq *doOpReq, name string, nd kv.KVStoreClient) (err error) {
+	ctx, span := tracer.Start(context.WithoutCancel(rq.ctx), "ring.replica.Write", trace.WithAttributes(attribute.String("kv.node", name)))
+	defer func() { tracing.End(span, err) }()
+	for attempt := 1; ; attempt++ {
+		err := r.writeOnce(ctx, rq, name, nd)
+		if err == nil || attempt >= r.Retry.MaxAttempts || !isRetryable(err) {
+			span.SetAttributes(attribute.Int("kv.attempts", attempt))
+			return err
+		}
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("kv.attempt", attempt), attribute.String("error", err.Error())))
+		time.Sleep(r.Retry.backoff(attempt - 1))
+		if !r.health.allow(name) {
+			return &custom_errors.UnavailableError{Node: name, Err: errBreakerOpen}
+		}
+	}
+}
+
+func (r *Ring) writeOnce(ctx context.Context, rq *doOpReq, name string, nd kv.KVStoreClient) error {
+	if r.Retry.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Retry.AttemptTimeout)
+		defer cancel()
+	}
+
+	var ok bool
+	var err error
+	if rq.isDelete {
+		var res *kv.DeleteResponse
+		res, err = nd.Delete(ctx, &kv.DeleteRequest{Table: rq.table, Key: rq.key, RequestId: rq.id, Version: rq.version})
+		ok = err == nil && res.Success
+	} else {
+		var res *kv.PutResponse
+		res, err = putValue(ctx, nd, rq)
+		ok = err == nil && res.Success
+	}
+	r.health.record(name, err)
+	if err != nil { // Önce ağ hatası kontrolü
+		return rpcerr.FromStatus(err, name)
+	}
+	if !ok {
+		return fmt.Errorf("Something Went Wrong %s Returned false without error", name)
+	}
+	return nil
+}
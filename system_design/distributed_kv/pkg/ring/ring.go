@@ -1,292 +1,513 @@
 package ring
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"slices"
-	"sort"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hlc"
+	"toy_dynamodb/pkg/hotkey"
+	"toy_dynamodb/pkg/limit"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/table"
+	"toy_dynamodb/pkg/tracing"
 	kv "toy_dynamodb/proto"
 
-	"github.com/cespare/xxhash/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+var tracer = otel.Tracer("toy_dynamodb/pkg/ring")
+
+// VirtualSpotCount is the number of vnodes per node of the default partitioner
 const VirtualSpotCount = 100
 
 type doOpReq struct {
-	key, val string
+	// ctx carries the span of the write to the replica RPCs, not its
+	// cancellation, see Table.WithContext
+	ctx      context.Context
+	table    string
+	id       string
+	key      string
+	val      []byte
 	w        int
 	isDelete bool
+	version  uint64
+}
+
+type replica struct {
+	name string
+	nd   kv.KVStoreClient
 }
 
 type getResponse struct {
 	nodeName string
-	value    string
-	ok       bool
+	value    []byte
+	version  uint64
+	found    bool
 	err      error
 }
+
+// replies collects the answers of a read: the replicas that have the key and
+// the newest tombstone among the ones that don't. missing keeps the tombstone
+// version of every replica without the key for read repair.
+type replies struct {
+	vals    map[string]Entry
+	deleted uint64
+	missing map[string]uint64
+}
+
+func newReplies() *replies {
+	return &replies{vals: make(map[string]Entry), missing: make(map[string]uint64)}
+}
+
+func (rs *replies) add(res getResponse) {
+	if res.found {
+		rs.vals[res.nodeName] = Entry{Value: res.value, Version: res.version}
+	} else {
+		rs.deleted = max(rs.deleted, res.version)
+		rs.missing[res.nodeName] = res.version
+	}
+}
+
+// latest resolves the answers to one value, ordered the way the replicas
+// order writes (ADR 0019). deleted is true when a tombstone newer than every
+// value won, a delete wins a tie.
+func (rs *replies) latest() (best Entry, deleted bool) {
+	first := true
+	for _, e := range rs.vals {
+		if first || e.Version > best.Version || e.Version == best.Version && bytes.Compare(e.Value, best.Value) > 0 {
+			best, first = e, false
+		}
+	}
+	// version 0 only comes from replicas that never had the key
+	return best, rs.deleted != 0 && rs.deleted >= best.Version
+}
+
+type opResponse struct {
+	nodeName string
+	err      error
+}
+
+// errBreakerOpen is the cause reported for replicas skipped by the breaker
+var errBreakerOpen = errors.New("circuit breaker is open")
+
 type Ring struct {
-	nodes        map[string]kv.KVStoreClient
-	connections  []kv.KVStoreClient
-	sortedNodes  []uint64
-	nodeMap      map[uint64]string
-	rwmu         *sync.RWMutex
+	// topo is swapped on membership changes, readers load it without a lock.
+	// mu only serializes the writers, see topology.go
+	topo         atomic.Pointer[topology]
+	mu           *sync.Mutex
 	ReplicaCount uint
+	// Partitioner picks the replicas of a key, nil means consistent hashing
+	// with VirtualSpotCount vnodes and xxhash. Every coordinator of a cluster
+	// must use the same one, see partitioner.go. Init takes it over, the ring
+	// only changes copies of it afterwards.
+	Partitioner Partitioner
+	// DialOptions are used by AddNode, e.g. TLS credentials and per-RPC tokens.
+	// When empty the connection is plaintext.
+	DialOptions []grpc.DialOption
+	// Breaker configures when a failing node is skipped, see health.go
+	Breaker BreakerConfig
+	health  *healthTracker
+	// ReadStrategy and Hedge control how Get picks replicas, see hedge.go
+	ReadStrategy ReadStrategy
+	Hedge        HedgeConfig
+	latency      *latencyTracker
+	// MaxValueSize rejects larger values before they are sent, 0 leaves the
+	// check to the nodes
+	MaxValueSize int
+	// Retry controls retries of Put and Delete, see retry.go
+	Retry RetryPolicy
+	// clock versions the writes of this coordinator, all replicas of a write
+	// store the same version
+	clock hlc.Clock
+	// tables is the catalog of named tables, replaced as a whole, see table.go
+	tables atomic.Pointer[map[string]table.Spec]
+	// limiter holds the rate limits of the tables and full the tables whose
+	// quota a replica reported full, see limits.go. defLimits are the limits
+	// of the default table, nil until they are set or refreshed.
+	limiter   limit.Limiter
+	full      sync.Map
+	defLimits atomic.Pointer[table.Limits]
+	// QuotaBackoff is how long writes of a full table are turned away
+	// without asking the replicas, 0 means DefaultQuotaBackoff
+	QuotaBackoff time.Duration
+	// HotKey counts requests per key and caches reads of hot keys, see
+	// hotkeys.go
+	HotKey HotKeyConfig
+	hot    *hotkey.Tracker
+	cache  *hotCache
 }
 
-func (r *Ring) AddNode(address string) error {
+// Mutation is a write with an explicit version, see Apply
+type Mutation struct {
+	// Table picks the table for Ring.Apply, empty is the default table.
+	// Table.Apply ignores it and writes to its own table.
+	Table  string
+	ID     string
+	Key    string
+	Value  []byte
+	Delete bool
+	// Version 0 takes the next version of the ring's clock
+	Version uint64
+}
 
-	r.rwmu.RLock()
-	if r.nodes == nil {
-		return &custom_errors.ArgError{Arg: fmt.Sprint(r.nodes), Message: "Is Not initilized"}
+func (r *Ring) AddNode(address string) error {
+	if r.mu == nil {
+		return &custom_errors.ArgError{Arg: "ring", Message: "Is Not initilized"}
 	}
-	_, exist := r.nodes[address]
-
-	if exist {
-		r.rwmu.RUnlock()
+	if _, exist := r.snapshot().nodes[address]; exist {
 		return &custom_errors.ArgError{Arg: address, Message: "Already Exist In Node"}
 	}
-	r.rwmu.RUnlock()
 
-	r.rwmu.Lock()
-	defer r.rwmu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// This double check is for fixing TOCTOU
-	// This occurs while routine a runlocks and in exact that moment
-	// routine b locks and adds to the ring, routine a thinks node doesn't exist
-	// bun infact it do exist
-	_, exist = r.nodes[address]
-
-	if exist {
+	// another AddNode may have published the address since the check above
+	t := r.snapshot()
+	if _, exist := t.nodes[address]; exist {
 		return &custom_errors.ArgError{Arg: address, Message: "Already Exist In Node"}
 	}
 
-	nodeConnection, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	dialOpts := r.DialOptions
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	dialOpts = append(slices.Clip(dialOpts), tracing.DialOption())
+	nodeConnection, err := grpc.NewClient(address, dialOpts...)
 
 	if err != nil {
 		return err
 	}
-	for i := range VirtualSpotCount {
 
-		key := address + "#" + strconv.Itoa(i)
-		uintval := getHash(key)
-		r.nodeMap[uintval] = address
-		r.sortedNodes = append(r.sortedNodes, uintval)
+	r.topo.Store(t.with(address, kv.NewKVStoreClient(nodeConnection), healthpb.NewHealthClient(nodeConnection), kv.NewAdminClient(nodeConnection)))
+	return nil
+
+}
+
+func (r *Ring) Get(key string, q int) (map[string][]byte, error) {
+	return r.defaultTable().Get(key, q)
+}
+
+func (tb *Table) Get(key string, q int) (map[string][]byte, error) {
+	rs, err := tb.read(key, q)
+	if err != nil {
+		return nil, tb.limitResult(err)
+	}
+	tb.repair(key, rs)
+	vals := make(map[string][]byte, len(rs.vals))
+	for name, e := range rs.vals {
+		vals[name] = e.Value
 	}
-	slices.Sort(r.sortedNodes)
-	c := kv.NewKVStoreClient(nodeConnection)
+	return vals, nil
+}
 
-	r.nodes[address] = c
-	r.connections = append(r.connections, c)
+// GetLatest reads key like Get and resolves the answers to one value, ordered
+// the way the replicas order writes (ADR 0019). When a replica answered with a
+// tombstone newer than every value that was read the key is NotFound. With
+// HotKey.CacheTTL the answer for a hot key may come from the cache.
+func (r *Ring) GetLatest(key string, q int) (Entry, error) {
+	return r.defaultTable().GetLatest(key, q)
+}
 
-	return nil
+func (tb *Table) GetLatest(key string, q int) (Entry, error) {
+	return tb.cachedLatest(key, q)
+}
 
+func (tb *Table) getLatest(key string, q int) (Entry, error) {
+	rs, err := tb.read(key, q)
+	if err != nil {
+		return Entry{}, tb.limitResult(err)
+	}
+	tb.repair(key, rs)
+	best, deleted := rs.latest()
+	if deleted {
+		return Entry{}, &custom_errors.NotFoundError{Key: key}
+	}
+	best.Key = key
+	return best, nil
 }
 
-func (r *Ring) Get(key string, q int) (map[string]string, error) {
+func (tb *Table) read(key string, q int) (_ *replies, err error) {
+	r := tb.r
+	ctx, span := tracer.Start(tb.context(), "ring.Get", trace.WithAttributes(tb.attributes(key, q)...))
+	defer func() { tracing.End(span, err) }()
+	tb.record(key)
+	if err := tb.admit(false); err != nil {
+		return nil, err
+	}
+	t := r.snapshot()
 
-	if len(r.nodes) < q {
-		return nil, &custom_errors.ArgError{Arg: fmt.Sprintf("%v count is %d", r.nodes, len(r.nodes)), Message: "Write Quorum Count can't be greater than node counts"}
+	if len(t.nodes) < q {
+		return nil, &custom_errors.ArgError{Arg: fmt.Sprintf("node count is %d", len(t.nodes)), Message: "Read Quorum Count can't be greater than node counts"}
 	}
 
-	getNodes := r.getNode(key, int(r.ReplicaCount))
+	getNodes := t.partitioner.Replicas(key, int(tb.spec.ReplicaCount))
 
 	if len(getNodes) == 0 {
 		return nil, &custom_errors.ArgError{Arg: fmt.Sprint(getNodes), Message: " returned count 0"}
 	}
-	vals := make(map[string]string)
-	nodes := make([]struct {
-		name string
-		nd   kv.KVStoreClient
-	}, 0, len(getNodes))
+	nodes := make([]replica, 0, len(getNodes))
+	causes := make(map[string]error)
 
-	r.rwmu.RLock()
 	for _, n := range getNodes {
-		nodes = append(nodes, struct {
-			name string
-			nd   kv.KVStoreClient
-		}{n, r.nodes[n]})
+		// nodes with an open breaker are skipped, see health.go
+		if !r.health.allow(n) {
+			causes[n] = &custom_errors.UnavailableError{Node: n, Err: errBreakerOpen}
+			continue
+		}
+		nodes = append(nodes, replica{n, t.nodes[n]})
+	}
+
+	if len(nodes) < q {
+		for _, p := range nodes {
+			r.health.release(p.name)
+		}
+		return nil, &custom_errors.QuorumReadError{Message: fmt.Sprintf("only %d of %d replicas are up", len(nodes), len(getNodes)), R: q, N: len(getNodes), Causes: causes}
+	}
+
+	if r.ReadStrategy == ReadHedged {
+		return r.getHedged(ctx, tb.spec.Name, key, q, nodes, len(getNodes), causes)
 	}
-	r.rwmu.RUnlock()
 
+	rs := newReplies()
 	ch := make(chan getResponse, len(nodes))
 	for _, p := range nodes {
-		go func(n string, nd kv.KVStoreClient) {
-			v, err := nd.Get(context.Background(), &kv.GetRequest{Key: key})
-			if err != nil {
-				ch <- getResponse{nodeName: n, err: err, ok: false}
-				return
-			}
-			ch <- getResponse{nodeName: n, value: string(v.Value), ok: v.Found, err: err}
-		}(p.name, p.nd)
+		go r.fetch(ctx, tb.spec.Name, key, p, ch)
 	}
 
-	s, f := 0, 0
+	answered, failed := 0, 0
 	for {
 		res := <-ch
 
-		if res.ok {
-			vals[res.nodeName] = res.value
-			s++
+		if res.err != nil {
+			causes[res.nodeName] = res.err
+			failed++
 		} else {
-			f++
+			answered++
+			rs.add(res)
 		}
 
-		if s == q {
-			return vals, nil
-		} else if f == len(getNodes) {
-			return nil, &custom_errors.QuorumReadError{Message: fmt.Sprintf("%s not found at any node", key), R: q, N: len(getNodes)}
-
-		} else if s+f == len(getNodes) {
-
-			return nil, &custom_errors.QuorumReadError{Message: "Failed to hit quorum", R: q, N: len(getNodes)}
-
+		if len(rs.vals) == q {
+			return rs, nil
+		} else if answered+failed == len(nodes) {
+			return r.readResult(key, q, len(getNodes), rs, answered, causes)
 		}
 	}
 
 }
 
-func (r *Ring) Put(key, val string, w int) error {
-	// pass by address for get rid unnecessary copies
-	return r.doOp(&doOpReq{key: key, val: val, w: w, isDelete: false})
+// readResult decides a read once every contacted replica answered without q
+// of them having the key. A replica without the key still answered, so a key
+// that is absent on a quorum is NotFound and only errors count against it.
+func (r *Ring) readResult(key string, q, n int, rs *replies, answered int, causes map[string]error) (*replies, error) {
+	switch {
+	case len(rs.vals) > 0 && answered >= q:
+		return rs, nil
+	case answered >= q:
+		return nil, &custom_errors.NotFoundError{Key: key}
+	}
+	return nil, &custom_errors.QuorumReadError{Message: "Failed to hit quorum", R: q, N: n, Causes: causes}
 }
 
-func (r *Ring) Delete(key string, w int) error {
-
-	return r.doOp(&doOpReq{key: key, w: w, isDelete: true})
+// Put doesn't copy val, it must not be modified until Put returns
+func (r *Ring) Put(key string, val []byte, w int) error {
+	return r.defaultTable().Put(key, val, w)
 }
 
-func (r *Ring) Init() {
-	r.nodeMap = make(map[uint64]string)
-	r.nodes = make(map[string]kv.KVStoreClient)
-	r.sortedNodes = []uint64{}
-	r.rwmu = &sync.RWMutex{}
+func (tb *Table) Put(key string, val []byte, w int) error {
+	return tb.PutWithID(NewRequestID(), key, val, w)
 }
 
-// Burası ramde test yapabilmek için var olan bir yer genel logici test etiyoruz yani
-func (r *Ring) RegisterClient(address string, client kv.KVStoreClient) {
-	r.rwmu.Lock()
-	defer r.rwmu.Unlock()
+// PutWithID is Put with a caller chosen request id. Calling it again with the
+// same id after an error doesn't apply the write twice on a replica that
+// already has it.
+func (r *Ring) PutWithID(id, key string, val []byte, w int) error {
+	return r.defaultTable().PutWithID(id, key, val, w)
+}
 
-	if _, exists := r.nodes[address]; exists {
-		return
-	}
+func (tb *Table) PutWithID(id, key string, val []byte, w int) error {
+	return tb.Apply(Mutation{ID: id, Key: key, Value: val}, w)
+}
 
-	// 1. Client'ı kaydet
-	r.nodes[address] = client
-	r.connections = append(r.connections, client)
+func (r *Ring) Delete(key string, w int) error {
+	return r.defaultTable().Delete(key, w)
+}
 
-	for i := range VirtualSpotCount {
-		key := address + "#" + strconv.Itoa(i)
-		uintval := getHash(key)
-		r.nodeMap[uintval] = address
-		r.sortedNodes = append(r.sortedNodes, uintval)
-	}
-	slices.Sort(r.sortedNodes)
+func (tb *Table) Delete(key string, w int) error {
+	return tb.DeleteWithID(NewRequestID(), key, w)
 }
 
-func (r *Ring) getNode(val string, n int) []string {
+func (r *Ring) DeleteWithID(id, key string, w int) error {
+	return r.defaultTable().DeleteWithID(id, key, w)
+}
 
-	r.rwmu.RLock()
-	defer r.rwmu.RUnlock()
+func (tb *Table) DeleteWithID(id, key string, w int) error {
+	return tb.Apply(Mutation{ID: id, Key: key, Delete: true}, w)
+}
 
-	seenSet := map[string]bool{}
-	nodes := []string{}
-	uintval := getHash(val)
-	index := sort.Search(len(r.sortedNodes), func(i int) bool { return r.sortedNodes[i] >= uintval })
+// Apply writes m to w replicas of m.Table. A replica keeps the value with the
+// highest version, so a mutation older than what a replica has is
+// acknowledged but not applied. Writes replicated from another cluster keep
+// their version this way, see pkg/xdcr. A table that isn't in the catalog
+// yet is looked up with RefreshTables once.
+func (r *Ring) Apply(m Mutation, w int) error {
+	tb, err := r.Table(m.Table)
+	if err != nil {
+		if rerr := r.RefreshTables(context.Background()); rerr != nil {
+			return err
+		}
+		if tb, err = r.Table(m.Table); err != nil {
+			return err
+		}
+	}
+	return tb.Apply(m, w)
+}
 
-	for i, ct, steps := ((index) % len(r.sortedNodes)), 0, 0; steps < len(r.sortedNodes) && ct < n; i, steps = (i+1)%len(r.sortedNodes), steps+1 {
+func (tb *Table) Apply(m Mutation, w int) (err error) {
+	r := tb.r
+	name := "ring.Put"
+	if m.Delete {
+		name = "ring.Delete"
+	}
+	ctx, span := tracer.Start(tb.context(), name, trace.WithAttributes(tb.attributes(m.Key, w)...))
+	defer func() { tracing.End(span, err) }()
+	if err := node.ValidKey(m.Key); err != nil {
+		return err
+	}
+	if !m.Delete && r.MaxValueSize > 0 && len(m.Value) > r.MaxValueSize {
+		return &custom_errors.ValueTooLargeError{Key: m.Key, Size: len(m.Value), Max: r.MaxValueSize}
+	}
+	if m.ID == "" {
+		m.ID = NewRequestID()
+	}
+	if m.Version == 0 {
+		m.Version = r.clock.Now()
+	} else {
+		r.clock.Observe(m.Version)
+	}
+	tb.record(m.Key)
+	if err := tb.admit(!m.Delete); err != nil {
+		return err
+	}
+	tb.invalidate(m.Key)
+	defer tb.invalidate(m.Key)
+	// pass by address for get rid unnecessary copies
+	span.SetAttributes(attribute.Int64("kv.version", int64(m.Version)))
+	return tb.limitResult(tb.doOp(&doOpReq{ctx: ctx, table: tb.spec.Name, id: m.ID, key: m.Key, val: m.Value, w: w, isDelete: m.Delete, version: m.Version}))
+}
 
-		if seenSet[r.nodeMap[r.sortedNodes[i]]] != true {
+func (r *Ring) Init() {
+	if r.Partitioner == nil {
+		r.Partitioner = NewConsistentHash(XXHash, VirtualSpotCount)
+	}
+	r.topo.Store(&topology{
+		nodes:       make(map[string]kv.KVStoreClient),
+		health:      make(map[string]healthpb.HealthClient),
+		admin:       make(map[string]kv.AdminClient),
+		partitioner: r.Partitioner.Clone(),
+	})
+	r.mu = &sync.Mutex{}
+	r.health = newHealthTracker(r.Breaker)
+	r.latency = newLatencyTracker()
+	if r.Hedge.Percentile <= 0 || r.Hedge.Percentile > 1 {
+		r.Hedge.Percentile = DefaultHedgePercentile
+	}
+	if r.Hedge.Delay <= 0 {
+		r.Hedge.Delay = DefaultHedgeDelay
+	}
+	if r.Retry.BaseDelay <= 0 {
+		r.Retry.BaseDelay = DefaultRetryBaseDelay
+	}
+	if r.Retry.MaxDelay <= 0 {
+		r.Retry.MaxDelay = DefaultRetryMaxDelay
+	}
+	if r.QuotaBackoff <= 0 {
+		r.QuotaBackoff = DefaultQuotaBackoff
+	}
+	r.initHotKeys()
+}
 
-			seenSet[r.nodeMap[r.sortedNodes[i]]] = true
-			nodes = append(nodes, r.nodeMap[r.sortedNodes[i]])
-			ct += 1
+// Burası ramde test yapabilmek için var olan bir yer genel logici test etiyoruz yani
+// Client kv.AdminClient'ı da implement ediyorsa tablo yönetimi de onun üzerinden yapılır
+func (r *Ring) RegisterClient(address string, client kv.KVStoreClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		}
+	t := r.snapshot()
+	if _, exists := t.nodes[address]; exists {
+		return
 	}
-	return nodes
 
+	// 1. Client'ı kaydet
+	ac, _ := client.(kv.AdminClient)
+	r.topo.Store(t.with(address, client, nil, ac))
 }
 
-func (r *Ring) doOp(rq *doOpReq) error {
+func (tb *Table) doOp(rq *doOpReq) error {
+	r := tb.r
+	t := r.snapshot()
 
-	if len(r.nodes) < rq.w {
-		return &custom_errors.ArgError{Arg: fmt.Sprintf("%v count is %d", r.nodes, len(r.nodes)), Message: "Write Quorum Count can't be greater than node counts"}
+	if len(t.nodes) < rq.w {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("node count is %d", len(t.nodes)), Message: "Write Quorum Count can't be greater than node counts"}
 	}
 
-	getNodes := r.getNode(rq.key, int(r.ReplicaCount))
+	getNodes := t.partitioner.Replicas(rq.key, int(tb.spec.ReplicaCount))
 
 	if len(getNodes) == 0 {
 		return &custom_errors.ArgError{Arg: fmt.Sprint(getNodes), Message: " returned count 0"}
 	}
 
-	nodes := make([]kv.KVStoreClient, 0, len(getNodes))
-	r.rwmu.RLock()
+	nodes := make(map[string]kv.KVStoreClient, len(getNodes))
+	causes := make(map[string]error)
 
 	for _, n := range getNodes {
-		nd := r.nodes[n]
-		if nd != nil {
-			nodes = append(nodes, nd)
+		if r.health.allow(n) {
+			nodes[n] = t.nodes[n]
+		} else {
+			causes[n] = &custom_errors.UnavailableError{Node: n, Err: errBreakerOpen}
 		}
 	}
-	r.rwmu.RUnlock()
-	ch := make(chan error, len(nodes))
-
-	for _, nd := range nodes {
-		go func(nd kv.KVStoreClient) {
-			var err error
-			var deleteRes *kv.DeleteResponse
-			var putRes *kv.PutResponse
-			if rq.isDelete {
-				deleteRes, err = nd.Delete(context.Background(), &kv.DeleteRequest{Key: rq.key})
-				if err != nil { // Önce ağ hatası kontrolü
-					ch <- err
-					return
-				}
-
-				if !deleteRes.Success {
-					err = fmt.Errorf("Something Went Wrong DeleteRes Returned false without error")
-				}
-
-			} else {
-				putRes, err = nd.Put(context.Background(), &kv.PutRequest{Key: rq.key, Value: []byte(rq.val)})
-				if err != nil { // Önce ağ hatası kontrolü
-					ch <- err
-					return
-				}
-				if !putRes.Success {
-					err = fmt.Errorf("Something Went Wrong DeleteRes Returned false without error")
-				}
-
-			}
-			ch <- err
-		}(nd)
+
+	if len(nodes) < rq.w {
+		for n := range nodes {
+			r.health.release(n)
+		}
+		return &custom_errors.QuorumWriteError{Message: fmt.Sprintf("only %d of %d replicas are up", len(nodes), len(getNodes)), W: rq.w, N: len(getNodes), Causes: causes}
+	}
+	ch := make(chan opResponse, len(nodes))
+
+	for name, nd := range nodes {
+		go func(name string, nd kv.KVStoreClient) {
+			ch <- opResponse{name, r.writeReplica(rq, name, nd)}
+		}(name, nd)
 	}
 
 	s, f := 0, 0
 
 	for {
-		err := <-ch
+		res := <-ch
 
-		if err == nil {
+		if res.err == nil {
 			s++
 		} else {
+			causes[res.nodeName] = res.err
 			f++
 		}
 
 		if s == rq.w {
 			return nil
 		} else if s+f == len(nodes) {
-			return &custom_errors.QuorumWriteError{Message: "Failed to hit quorum", W: rq.w, N: len(nodes)}
+			return &custom_errors.QuorumWriteError{Message: "Failed to hit quorum", W: rq.w, N: len(nodes), Causes: causes}
 		}
 	}
 }
-
-func getHash(val string) uint64 {
-	return xxhash.Sum64String(val)
-}
@@ -0,0 +1,843 @@
+package ring_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/adapter"
+	"toy_dynamodb/pkg/chunk"
+	"toy_dynamodb/pkg/limit"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/simnet"
+	"toy_dynamodb/pkg/table"
+	kv "toy_dynamodb/proto"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var nodeNames = []string{"node-1", "node-2", "node-3"}
+
+func newCluster(t *testing.T, seed int64, r *ring.Ring) *simnet.Network {
+	t.Helper()
+
+	net := simnet.New(seed, t.TempDir())
+	r.Init()
+	for _, name := range nodeNames {
+		c, err := net.AddNode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RegisterClient(name, c)
+	}
+	t.Cleanup(func() { net.Close() })
+	return net
+}
+
+// replicasWith counts the nodes whose storage engine holds key=val
+func replicasWith(net *simnet.Network, key, val string) int {
+	c := 0
+	for _, name := range nodeNames {
+		if v, ok := net.Node(name).Get(key); ok && string(v) == val {
+			c++
+		}
+	}
+	return c
+}
+
+func TestPutGetQuorum(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	newCluster(t, 1, r)
+
+	if err := r.Put("Mahmut", []byte("Ozer"), 2); err != nil {
+		t.Fatalf("Expected put to succeed but got %v", err)
+	}
+
+	vals, err := r.Get("Mahmut", 2)
+	if err != nil {
+		t.Fatalf("Expected get to succeed but got %v", err)
+	}
+	if len(vals) != 2 {
+		t.Errorf("Expected 2 values, but got %v", vals)
+	}
+	for n, v := range vals {
+		if string(v) != "Ozer" {
+			t.Errorf("Expected Ozer from %s but got %v", n, v)
+		}
+	}
+}
+
+func TestQuorumNotMetUnderPartition(t *testing.T) {
+	// keep the breaker out of the way, the partitioned nodes must be contacted
+	r := &ring.Ring{ReplicaCount: 3, Breaker: ring.BreakerConfig{FailureThreshold: 100}}
+	net := newCluster(t, 1, r)
+
+	if err := r.Put("k", []byte("v"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	net.Partition("node-1", "node-2")
+
+	var wErr *custom_errors.QuorumWriteError
+	if err := r.Put("k", []byte("v2"), 2); !errors.As(err, &wErr) {
+		t.Errorf("Expected QuorumWriteError with 1 of 3 replicas reachable, but got %v", err)
+	}
+	if err := r.Put("k", []byte("v2"), 1); err != nil {
+		t.Errorf("Expected w=1 to succeed with 1 replica reachable, but got %v", err)
+	}
+
+	var rErr *custom_errors.QuorumReadError
+	if _, err := r.Get("k", 2); !errors.As(err, &rErr) {
+		t.Errorf("Expected QuorumReadError with 1 of 3 replicas reachable, but got %v", err)
+	}
+
+	net.Heal()
+	if _, err := r.Get("k", 3); err != nil {
+		t.Errorf("Expected r=3 to succeed after heal, but got %v", err)
+	}
+}
+
+// Every acknowledged write must be on at least W replicas, no matter how many
+// requests and responses the network lost.
+func TestAckedWritesReachWReplicasUnderLoss(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 42, r)
+	net.SetLink(simnet.Link{MaxDelay: time.Millisecond, DropRequest: 0.2, DropResponse: 0.2})
+
+	const w = 2
+	acked := 0
+	for i := range 300 {
+		key, val := fmt.Sprint("key-", i), fmt.Sprint("val-", i)
+		if err := r.Put(key, []byte(val), w); err != nil {
+			continue
+		}
+		acked++
+		if c := replicasWith(net, key, val); c < w {
+			t.Errorf("Expected %s on at least %d replicas, but found it on %d", key, w, c)
+		}
+	}
+	if acked == 0 {
+		t.Fatal("Expected some writes to be acknowledged")
+	}
+}
+
+// Acknowledged writes survive a crash of every node, including torn WAL tails.
+func TestDurabilityAcrossCrashes(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 7, r)
+	net.SetLink(simnet.Link{MaxDelay: time.Millisecond, DropRequest: 0.1, DropResponse: 0.1})
+
+	// w=N, an acked write has no replica call left in flight when the nodes crash
+	const w = 3
+	acked := map[string]string{}
+	for i := range 100 {
+		key, val := fmt.Sprint("key-", i), fmt.Sprint("val-", i)
+		if r.Put(key, []byte(val), w) == nil {
+			acked[key] = val
+		}
+	}
+	if len(acked) == 0 {
+		t.Fatal("Expected some writes to be acknowledged")
+	}
+
+	for _, name := range nodeNames {
+		if err := net.Crash(name, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range nodeNames {
+		if err := net.Restart(name); err != nil {
+			t.Fatalf("Expected %s to recover from a torn WAL, but got %v", name, err)
+		}
+		if net.Node(name).CleanStart() {
+			t.Errorf("Expected %s to detect the crash", name)
+		}
+	}
+
+	for key, val := range acked {
+		if c := replicasWith(net, key, val); c < w {
+			t.Errorf("Expected %s on at least %d replicas after restart, but found it on %d", key, w, c)
+		}
+	}
+}
+
+// With R+W>N a read always overlaps the replicas of the last acked write,
+// even if one replica missed it during a partition.
+func TestQuorumIntersectionAfterPartition(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 3, r)
+
+	if err := r.Put("k", []byte("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+	net.Partition("node-3")
+	if err := r.Put("k", []byte("new"), 2); err != nil {
+		t.Fatal(err)
+	}
+	net.Heal()
+
+	vals, err := r.Get("k", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, v := range vals {
+		found = found || string(v) == "new"
+	}
+	if !found {
+		t.Errorf("Expected a R=3 read to observe the latest write, but got %v", vals)
+	}
+}
+
+// A stale replica answers too, GetLatest must pick the newest value and see
+// a delete that only reached the other replicas.
+func TestGetLatestResolvesStaleReplicas(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 3, r)
+
+	if err := r.Put("k", []byte("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+	net.Partition("node-3")
+	if err := r.Put("k", []byte("new"), 2); err != nil {
+		t.Fatal(err)
+	}
+	net.Heal()
+
+	e, err := r.GetLatest("k", 3)
+	if err != nil || string(e.Value) != "new" || e.Version == 0 {
+		t.Errorf("Expected the latest write with its version, but got %+v and %v", e, err)
+	}
+
+	net.Partition("node-3")
+	if err := r.Delete("k", 2); err != nil {
+		t.Fatal(err)
+	}
+	net.Heal()
+	if _, err := r.GetLatest("k", 3); !errors.Is(err, custom_errors.ErrNotFound) {
+		t.Errorf("Expected the delete to hide the stale replica, but got %v", err)
+	}
+}
+
+// A replica that missed a change of the indexed field still matches the old
+// value, QueryIndex must not report it.
+func TestQueryIndexSkipsStaleReplicas(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	r.Init()
+	opts := node.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.FsyncMode = node.FsyncNever
+	opts.Indexes = []node.Index{{Name: "email", Prefix: "users/", Field: "email"}}
+	nodes := map[string]*node.Node{}
+	for _, name := range nodeNames {
+		n, err := node.NewWithOptions(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { n.Close() })
+		nodes[name] = n
+		r.RegisterClient(name, adapter.NewLocalClient(n))
+	}
+
+	for _, name := range nodeNames {
+		nodes[name].Apply(node.Write{Key: "users/1", Value: []byte(`{"email":"old@x.com"}`), Version: 1})
+	}
+	nodes["node-1"].Apply(node.Write{Key: "users/1", Value: []byte(`{"email":"new@x.com"}`), Version: 2})
+	nodes["node-2"].Apply(node.Write{Key: "users/1", Value: []byte(`{"email":"new@x.com"}`), Version: 2})
+	if err := r.Put("users/2", []byte(`{"email":"old@x.com"}`), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(value string) []string {
+		var got []string
+		if err := r.QueryIndex(context.Background(), "email", value, 2, func(e ring.Entry) error {
+			got = append(got, e.Key)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := keys("old@x.com"); !reflect.DeepEqual(got, []string{"users/2"}) {
+		t.Errorf("Expected only users/2 to still have the old email, but got %v", got)
+	}
+	if got := keys("new@x.com"); !reflect.DeepEqual(got, []string{"users/1"}) {
+		t.Errorf("Expected users/1 to be found by its new email, but got %v", got)
+	}
+}
+
+// A table's writes go to its own replica count and stay out of the default
+// table, a second coordinator finds it with RefreshTables
+func TestTableReplicaCount(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	r.Init()
+	opts := node.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.FsyncMode = node.FsyncNever
+	stores := map[string]*table.Store{}
+	for _, name := range nodeNames {
+		s, err := table.Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		stores[name] = s
+		r.RegisterClient(name, adapter.NewStoreClient(s))
+	}
+
+	if err := r.CreateTable(context.Background(), table.Spec{Name: "cache", ReplicaCount: 4}); !errors.Is(err, custom_errors.ErrInvalidArgument) {
+		t.Errorf("Expected an ArgError for 4 replicas on 3 nodes but got %v", err)
+	}
+	if err := r.CreateTable(context.Background(), table.Spec{Name: "cache", ReplicaCount: 1, Consistency: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	tb, err := r.Table("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := tb.QuorumSize(""); q != 1 {
+		t.Errorf("Expected the default level of the table to need 1 replica but got %d", q)
+	}
+	if err := tb.Put("k", []byte("v"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tb.Get("k", 2); err == nil {
+		t.Error("Expected r=2 to fail on a table with 1 replica")
+	}
+
+	holders := 0
+	for _, s := range stores {
+		n, _ := s.Node("cache")
+		if _, found := n.Get("k"); found {
+			holders++
+		}
+		if _, found := s.Default().Get("k"); found {
+			t.Error("Expected the default table not to have k")
+		}
+	}
+	if holders != 1 {
+		t.Errorf("Expected 1 replica of k but got %d", holders)
+	}
+
+	other := &ring.Ring{ReplicaCount: 3}
+	other.Init()
+	for _, name := range nodeNames {
+		other.RegisterClient(name, adapter.NewStoreClient(stores[name]))
+	}
+	if _, err := other.Table("cache"); err == nil {
+		t.Error("Expected an unknown table before RefreshTables")
+	}
+	if err := other.RefreshTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tb, err = other.Table("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := tb.GetLatest("k", 1); err != nil || string(e.Value) != "v" {
+		t.Errorf("Expected v but got %q, %v", e.Value, err)
+	}
+
+	if err := r.DropTable(context.Background(), "cache"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores["node-1"].Node("cache"); err == nil {
+		t.Error("Expected the table to be dropped on every node")
+	}
+}
+
+// The coordinator limits its own requests, the nodes limit what another
+// coordinator sends them, and a full quota turns writes away but not deletes
+func TestTableLimits(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	r.Init()
+	other := &ring.Ring{ReplicaCount: 3}
+	other.Init()
+	opts := node.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.FsyncMode = node.FsyncNever
+	for _, name := range nodeNames {
+		s, err := table.Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		r.RegisterClient(name, adapter.NewStoreClient(s))
+		other.RegisterClient(name, adapter.NewStoreClient(s))
+	}
+	ctx := context.Background()
+
+	if err := r.SetLimits(ctx, "", table.Limits{Rate: limit.Rate{PerSecond: 0.001, Burst: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put("a", []byte("1"), 3); err != nil {
+		t.Fatal(err)
+	}
+	var re *custom_errors.ResourceExhaustedError
+	if err := r.Put("b", []byte("1"), 1); !errors.As(err, &re) || re.RetryAfter <= 0 {
+		t.Errorf("Expected the coordinator to rate limit with a retry-after but got %v", err)
+	}
+	if err := other.Put("b", []byte("1"), 1); !errors.As(err, &re) || re.RetryAfter <= 0 {
+		t.Errorf("Expected the nodes to rate limit a coordinator without limits but got %v", err)
+	}
+	if err := r.SetLimits(ctx, "", table.Limits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.CreateTable(ctx, table.Spec{Name: "small", ReplicaCount: 3, Limits: table.Limits{QuotaBytes: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	tb, _ := r.Table("small")
+	if err := tb.Put("a", []byte("1234567"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Put("b", []byte("1234567"), 2); !errors.As(err, &re) || re.RetryAfter != 0 {
+		t.Errorf("Expected the quota error of the replicas but got %v", err)
+	}
+	if err := tb.Put("b", []byte("1234567"), 2); !errors.As(err, &re) || re.RetryAfter <= 0 {
+		t.Errorf("Expected the coordinator to turn the write away for a while but got %v", err)
+	}
+	if err := tb.Delete("a", 2); err != nil {
+		t.Errorf("Expected a delete to pass a full quota but got %v", err)
+	}
+
+	if err := other.RefreshTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tb, err := other.Table("small"); err != nil || tb.Spec().QuotaBytes != 10 {
+		t.Errorf("Expected the refreshed catalog to have the quota of small but got %v", err)
+	}
+}
+
+// A hot key is read from the cache until a write through the same
+// coordinator, a write of another coordinator is only seen by a stronger or
+// an uncached read. Both the coordinator and the nodes list the key as hot.
+func TestHotKeyCache(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3, HotKey: ring.HotKeyConfig{CacheTTL: time.Minute, Threshold: 1}}
+	r.Init()
+	other := &ring.Ring{ReplicaCount: 3}
+	other.Init()
+	opts := node.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	opts.FsyncMode = node.FsyncNever
+	for _, name := range nodeNames {
+		s, err := table.Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		r.RegisterClient(name, adapter.NewStoreClient(s))
+		other.RegisterClient(name, adapter.NewStoreClient(s))
+	}
+
+	if err := r.Put("leaderboard", []byte("v1"), 3); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		r.GetLatest("leaderboard", 2)
+	}
+	if err := other.Put("leaderboard", []byte("v2"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := r.GetLatest("leaderboard", 2); err != nil || string(e.Value) != "v1" {
+		t.Errorf("Expected the cached v1 but got %q %v", e.Value, err)
+	}
+	tb, _ := r.Table("")
+	if e, err := tb.WithoutCache().GetLatest("leaderboard", 2); err != nil || string(e.Value) != "v2" {
+		t.Errorf("Expected an uncached read to see v2 but got %q %v", e.Value, err)
+	}
+	if e, err := r.GetLatest("leaderboard", 3); err != nil || string(e.Value) != "v2" {
+		t.Errorf("Expected a stronger read than the cached one to see v2 but got %q %v", e.Value, err)
+	}
+	if err := r.Put("leaderboard", []byte("v3"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := r.GetLatest("leaderboard", 1); err != nil || string(e.Value) != "v3" {
+		t.Errorf("Expected the write to invalidate the cache but got %q %v", e.Value, err)
+	}
+
+	if hot := r.HotKeys(1); len(hot) != 1 || hot[0].Key != "leaderboard" {
+		t.Errorf("Expected the coordinator to list leaderboard as hot but got %+v", hot)
+	}
+	res, err := r.AdminClient("node-1").HotKeys(context.Background(), &kv.HotKeysRequest{Limit: 1})
+	if err != nil || len(res.Keys) != 1 || res.Keys[0].Key != "leaderboard" || res.Keys[0].Count == 0 {
+		t.Errorf("Expected node-1 to list leaderboard as hot but got %v %v", res, err)
+	}
+}
+
+// A replica that missed a write or a delete during a partition gets it back
+// from the next read that sees it stale.
+func TestReadRepair(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 5, r)
+
+	if err := r.Put("k", []byte("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+	net.Partition("node-3")
+	if err := r.Put("k", []byte("new"), 2); err != nil {
+		t.Fatal(err)
+	}
+	net.Heal()
+	if c := replicasWith(net, "k", "new"); c != 2 {
+		t.Fatalf("Expected node-3 to miss the write, but new is on %d replicas", c)
+	}
+
+	if _, err := r.Get("k", 3); err != nil {
+		t.Fatal(err)
+	}
+	if c := replicasWith(net, "k", "new"); c != 3 {
+		t.Errorf("Expected the read to repair node-3, but new is on %d replicas", c)
+	}
+
+	net.Partition("node-3")
+	if err := r.Delete("k", 2); err != nil {
+		t.Fatal(err)
+	}
+	net.Heal()
+	if _, err := r.GetLatest("k", 3); !errors.Is(err, custom_errors.ErrNotFound) {
+		t.Fatalf("Expected the delete to win, but got %v", err)
+	}
+	if v, ok := net.Node("node-3").Get("k"); ok {
+		t.Errorf("Expected the read to delete k on node-3, but it still has %q", v)
+	}
+	// the repair keeps the version of the write it copies
+	if _, v1, _ := net.Node("node-1").GetVersion("k"); v1 == 0 {
+		t.Error("Expected node-1 to keep the tombstone's version")
+	} else if _, v3, _ := net.Node("node-3").GetVersion("k"); v3 != v1 {
+		t.Errorf("Expected node-3 to get the tombstone with version %d but got %d", v1, v3)
+	}
+}
+
+// Scheduled faults and seeded loss produce the same history on every run.
+func TestScheduleIsDeterministic(t *testing.T) {
+	run := func() []bool {
+		r := &ring.Ring{ReplicaCount: 3, Breaker: ring.BreakerConfig{FailureThreshold: 100}}
+		net := newCluster(t, 99, r)
+		net.SetLink(simnet.Link{DropRequest: 0.1, DropResponse: 0.1})
+		net.Schedule(
+			simnet.Event{AtStep: 10, Do: simnet.Partition("node-2")},
+			simnet.Event{AtStep: 20, Do: simnet.Crash("node-1", true)},
+			simnet.Event{AtStep: 30, Do: simnet.Heal()},
+			simnet.Event{AtStep: 30, Do: simnet.Restart("node-1")},
+		)
+
+		var history []bool
+		for i := range 50 {
+			net.Step()
+			key := fmt.Sprint("key-", i%10)
+			history = append(history, r.Put(key, []byte(fmt.Sprint(i)), 3) == nil)
+			_, err := r.Get(key, 3)
+			history = append(history, err == nil)
+		}
+		return history
+	}
+
+	first, second := run(), run()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same history for the same seed\n%v\n%v", first, second)
+	}
+}
+
+func TestBreakerSkipsPartitionedNode(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3, Breaker: ring.BreakerConfig{FailureThreshold: 2, Cooldown: time.Hour}}
+	net := newCluster(t, 1, r)
+
+	// w=3 waits for node-3's failure, so no RPC is still in flight afterwards
+	net.Partition("node-3")
+	for i := range 2 {
+		r.Put(fmt.Sprint("k", i), []byte("v"), 3)
+	}
+	if s := r.NodeState("node-3"); s != ring.NodeDown {
+		t.Fatalf("Expected node-3 to be down, but got %v", s)
+	}
+
+	before := net.Calls()
+	if err := r.Put("k", []byte("v"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if c := net.Calls() - before; c != 2 {
+		t.Errorf("Expected 2 RPCs with node-3 skipped, but got %d", c)
+	}
+}
+
+func TestHedgedReadAvoidsSlowReplica(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3, ReadStrategy: ring.ReadHedged, Hedge: ring.HedgeConfig{Delay: 5 * time.Millisecond}}
+	net := newCluster(t, 1, r)
+
+	if err := r.Put("k", []byte("v"), 3); err != nil {
+		t.Fatal(err)
+	}
+	net.SetLink(simnet.Link{MinDelay: 200 * time.Millisecond, MaxDelay: 201 * time.Millisecond}, "node-2")
+
+	start := time.Now()
+	if _, err := r.Get("k", 2); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Expected the hedge to bypass the slow replica, but the read took %v", d)
+	}
+}
+
+// Values above the single message threshold go through PutStream/GetStream.
+func TestLargeValueRoundTrip(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	newCluster(t, 1, r)
+
+	val := make([]byte, 3*chunk.Size+17)
+	for i := range val {
+		val[i] = byte(i % 251)
+	}
+	if err := r.Put("blob", val, 3); err != nil {
+		t.Fatalf("Expected a %d byte put to succeed, but got %v", len(val), err)
+	}
+
+	vals, err := r.Get("blob", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, v := range vals {
+		if !bytes.Equal(v, val) {
+			t.Errorf("Expected %s to return the %d byte value, but got %d bytes", n, len(val), len(v))
+		}
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3, MaxValueSize: 1024}
+	newCluster(t, 1, r)
+
+	var tooLarge *custom_errors.ValueTooLargeError
+	if err := r.Put("k", make([]byte, 1025), 2); !errors.As(err, &tooLarge) {
+		t.Errorf("Expected ValueTooLargeError, but got %v", err)
+	}
+	if err := r.Put("k", make([]byte, 1024), 2); err != nil {
+		t.Errorf("Expected a value at the limit to be accepted, but got %v", err)
+	}
+}
+
+func TestGetDistinguishesAbsentFromUnreachable(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3, Breaker: ring.BreakerConfig{FailureThreshold: 100}}
+	net := newCluster(t, 1, r)
+
+	if _, err := r.Get("missing", 2); !errors.Is(err, custom_errors.ErrNotFound) {
+		t.Errorf("Expected NotFound for a key no replica has, but got %v", err)
+	}
+
+	net.Partition("node-1", "node-2")
+	_, err := r.Get("missing", 2)
+	var rErr *custom_errors.QuorumReadError
+	if !errors.As(err, &rErr) || errors.Is(err, custom_errors.ErrNotFound) {
+		t.Fatalf("Expected QuorumReadError with 2 replicas partitioned, but got %v", err)
+	}
+	if len(rErr.Causes) != 2 || !errors.Is(err, custom_errors.ErrUnavailable) {
+		t.Errorf("Expected 2 unavailable replicas as causes, but got %v", rErr.Causes)
+	}
+}
+
+// A lost answer makes the ring retry a write the replica already applied, the
+// request id keeps it from being written to the WAL twice.
+func TestRetriedWritesAreAppliedOnce(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3, Breaker: ring.BreakerConfig{FailureThreshold: 1000},
+		Retry: ring.RetryPolicy{MaxAttempts: 20, BaseDelay: time.Microsecond, MaxDelay: time.Millisecond}}
+	net := newCluster(t, 3, r)
+	net.SetLink(simnet.Link{DropRequest: 0.1, DropResponse: 0.3})
+
+	const writes = 50
+	for i := range writes {
+		if err := r.Put(fmt.Sprint("key-", i), []byte("v"), 3); err != nil {
+			t.Fatalf("Expected put to succeed with retries, but got %v", err)
+		}
+	}
+
+	for _, name := range nodeNames {
+		wal, err := os.ReadFile(net.Node(name).Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := bytes.Count(wal, []byte("\n")); c != writes {
+			t.Errorf("Expected %d WAL records on %s, but got %d", writes, name, c)
+		}
+	}
+}
+
+func TestStaleRetryDoesNotOverwrite(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 1, r)
+
+	id := ring.NewRequestID()
+	if err := r.PutWithID(id, "k", []byte("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put("k", []byte("new"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// a late retry of the first write
+	if err := r.PutWithID(id, "k", []byte("old"), 3); err != nil {
+		t.Fatalf("Expected the retry to be acknowledged, but got %v", err)
+	}
+	if c := replicasWith(net, "k", "new"); c != 3 {
+		t.Errorf("Expected the newer value on 3 replicas, but found it on %d", c)
+	}
+}
+
+// Operations running while nodes join must see one consistent topology each,
+// go test -race checks that they don't read it while it is being built.
+func TestMembershipChangeDuringTraffic(t *testing.T) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := newCluster(t, 1, r)
+	if v := r.Version(); v != 3 {
+		t.Fatalf("Expected version 3 after 3 nodes joined, but got %d", v)
+	}
+
+	// every client reports the topology version its last Put and Get started
+	// on, a node only joins after all clients finished ops on the one before
+	const clients = 4
+	type ack struct {
+		client  int
+		version uint64
+	}
+	acks := make(chan ack, clients*8)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reported := uint64(0)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				v := r.Version()
+				key := fmt.Sprintf("c%d-%d", c, i)
+				if err := r.Put(key, []byte("v"), 1); err != nil {
+					t.Errorf("Expected put to succeed while nodes join, but got %v", err)
+					return
+				}
+				r.Get(key, 1)
+				if v > reported {
+					reported = v
+					acks <- ack{c, v}
+				}
+			}
+		}()
+	}
+
+	seen := make([]uint64, clients)
+	waitFor := func(version uint64) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for slices.Min(seen) < version {
+			select {
+			case a := <-acks:
+				seen[a.client] = a.version
+			case <-timeout:
+				close(stop)
+				t.Fatalf("Expected every client to run on version %d, but they reported %v", version, seen)
+			}
+		}
+	}
+
+	for i := 4; i <= 8; i++ {
+		waitFor(r.Version())
+		name := fmt.Sprint("node-", i)
+		c, err := net.AddNode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RegisterClient(name, c)
+	}
+	waitFor(r.Version())
+	close(stop)
+	wg.Wait()
+
+	if v := r.Version(); v != 8 {
+		t.Errorf("Expected version 8 after 8 nodes joined, but got %d", v)
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	r := &ring.Ring{ReplicaCount: 3}
+	net := simnet.New(1, b.TempDir())
+	defer net.Close()
+	r.Init()
+	for _, name := range nodeNames {
+		c, err := net.AddNode(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.RegisterClient(name, c)
+	}
+	for i := range 100 {
+		r.Put(fmt.Sprint("key-", i), []byte("v"), 3)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			r.Get(fmt.Sprint("key-", i%100), 2)
+		}
+	})
+}
+
+// spans records the spans of the test binary. The packages keep the tracer
+// of the first provider that is set, so it is set once.
+var spans = sync.OnceValue(func() *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	return rec
+})
+
+// A write through WithContext is one trace: the ring's span, a span per
+// replica and below each the node's apply, WAL append and fsync
+func TestWriteTrace(t *testing.T) {
+	rec := spans()
+
+	r := &ring.Ring{ReplicaCount: 3}
+	newCluster(t, 1, r)
+	ctx, root := otel.Tracer("test").Start(context.Background(), "request")
+	if err := r.WithContext(ctx).Put("k", []byte("v"), 3); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	// reads of other tests that are still running end up in rec too
+	byID := map[trace.SpanID]sdktrace.ReadOnlySpan{}
+	count := map[string]int{}
+	for _, s := range rec.Ended() {
+		if s.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			byID[s.SpanContext().SpanID()] = s
+			count[s.Name()]++
+		}
+	}
+	want := map[string]int{"request": 1, "ring.Put": 1, "ring.replica.Write": 3, "node.Apply": 3, "wal.append": 3, "wal.fsync": 3}
+	if !reflect.DeepEqual(count, want) {
+		t.Fatalf("Expected spans %v but got %v", want, count)
+	}
+	for _, s := range byID {
+		if s.Name() != "wal.fsync" {
+			continue
+		}
+		var path []string
+		for p := s; p != nil; p = byID[p.Parent().SpanID()] {
+			path = append(path, p.Name())
+		}
+		if got := fmt.Sprint(path); got != "[wal.fsync wal.append node.Apply ring.replica.Write ring.Put request]" {
+			t.Errorf("Expected the fsync below its replica write but got %s", got)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ring
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"toy_dynamodb/pkg/rpcerr"
+	kv "toy_dynamodb/proto"
+
+	"google.golang.org/grpc"
+)
+
+// Entry is the newest value of a key across its replicas, see Scan
+type Entry struct {
+	Key     string
+	Value   []byte
+	Version uint64
+}
+
+// cursor is the current entry of one node's scan stream, nil once it ended
+type cursor struct {
+	name   string
+	nd     kv.KVStoreClient
+	stream grpc.ServerStreamingClient[kv.ScanEntry]
+	cur    *kv.ScanEntry
+}
+
+func (c *cursor) next() error {
+	e, err := c.stream.Recv()
+	if err == io.EOF {
+		c.cur = nil
+		return nil
+	}
+	if err != nil {
+		return rpcerr.FromStatus(err, c.name)
+	}
+	c.cur = e
+	return nil
+}
+
+// Scan calls fn for every key starting with prefix in key order. Every node
+// is scanned once and the sorted streams are merged, so a key held by several
+// replicas is reported once, with its highest version, and memory doesn't
+// grow with the number of keys. Deleted keys are left out. Every node has to
+// answer, a node that is down may be the only one with some keys.
+func (r *Ring) Scan(ctx context.Context, prefix string, fn func(Entry) error) error {
+	return r.defaultTable().Scan(ctx, prefix, fn)
+}
+
+func (tb *Table) Scan(ctx context.Context, prefix string, fn func(Entry) error) error {
+	t := tb.r.snapshot()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	names := make([]string, 0, len(t.nodes))
+	for name := range t.nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var cs []*cursor
+	for _, name := range names {
+		nd := t.nodes[name]
+		s, err := nd.Scan(ctx, &kv.ScanRequest{Table: tb.spec.Name, Prefix: prefix})
+		if err != nil {
+			return rpcerr.FromStatus(err, name)
+		}
+		c := &cursor{name: name, nd: nd, stream: s}
+		if err := c.next(); err != nil {
+			return err
+		}
+		if c.cur != nil {
+			cs = append(cs, c)
+		}
+	}
+
+	for len(cs) > 0 {
+		key := cs[0].cur.Key
+		for _, c := range cs[1:] {
+			key = min(key, c.cur.Key)
+		}
+
+		var best *kv.ScanEntry
+		var from *cursor
+		for _, c := range cs {
+			if c.cur.Key != key {
+				continue
+			}
+			if best == nil || newer(c.cur, best) {
+				best, from = c.cur, c
+			}
+			if err := c.next(); err != nil {
+				return err
+			}
+		}
+		cs = slices.DeleteFunc(cs, func(c *cursor) bool { return c.cur == nil })
+
+		if best.Deleted {
+			continue
+		}
+		val := best.Value
+		if best.Chunked {
+			v, _, found, err := getValue(ctx, from.nd, tb.spec.Name, key)
+			if err != nil {
+				return rpcerr.FromStatus(err, from.name)
+			}
+			if !found {
+				// deleted since it was listed
+				continue
+			}
+			val = v
+		}
+		if err := fn(Entry{Key: key, Value: val, Version: best.Version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newer orders the replicas of a key the way the nodes do (ADR 0019)
+func newer(a, b *kv.ScanEntry) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	if a.Deleted != b.Deleted {
+		return a.Deleted
+	}
+	return bytes.Compare(a.Value, b.Value) > 0
+}
@@ -0,0 +1,45 @@
+package ring
+
+import (
+	"context"
+	"io"
+	"toy_dynamodb/pkg/chunk"
+	kv "toy_dynamodb/proto"
+)
+
+// putValue sends small values in a single Put and streams the rest in chunks
+func putValue(ctx context.Context, nd kv.KVStoreClient, rq *doOpReq) (*kv.PutResponse, error) {
+	if len(rq.val) <= chunk.Threshold {
+		return nd.Put(ctx, &kv.PutRequest{Table: rq.table, Key: rq.key, Value: rq.val, RequestId: rq.id, Version: rq.version})
+	}
+
+	stream, err := nd.PutStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = chunk.Split(rq.table, rq.key, rq.id, rq.version, rq.val, stream.Send)
+	// io.EOF means the server gave up on the stream, the reason comes with CloseAndRecv
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+// getValue reads the value with Get and falls back to GetStream when the
+// node says it is too large for one message. The version of a key that isn't
+// found is the one of its tombstone.
+func getValue(ctx context.Context, nd kv.KVStoreClient, table, key string) ([]byte, uint64, bool, error) {
+	res, err := nd.Get(ctx, &kv.GetRequest{Table: table, Key: key})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if !res.Chunked {
+		return res.Value, res.Version, res.Found, nil
+	}
+
+	stream, err := nd.GetStream(ctx, &kv.GetRequest{Table: table, Key: key})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return chunk.Collect(stream.Recv)
+}
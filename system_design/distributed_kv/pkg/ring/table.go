@@ -0,0 +1,216 @@
+package ring
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/limit"
+	"toy_dynamodb/pkg/rpcerr"
+	"toy_dynamodb/pkg/table"
+	kv "toy_dynamodb/proto"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Table is a named keyspace with its own replica count and default
+// consistency (ADR 0025). It has the data methods of the Ring, the Ring's own
+// methods work on the default table with ReplicaCount replicas.
+type Table struct {
+	r    *Ring
+	spec table.Spec
+	// ctx is the parent of the table's spans, see WithContext
+	ctx context.Context
+	// uncached reads skip the cache of hot keys, see WithoutCache
+	uncached bool
+}
+
+// WithContext returns the table with ctx as the parent of the spans of its
+// reads and writes (ADR 0028). The replica RPCs carry the trace of ctx but
+// not its cancellation, a write keeps going to the replicas after W of them
+// answered.
+func (tb *Table) WithContext(ctx context.Context) *Table {
+	c := *tb
+	c.ctx = ctx
+	return &c
+}
+
+// WithContext is Table.WithContext for the default table
+func (r *Ring) WithContext(ctx context.Context) *Table {
+	return r.defaultTable().WithContext(ctx)
+}
+
+func (tb *Table) context() context.Context {
+	if tb.ctx == nil {
+		return context.Background()
+	}
+	return tb.ctx
+}
+
+// attributes describe a read or write of key with quorum q in its span
+func (tb *Table) attributes(key string, q int) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("kv.table", tb.spec.Name), attribute.String("kv.key", key),
+		attribute.Int("kv.quorum", q), attribute.Int("kv.replicas", int(tb.spec.ReplicaCount))}
+}
+
+func (r *Ring) defaultTable() *Table {
+	tb := &Table{r: r, spec: table.Spec{ReplicaCount: r.ReplicaCount}}
+	if l := r.defLimits.Load(); l != nil {
+		tb.spec.Limits = *l
+	}
+	return tb
+}
+
+// Table returns a table of the ring's catalog, the empty name is the default
+// table. The catalog is filled by CreateTable and RefreshTables.
+func (r *Ring) Table(name string) (*Table, error) {
+	if name == table.Default {
+		return r.defaultTable(), nil
+	}
+	if m := r.tables.Load(); m != nil {
+		if spec, ok := (*m)[name]; ok {
+			return &Table{r: r, spec: spec}, nil
+		}
+	}
+	return nil, &custom_errors.ArgError{Arg: "table " + name, Message: "is not in the catalog of the ring, create it or call RefreshTables"}
+}
+
+// Tables returns the catalog in name order
+func (r *Ring) Tables() []table.Spec {
+	var out []table.Spec
+	if m := r.tables.Load(); m != nil {
+		out = slices.Collect(maps.Values(*m))
+	}
+	slices.SortFunc(out, func(a, b table.Spec) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+func (tb *Table) Spec() table.Spec {
+	return tb.spec
+}
+
+// Consistency is the level front-ends use when the client doesn't pick one
+func (tb *Table) Consistency() Consistency {
+	if tb.spec.Consistency == "" {
+		return ConsistencyQuorum
+	}
+	return Consistency(tb.spec.Consistency)
+}
+
+// CreateTable creates the table on every node and adds it to the catalog.
+// A node that fails leaves the table on the others, creating it again with
+// the same spec finishes the job.
+func (r *Ring) CreateTable(ctx context.Context, spec table.Spec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	if n := len(r.snapshot().nodes); int(spec.ReplicaCount) > n {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("table %s replica_count=%d", spec.Name, spec.ReplicaCount), Message: fmt.Sprintf("can't be greater than the node count %d", n)}
+	}
+	// a table that existed keeps its limits, the nodes answer with them
+	created := spec
+	err := r.eachAdmin(ctx, func(ac kv.AdminClient) error {
+		info, err := ac.CreateTable(ctx, &kv.CreateTableRequest{Spec: spec.Proto()})
+		if err == nil {
+			created = table.FromProto(info.GetSpec())
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.limiter.Set(created.Name, created.Rate)
+	r.updateTables(func(m map[string]table.Spec) { m[created.Name] = created })
+	return nil
+}
+
+// DropTable deletes the table and its data on every node. It leaves the
+// catalog once every node dropped it.
+func (r *Ring) DropTable(ctx context.Context, name string) error {
+	if name == table.Default {
+		return &custom_errors.ArgError{Arg: "table", Message: "the default table can't be dropped"}
+	}
+	err := r.eachAdmin(ctx, func(ac kv.AdminClient) error {
+		_, err := ac.DropTable(ctx, &kv.DropTableRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.limiter.Set(name, limit.Rate{})
+	r.full.Delete(name)
+	r.updateTables(func(m map[string]table.Spec) { delete(m, name) })
+	return nil
+}
+
+// RefreshTables replaces the catalog and the limits with the tables of the
+// first node that answers, for coordinators that didn't create them
+func (r *Ring) RefreshTables(ctx context.Context) error {
+	t := r.snapshot()
+	causes := make(map[string]error)
+	for _, name := range slices.Sorted(maps.Keys(t.admin)) {
+		res, err := t.admin[name].ListTables(ctx, &kv.ListTablesRequest{})
+		if err != nil {
+			causes[name] = rpcerr.FromStatus(err, name)
+			continue
+		}
+		m := make(map[string]table.Spec, len(res.Tables))
+		for _, info := range res.Tables {
+			spec := table.FromProto(info.GetSpec())
+			m[spec.Name] = spec
+			r.limiter.Set(spec.Name, spec.Rate)
+		}
+		if old := r.tables.Swap(&m); old != nil {
+			for name := range *old {
+				if _, ok := m[name]; !ok {
+					r.limiter.Set(name, limit.Rate{})
+				}
+			}
+		}
+		if def := res.GetDefaultTable(); def != nil {
+			l := table.FromProto(def.GetSpec()).Limits
+			r.defLimits.Store(&l)
+			r.limiter.Set(table.Default, l.Rate)
+		}
+		return nil
+	}
+	return &custom_errors.QuorumReadError{Message: "no node listed its tables", R: 1, N: len(t.nodes), Causes: causes}
+}
+
+// updateTables swaps in a changed copy of the catalog
+func (r *Ring) updateTables(change func(map[string]table.Spec)) {
+	for {
+		cur := r.tables.Load()
+		next := make(map[string]table.Spec)
+		if cur != nil {
+			maps.Copy(next, *cur)
+		}
+		change(next)
+		if r.tables.CompareAndSwap(cur, &next) {
+			return
+		}
+	}
+}
+
+// eachAdmin calls fn with the admin client of every node, all of them have
+// to succeed
+func (r *Ring) eachAdmin(ctx context.Context, fn func(kv.AdminClient) error) error {
+	t := r.snapshot()
+	causes := make(map[string]error)
+	for _, name := range slices.Sorted(maps.Keys(t.nodes)) {
+		ac, ok := t.admin[name]
+		if !ok {
+			causes[name] = &custom_errors.ArgError{Arg: "node " + name, Message: "has no admin client"}
+			continue
+		}
+		if err := fn(ac); err != nil {
+			causes[name] = rpcerr.FromStatus(err, name)
+		}
+	}
+	if len(causes) > 0 {
+		return &custom_errors.QuorumWriteError{Message: "table change failed on some nodes", W: len(t.nodes), N: len(t.nodes), Causes: causes}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package ring
+
+import (
+	"maps"
+	kv "toy_dynamodb/proto"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// topology is an immutable view of the ring membership. A membership change
+// builds the next topology from a copy and swaps it in atomically, so an
+// operation that loaded a topology sees the same nodes and replicas from start
+// to end without taking a lock (ADR 0005, option 3).
+type topology struct {
+	version     uint64
+	nodes       map[string]kv.KVStoreClient
+	health      map[string]healthpb.HealthClient
+	admin       map[string]kv.AdminClient
+	partitioner Partitioner
+}
+
+// with returns the next topology with address added, t is left unchanged.
+// hc and ac may be nil for in-memory clients.
+func (t *topology) with(address string, c kv.KVStoreClient, hc healthpb.HealthClient, ac kv.AdminClient) *topology {
+	next := &topology{
+		version:     t.version + 1,
+		nodes:       maps.Clone(t.nodes),
+		health:      maps.Clone(t.health),
+		admin:       maps.Clone(t.admin),
+		partitioner: t.partitioner.Clone(),
+	}
+	next.nodes[address] = c
+	if hc != nil {
+		next.health[address] = hc
+	}
+	if ac != nil {
+		next.admin[address] = ac
+	}
+	next.partitioner.Add(address)
+	return next
+}
+
+func (r *Ring) snapshot() *topology {
+	return r.topo.Load()
+}
+
+// Version increases with every membership change. Operations report the
+// replicas of the version they started with.
+func (r *Ring) Version() uint64 {
+	return r.snapshot().version
+}
+
+// AdminClient returns the Admin service of a node, nil for a node without one
+func (r *Ring) AdminClient(address string) kv.AdminClient {
+	return r.snapshot().admin[address]
+}
@@ -0,0 +1,246 @@
+// Package rpcerr maps the custom_errors taxonomy to gRPC status codes and
+// back. The typed fields travel as an errdetails.ErrorInfo, so a client gets
+// the same error value the server had and can use errors.Is/As on it instead
+// of parsing messages.
+package rpcerr
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strconv"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/node"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const Domain = "toy_dynamodb"
+
+const (
+	ReasonNotFound          = "NOT_FOUND"
+	ReasonQuorumNotMet      = "QUORUM_NOT_MET"
+	ReasonTimeout           = "TIMEOUT"
+	ReasonUnavailable       = "UNAVAILABLE"
+	ReasonInvalidArgument   = "INVALID_ARGUMENT"
+	ReasonValueTooLarge     = "VALUE_TOO_LARGE"
+	ReasonConflict          = "CONFLICT"
+	ReasonResourceExhausted = "RESOURCE_EXHAUSTED"
+)
+
+// Per-replica causes of a quorum error travel as additional ErrorInfos in
+// causeDomain, with their node, code and message next to their own metadata
+const (
+	causeDomain  = Domain + "/cause"
+	causeNode    = "cause_node"
+	causeCode    = "cause_code"
+	causeMessage = "cause_message"
+)
+
+// ToStatus converts err into a gRPC status error. Errors that already are a
+// status and unknown errors keep their code.
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var (
+		notFound  *custom_errors.NotFoundError
+		qWrite    *custom_errors.QuorumWriteError
+		qRead     *custom_errors.QuorumReadError
+		timeout   *custom_errors.TimeoutError
+		unavail   *custom_errors.UnavailableError
+		tooLarge  *custom_errors.ValueTooLargeError
+		argErr    *custom_errors.ArgError
+		conflict  *custom_errors.ConflictError
+		exhausted *custom_errors.ResourceExhaustedError
+		code      codes.Code
+		reason    string
+		meta      = map[string]string{}
+		causeSrcs map[string]error
+	)
+
+	// the quorum errors come first, they unwrap to the errors of the
+	// replicas and a NotFound cause must not hide the failed quorum
+	switch {
+	case errors.As(err, &qWrite):
+		code, reason = codes.Unavailable, ReasonQuorumNotMet
+		meta["op"], meta["message"] = "write", qWrite.Message
+		meta["need"], meta["n"] = strconv.Itoa(qWrite.W), strconv.Itoa(qWrite.N)
+		causeSrcs = qWrite.Causes
+	case errors.As(err, &qRead):
+		code, reason = codes.Unavailable, ReasonQuorumNotMet
+		meta["op"], meta["message"] = "read", qRead.Message
+		meta["need"], meta["n"] = strconv.Itoa(qRead.R), strconv.Itoa(qRead.N)
+		causeSrcs = qRead.Causes
+	case errors.As(err, &notFound):
+		code, reason = codes.NotFound, ReasonNotFound
+		meta["key"] = notFound.Key
+	case errors.As(err, &timeout):
+		code, reason = codes.DeadlineExceeded, ReasonTimeout
+		meta["op"], meta["after"] = timeout.Op, timeout.After.String()
+	case errors.Is(err, context.DeadlineExceeded):
+		code, reason = codes.DeadlineExceeded, ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.As(err, &unavail):
+		code, reason = codes.Unavailable, ReasonUnavailable
+		meta["node"] = unavail.Node
+	case errors.Is(err, node.ErrClosed):
+		code, reason = codes.Unavailable, ReasonUnavailable
+	case errors.As(err, &tooLarge):
+		code, reason = codes.InvalidArgument, ReasonValueTooLarge
+		meta["key"], meta["size"], meta["max"] = tooLarge.Key, strconv.Itoa(tooLarge.Size), strconv.Itoa(tooLarge.Max)
+	case errors.As(err, &argErr):
+		code, reason = codes.InvalidArgument, ReasonInvalidArgument
+		meta["arg"], meta["message"] = argErr.Arg, argErr.Message
+	case errors.As(err, &conflict):
+		code, reason = codes.Aborted, ReasonConflict
+		meta["key"], meta["message"] = conflict.Key, conflict.Message
+	case errors.As(err, &exhausted):
+		code, reason = codes.ResourceExhausted, ReasonResourceExhausted
+		meta["resource"], meta["limit"], meta["message"] = exhausted.Resource, strconv.FormatInt(exhausted.Limit, 10), exhausted.Message
+		if exhausted.RetryAfter > 0 {
+			meta["retry_after"] = exhausted.RetryAfter.String()
+		}
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: reason, Domain: Domain, Metadata: meta}}
+	// RetryInfo is the standard detail gRPC clients in other languages know
+	if exhausted != nil && exhausted.RetryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(exhausted.RetryAfter)})
+	}
+	for name, c := range causeSrcs {
+		cst := status.Convert(ToStatus(c))
+		ci := &errdetails.ErrorInfo{Domain: causeDomain, Metadata: map[string]string{}}
+		if info := findInfo(cst, Domain); info != nil {
+			ci.Reason = info.Reason
+			maps.Copy(ci.Metadata, info.Metadata)
+		}
+		ci.Metadata[causeNode], ci.Metadata[causeCode], ci.Metadata[causeMessage] = name, cst.Code().String(), cst.Message()
+		details = append(details, ci)
+	}
+
+	st, derr := status.New(code, err.Error()).WithDetails(details...)
+	if derr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
+
+// FromStatus turns a gRPC error received from nodeName back into a typed
+// error. Errors that are not a status are returned unchanged.
+func FromStatus(err error, nodeName string) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	if info := findInfo(st, Domain); info != nil {
+		if typed := fromInfo(info, st, nodeName); typed != nil {
+			return typed
+		}
+	}
+
+	switch st.Code() {
+	case codes.NotFound:
+		return &custom_errors.NotFoundError{Key: st.Message()}
+	case codes.DeadlineExceeded:
+		return &custom_errors.TimeoutError{Op: nodeName}
+	case codes.Unavailable:
+		return &custom_errors.UnavailableError{Node: nodeName, Err: err}
+	case codes.InvalidArgument:
+		return &custom_errors.ArgError{Arg: nodeName, Message: st.Message()}
+	case codes.Aborted:
+		return &custom_errors.ConflictError{Message: st.Message()}
+	case codes.ResourceExhausted:
+		return &custom_errors.ResourceExhaustedError{Resource: nodeName, Message: st.Message()}
+	}
+	return err
+}
+
+func fromInfo(info *errdetails.ErrorInfo, st *status.Status, nodeName string) error {
+	m := info.Metadata
+	switch info.Reason {
+	case ReasonNotFound:
+		return &custom_errors.NotFoundError{Key: m["key"]}
+	case ReasonQuorumNotMet:
+		need, _ := strconv.Atoi(m["need"])
+		n, _ := strconv.Atoi(m["n"])
+		causes := map[string]error{}
+		for _, d := range st.Details() {
+			ci, ok := d.(*errdetails.ErrorInfo)
+			if !ok || ci.Domain != causeDomain {
+				continue
+			}
+			name := ci.Metadata[causeNode]
+			cst := status.New(parseCode(ci.Metadata[causeCode]), ci.Metadata[causeMessage])
+			if typed := fromInfo(ci, cst, name); typed != nil {
+				causes[name] = typed
+			} else {
+				causes[name] = FromStatus(cst.Err(), name)
+			}
+		}
+		if m["op"] == "read" {
+			return &custom_errors.QuorumReadError{Message: m["message"], R: need, N: n, Causes: causes}
+		}
+		return &custom_errors.QuorumWriteError{Message: m["message"], W: need, N: n, Causes: causes}
+	case ReasonTimeout:
+		after, _ := time.ParseDuration(m["after"])
+		op := m["op"]
+		if op == "" {
+			op = nodeName
+		}
+		return &custom_errors.TimeoutError{Op: op, After: after}
+	case ReasonUnavailable:
+		name := m["node"]
+		if name == "" {
+			name = nodeName
+		}
+		return &custom_errors.UnavailableError{Node: name, Err: st.Err()}
+	case ReasonValueTooLarge:
+		size, _ := strconv.Atoi(m["size"])
+		max, _ := strconv.Atoi(m["max"])
+		return &custom_errors.ValueTooLargeError{Key: m["key"], Size: size, Max: max}
+	case ReasonInvalidArgument:
+		return &custom_errors.ArgError{Arg: m["arg"], Message: m["message"]}
+	case ReasonConflict:
+		return &custom_errors.ConflictError{Key: m["key"], Message: m["message"]}
+	case ReasonResourceExhausted:
+		limit, _ := strconv.ParseInt(m["limit"], 10, 64)
+		after, _ := time.ParseDuration(m["retry_after"])
+		return &custom_errors.ResourceExhaustedError{Resource: m["resource"], Limit: limit, Message: m["message"], RetryAfter: after}
+	}
+	return nil
+}
+
+func findInfo(st *status.Status, domain string) *errdetails.ErrorInfo {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == domain {
+			return info
+		}
+	}
+	return nil
+}
+
+func parseCode(name string) codes.Code {
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if c.String() == name {
+			return c
+		}
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,108 @@
+package rpcerr_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/rpcerr"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		err  error
+		code codes.Code
+		kind error
+	}{
+		{&custom_errors.NotFoundError{Key: "k"}, codes.NotFound, custom_errors.ErrNotFound},
+		{&custom_errors.TimeoutError{Op: "put", After: 0}, codes.DeadlineExceeded, custom_errors.ErrTimeout},
+		{&custom_errors.UnavailableError{Node: "node-1"}, codes.Unavailable, custom_errors.ErrUnavailable},
+		{&custom_errors.ArgError{Arg: "key", Message: "must not be empty"}, codes.InvalidArgument, custom_errors.ErrInvalidArgument},
+		{&custom_errors.ValueTooLargeError{Key: "k", Size: 10, Max: 5}, codes.InvalidArgument, custom_errors.ErrInvalidArgument},
+		{&custom_errors.ConflictError{Key: "k", Message: "etag mismatch"}, codes.Aborted, custom_errors.ErrConflict},
+		{&custom_errors.ResourceExhaustedError{Resource: "table users", Limit: 1024, Message: "storage quota"}, codes.ResourceExhausted, custom_errors.ErrResourceExhausted},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), codes.DeadlineExceeded, custom_errors.ErrTimeout},
+	}
+
+	for _, c := range cases {
+		st := rpcerr.ToStatus(c.err)
+		if got := status.Code(st); got != c.code {
+			t.Errorf("Expected %v for %v, but got %v", c.code, c.err, got)
+		}
+		back := rpcerr.FromStatus(st, "node-1")
+		if !errors.Is(back, c.kind) {
+			t.Errorf("Expected %v to round-trip as %v, but got %T %v", c.err, c.kind, back, back)
+		}
+	}
+}
+
+func TestQuorumCausesRoundTrip(t *testing.T) {
+	err := &custom_errors.QuorumWriteError{Message: "Failed to hit quorum", W: 2, N: 3, Causes: map[string]error{
+		"node-1": &custom_errors.ValueTooLargeError{Key: "k", Size: 10, Max: 5},
+		"node-2": &custom_errors.UnavailableError{Node: "node-2"},
+	}}
+
+	back := rpcerr.FromStatus(rpcerr.ToStatus(err), "coordinator")
+
+	var qErr *custom_errors.QuorumWriteError
+	if !errors.As(back, &qErr) {
+		t.Fatalf("Expected a QuorumWriteError, but got %T %v", back, back)
+	}
+	if qErr.W != 2 || qErr.N != 3 || len(qErr.Causes) != 2 {
+		t.Errorf("Expected w=2 n=3 and 2 causes, but got %+v", qErr)
+	}
+	if !errors.Is(back, custom_errors.ErrQuorumNotMet) || !errors.Is(back, custom_errors.ErrUnavailable) {
+		t.Errorf("Expected the quorum error and its causes to match, but got %v", back)
+	}
+	var tooLarge *custom_errors.ValueTooLargeError
+	if !errors.As(back, &tooLarge) {
+		t.Errorf("Expected errors.As to find the replica's ValueTooLargeError in %v", back)
+	}
+}
+
+// A read quorum that failed while one replica didn't have the key is not a
+// NotFound, the key may exist on the replicas that didn't answer
+func TestQuorumWithNotFoundCause(t *testing.T) {
+	err := &custom_errors.QuorumReadError{Message: "Failed to hit quorum", R: 2, N: 3, Causes: map[string]error{
+		"node-1": &custom_errors.NotFoundError{Key: "k"},
+		"node-2": &custom_errors.UnavailableError{Node: "node-2"},
+	}}
+
+	st := rpcerr.ToStatus(err)
+	if got := status.Code(st); got != codes.Unavailable {
+		t.Errorf("Expected %v, but got %v", codes.Unavailable, got)
+	}
+	back := rpcerr.FromStatus(st, "coordinator")
+	var qErr *custom_errors.QuorumReadError
+	if !errors.As(back, &qErr) || qErr.R != 2 || qErr.N != 3 || len(qErr.Causes) != 2 {
+		t.Fatalf("Expected a QuorumReadError with r=2 n=3 and 2 causes, but got %T %v", back, back)
+	}
+	if !errors.Is(back, custom_errors.ErrQuorumNotMet) {
+		t.Errorf("Expected the quorum error to match, but got %v", back)
+	}
+}
+
+func TestRetryAfterRoundTrip(t *testing.T) {
+	err := &custom_errors.ResourceExhaustedError{Resource: "requests of table jobs", Limit: 100, Message: "rate limit", RetryAfter: 250 * time.Millisecond}
+	st := rpcerr.ToStatus(err)
+
+	var re *custom_errors.ResourceExhaustedError
+	if back := rpcerr.FromStatus(st, "node-1"); !errors.As(back, &re) || re.RetryAfter != err.RetryAfter {
+		t.Errorf("Expected retry after %v, but got %v", err.RetryAfter, back)
+	}
+	var info *errdetails.RetryInfo
+	for _, d := range status.Convert(st).Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok {
+			info = ri
+		}
+	}
+	if info == nil || info.RetryDelay.AsDuration() != err.RetryAfter {
+		t.Errorf("Expected a RetryInfo detail of %v, but got %v", err.RetryAfter, info)
+	}
+}
@@ -0,0 +1,459 @@
+// Package simnet is a simulated network between a coordinator (Ring) and
+// in-process nodes. Every node gets a KVStoreClient that wraps
+// adapter.LocalClient and injects delay, lost requests, lost responses,
+// partitions and crashes.
+//
+// Randomness is seeded per link and scheduled events fire on Step, which the
+// test calls between operations. A test that issues its operations one at a
+// time and waits for every replica (W=N, R=N) therefore sees exactly the same
+// faults on every run.
+package simnet
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/adapter"
+	"toy_dynamodb/pkg/node"
+	kv "toy_dynamodb/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Link describes the connection between the coordinator and one node
+type Link struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// DropRequest is the probability that a request never reaches the node
+	DropRequest float64
+	// DropResponse is the probability that the node applies the request but
+	// the answer is lost on the way back
+	DropResponse float64
+}
+
+// Event runs when the step counter reaches AtStep, see Network.Step
+type Event struct {
+	AtStep int
+	Do     func(*Network)
+}
+
+// Crash, Restart, Partition and Heal return actions for Schedule
+func Crash(name string, torn bool) func(*Network) {
+	return func(n *Network) { n.Crash(name, torn) }
+}
+
+func Restart(name string) func(*Network) {
+	return func(n *Network) { n.Restart(name) }
+}
+
+func Partition(names ...string) func(*Network) {
+	return func(n *Network) { n.Partition(names...) }
+}
+
+func Heal(names ...string) func(*Network) {
+	return func(n *Network) { n.Heal(names...) }
+}
+
+type simNode struct {
+	mu          sync.Mutex
+	name        string
+	node        *node.Node
+	local       *adapter.LocalClient
+	rng         *rand.Rand
+	link        Link
+	partitioned bool
+	crashed     bool
+}
+
+type Network struct {
+	mu     sync.Mutex
+	seed   int64
+	opts   node.Options
+	nodes  map[string]*simNode
+	calls  int64
+	step   int
+	events []Event
+}
+
+// New creates a network whose nodes keep their WAL files in dir
+func New(seed int64, dir string) *Network {
+	opts := node.DefaultOptions()
+	opts.DataDir = dir
+	return &Network{seed: seed, opts: opts, nodes: make(map[string]*simNode)}
+}
+
+// AddNode starts a node and returns the client the ring should register
+func (n *Network) AddNode(name string) (kv.KVStoreClient, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.nodes[name]; ok {
+		return nil, &custom_errors.ArgError{Arg: name, Message: "Already Exist In Network"}
+	}
+
+	nd, err := node.NewWithOptions(name, n.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sn := &simNode{
+		name:  name,
+		node:  nd,
+		local: adapter.NewLocalClient(nd),
+		rng:   rand.New(rand.NewSource(n.seed ^ int64(h.Sum64()))),
+	}
+	n.nodes[name] = sn
+	return &client{net: n, sn: sn}, nil
+}
+
+func (n *Network) get(name string) *simNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nodes[name]
+}
+
+func (n *Network) names() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out := make([]string, 0, len(n.nodes))
+	for name := range n.nodes {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SetLink changes the link of the given nodes, or of every node if none given
+func (n *Network) SetLink(l Link, names ...string) {
+	if len(names) == 0 {
+		names = n.names()
+	}
+	for _, name := range names {
+		if sn := n.get(name); sn != nil {
+			sn.mu.Lock()
+			sn.link = l
+			sn.mu.Unlock()
+		}
+	}
+}
+
+// Partition cuts the coordinator off from the given nodes
+func (n *Network) Partition(names ...string) {
+	for _, name := range names {
+		if sn := n.get(name); sn != nil {
+			sn.mu.Lock()
+			sn.partitioned = true
+			sn.mu.Unlock()
+		}
+	}
+}
+
+// Heal removes the partition of the given nodes, or of every node if none given
+func (n *Network) Heal(names ...string) {
+	if len(names) == 0 {
+		names = n.names()
+	}
+	for _, name := range names {
+		if sn := n.get(name); sn != nil {
+			sn.mu.Lock()
+			sn.partitioned = false
+			sn.mu.Unlock()
+		}
+	}
+}
+
+// Crash kills the node without a clean shutdown. With torn set, half of a
+// record is appended to the WAL as if the process died in the middle of a write.
+func (n *Network) Crash(name string, torn bool) error {
+	sn := n.get(name)
+	if sn == nil {
+		return &custom_errors.ArgError{Arg: name, Message: "Not Exist In Network"}
+	}
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if sn.crashed {
+		return nil
+	}
+	sn.crashed = true
+	if err := sn.node.Kill(); err != nil {
+		return err
+	}
+	if !torn {
+		return nil
+	}
+
+	f, err := os.OpenFile(sn.node.Path(), os.O_APPEND|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString("SET,torn-write,dG9y")
+	return err
+}
+
+// Restart reopens a crashed node from its WAL
+func (n *Network) Restart(name string) error {
+	sn := n.get(name)
+	if sn == nil {
+		return &custom_errors.ArgError{Arg: name, Message: "Not Exist In Network"}
+	}
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if !sn.crashed {
+		return nil
+	}
+	nd, err := node.NewWithOptions(name, n.opts)
+	if err != nil {
+		return err
+	}
+	sn.node, sn.local, sn.crashed = nd, adapter.NewLocalClient(nd), false
+	return nil
+}
+
+// Node returns the storage engine currently behind name, for assertions
+func (n *Network) Node(name string) *node.Node {
+	sn := n.get(name)
+	if sn == nil {
+		return nil
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.node
+}
+
+// Schedule registers events that fire when Step reaches their AtStep
+func (n *Network) Schedule(events ...Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.events = append(n.events, events...)
+	sort.SliceStable(n.events, func(i, j int) bool { return n.events[i].AtStep < n.events[j].AtStep })
+}
+
+// Step advances the logical clock by one and runs the events that became due.
+// Events are not tied to the RPC counter because the replicas of one
+// operation are called concurrently and an event in the middle of a fan-out
+// would hit a random subset of them.
+func (n *Network) Step() int {
+	n.mu.Lock()
+	n.step++
+	step := n.step
+	var due []Event
+	for len(n.events) > 0 && n.events[0].AtStep <= step {
+		due = append(due, n.events[0])
+		n.events = n.events[1:]
+	}
+	n.mu.Unlock()
+
+	for _, e := range due {
+		e.Do(n)
+	}
+	return step
+}
+
+// Calls returns how many RPCs the network has seen
+func (n *Network) Calls() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls
+}
+
+// Close shuts every running node down cleanly
+func (n *Network) Close() error {
+	var first error
+	for _, name := range n.names() {
+		sn := n.get(name)
+		sn.mu.Lock()
+		if !sn.crashed {
+			if err := sn.node.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+		sn.mu.Unlock()
+	}
+	return first
+}
+
+type fault struct {
+	delay        time.Duration
+	dropRequest  bool
+	dropResponse bool
+}
+
+type client struct {
+	net *Network
+	sn  *simNode
+}
+
+// before decides the fate of a call and returns the client to forward it to.
+// Three random numbers are drawn on every call so the sequence per link does
+// not depend on which faults are configured.
+func (c *client) before(ctx context.Context) (*adapter.LocalClient, fault, error) {
+	c.net.mu.Lock()
+	c.net.calls++
+	c.net.mu.Unlock()
+
+	c.sn.mu.Lock()
+	l := c.sn.link
+	f := fault{delay: l.MinDelay}
+	d, req, res := c.sn.rng.Int63(), c.sn.rng.Float64(), c.sn.rng.Float64()
+	if l.MaxDelay > l.MinDelay {
+		f.delay += time.Duration(d % int64(l.MaxDelay-l.MinDelay))
+	}
+	f.dropRequest = req < l.DropRequest
+	f.dropResponse = res < l.DropResponse
+	down := c.sn.partitioned || c.sn.crashed
+	local := c.sn.local
+	c.sn.mu.Unlock()
+
+	if down {
+		return nil, f, status.Errorf(codes.Unavailable, "simnet: %s is unreachable", c.sn.name)
+	}
+	if err := sleep(ctx, f.delay); err != nil {
+		return nil, f, err
+	}
+	if f.dropRequest {
+		return nil, f, status.Errorf(codes.Unavailable, "simnet: request to %s lost", c.sn.name)
+	}
+	return local, f, nil
+}
+
+func (c *client) after(ctx context.Context, f fault) error {
+	if err := sleep(ctx, f.delay); err != nil {
+		return err
+	}
+	if f.dropResponse {
+		return status.Errorf(codes.Unavailable, "simnet: response from %s lost", c.sn.name)
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (c *client) Put(ctx context.Context, in *kv.PutRequest, opts ...grpc.CallOption) (*kv.PutResponse, error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := local.Put(ctx, in, opts...)
+	if aerr := c.after(ctx, f); aerr != nil {
+		return nil, aerr
+	}
+	return res, err
+}
+
+func (c *client) Get(ctx context.Context, in *kv.GetRequest, opts ...grpc.CallOption) (*kv.GetResponse, error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := local.Get(ctx, in, opts...)
+	if aerr := c.after(ctx, f); aerr != nil {
+		return nil, aerr
+	}
+	return res, err
+}
+
+func (c *client) Delete(ctx context.Context, in *kv.DeleteRequest, opts ...grpc.CallOption) (*kv.DeleteResponse, error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := local.Delete(ctx, in, opts...)
+	if aerr := c.after(ctx, f); aerr != nil {
+		return nil, aerr
+	}
+	return res, err
+}
+
+// PutStream is faulted as a whole: the request side when the stream opens,
+// the response side in CloseAndRecv
+func (c *client) PutStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[kv.PutChunk, kv.PutResponse], error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := local.PutStream(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &putStream{ClientStreamingClient: s, c: c, f: f}, nil
+}
+
+type putStream struct {
+	grpc.ClientStreamingClient[kv.PutChunk, kv.PutResponse]
+	c *client
+	f fault
+}
+
+func (s *putStream) CloseAndRecv() (*kv.PutResponse, error) {
+	res, err := s.ClientStreamingClient.CloseAndRecv()
+	if aerr := s.c.after(s.Context(), s.f); aerr != nil {
+		return nil, aerr
+	}
+	return res, err
+}
+
+func (c *client) GetStream(ctx context.Context, in *kv.GetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[kv.GetChunk], error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := local.GetStream(ctx, in, opts...)
+	if aerr := c.after(ctx, f); aerr != nil {
+		return nil, aerr
+	}
+	return s, err
+}
+
+// Scan is faulted like GetStream, the entries are collected when it opens
+func (c *client) Scan(ctx context.Context, in *kv.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[kv.ScanEntry], error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := local.Scan(ctx, in, opts...)
+	if aerr := c.after(ctx, f); aerr != nil {
+		return nil, aerr
+	}
+	return s, err
+}
+
+// Query is faulted like Scan
+func (c *client) Query(ctx context.Context, in *kv.QueryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[kv.ScanEntry], error) {
+	local, f, err := c.before(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := local.Query(ctx, in, opts...)
+	if aerr := c.after(ctx, f); aerr != nil {
+		return nil, aerr
+	}
+	return s, err
+}
@@ -0,0 +1,70 @@
+package table
+
+import (
+	"context"
+	"toy_dynamodb/pkg/hotkey"
+	"toy_dynamodb/pkg/rpcerr"
+	kv "toy_dynamodb/proto"
+)
+
+// AdminServer answers the table RPCs of the Admin service from a Store.
+// cmd/server serves it over gRPC with its own Backup, adapter.StoreClient
+// calls it in process. Errors are gRPC statuses like on the wire.
+type AdminServer struct {
+	kv.UnimplementedAdminServer
+	Store *Store
+}
+
+func infoProto(i Info) *kv.TableInfo {
+	return &kv.TableInfo{Spec: i.Spec.Proto(), UsedBytes: i.UsedBytes}
+}
+
+func (a *AdminServer) CreateTable(ctx context.Context, r *kv.CreateTableRequest) (*kv.TableInfo, error) {
+	i, err := a.Store.Create(FromProto(r.GetSpec()))
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	return infoProto(i), nil
+}
+
+func (a *AdminServer) DropTable(ctx context.Context, r *kv.DropTableRequest) (*kv.DropTableResponse, error) {
+	if err := a.Store.Drop(r.Name); err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	return &kv.DropTableResponse{}, nil
+}
+
+func (a *AdminServer) ListTables(ctx context.Context, r *kv.ListTablesRequest) (*kv.ListTablesResponse, error) {
+	res := &kv.ListTablesResponse{DefaultTable: infoProto(a.Store.DefaultInfo())}
+	for _, i := range a.Store.List() {
+		res.Tables = append(res.Tables, infoProto(i))
+	}
+	return res, nil
+}
+
+func (a *AdminServer) SetLimits(ctx context.Context, r *kv.SetLimitsRequest) (*kv.TableInfo, error) {
+	i, err := a.Store.SetLimits(r.Table, LimitsFromProto(r))
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	return infoProto(i), nil
+}
+
+// Reencrypt moves the values of a table to the node's active key after a
+// rotation of the key file (ADR 0027)
+func (a *AdminServer) Reencrypt(ctx context.Context, r *kv.ReencryptRequest) (*kv.ReencryptResponse, error) {
+	n, err := a.Store.Node(r.Table)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	count, err := n.Reencrypt(r.DryRun)
+	if err != nil {
+		return nil, rpcerr.ToStatus(err)
+	}
+	return &kv.ReencryptResponse{Rewritten: int64(count), ActiveKey: n.ActiveKey(), KeyUsage: n.KeyUsage()}, nil
+}
+
+// HotKeys lists the keys of all tables this node was asked for most (ADR 0030)
+func (a *AdminServer) HotKeys(ctx context.Context, r *kv.HotKeysRequest) (*kv.HotKeysResponse, error) {
+	return hotkey.Response(a.Store.HotKeys(int(r.Limit))), nil
+}
@@ -0,0 +1,503 @@
+// Package table keeps the tables of one node. The default table, the one of
+// requests without a table name, is the node's own WAL. Every other table is
+// a node.Node of its own in a directory below the data dir, so tables only
+// share the process: a table's TTL, quota and fsyncs don't touch the others.
+package table
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hotkey"
+	"toy_dynamodb/pkg/limit"
+	"toy_dynamodb/pkg/node"
+	kv "toy_dynamodb/proto"
+)
+
+// Default is the table of requests without a table name
+const Default = ""
+
+// MaxNameLength bounds table names, they are directory names on the nodes
+const MaxNameLength = 64
+
+// Spec is a table. ReplicaCount and Consistency are read by the coordinators,
+// TTL by every node and the Limits by both.
+type Spec struct {
+	Name         string `json:"name"`
+	ReplicaCount uint   `json:"replica_count"`
+	// Consistency is the default R and W of front-ends: one, quorum or all.
+	// Empty means quorum.
+	Consistency string `json:"consistency,omitempty"`
+	// TTL hides values older than it, 0 keeps them
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Compression of the values in the table's WAL: snappy, zstd or none.
+	// Empty uses the compression of the node, so does CompressMinSize 0.
+	Compression     string `json:"compression,omitempty"`
+	CompressMinSize int    `json:"compress_min_size,omitempty"`
+	Limits
+}
+
+// NoCompression turns compression off for a table on nodes that compress
+const NoCompression = "none"
+
+// Limits are the part of a table SetLimits changes at runtime. The default
+// table has them too.
+type Limits struct {
+	// Rate bounds the requests of the table on every coordinator and on
+	// every node (ADR 0026)
+	Rate limit.Rate `json:"rate,omitzero"`
+	// QuotaBytes bounds the keys and values of the table on every node, not
+	// across the cluster. 0 means no quota.
+	QuotaBytes int64 `json:"quota_bytes,omitempty"`
+}
+
+func (l Limits) Validate() error {
+	if l.QuotaBytes < 0 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("quota %d", l.QuotaBytes), Message: "must not be negative"}
+	}
+	return l.Rate.Validate()
+}
+
+func (s Spec) Validate() error {
+	if s.Name == "" || len(s.Name) > MaxNameLength {
+		return &custom_errors.ArgError{Arg: "table name " + s.Name, Message: fmt.Sprintf("must have 1 to %d characters", MaxNameLength)}
+	}
+	for _, c := range s.Name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return &custom_errors.ArgError{Arg: "table name " + s.Name, Message: "may only contain a-z, 0-9, '_' and '-'"}
+		}
+	}
+	if s.ReplicaCount == 0 {
+		return &custom_errors.ArgError{Arg: "table " + s.Name + " replica_count", Message: "must be at least 1"}
+	}
+	switch s.Consistency {
+	case "", "one", "quorum", "all":
+	default:
+		return &custom_errors.ArgError{Arg: "table " + s.Name + " consistency=" + s.Consistency, Message: "must be one, quorum or all"}
+	}
+	if s.TTL < 0 {
+		return &custom_errors.ArgError{Arg: "table " + s.Name + " ttl", Message: "must not be negative"}
+	}
+	if s.Compression != NoCompression {
+		if err := node.Compression(s.Compression).Validate(); err != nil {
+			return err
+		}
+	}
+	if s.CompressMinSize < 0 {
+		return &custom_errors.ArgError{Arg: "table " + s.Name + " compress_min_size", Message: "must not be negative"}
+	}
+	return s.Limits.Validate()
+}
+
+// withoutLimits is what a second Create of the table has to agree on
+func (s Spec) withoutLimits() Spec {
+	s.Limits = Limits{}
+	return s
+}
+
+func (s Spec) Proto() *kv.TableSpec {
+	return &kv.TableSpec{Name: s.Name, ReplicaCount: uint32(s.ReplicaCount), Consistency: s.Consistency,
+		TtlMs: s.TTL.Milliseconds(), QuotaBytes: s.QuotaBytes, RatePerSecond: s.Rate.PerSecond, RateBurst: uint32(s.Rate.Burst),
+		Compression: s.Compression, CompressMinSize: uint32(s.CompressMinSize)}
+}
+
+func FromProto(p *kv.TableSpec) Spec {
+	return Spec{Name: p.GetName(), ReplicaCount: uint(p.GetReplicaCount()), Consistency: p.GetConsistency(),
+		TTL:         time.Duration(p.GetTtlMs()) * time.Millisecond,
+		Compression: p.GetCompression(), CompressMinSize: int(p.GetCompressMinSize()),
+		Limits: Limits{QuotaBytes: p.GetQuotaBytes(), Rate: limit.Rate{PerSecond: p.GetRatePerSecond(), Burst: int(p.GetRateBurst())}}}
+}
+
+// Proto is the request that sets l on the table name
+func (l Limits) Proto(name string) *kv.SetLimitsRequest {
+	return &kv.SetLimitsRequest{Table: name, RatePerSecond: l.Rate.PerSecond, RateBurst: uint32(l.Rate.Burst), QuotaBytes: l.QuotaBytes}
+}
+
+func LimitsFromProto(p *kv.SetLimitsRequest) Limits {
+	return Limits{Rate: limit.Rate{PerSecond: p.GetRatePerSecond(), Burst: int(p.GetRateBurst())}, QuotaBytes: p.GetQuotaBytes()}
+}
+
+// Info is a table as one node sees it
+type Info struct {
+	Spec      Spec
+	UsedBytes int64
+}
+
+type table struct {
+	spec Spec
+	node *node.Node
+}
+
+// Store holds the tables of the node name. The catalog file lists them and
+// the limits of the default table, it is rewritten on every change.
+type Store struct {
+	name string
+	opts node.Options
+	def  *node.Node
+
+	// mu guards tables and defLimits, it is held across a change so the
+	// catalog file and the map change together
+	mu        sync.RWMutex
+	tables    map[string]*table
+	defLimits Limits
+	limiter   limit.Limiter
+	// hot counts the keys of the requests Admit lets through or turns away
+	hot atomic.Pointer[hotkey.Tracker]
+	// watchers are called by Create and Drop, see Watch
+	watchers []func(Change)
+}
+
+// Change is a table that was created or dropped, Node is its node. A table
+// dropped and created again with the same name has another Node.
+type Change struct {
+	Spec    Spec
+	Node    *node.Node
+	Dropped bool
+}
+
+// catalog is the content of catalog.json
+type catalog struct {
+	Default Limits `json:"default,omitzero"`
+	Tables  []Spec `json:"tables"`
+}
+
+// Open opens the default table and every table of the catalog. opts are the
+// options of the default table, the other tables get their TTL, quota and
+// indexes from their spec and the rest from opts.
+func Open(name string, opts node.Options) (*Store, error) {
+	if opts.DataDir == "" {
+		opts.DataDir = node.DefaultDataDir
+	}
+	s := &Store{name: name, opts: opts, tables: make(map[string]*table)}
+	s.hot.Store(hotkey.NewTracker(hotkey.Config{}))
+
+	def, err := node.NewWithOptions(name, s.nodeOptions(Spec{}))
+	if err != nil {
+		return nil, err
+	}
+	s.def = def
+
+	c, err := s.readCatalog()
+	if err != nil {
+		def.Close()
+		return nil, err
+	}
+	s.defLimits = c.Default
+	def.SetMaxBytes(c.Default.QuotaBytes)
+	s.limiter.Set(Default, c.Default.Rate)
+	for _, spec := range c.Tables {
+		n, err := node.NewWithOptions(name, s.nodeOptions(spec))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("opening table %s: %w", spec.Name, err)
+		}
+		s.tables[spec.Name] = &table{spec: spec, node: n}
+		s.limiter.Set(spec.Name, spec.Rate)
+	}
+	return s, nil
+}
+
+func (s *Store) dir() string {
+	return filepath.Join(s.opts.DataDir, s.name+".tables")
+}
+
+func (s *Store) catalogPath() string {
+	return filepath.Join(s.dir(), "catalog.json")
+}
+
+func (s *Store) nodeOptions(spec Spec) node.Options {
+	o := s.opts
+	o.Indexes = nil
+	for _, ix := range s.opts.Indexes {
+		if ix.Table == spec.Name {
+			o.Indexes = append(o.Indexes, ix)
+		}
+	}
+	if spec.Name != Default {
+		o.DataDir = filepath.Join(s.dir(), spec.Name)
+		o.TTL, o.MaxBytes = spec.TTL, spec.QuotaBytes
+		switch spec.Compression {
+		case "":
+		case NoCompression:
+			o.Compression = node.CompressNone
+		default:
+			o.Compression = node.Compression(spec.Compression)
+		}
+		if spec.CompressMinSize > 0 {
+			o.CompressMinSize = spec.CompressMinSize
+		}
+	}
+	return o
+}
+
+// Default is the node of the default table
+func (s *Store) Default() *node.Node {
+	return s.def
+}
+
+// Node returns the node of a table, Default for the empty name
+func (s *Store) Node(name string) (*node.Node, error) {
+	if name == Default {
+		return s.def, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tables[name]
+	if !ok {
+		return nil, &custom_errors.ArgError{Arg: "table " + name, Message: "doesn't exist on " + s.name}
+	}
+	return t.node, nil
+}
+
+// Admit is Node for a request of a client for key, it takes a token of the
+// table's rate limit. The key counts for HotKeys even when the limit turns
+// the request away.
+func (s *Store) Admit(name, key string) (*node.Node, error) {
+	n, err := s.Node(name)
+	if err != nil {
+		return nil, err
+	}
+	s.hot.Load().Record(name, key)
+	if err := s.limiter.Allow(name); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// TrackHotKeys replaces the tracker of HotKeys with one sized by c, the
+// counts start over
+func (s *Store) TrackHotKeys(c hotkey.Config) {
+	s.hot.Store(hotkey.NewTracker(c))
+}
+
+// HotKeys returns up to n of the keys of all tables that were requested
+// most, n <= 0 returns every tracked key (ADR 0030)
+func (s *Store) HotKeys(n int) []hotkey.Key {
+	return s.hot.Load().Top(n)
+}
+
+// Watch calls fn after a table was created or dropped, before Create or Drop
+// return. fn runs without the store's lock, changes of different tables may
+// call it concurrently.
+func (s *Store) Watch(fn func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, fn)
+}
+
+func (s *Store) notify(c Change) {
+	s.mu.RLock()
+	watchers := s.watchers
+	s.mu.RUnlock()
+	for _, fn := range watchers {
+		fn(c)
+	}
+}
+
+// Create adds a table. A table that exists with the same spec is kept with
+// the limits it has, a spec that differs in more than the limits is a
+// ConflictError.
+func (s *Store) Create(spec Spec) (Info, error) {
+	info, n, err := s.create(spec)
+	if n != nil {
+		s.notify(Change{Spec: info.Spec, Node: n})
+	}
+	return info, err
+}
+
+// create returns the node of a table it added, nil when the table existed
+func (s *Store) create(spec Spec) (Info, *node.Node, error) {
+	if err := spec.Validate(); err != nil {
+		return Info{}, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tables[spec.Name]; ok {
+		if t.spec.withoutLimits() != spec.withoutLimits() {
+			return Info{}, nil, &custom_errors.ConflictError{Key: spec.Name, Message: fmt.Sprintf("table exists with %+v", t.spec)}
+		}
+		return Info{Spec: t.spec, UsedBytes: t.node.UsedBytes()}, nil, nil
+	}
+
+	// a directory without a catalog entry is left over from a drop that
+	// didn't finish, its data must not come back
+	o := s.nodeOptions(spec)
+	if err := os.RemoveAll(o.DataDir); err != nil {
+		return Info{}, nil, err
+	}
+	n, err := node.NewWithOptions(s.name, o)
+	if err != nil {
+		return Info{}, nil, err
+	}
+	s.tables[spec.Name] = &table{spec: spec, node: n}
+	if err := s.writeCatalog(); err != nil {
+		delete(s.tables, spec.Name)
+		n.Close()
+		return Info{}, nil, err
+	}
+	s.limiter.Set(spec.Name, spec.Rate)
+	return Info{Spec: spec}, n, nil
+}
+
+// SetLimits changes the limits of a table, Default included, while it
+// serves requests
+func (s *Store) SetLimits(name string, l Limits) (Info, error) {
+	if err := l.Validate(); err != nil {
+		return Info{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == Default {
+		old := s.defLimits
+		s.defLimits = l
+		if err := s.writeCatalog(); err != nil {
+			s.defLimits = old
+			return Info{}, err
+		}
+		s.def.SetMaxBytes(l.QuotaBytes)
+		s.limiter.Set(name, l.Rate)
+		return Info{Spec: Spec{Limits: l}, UsedBytes: s.def.UsedBytes()}, nil
+	}
+
+	t, ok := s.tables[name]
+	if !ok {
+		return Info{}, &custom_errors.ArgError{Arg: "table " + name, Message: "doesn't exist on " + s.name}
+	}
+	old := t.spec.Limits
+	t.spec.Limits = l
+	if err := s.writeCatalog(); err != nil {
+		t.spec.Limits = old
+		return Info{}, err
+	}
+	t.node.SetMaxBytes(l.QuotaBytes)
+	s.limiter.Set(name, l.Rate)
+	return Info{Spec: t.spec, UsedBytes: t.node.UsedBytes()}, nil
+}
+
+// DefaultInfo is the default table with its limits
+func (s *Store) DefaultInfo() Info {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Info{Spec: Spec{Limits: s.defLimits}, UsedBytes: s.def.UsedBytes()}
+}
+
+// Drop deletes a table and its data. Requests still running on it fail with
+// node.ErrClosed. Dropping a missing table succeeds.
+func (s *Store) Drop(name string) error {
+	t, err := s.drop(name)
+	if t != nil {
+		s.notify(Change{Spec: t.spec, Node: t.node, Dropped: true})
+	}
+	return err
+}
+
+// drop returns the table it removed from the catalog, nil when there was none
+func (s *Store) drop(name string) (*table, error) {
+	if name == Default {
+		return nil, &custom_errors.ArgError{Arg: "table", Message: "the default table can't be dropped"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tables[name]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.tables, name)
+	if err := s.writeCatalog(); err != nil {
+		s.tables[name] = t
+		return nil, err
+	}
+	s.limiter.Set(name, limit.Rate{})
+	// the catalog doesn't list it anymore, a crash from here on leaves a
+	// directory that the next Create of the name removes
+	t.node.Close()
+	return t, os.RemoveAll(s.nodeOptions(t.spec).DataDir)
+}
+
+// List returns the tables in name order, without the default table
+func (s *Store) List() []Info {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Info, 0, len(s.tables))
+	for _, t := range s.tables {
+		out = append(out, Info{Spec: t.spec, UsedBytes: t.node.UsedBytes()})
+	}
+	slices.SortFunc(out, func(a, b Info) int { return strings.Compare(a.Spec.Name, b.Spec.Name) })
+	return out
+}
+
+// Close closes every table, the default table last
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for name, t := range s.tables {
+		if err := t.node.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %w", name, err))
+		}
+	}
+	if s.def != nil {
+		errs = append(errs, s.def.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) readCatalog() (catalog, error) {
+	var c catalog
+	b, err := os.ReadFile(s.catalogPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, &custom_errors.ArgError{Arg: s.catalogPath(), Message: "invalid table catalog: " + err.Error()}
+	}
+	return c, nil
+}
+
+// writeCatalog replaces the catalog file atomically, s.mu must be held
+func (s *Store) writeCatalog() error {
+	c := catalog{Default: s.defLimits, Tables: make([]Spec, 0, len(s.tables))}
+	for _, t := range s.tables {
+		c.Tables = append(c.Tables, t.spec)
+	}
+	slices.SortFunc(c.Tables, func(a, b Spec) int { return strings.Compare(a.Name, b.Name) })
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir(), 0755); err != nil {
+		return err
+	}
+	tmp := s.catalogPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.catalogPath())
+}
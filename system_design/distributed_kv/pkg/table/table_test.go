@@ -0,0 +1,98 @@
+package table
+
+import (
+	"errors"
+	"os"
+	"testing"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/node"
+)
+
+func open(t *testing.T, dir string) *Store {
+	t.Helper()
+	opts := node.DefaultOptions()
+	opts.DataDir = dir
+	opts.FsyncMode = node.FsyncNever
+	s, err := Open("n1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Tables keep their data apart from the default table, come back after a
+// restart and lose their data when dropped
+func TestCreateReopenDrop(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir)
+	spec := Spec{Name: "sessions", ReplicaCount: 2, Limits: Limits{QuotaBytes: 1 << 20}}
+	if _, err := s.Create(spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(spec); err != nil {
+		t.Errorf("Expected creating the same table again to succeed but got %v", err)
+	}
+	if _, err := s.Create(Spec{Name: "sessions", ReplicaCount: 3}); !errors.Is(err, custom_errors.ErrConflict) {
+		t.Errorf("Expected a ConflictError for a different spec but got %v", err)
+	}
+
+	n, _ := s.Node("sessions")
+	n.Put("k", []byte("session"))
+	s.Default().Put("k", []byte("default"))
+	s.Close()
+
+	s = open(t, dir)
+	if got := s.List(); len(got) != 1 || got[0].Spec != spec || got[0].UsedBytes != int64(len("k")+len("session")) {
+		t.Fatalf("Expected sessions with 8 used bytes after reopening but got %+v", got)
+	}
+	n, _ = s.Node("sessions")
+	if v, _ := n.Get("k"); string(v) != "session" {
+		t.Errorf("Expected session but got %q", v)
+	}
+	if v, _ := s.Default().Get("k"); string(v) != "default" {
+		t.Errorf("Expected default but got %q", v)
+	}
+
+	if err := s.Drop("sessions"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Node("sessions"); !errors.Is(err, custom_errors.ErrInvalidArgument) {
+		t.Errorf("Expected an ArgError for a dropped table but got %v", err)
+	}
+	if _, err := os.Stat(s.nodeOptions(spec).DataDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the data of the dropped table to be removed but got %v", err)
+	}
+	if err := s.Drop("sessions"); err != nil {
+		t.Errorf("Expected dropping a missing table to succeed but got %v", err)
+	}
+	s.Close()
+}
+
+// Watch sees every table that was added or removed, not the creates and
+// drops that changed nothing
+func TestWatch(t *testing.T) {
+	s := open(t, t.TempDir())
+	defer s.Close()
+	var changes []Change
+	s.Watch(func(c Change) { changes = append(changes, c) })
+
+	spec := Spec{Name: "sessions", ReplicaCount: 1}
+	s.Create(spec)
+	s.Create(spec)
+	s.Drop("sessions")
+	s.Drop("sessions")
+	s.Create(spec)
+
+	if len(changes) != 3 {
+		t.Fatalf("Expected create, drop and create but got %+v", changes)
+	}
+	if changes[0].Dropped || !changes[1].Dropped || changes[2].Dropped {
+		t.Errorf("Expected create, drop and create but got %+v", changes)
+	}
+	if changes[0].Node != changes[1].Node || changes[2].Node == changes[0].Node {
+		t.Error("Expected the drop to name the created node and the new table to have another one")
+	}
+	if n, _ := s.Node("sessions"); n != changes[2].Node {
+		t.Error("Expected the change to have the node of the table")
+	}
+}
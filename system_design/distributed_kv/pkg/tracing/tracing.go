@@ -0,0 +1,129 @@
+// Package tracing sets up OpenTelemetry spans for a process (ADR 0028). The
+// packages that create spans only use the otel API, a process without Setup
+// gets the global no-op provider and pays almost nothing for them.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	custom_errors "toy_dynamodb/Errors"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// Exporter is where finished spans go
+type Exporter string
+
+const (
+	ExporterNone   Exporter = ""
+	ExporterStdout Exporter = "stdout"
+	ExporterOTLP   Exporter = "otlp"
+)
+
+// DefaultOTLPEndpoint is the gRPC port of a collector on the same host
+const DefaultOTLPEndpoint = "localhost:4317"
+
+// Config chooses the exporter, the zero value doesn't export anything
+type Config struct {
+	Exporter Exporter `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP collector, empty means
+	// DefaultOTLPEndpoint. The connection is plaintext, collectors usually
+	// run next to the process.
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the part of the traces started here that are kept, 0
+	// means all of them. A trace that comes in through gRPC keeps the
+	// decision of its caller.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case ExporterNone, ExporterStdout, ExporterOTLP:
+	default:
+		return &custom_errors.ArgError{Arg: "tracing.exporter=" + string(c.Exporter), Message: "must be stdout, otlp or empty"}
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return &custom_errors.ArgError{Arg: fmt.Sprintf("tracing.sample_ratio=%v", c.SampleRatio), Message: "must be between 0 and 1"}
+	}
+	return nil
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes the spans that weren't exported
+// yet, it is called on shutdown.
+func Setup(ctx context.Context, service string, c Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		endpoint := c.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultOTLPEndpoint
+		}
+		exp, err = otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := c.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// ServerOption reads the trace context of incoming RPCs from their metadata
+// and starts a server span for each
+func ServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithFilter(traced)))
+}
+
+// DialOption writes the trace context of outgoing RPCs into their metadata
+// and starts a client span for each
+func DialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithFilter(traced)))
+}
+
+// traced leaves out the health checks, they run on a timer and belong to no
+// request
+func traced(info *stats.RPCTagInfo) bool {
+	return !strings.HasPrefix(info.FullMethodName, "/grpc.health.v1.Health/")
+}
+
+// End records err on span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
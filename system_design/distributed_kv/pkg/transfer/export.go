@@ -0,0 +1,21 @@
+package transfer
+
+import (
+	"context"
+	"toy_dynamodb/pkg/ring"
+)
+
+// Export writes every key starting with prefix to w in key order and returns
+// the number of keys. Each key is written once, with the newest value and
+// version found on its replicas. Every node of r must be reachable.
+func Export(ctx context.Context, r *ring.Ring, prefix string, w Writer) (int, error) {
+	n := 0
+	err := r.Scan(ctx, prefix, func(e ring.Entry) error {
+		n++
+		return w.Write(Record{Key: e.Key, Value: e.Value, Version: e.Version})
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, w.Flush()
+}
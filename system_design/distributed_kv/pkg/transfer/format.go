@@ -0,0 +1,220 @@
+// Package transfer moves the whole keyspace in and out of a cluster: Export
+// streams every key from a ring into a portable file, Importer writes such a
+// file back through a ring.
+package transfer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	custom_errors "toy_dynamodb/Errors"
+	"unicode/utf8"
+)
+
+// Record is one key of an export. Version 0 means the importing ring picks
+// one, e.g. for data that comes from another store.
+type Record struct {
+	Key     string
+	Value   []byte
+	Version uint64
+}
+
+type Format string
+
+const (
+	// FormatJSONL is one JSON object per line: {"key":..,"value":..,"version":..}
+	// with the value as a string, or {"key":..,"value_b64":..} base64 encoded.
+	FormatJSONL Format = "jsonl"
+	// FormatBinary is a header followed by records of uvarint length prefixed
+	// key and value and a uvarint version
+	FormatBinary Format = "binary"
+)
+
+// binaryMagic starts every binary export
+const binaryMagic = "TKVDUMP1\n"
+
+// ValueEncoding decides how FormatJSONL writes values
+type ValueEncoding string
+
+const (
+	ValuesBase64 ValueEncoding = "base64"
+	// ValuesRaw writes values as JSON strings, values that aren't valid
+	// UTF-8 are still written as base64
+	ValuesRaw ValueEncoding = "raw"
+)
+
+type Writer interface {
+	Write(Record) error
+	// Flush writes buffered records to the underlying writer
+	Flush() error
+}
+
+type Reader interface {
+	// Read returns io.EOF after the last record
+	Read() (Record, error)
+}
+
+func NewWriter(f Format, values ValueEncoding, w io.Writer) (Writer, error) {
+	switch f {
+	case FormatJSONL:
+		if values != ValuesBase64 && values != ValuesRaw {
+			return nil, &custom_errors.ArgError{Arg: string(values), Message: "value encoding must be base64 or raw"}
+		}
+		bw := bufio.NewWriter(w)
+		return &jsonWriter{w: bw, enc: json.NewEncoder(bw), raw: values == ValuesRaw}, nil
+	case FormatBinary:
+		bw := bufio.NewWriter(w)
+		if _, err := bw.WriteString(binaryMagic); err != nil {
+			return nil, err
+		}
+		return &binaryWriter{w: bw}, nil
+	}
+	return nil, &custom_errors.ArgError{Arg: string(f), Message: "format must be jsonl or binary"}
+}
+
+func NewReader(f Format, r io.Reader) (Reader, error) {
+	br := bufio.NewReader(r)
+	switch f {
+	case FormatJSONL:
+		return &jsonReader{dec: json.NewDecoder(br)}, nil
+	case FormatBinary:
+		magic := make([]byte, len(binaryMagic))
+		if _, err := io.ReadFull(br, magic); err != nil || string(magic) != binaryMagic {
+			return nil, &custom_errors.ArgError{Arg: "input", Message: "is not a binary export"}
+		}
+		return &binaryReader{r: br}, nil
+	}
+	return nil, &custom_errors.ArgError{Arg: string(f), Message: "format must be jsonl or binary"}
+}
+
+type jsonRecord struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value,omitempty"`
+	ValueB64 []byte  `json:"value_b64,omitempty"`
+	Version  uint64  `json:"version,omitempty"`
+}
+
+type jsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+	raw bool
+}
+
+func (w *jsonWriter) Write(rec Record) error {
+	jr := jsonRecord{Key: rec.Key, Version: rec.Version}
+	if w.raw && utf8.Valid(rec.Value) {
+		s := string(rec.Value)
+		jr.Value = &s
+	} else {
+		// encoding/json writes []byte as base64, an empty value is left out
+		jr.ValueB64 = rec.Value
+	}
+	return w.enc.Encode(jr)
+}
+
+func (w *jsonWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type jsonReader struct {
+	dec *json.Decoder
+	n   int
+}
+
+func (r *jsonReader) Read() (Record, error) {
+	var jr jsonRecord
+	r.n++
+	if err := r.dec.Decode(&jr); err != nil {
+		if err == io.EOF {
+			return Record{}, err
+		}
+		return Record{}, &custom_errors.ArgError{Arg: fmt.Sprintf("record %d", r.n), Message: err.Error()}
+	}
+	if jr.Key == "" {
+		return Record{}, &custom_errors.ArgError{Arg: fmt.Sprintf("record %d", r.n), Message: "key is missing"}
+	}
+	rec := Record{Key: jr.Key, Value: jr.ValueB64, Version: jr.Version}
+	if jr.Value != nil {
+		rec.Value = []byte(*jr.Value)
+	}
+	if rec.Value == nil {
+		rec.Value = []byte{}
+	}
+	return rec, nil
+}
+
+type binaryWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (w *binaryWriter) Write(rec Record) error {
+	b := w.buf[:0]
+	b = binary.AppendUvarint(b, uint64(len(rec.Key)))
+	b = append(b, rec.Key...)
+	b = binary.AppendUvarint(b, uint64(len(rec.Value)))
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(rec.Value); err != nil {
+		return err
+	}
+	b = binary.AppendUvarint(b[:0], rec.Version)
+	w.buf = b
+	_, err := w.w.Write(b)
+	return err
+}
+
+func (w *binaryWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// maxBinaryField bounds the lengths read from a binary export, a corrupt
+// length must not turn into a huge allocation
+const maxBinaryField = 1 << 30
+
+type binaryReader struct {
+	r *bufio.Reader
+}
+
+func (r *binaryReader) Read() (Record, error) {
+	key, err := r.field()
+	if err == io.EOF {
+		return Record{}, err
+	}
+	if err != nil {
+		return Record{}, corrupt(err)
+	}
+	val, err := r.field()
+	if err != nil {
+		return Record{}, corrupt(err)
+	}
+	version, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, corrupt(err)
+	}
+	return Record{Key: string(key), Value: val, Version: version}, nil
+}
+
+func (r *binaryReader) field() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBinaryField {
+		return nil, fmt.Errorf("field of %d bytes", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r.r, b)
+	return b, err
+}
+
+func corrupt(err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return &custom_errors.ArgError{Arg: "binary export", Message: "is truncated or corrupt: " + err.Error()}
+}
@@ -0,0 +1,208 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/ring"
+)
+
+const (
+	DefaultImportWorkers = 8
+	DefaultImportBatch   = 500
+)
+
+// Importer writes records through a ring with write quorum W. Records are
+// read in batches of BatchSize and Workers batches are written in parallel.
+// After every batch the number of input records that are written, counted
+// from the start of the input without gaps, is saved in Checkpoint. A rerun
+// with the same input and checkpoint skips them.
+type Importer struct {
+	Ring      *ring.Ring
+	W         int
+	Workers   int
+	BatchSize int
+	// Checkpoint is a file, empty means the import can't be resumed
+	Checkpoint string
+	// ResetVersions gives every record a new version, so it replaces what
+	// the cluster holds. Otherwise exported versions are kept and a record
+	// older than the cluster's value is acknowledged without being applied.
+	ResetVersions bool
+}
+
+type ImportStats struct {
+	// Skipped records were imported by an earlier run
+	Skipped  int
+	Imported int
+}
+
+type batch struct {
+	seq  int
+	recs []Record
+}
+
+type batchResult struct {
+	seq int
+	n   int
+	err error
+}
+
+// Run imports rd until its end. A batch with a failed write stops the import,
+// the records before it stay counted in the checkpoint.
+func (im *Importer) Run(ctx context.Context, rd Reader) (ImportStats, error) {
+	workers, size := im.Workers, im.BatchSize
+	if workers <= 0 {
+		workers = DefaultImportWorkers
+	}
+	if size <= 0 {
+		size = DefaultImportBatch
+	}
+	done, err := loadCheckpoint(im.Checkpoint)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	stats := ImportStats{Skipped: done}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan batch)
+	results := make(chan batchResult)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(batches)
+		readErr <- feed(ctx, rd, done, size, batches)
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				results <- batchResult{seq: b.seq, n: len(b.recs), err: im.write(ctx, b.recs)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// batches finish out of order, the checkpoint only moves over a gapless prefix
+	finished := map[int]batchResult{}
+	next := 0
+	var firstErr error
+	for res := range results {
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+			cancel()
+		}
+		finished[res.seq] = res
+		moved := false
+		for r, ok := finished[next]; ok && r.err == nil; r, ok = finished[next] {
+			delete(finished, next)
+			next++
+			done += r.n
+			stats.Imported += r.n
+			moved = true
+		}
+		if moved && im.Checkpoint != "" {
+			if err := saveCheckpoint(im.Checkpoint, done); err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}
+	}
+	if err := <-readErr; firstErr == nil {
+		firstErr = err
+	}
+	return stats, firstErr
+}
+
+// feed skips the records of an earlier run and sends the rest in batches
+func feed(ctx context.Context, rd Reader, skip, size int, batches chan<- batch) error {
+	for i := range skip {
+		if _, err := rd.Read(); err != nil {
+			if err == io.EOF {
+				return &custom_errors.ArgError{Arg: "checkpoint", Message: fmt.Sprintf("says %d records are done but the input ends after %d", skip, i)}
+			}
+			return err
+		}
+	}
+
+	for seq := 0; ; seq++ {
+		recs := make([]Record, 0, size)
+		var err error
+		for len(recs) < size {
+			var rec Record
+			if rec, err = rd.Read(); err != nil {
+				break
+			}
+			recs = append(recs, rec)
+		}
+		if len(recs) > 0 {
+			select {
+			case batches <- batch{seq: seq, recs: recs}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (im *Importer) write(ctx context.Context, recs []Record) error {
+	for _, rec := range recs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m := ring.Mutation{Key: rec.Key, Value: rec.Value, Version: rec.Version}
+		if im.ResetVersions {
+			m.Version = 0
+		}
+		if err := im.Ring.Apply(m, im.W); err != nil {
+			return fmt.Errorf("importing %q: %w", rec.Key, err)
+		}
+	}
+	return nil
+}
+
+func loadCheckpoint(path string) (int, error) {
+	if path == "" {
+		return 0, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n < 0 {
+		return 0, &custom_errors.ArgError{Arg: path, Message: "checkpoint is not a record count"}
+	}
+	return n, nil
+}
+
+// saveCheckpoint replaces the file with rename, a crash leaves either the old
+// or the new count
+func saveCheckpoint(path string, n int) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(n)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
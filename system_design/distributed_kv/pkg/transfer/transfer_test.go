@@ -0,0 +1,141 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/simnet"
+	"toy_dynamodb/pkg/transfer"
+)
+
+var nodeNames = []string{"node-1", "node-2", "node-3"}
+
+func newCluster(t *testing.T, seed int64) (*ring.Ring, *simnet.Network) {
+	t.Helper()
+
+	r := &ring.Ring{ReplicaCount: 3}
+	net := simnet.New(seed, t.TempDir())
+	r.Init()
+	for _, name := range nodeNames {
+		c, err := net.AddNode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RegisterClient(name, c)
+	}
+	t.Cleanup(func() { net.Close() })
+	return r, net
+}
+
+// Every key lives on 3 replicas and one replica missed the last write, the
+// export must still hold each key once with its newest value.
+func TestExportImportRoundTrip(t *testing.T) {
+	src, net := newCluster(t, 1)
+	for i := range 50 {
+		if err := src.Put(fmt.Sprint("key-", i), []byte(fmt.Sprint("v1-", i)), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	net.Partition("node-2")
+	if err := src.Put("key-7", []byte("newer"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Delete("key-8", 2); err != nil {
+		t.Fatal(err)
+	}
+	net.Heal()
+	binaryValue := []byte{0xff, 0x00, 0xfe}
+	if err := src.Put("bin", binaryValue, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []transfer.Format{transfer.FormatJSONL, transfer.FormatBinary} {
+		var buf bytes.Buffer
+		w, err := transfer.NewWriter(f, transfer.ValuesRaw, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := transfer.Export(context.Background(), src, "", w)
+		if err != nil {
+			t.Fatalf("%s: Expected export to succeed, but got %v", f, err)
+		}
+		if n != 50 {
+			t.Errorf("%s: Expected 50 keys, but exported %d", f, n)
+		}
+
+		dst, _ := newCluster(t, 2)
+		rd, err := transfer.NewReader(f, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		im := &transfer.Importer{Ring: dst, W: 3, Workers: 4, BatchSize: 7}
+		if s, err := im.Run(context.Background(), rd); err != nil || s.Imported != 50 {
+			t.Fatalf("%s: Expected 50 imported records, but got %+v and %v", f, s, err)
+		}
+
+		want := map[string]string{"key-7": "newer", "key-0": "v1-0", "bin": string(binaryValue)}
+		for key, v := range want {
+			vals, err := dst.Get(key, 3)
+			if err != nil || string(vals["node-1"]) != v {
+				t.Errorf("%s: Expected %s=%q after import, but got %v, %v", f, key, v, vals, err)
+			}
+		}
+		if _, err := dst.Get("key-8", 1); err == nil {
+			t.Errorf("%s: Expected the deleted key-8 not to be exported", f)
+		}
+	}
+}
+
+// failingReader ends with an error after n records, like a broken pipe
+type failingReader struct {
+	transfer.Reader
+	n int
+}
+
+var errBroken = errors.New("broken input")
+
+func (r *failingReader) Read() (transfer.Record, error) {
+	if r.n == 0 {
+		return transfer.Record{}, errBroken
+	}
+	r.n--
+	return r.Reader.Read()
+}
+
+func TestImportResumesFromCheckpoint(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := transfer.NewWriter(transfer.FormatJSONL, transfer.ValuesBase64, &buf)
+	for i := range 100 {
+		w.Write(transfer.Record{Key: fmt.Sprint("key-", i), Value: []byte("v")})
+	}
+	w.Flush()
+	input := buf.Bytes()
+
+	dst, _ := newCluster(t, 1)
+	im := &transfer.Importer{Ring: dst, W: 2, Workers: 3, BatchSize: 10, Checkpoint: filepath.Join(t.TempDir(), "import.checkpoint")}
+
+	rd, _ := transfer.NewReader(transfer.FormatJSONL, bytes.NewReader(input))
+	s, err := im.Run(context.Background(), &failingReader{Reader: rd, n: 45})
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("Expected the input error, but got %v", err)
+	}
+	// the records read before the error are imported too
+	if s.Imported != 45 {
+		t.Errorf("Expected 45 imported records, but got %+v", s)
+	}
+
+	rd, _ = transfer.NewReader(transfer.FormatJSONL, bytes.NewReader(input))
+	s, err = im.Run(context.Background(), rd)
+	if err != nil || s.Skipped != 45 || s.Imported != 55 {
+		t.Fatalf("Expected 45 skipped and 55 imported records, but got %+v and %v", s, err)
+	}
+	for i := range 100 {
+		if _, err := dst.Get(fmt.Sprint("key-", i), 2); err != nil {
+			t.Errorf("Expected key-%d after the resumed import, but got %v", i, err)
+		}
+	}
+}
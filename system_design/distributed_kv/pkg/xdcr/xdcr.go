@@ -0,0 +1,271 @@
+// Package xdcr replicates the writes of one cluster to another cluster
+// asynchronously. A Replicator follows the WAL of a single table of a node
+// and applies every record to the same table of the remote cluster through a
+// ring.Ring with the record's own version, so both clusters keep the newer of
+// two conflicting writes (ADR 0019).
+package xdcr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	custom_errors "toy_dynamodb/Errors"
+	"toy_dynamodb/pkg/hlc"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/table"
+)
+
+const (
+	DefaultPollInterval = 100 * time.Millisecond
+	// DefaultCheckpointEvery is the number of shipped records after which the
+	// position is saved even though the pass isn't finished
+	DefaultCheckpointEvery = 1000
+)
+
+// errStop ends a ReadWAL early
+var errStop = errors.New("stop")
+
+// Replicator ships the records of one WAL to a remote cluster. The position
+// of the next record is checkpointed in a file, a restarted replicator
+// continues from there and ships at most the records since the last
+// checkpoint again, which the remote replicas acknowledge without applying.
+type Replicator struct {
+	// WAL is the log of the source node, usually node.Path()
+	WAL string
+	// Table is the spec of the table WAL belongs to, the zero value is the
+	// default table. A named table missing on the target is created there
+	// with this spec before the first record is shipped.
+	Table table.Spec
+	// Checkpoint is the file the position is kept in
+	Checkpoint string
+	// Target is a ring of the remote cluster, W its write quorum
+	Target *ring.Ring
+	W      int
+	// Keys decrypts the values of an encrypted WAL, the remote cluster
+	// stores them with its own keys
+	Keys *node.Keyring
+	// PollInterval is the wait after the replicator caught up or failed
+	PollInterval    time.Duration
+	CheckpointEvery int
+
+	mu       sync.Mutex
+	off      int64
+	loaded   bool
+	created  bool
+	shipped  atomic.Uint64
+	failures atomic.Uint64
+	last     atomic.Uint64
+}
+
+// Stats describe how far the replicator is behind its WAL
+type Stats struct {
+	// Offset is the WAL position of the next record to ship
+	Offset int64
+	// BehindBytes is the part of the WAL that isn't shipped yet
+	BehindBytes int64
+	// Lag is the age of the oldest record that isn't shipped yet, 0 when the
+	// replicator caught up
+	Lag time.Duration
+	// LastVersion is the version of the last shipped record
+	LastVersion uint64
+	Shipped     uint64
+	Errors      uint64
+}
+
+// Run ships records until ctx is cancelled. Failed passes are retried after
+// PollInterval, the error is only counted in Stats.
+func (r *Replicator) Run(ctx context.Context) {
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		r.Ship()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Ship applies every complete record after the checkpoint to the target and
+// returns how many it shipped. It stops at the first record the target
+// didn't accept, the next call starts with that record again.
+func (r *Replicator) Ship() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.ship()
+	if err != nil {
+		r.failures.Add(1)
+	}
+	return n, err
+}
+
+func (r *Replicator) ship() (int, error) {
+	if !r.loaded {
+		off, err := loadCheckpoint(r.Checkpoint)
+		if err != nil {
+			return 0, err
+		}
+		r.off, r.loaded = off, true
+	}
+	if err := r.createTable(); err != nil {
+		return 0, err
+	}
+	// a log shorter than the checkpoint was rewritten, e.g. its torn tail was
+	// cut, shipping it again from the start is safe
+	if st, err := os.Stat(r.WAL); err == nil && st.Size() < r.off {
+		r.off = 0
+	}
+
+	every := r.CheckpointEvery
+	if every <= 0 {
+		every = DefaultCheckpointEvery
+	}
+
+	n := 0
+	_, err := node.ReadWAL(r.WAL, r.off, func(rec node.Record, next int64) error {
+		rec, err := rec.Decode(r.Keys)
+		if err != nil {
+			return err
+		}
+		if err := r.Target.Apply(mutationOf(r.Table.Name, rec), r.W); err != nil {
+			return err
+		}
+		r.last.Store(rec.Version)
+		r.shipped.Add(1)
+		r.off = next
+		if n++; n%every == 0 {
+			return saveCheckpoint(r.Checkpoint, r.off)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		// the node hasn't written anything yet
+		return 0, nil
+	}
+	// the records before a failed one are done, their position is saved too
+	if n%every != 0 {
+		if cerr := saveCheckpoint(r.Checkpoint, r.off); err == nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+// createTable makes sure the target has the table. Only a table that isn't
+// there after RefreshTables is created, so the target's identity only needs
+// admin rights for tables that are new to it.
+func (r *Replicator) createTable() error {
+	if r.created || r.Table.Name == table.Default {
+		return nil
+	}
+	ctx := context.Background()
+	if r.Target.RefreshTables(ctx) != nil || !r.hasTable() {
+		// a create with the same spec succeeds on nodes that have the table
+		if err := r.Target.CreateTable(ctx, r.Table); err != nil {
+			return err
+		}
+	}
+	r.created = true
+	return nil
+}
+
+func (r *Replicator) hasTable() bool {
+	_, err := r.Target.Table(r.Table.Name)
+	return err == nil
+}
+
+// Stats reads the WAL size and the oldest pending record, so it does a
+// little I/O
+func (r *Replicator) Stats() Stats {
+	r.mu.Lock()
+	off := r.off
+	r.mu.Unlock()
+
+	s := Stats{Offset: off, LastVersion: r.last.Load(), Shipped: r.shipped.Load(), Errors: r.failures.Load()}
+	if st, err := os.Stat(r.WAL); err == nil {
+		s.BehindBytes = max(st.Size()-off, 0)
+	}
+	if s.BehindBytes > 0 {
+		node.ReadWAL(r.WAL, off, func(rec node.Record, next int64) error {
+			if rec.Version > 0 {
+				s.Lag = max(time.Since(hlc.Time(rec.Version)), 0)
+			}
+			return errStop
+		})
+	}
+	return s
+}
+
+// mutationOf turns a WAL record into the write that reproduces it on another
+// cluster. The request id depends only on the key and the version, so the
+// same record shipped from every replica of the source is applied once.
+// Records written before versions existed get version 1 and lose against
+// every versioned write.
+func mutationOf(tableName string, rec node.Record) ring.Mutation {
+	version := max(rec.Version, 1)
+	h := fnv.New64a()
+	h.Write([]byte(rec.Key))
+	return ring.Mutation{
+		Table:   tableName,
+		ID:      fmt.Sprintf("xdcr-%x-%d", h.Sum64(), version),
+		Key:     rec.Key,
+		Value:   rec.Value,
+		Delete:  rec.Delete,
+		Version: version,
+	}
+}
+
+func loadCheckpoint(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	off, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || off < 0 {
+		return 0, &custom_errors.ArgError{Arg: path, Message: "checkpoint is not a WAL offset"}
+	}
+	return off, nil
+}
+
+// saveCheckpoint replaces the file with rename, a crash leaves either the old
+// or the new position
+func saveCheckpoint(path string, off int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, off); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
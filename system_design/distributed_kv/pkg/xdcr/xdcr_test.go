@@ -0,0 +1,225 @@
+package xdcr_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"toy_dynamodb/pkg/adapter"
+	"toy_dynamodb/pkg/node"
+	"toy_dynamodb/pkg/ring"
+	"toy_dynamodb/pkg/simnet"
+	"toy_dynamodb/pkg/table"
+	"toy_dynamodb/pkg/xdcr"
+)
+
+var nodeNames = []string{"node-1", "node-2", "node-3"}
+
+type cluster struct {
+	net  *simnet.Network
+	ring *ring.Ring
+	dir  string
+}
+
+func newCluster(t *testing.T, seed int64) *cluster {
+	t.Helper()
+
+	c := &cluster{dir: t.TempDir(), ring: &ring.Ring{ReplicaCount: 3}}
+	c.net = simnet.New(seed, c.dir)
+	c.ring.Init()
+	for _, name := range nodeNames {
+		cl, err := c.net.AddNode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ring.RegisterClient(name, cl)
+	}
+	t.Cleanup(func() { c.net.Close() })
+	return c
+}
+
+// replicators ship every node of from to the cluster to
+func replicators(from, to *cluster, target string) []*xdcr.Replicator {
+	var rs []*xdcr.Replicator
+	for _, name := range nodeNames {
+		rs = append(rs, &xdcr.Replicator{
+			WAL:        from.net.Node(name).Path(),
+			Checkpoint: filepath.Join(from.dir, name+"."+target+".checkpoint"),
+			Target:     to.ring,
+			W:          3,
+		})
+	}
+	return rs
+}
+
+// shipAll runs every replicator once and returns the number of shipped records
+func shipAll(t *testing.T, rs ...*xdcr.Replicator) int {
+	t.Helper()
+	total := 0
+	for _, r := range rs {
+		n, err := r.Ship()
+		if err != nil {
+			t.Fatalf("Expected ship to succeed, but got %v", err)
+		}
+		total += n
+	}
+	return total
+}
+
+// valuesOn returns the value of key on every replica of c, "" for absent
+func valuesOn(c *cluster, key string) []string {
+	var out []string
+	for _, name := range nodeNames {
+		v, _ := c.net.Node(name).Get(key)
+		out = append(out, string(v))
+	}
+	return out
+}
+
+func TestReplicatesWritesAndDeletes(t *testing.T) {
+	a, b := newCluster(t, 1), newCluster(t, 2)
+	toB := replicators(a, b, "b")
+
+	for i := range 20 {
+		if err := a.ring.Put(fmt.Sprint("key-", i), []byte(fmt.Sprint("val-", i)), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.ring.Delete("key-0", 3); err != nil {
+		t.Fatal(err)
+	}
+	shipAll(t, toB...)
+
+	for i := range 20 {
+		key, want := fmt.Sprint("key-", i), fmt.Sprint("val-", i)
+		if i == 0 {
+			want = ""
+		}
+		for _, v := range valuesOn(b, key) {
+			if v != want {
+				t.Errorf("Expected %s=%q on every replica of b, but got %v", key, want, valuesOn(b, key))
+				break
+			}
+		}
+	}
+	for _, r := range toB {
+		if s := r.Stats(); s.BehindBytes != 0 || s.Lag != 0 || s.Shipped != 21 {
+			t.Errorf("Expected 21 shipped records and no lag, but got %+v", s)
+		}
+	}
+}
+
+// Both clusters write the same key before either one shipped. Afterwards both
+// must hold the later write and the changes must stop bouncing.
+func TestConflictingWritesConverge(t *testing.T) {
+	a, b := newCluster(t, 1), newCluster(t, 2)
+	toB, toA := replicators(a, b, "b"), replicators(b, a, "a")
+
+	if err := a.ring.Put("k", []byte("from-a"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ring.Put("k", []byte("from-b"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	rounds := 0
+	for shipAll(t, append(toB, toA...)...) > 0 {
+		if rounds++; rounds > 5 {
+			t.Fatal("Expected replication to settle, but records keep bouncing")
+		}
+	}
+
+	for _, c := range []*cluster{a, b} {
+		for _, v := range valuesOn(c, "k") {
+			if v != "from-b" {
+				t.Errorf("Expected the later write from-b everywhere, but got %v and %v", valuesOn(a, "k"), valuesOn(b, "k"))
+				return
+			}
+		}
+	}
+}
+
+func TestResumesFromCheckpoint(t *testing.T) {
+	a, b := newCluster(t, 1), newCluster(t, 2)
+
+	if err := a.ring.Put("k1", []byte("v1"), 3); err != nil {
+		t.Fatal(err)
+	}
+	shipAll(t, replicators(a, b, "b")...)
+
+	if err := a.ring.Put("k2", []byte("v2"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// a restarted replicator only has its checkpoint file
+	if n := shipAll(t, replicators(a, b, "b")...); n != 3 {
+		t.Errorf("Expected only the new record of each node to be shipped, but shipped %d", n)
+	}
+	if v := valuesOn(b, "k2"); v[0] != "v2" || v[1] != "v2" || v[2] != "v2" {
+		t.Errorf("Expected k2=v2 on b, but got %v", v)
+	}
+}
+
+// A named table is shipped into the same table of the target, which the
+// replicator creates there first
+func TestReplicatesTables(t *testing.T) {
+	stores := func() (*ring.Ring, map[string]*table.Store) {
+		r := &ring.Ring{ReplicaCount: 3}
+		r.Init()
+		opts := node.DefaultOptions()
+		opts.DataDir = t.TempDir()
+		opts.FsyncMode = node.FsyncNever
+		out := map[string]*table.Store{}
+		for _, name := range nodeNames {
+			s, err := table.Open(name, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			out[name] = s
+			r.RegisterClient(name, adapter.NewStoreClient(s))
+		}
+		return r, out
+	}
+	a, aStores := stores()
+	b, bStores := stores()
+
+	spec := table.Spec{Name: "sessions", ReplicaCount: 3, Consistency: "all"}
+	if err := a.CreateTable(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	tb, _ := a.Table("sessions")
+	if err := tb.Put("k", []byte("session"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	var toB []*xdcr.Replicator
+	for _, name := range nodeNames {
+		n, _ := aStores[name].Node("sessions")
+		toB = append(toB, &xdcr.Replicator{
+			WAL:        n.Path(),
+			Table:      spec,
+			Checkpoint: filepath.Join(t.TempDir(), name+".b.checkpoint"),
+			Target:     b,
+			W:          3,
+		})
+	}
+	if n := shipAll(t, toB...); n != 3 {
+		t.Errorf("Expected the record of each node to be shipped, but shipped %d", n)
+	}
+
+	for _, name := range nodeNames {
+		n, err := bStores[name].Node("sessions")
+		if err != nil {
+			t.Fatalf("Expected the replicator to create the table on %s but got %v", name, err)
+		}
+		if v, _ := n.Get("k"); string(v) != "session" {
+			t.Errorf("Expected k=session in the table on %s, but got %q", name, v)
+		}
+		if v, found := bStores[name].Default().Get("k"); found {
+			t.Errorf("Expected the default table of %s to stay empty, but got %q", name, v)
+		}
+		if got := bStores[name].List(); len(got) != 1 || got[0].Spec != spec {
+			t.Errorf("Expected the spec of a on %s but got %+v", name, got)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+#!/bin/sh
+# Yerel test için CA, node ve istemci sertifikaları üretir.
+# Kullanım: ./scripts/gen-certs.sh [çıktı klasörü]
+set -e
+
+OUT=${1:-certs}
+mkdir -p "$OUT"
+cd "$OUT"
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+  -keyout ca.key -out ca.crt -subj "/CN=toy-dynamodb-ca"
+
+for n in node-1 node-2 node-3; do
+  openssl req -newkey rsa:2048 -nodes -keyout "$n.key" -out "$n.csr" -subj "/CN=$n"
+  printf "subjectAltName=DNS:%s,DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=serverAuth,clientAuth\n" "$n" > "$n.ext"
+  openssl x509 -req -in "$n.csr" -CA ca.crt -CAkey ca.key -CAcreateserial \
+    -days 365 -out "$n.crt" -extfile "$n.ext"
+  rm "$n.csr" "$n.ext"
+done
+
+# Coordinator / istemci kimliği, CN değeri auth.rules içindeki identity ile eşleşir
+openssl req -newkey rsa:2048 -nodes -keyout coordinator.key -out coordinator.csr -subj "/CN=coordinator"
+printf "extendedKeyUsage=clientAuth\n" > coordinator.ext
+openssl x509 -req -in coordinator.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+  -days 365 -out coordinator.crt -extfile coordinator.ext
+rm coordinator.csr coordinator.ext